@@ -0,0 +1,1466 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"acp-gate/internal/asciicast"
+	"acp-gate/internal/audit"
+	"acp-gate/internal/transcript"
+)
+
+const auditUsage = `usage: acp-gate audit <command> [flags]
+
+Commands:
+  sessions     list recorded sessions
+  turns        show prompt turns with their prompt, agent reply, thoughts and timing
+  connections  list connections and the agent processes launched for them
+  tools        show the tool calls agents ran, with status changes and affected files
+  terminals    list the commands agents ran in editor terminals and how they exited
+  attachments  list the files, images and audio attached to prompts and messages
+  permissions  show permission requests, the options offered and how each was decided
+  approvals    report how permission requests are answered, per tool
+  events       show recorded events (filter by session, method, direction, time)
+  calls        show requests paired with their responses and latency
+  search       full-text search over prompts, agent output and tool call titles
+  export       export a session transcript as Markdown or HTML
+  diff         print the files a session changed as a unified diff
+  cast         export the output of a terminal as an asciinema recording
+  blob         write a stored image, audio or resource blob to a file
+  migrate      upgrade the audit DB schema to the version of this binary
+  prune        delete or trim old events according to retention limits
+  verify       check the hash chain and signed checkpoints for tampering
+  keygen       print a new key for payload encryption (or -signing for checkpoints)
+  rekey        rewrap data keys with the first key of the keyring
+
+Run "acp-gate audit <command> -h" for command flags.
+`
+
+// runAudit implements the "acp-gate audit" subcommand family and returns the
+// process exit code.
+func runAudit(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, auditUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "sessions":
+		err = auditSessions(ctx, args[1:])
+	case "turns":
+		err = auditTurns(ctx, args[1:])
+	case "connections":
+		err = auditConnections(ctx, args[1:])
+	case "tools":
+		err = auditTools(ctx, args[1:])
+	case "terminals":
+		err = auditTerminals(ctx, args[1:])
+	case "attachments":
+		err = auditAttachments(ctx, args[1:])
+	case "permissions":
+		err = auditPermissions(ctx, args[1:])
+	case "approvals":
+		err = auditApprovals(ctx, args[1:])
+	case "events":
+		err = auditEvents(ctx, args[1:])
+	case "calls":
+		err = auditCalls(ctx, args[1:])
+	case "search":
+		err = auditSearch(ctx, args[1:])
+	case "export":
+		err = auditExport(ctx, args[1:])
+	case "diff":
+		err = auditDiff(ctx, args[1:])
+	case "cast":
+		err = auditCast(ctx, args[1:])
+	case "blob":
+		err = auditBlob(ctx, args[1:])
+	case "migrate":
+		err = auditMigrate(ctx, args[1:])
+	case "prune":
+		err = auditPrune(ctx, args[1:])
+	case "verify":
+		err = auditVerify(ctx, args[1:])
+	case "keygen":
+		err = auditKeygen(args[1:])
+	case "rekey":
+		err = auditRekey(ctx, args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, auditUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown audit command %q\n\n%s", args[0], auditUsage)
+		return 2
+	}
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// auditFlags holds the flags shared by the read-side audit commands.
+type auditFlags struct {
+	fs      *flag.FlagSet
+	dbPath  string
+	since   string
+	until   string
+	limit   int
+	offset  int
+	asJSON  bool
+	keyFile string
+}
+
+func newAuditFlags(name string) *auditFlags {
+	af := &auditFlags{fs: flag.NewFlagSet("audit "+name, flag.ContinueOnError)}
+	af.fs.StringVar(&af.dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	af.fs.StringVar(&af.since, "since", "", "only include events at or after this time (RFC 3339 or a duration like 24h)")
+	af.fs.StringVar(&af.until, "until", "", "only include events before this time (RFC 3339 or a duration like 1h)")
+	af.fs.IntVar(&af.limit, "limit", 0, "maximum number of rows to print (0 for no limit)")
+	af.fs.IntVar(&af.offset, "offset", 0, "number of rows to skip")
+	af.fs.BoolVar(&af.asJSON, "json", false, "print JSON lines instead of a table")
+	af.fs.StringVar(&af.keyFile, "audit-key-file", "", auditKeyFileUsage)
+	return af
+}
+
+// parse parses args and returns the time and paging filter they set.
+func (af *auditFlags) parse(args []string) (audit.Filter, error) {
+	if err := af.fs.Parse(args); err != nil {
+		return audit.Filter{}, err
+	}
+	return af.filter(time.Now())
+}
+
+func (af *auditFlags) filter(now time.Time) (audit.Filter, error) {
+	f := audit.Filter{Limit: af.limit, Offset: af.offset}
+	var err error
+	if f.Since, err = parseTimeFlag(af.since, now); err != nil {
+		return f, fmt.Errorf("-since: %w", err)
+	}
+	if f.Until, err = parseTimeFlag(af.until, now); err != nil {
+		return f, fmt.Errorf("-until: %w", err)
+	}
+	return f, nil
+}
+
+func (af *auditFlags) open(ctx context.Context) (*audit.Store, error) {
+	return openAuditDB(ctx, af.dbPath, af.keyFile)
+}
+
+// openAuditDB opens an existing audit DB; unlike audit.Open it refuses to
+// create a new, empty one when the path is wrong, and to migrate an older
+// one, which is left to audit migrate and its backup. Encrypted payloads
+// are decrypted when a keyring is available; see loadAuditKeyring.
+func openAuditDB(ctx context.Context, path, keyFile string) (*audit.Store, error) {
+	st, err := audit.CheckSchema(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(st.Pending) > 0 {
+		return nil, fmt.Errorf("%s has schema version %d, this binary needs %d; run `acp-gate audit migrate -audit-db %s` first",
+			path, st.Current, audit.SchemaVersion(), path)
+	}
+	keyring, err := loadAuditKeyring(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	store, err := audit.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if keyring != nil {
+		store.SetKeyring(keyring)
+	}
+	return store, nil
+}
+
+const auditKeyFileUsage = "keyring file for encrypting audit payloads (default: $ACP_GATE_AUDIT_KEY_FILE, or the key in $ACP_GATE_AUDIT_KEY); " +
+	"tool and permission titles, kinds and options, session cwds, file paths, attachment names, connection commands and error_message stay in plaintext"
+
+// loadAuditKeyring reads the keyring from keyFile, falling back to the
+// ACP_GATE_AUDIT_KEY_FILE and ACP_GATE_AUDIT_KEY environment variables. It
+// returns nil when no key is configured.
+func loadAuditKeyring(keyFile string) (*audit.Keyring, error) {
+	if keyFile == "" {
+		keyFile = os.Getenv("ACP_GATE_AUDIT_KEY_FILE")
+	}
+	if keyFile != "" {
+		return audit.LoadKeyring(keyFile)
+	}
+	if key := os.Getenv("ACP_GATE_AUDIT_KEY"); key != "" {
+		return audit.ParseKeyring([]byte(key))
+	}
+	return nil, nil
+}
+
+// printRows prints rows to stdout as JSON lines, or as a table with the
+// tab-separated header and the cells row returns for each of them.
+func printRows[T any](asJSON bool, rows []T, header string, row func(T) []any) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range rows {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	for _, r := range rows {
+		cells := row(r)
+		for i, c := range cells {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, c)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// parseTimeFlag accepts an RFC 3339 timestamp, a date (2006-01-02), or a Go
+// duration that is interpreted relative to now (e.g. "24h" means 24h ago).
+func parseTimeFlag(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
+
+func auditSessions(ctx context.Context, args []string) error {
+	af := newAuditFlags("sessions")
+	agent := af.fs.String("agent", "", "only include sessions served by this agent (name from config)")
+	cwd := af.fs.String("cwd", "", "only include sessions whose working directory is this directory or below it")
+	active := af.fs.Bool("active", false, "only include sessions whose connection is still open")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	sessions, err := store.ListSessions(ctx, audit.SessionFilter{
+		AgentName: *agent,
+		Cwd:       *cwd,
+		Active:    *active,
+		Since:     f.Since,
+		Until:     f.Until,
+		Limit:     f.Limit,
+		Offset:    f.Offset,
+	})
+	if err != nil {
+		return err
+	}
+	return printRows(af.asJSON, sessions, "SESSION\tCREATED\tLAST ACTIVE\tENDED\tTURNS\tSTOP REASON\tAGENT\tMODE\tCWD", func(s audit.Session) []any {
+		ended := "active"
+		if !s.Ended.IsZero() {
+			ended = formatTime(s.Ended)
+		}
+		return []any{s.ID, formatTime(s.Created), formatTime(s.LastActive), ended, s.Turns, s.LastStopReason, s.AgentName, s.Mode, s.Cwd}
+	})
+}
+
+func auditTurns(ctx context.Context, args []string) error {
+	af := newAuditFlags("turns")
+	sessionID := af.fs.String("session", "", "only include turns of this session id")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	turns, err := store.Turns(ctx, audit.TurnFilter{
+		SessionID: *sessionID,
+		Since:     f.Since,
+		Until:     f.Until,
+		Limit:     f.Limit,
+		Offset:    f.Offset,
+	})
+	if err != nil {
+		return err
+	}
+	return printRows(af.asJSON, turns, "SESSION\tSTARTED\tDURATION\tFIRST CHUNK\tSTATUS\tSTOP REASON\tCHUNKS\tPROMPT\tREPLY", func(t audit.Turn) []any {
+		var first string
+		if !t.FirstChunk.IsZero() {
+			first = formatLatency(t.FirstChunk.Sub(t.Started))
+		}
+		stop := t.StopReason
+		if t.ErrorMessage != "" {
+			stop = "error: " + t.ErrorMessage
+		}
+		prompt, reply := oneLine(t.UserText, 40), oneLine(t.AgentText, 60)
+		if t.Sealed {
+			prompt, reply = "(encrypted)", "(encrypted)"
+		}
+		return []any{t.SessionID, formatTime(t.Started), formatLatency(t.Duration), first, t.Status, oneLine(stop, 40), t.Chunks, prompt, reply}
+	})
+}
+
+func auditConnections(ctx context.Context, args []string) error {
+	af := newAuditFlags("connections")
+	mode := af.fs.String("mode", "", "only include connections of this mode (local or tunnel)")
+	active := af.fs.Bool("active", false, "only include connections that are still open")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	conns, err := store.ListConnections(ctx, audit.ConnectionFilter{
+		Mode:   *mode,
+		Active: *active,
+		Since:  f.Since,
+		Until:  f.Until,
+		Limit:  f.Limit,
+		Offset: f.Offset,
+	})
+	if err != nil {
+		return err
+	}
+	return printRows(af.asJSON, conns, "CONNECTION\tMODE\tSTARTED\tENDED\tPID\tEXIT\tREASON\tHOPS\tCOMMAND", func(c audit.Connection) []any {
+		ended, exit := "active", ""
+		if !c.Ended.IsZero() {
+			ended = formatTime(c.Ended)
+		}
+		if c.ExitCode != nil {
+			exit = strconv.Itoa(*c.ExitCode)
+		}
+		return []any{c.ID, c.Mode, formatTime(c.Started), ended, c.PID, exit, c.CloseReason, strings.Join(c.Hops, " > "),
+			strings.Join(append([]string{c.Command}, c.Args...), " ")}
+	})
+}
+
+func auditTools(ctx context.Context, args []string) error {
+	af := newAuditFlags("tools")
+	sessionID := af.fs.String("session", "", "only include tool calls of this session id")
+	kind := af.fs.String("kind", "", "only include tool calls of this kind (e.g. edit, execute)")
+	status := af.fs.String("status", "", "only include tool calls in this state (pending, in_progress, completed, failed)")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	calls, err := store.ToolCalls(ctx, audit.ToolCallFilter{
+		SessionID: *sessionID,
+		Kind:      *kind,
+		Status:    *status,
+		Since:     f.Since,
+		Until:     f.Until,
+		Limit:     f.Limit,
+		Offset:    f.Offset,
+	})
+	if err != nil {
+		return err
+	}
+	return printRows(af.asJSON, calls, "SESSION\tTOOL CALL\tCREATED\tKIND\tSTATUS\tDURATION\tTITLE\tLOCATIONS\tTRANSITIONS", func(c audit.ToolCall) []any {
+		var duration string
+		if !c.Ended.IsZero() {
+			duration = formatLatency(c.Duration)
+		}
+		locs := make([]string, 0, len(c.Locations))
+		for _, l := range c.Locations {
+			if l.Line != nil {
+				locs = append(locs, fmt.Sprintf("%s:%d", l.Path, *l.Line))
+			} else {
+				locs = append(locs, l.Path)
+			}
+		}
+		if c.Sealed && len(locs) == 0 {
+			locs = append(locs, "[encrypted]")
+		}
+		steps := make([]string, 0, len(c.Transitions))
+		for i, t := range c.Transitions {
+			if i == 0 {
+				steps = append(steps, t.Status)
+			} else {
+				steps = append(steps, fmt.Sprintf("%s (+%s)", t.Status, formatLatency(t.Duration)))
+			}
+		}
+		return []any{c.SessionID, c.ID, formatTime(c.Created), c.Kind, c.Status, duration, oneLine(c.Title, 60), strings.Join(locs, ", "),
+			strings.Join(steps, " > ")}
+	})
+}
+
+func auditTerminals(ctx context.Context, args []string) error {
+	af := newAuditFlags("terminals")
+	sessionID := af.fs.String("session", "", "only include terminals of this session id")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	terms, err := store.Terminals(ctx, audit.TerminalFilter{
+		SessionID: *sessionID,
+		Since:     f.Since,
+		Until:     f.Until,
+		Limit:     f.Limit,
+		Offset:    f.Offset,
+	})
+	if err != nil {
+		return err
+	}
+	return printRows(af.asJSON, terms, "SESSION\tTERMINAL\tCREATED\tTOOL CALL\tEXIT\tDURATION\tOUTPUT\tCWD\tCOMMAND", func(t audit.Terminal) []any {
+		var exit, duration string
+		switch {
+		case t.ExitCode != nil:
+			exit = strconv.Itoa(*t.ExitCode)
+		case t.Signal != "":
+			exit = t.Signal
+		case !t.Killed.IsZero():
+			exit = "killed"
+		}
+		if !t.Exited.IsZero() {
+			duration = formatLatency(t.Exited.Sub(t.Created))
+		}
+		output := strconv.Itoa(t.OutputBytes)
+		if t.Truncated {
+			output += " (truncated)"
+		}
+		cwd, command := t.Cwd, oneLine(strings.Join(append([]string{t.Command}, t.Args...), " "), 80)
+		if t.Sealed {
+			cwd, command = "[encrypted]", "[encrypted]"
+		}
+		return []any{t.SessionID, t.ID, formatTime(t.Created), t.ToolCallID, exit, duration, output, cwd, command}
+	})
+}
+
+func auditAttachments(ctx context.Context, args []string) error {
+	af := newAuditFlags("attachments")
+	sessionID := af.fs.String("session", "", "only include attachments of this session id")
+	uri := af.fs.String("uri", "", "only include attachments of this resource URI, or below it if it ends with /")
+	source := af.fs.String("source", "", "only include blocks from this source: prompt, user_message, agent_message, agent_thought or tool_call")
+	kind := af.fs.String("kind", "", "only include blocks of this kind: resource_link, resource, image or audio")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	atts, err := store.Attachments(ctx, audit.AttachmentFilter{
+		SessionID: *sessionID,
+		URI:       *uri,
+		Source:    *source,
+		Kind:      *kind,
+		Since:     f.Since,
+		Until:     f.Until,
+		Limit:     f.Limit,
+		Offset:    f.Offset,
+	})
+	if err != nil {
+		return err
+	}
+	return printRows(af.asJSON, atts, "SESSION\tTIME\tSOURCE\tKIND\tMIME\tSIZE\tBLOB\tURI", func(a audit.Attachment) []any {
+		var size string
+		if a.Size >= 0 {
+			size = strconv.FormatInt(a.Size, 10)
+		}
+		name := a.URI
+		if name == "" {
+			name = a.Name
+		}
+		return []any{a.SessionID, formatTime(a.Time), a.Source, a.Kind, a.MimeType, size, a.BlobSHA256, name}
+	})
+}
+
+func auditPermissions(ctx context.Context, args []string) error {
+	af := newAuditFlags("permissions")
+	sessionID := af.fs.String("session", "", "only include requests of this session id")
+	toolCall := af.fs.String("tool-call", "", "only include requests for this tool call id")
+	outcome := af.fs.String("outcome", "", "only include requests with this outcome (selected, cancelled, failed, abandoned, pending)")
+	decidedBy := af.fs.String("decided-by", "", "only include requests decided by (user, session_cancel, editor, disconnect)")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	perms, err := store.Permissions(ctx, audit.PermissionFilter{
+		SessionID:  *sessionID,
+		ToolCallID: *toolCall,
+		Outcome:    *outcome,
+		DecidedBy:  *decidedBy,
+		Since:      f.Since,
+		Until:      f.Until,
+		Limit:      f.Limit,
+		Offset:     f.Offset,
+	})
+	if err != nil {
+		return err
+	}
+	return printRows(af.asJSON, perms, "REQUESTED\tSESSION\tTOOL CALL\tKIND\tTITLE\tOPTIONS\tOUTCOME\tDECIDED BY\tDECISION TIME", func(p audit.Permission) []any {
+		opts := make([]string, 0, len(p.Options))
+		for _, o := range p.Options {
+			opts = append(opts, o.Kind)
+		}
+		outcome := p.Outcome
+		switch {
+		case outcome == "":
+			outcome = "pending"
+		case p.OptionKind != "":
+			outcome += ": " + p.OptionKind
+		case p.OptionID != "":
+			outcome += ": " + p.OptionID
+		}
+		var spent string
+		if !p.Decided.IsZero() {
+			spent = formatLatency(p.DecisionTime)
+		}
+		return []any{formatTime(p.Requested), p.SessionID, p.ToolCallID, p.ToolKind, oneLine(p.Title, 60), strings.Join(opts, ","), outcome,
+			p.DecidedBy, spent}
+	})
+}
+
+func auditApprovals(ctx context.Context, args []string) error {
+	af := newAuditFlags("approvals")
+	sessionID := af.fs.String("session", "", "only include requests of this session id")
+	by := af.fs.String("by", "kind", "group requests by tool kind or by tool call title (kind or title)")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	tools, total, err := store.PermissionReport(ctx, audit.PermissionFilter{
+		SessionID: *sessionID,
+		Since:     f.Since,
+		Until:     f.Until,
+	}, *by)
+	if err != nil {
+		return err
+	}
+	if f.Offset > 0 {
+		tools = tools[min(f.Offset, len(tools)):]
+	}
+	if f.Limit > 0 && len(tools) > f.Limit {
+		tools = tools[:f.Limit]
+	}
+	// The table ends with a TOTAL row; JSON lines end with a Total object.
+	if !af.asJSON {
+		total.Tool = "TOTAL"
+		tools = append(tools, total)
+	}
+	err = printRows(af.asJSON, tools, "TOOL\tREQUESTS\tALLOW ONCE\tALLOW ALWAYS\tREJECT ONCE\tREJECT ALWAYS\tCANCELLED\tUNANSWERED\tALWAYS\tAVG DECISION",
+		func(ps audit.PermissionStats) []any {
+			name := ps.Tool
+			if name == "" {
+				name = "(unknown)"
+			}
+			always := "-"
+			if n := ps.Approvals(); n > 0 {
+				always = fmt.Sprintf("%.0f%%", 100*float64(ps.Selected["allow_always"])/float64(n))
+			}
+			return []any{oneLine(name, 60), ps.Requests, ps.Selected["allow_once"], ps.Selected["allow_always"], ps.Selected["reject_once"],
+				ps.Selected["reject_always"], ps.Cancelled, ps.Failed + ps.Abandoned + ps.Pending, always, formatLatency(ps.AvgDecision)}
+		})
+	if err != nil || !af.asJSON {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(struct {
+		Total audit.PermissionStats
+	}{total})
+}
+
+func auditEvents(ctx context.Context, args []string) error {
+	af := newAuditFlags("events")
+	var (
+		sessionID string
+		method    string
+		direction string
+		corrID    string
+		connID    string
+		status    string
+		showRaw   bool
+		onlyErrs  bool
+		blobs     bool
+	)
+	af.fs.StringVar(&sessionID, "session", "", "only include events for this session id")
+	af.fs.StringVar(&method, "method", "", "only include events for this ACP method (e.g. session/prompt)")
+	af.fs.StringVar(&direction, "direction", "", "only include events in this direction (upstream_to_downstream or downstream_to_upstream)")
+	af.fs.StringVar(&corrID, "corr", "", "only include the rows of the call with this correlation id")
+	af.fs.StringVar(&connID, "conn", "", "only include the rows of the connection with this id (see audit connections)")
+	af.fs.StringVar(&status, "status", "", "only include requests in this state (pending, completed, failed, abandoned)")
+	af.fs.BoolVar(&showRaw, "raw", false, "include the raw JSON payload in table output")
+	af.fs.BoolVar(&onlyErrs, "errors", false, "only include failed calls (rows carrying a JSON-RPC error)")
+	af.fs.BoolVar(&blobs, "blobs", false, "put stored images, audio and resource blobs back into the raw JSON payloads")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	f.SessionID = sessionID
+	f.Method = method
+	f.CorrelationID = corrID
+	f.ConnID = connID
+	f.ErrorsOnly = onlyErrs
+	if f.Status, err = parseStatusFlag(status); err != nil {
+		return err
+	}
+	switch d := audit.Direction(direction); d {
+	case "", audit.DirectionUpstreamToDownstream, audit.DirectionDownstreamToUpstream:
+		f.Direction = d
+	default:
+		return fmt.Errorf("-direction: unknown direction %q", direction)
+	}
+
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	records, err := store.Query(ctx, f)
+	if err != nil {
+		return err
+	}
+	if blobs {
+		for i := range records {
+			if records[i].Raw, err = store.Rehydrate(ctx, records[i].Raw); err != nil {
+				return err
+			}
+		}
+	}
+	events := make([]eventJSON, len(records))
+	for i, r := range records {
+		events[i] = newEventJSON(r)
+	}
+	return printRows(af.asJSON, events, "ID\tTIME\tSEQ\tDIRECTION\tKIND\tSESSION\tMETHOD\tLATENCY\tTEXT", func(ev eventJSON) []any {
+		text := ev.UserText
+		if text == "" {
+			text = ev.AgentText
+		}
+		if ev.Error != nil {
+			text = fmt.Sprintf("error %d: %s", ev.Error.Code, ev.Error.Message)
+		}
+		if showRaw {
+			text = string(ev.Raw)
+		}
+		if ev.Sealed {
+			text = "[encrypted]"
+		}
+		latency := ""
+		if ev.LatencyMs != nil {
+			latency = formatLatency(time.Duration(*ev.LatencyMs) * time.Millisecond)
+		}
+		return []any{ev.ID, formatTime(ev.Timestamp), formatSeq(ev.Seq), ev.Direction, ev.Kind, ev.SessionID, ev.Method, latency, oneLine(text, 80)}
+	})
+}
+
+func auditSearch(ctx context.Context, args []string) error {
+	af := newAuditFlags("search")
+	var (
+		sessionID string
+		method    string
+		match     bool
+	)
+	af.fs.StringVar(&sessionID, "session", "", "only search events of this session id")
+	af.fs.StringVar(&method, "method", "", "only search events for this ACP method (e.g. session/prompt)")
+	af.fs.BoolVar(&match, "match", false, "treat the query as an FTS5 query (AND, OR, NOT, \"phrases\", prefix*) instead of plain words")
+	af.fs.Usage = func() {
+		fmt.Fprintln(af.fs.Output(), "usage: acp-gate audit search [flags] <query>")
+		af.fs.PrintDefaults()
+	}
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	query := strings.Join(af.fs.Args(), " ")
+	if strings.TrimSpace(query) == "" {
+		af.fs.Usage()
+		return fmt.Errorf("missing search query")
+	}
+	if !match {
+		query = audit.QuoteSearch(query)
+	}
+	f.SessionID = sessionID
+	f.Method = method
+
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	opts := audit.SearchOptions{Filter: f}
+	if !af.asJSON && isTerminal(os.Stdout) {
+		opts.Open, opts.Close = "\x1b[1;31m", "\x1b[0m"
+	}
+	hits, err := store.Search(ctx, query, opts)
+	if err != nil {
+		return err
+	}
+	events := make([]eventJSON, len(hits))
+	for i, h := range hits {
+		events[i] = newEventJSON(h.Record)
+		events[i].Snippet = h.Snippet
+	}
+	return printRows(af.asJSON, events, "ID\tTIME\tSESSION\tMETHOD\tSNIPPET", func(ev eventJSON) []any {
+		return []any{ev.ID, formatTime(ev.Timestamp), ev.SessionID, ev.Method, strings.Join(strings.Fields(ev.Snippet), " ")}
+	})
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func auditCalls(ctx context.Context, args []string) error {
+	af := newAuditFlags("calls")
+	var (
+		sessionID string
+		method    string
+		status    string
+	)
+	af.fs.StringVar(&sessionID, "session", "", "only include calls for this session id")
+	af.fs.StringVar(&method, "method", "", "only include calls of this ACP method (e.g. session/prompt)")
+	af.fs.StringVar(&status, "status", "", "only include calls in this state (pending, completed, failed, abandoned)")
+	f, err := af.parse(args)
+	if err != nil {
+		return err
+	}
+	f.SessionID = sessionID
+	f.Method = method
+	if f.Status, err = parseStatusFlag(status); err != nil {
+		return err
+	}
+
+	store, err := af.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	calls, err := store.Calls(ctx, f)
+	if err != nil {
+		return err
+	}
+	rows := make([]callJSON, len(calls))
+	for i, c := range calls {
+		rows[i] = callJSON{
+			CorrelationID: c.Request.CorrelationID,
+			Seq:           c.Request.Seq,
+			Start:         c.Request.Timestamp,
+			Direction:     c.Request.Direction,
+			SessionID:     c.Request.SessionID,
+			Method:        c.Request.Method,
+			Status:        callStatus(c),
+		}
+		if c.Response != nil {
+			rows[i].End = &c.Response.Timestamp
+			rows[i].LatencyMs = c.Latency().Milliseconds()
+		}
+	}
+	return printRows(af.asJSON, rows, "SEQ\tSTART\tSESSION\tMETHOD\tLATENCY\tSTATUS\tCORRELATION ID", func(c callJSON) []any {
+		latency := ""
+		if c.End != nil {
+			latency = formatLatency(time.Duration(c.LatencyMs) * time.Millisecond)
+		}
+		return []any{formatSeq(c.Seq), formatTime(c.Start), c.SessionID, c.Method, latency, c.Status, c.CorrelationID}
+	})
+}
+
+// callJSON is the JSON lines shape printed by "audit calls -json".
+type callJSON struct {
+	CorrelationID string          `json:"corrId"`
+	Seq           int64           `json:"seq"`
+	Start         time.Time       `json:"start"`
+	End           *time.Time      `json:"end,omitempty"`
+	LatencyMs     int64           `json:"latencyMs,omitempty"`
+	Direction     audit.Direction `json:"direction"`
+	SessionID     string          `json:"sessionId,omitempty"`
+	Method        string          `json:"method"`
+	Status        string          `json:"status"`
+}
+
+func callStatus(c audit.Call) string {
+	switch {
+	case c.Request.Status == audit.StatusAbandoned:
+		return "abandoned"
+	case c.Response == nil && c.Request.Status == audit.StatusPending:
+		return "pending"
+	case c.Response == nil:
+		return "no response"
+	case c.Response.Error != nil:
+		return fmt.Sprintf("error %d", c.Response.Error.Code)
+	default:
+		return "ok"
+	}
+}
+
+func parseStatusFlag(v string) (audit.Status, error) {
+	switch st := audit.Status(v); st {
+	case "", audit.StatusPending, audit.StatusCompleted, audit.StatusFailed, audit.StatusAbandoned:
+		return st, nil
+	}
+	return "", fmt.Errorf("-status: unknown status %q (want pending, completed, failed or abandoned)", v)
+}
+
+func auditExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit export", flag.ContinueOnError)
+	var (
+		dbPath    string
+		sessionID string
+		format    string
+		outPath   string
+		keyFile   string
+	)
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.StringVar(&sessionID, "session", "", "session id to export (required)")
+	fs.StringVar(&format, "format", "md", "output format: md or html")
+	fs.StringVar(&outPath, "o", "", "write to this file instead of stdout")
+	fs.StringVar(&keyFile, "audit-key-file", "", auditKeyFileUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sessionID == "" {
+		return fmt.Errorf("missing required flag: -session")
+	}
+	if format != "md" && format != "html" {
+		return fmt.Errorf("-format: unknown format %q (want md or html)", format)
+	}
+
+	store, err := openAuditDB(ctx, dbPath, keyFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	records, err := store.Query(ctx, audit.Filter{SessionID: sessionID})
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no events recorded for session %q", sessionID)
+	}
+	for _, r := range records {
+		if r.Sealed {
+			return fmt.Errorf("session %q has encrypted payloads; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", sessionID)
+		}
+	}
+	// Sessions recorded with -audit-turns drop may lack the message chunks.
+	turns, err := store.Turns(ctx, audit.TurnFilter{SessionID: sessionID})
+	if err != nil {
+		return err
+	}
+	for _, t := range turns {
+		if t.Sealed {
+			return fmt.Errorf("session %q has encrypted payloads; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", sessionID)
+		}
+	}
+	t := transcript.BuildWithTurns(sessionID, records, turns)
+
+	var w io.Writer = os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if format == "html" {
+		return t.WriteHTML(w)
+	}
+	return t.WriteMarkdown(w)
+}
+
+func auditDiff(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit diff", flag.ContinueOnError)
+	var (
+		dbPath    string
+		sessionID string
+		path      string
+		outPath   string
+		keyFile   string
+	)
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.StringVar(&sessionID, "session", "", "session whose file changes to print (required)")
+	fs.StringVar(&path, "path", "", "only include changes to this file, or below this directory if it ends with /")
+	fs.StringVar(&outPath, "o", "", "write to this file instead of stdout")
+	fs.StringVar(&keyFile, "audit-key-file", "", auditKeyFileUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sessionID == "" {
+		return fmt.Errorf("missing required flag: -session")
+	}
+
+	store, err := openAuditDB(ctx, dbPath, keyFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	changes, err := store.FileChanges(ctx, audit.FileChangeFilter{SessionID: sessionID, Path: path})
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return fmt.Errorf("no file changes recorded for session %q", sessionID)
+	}
+	// Paths below the session's working directory are made relative to it
+	// so the patch applies from there.
+	var cwd string
+	if sessions, err := store.ListSessions(ctx, audit.SessionFilter{ID: sessionID}); err == nil && len(sessions) == 1 {
+		cwd = sessions[0].Cwd
+	}
+
+	var w io.Writer = os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	for _, c := range changes {
+		if c.Status == audit.StatusFailed || c.Diff == "" && !c.Sealed {
+			continue
+		}
+		if c.Sealed {
+			return fmt.Errorf("session %q has encrypted diffs; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", sessionID)
+		}
+		name := strings.TrimPrefix(c.Path, "/")
+		if rel, ok := strings.CutPrefix(c.Path, strings.TrimSuffix(cwd, "/")+"/"); ok && cwd != "" {
+			name = rel
+		}
+		from := "a/" + name
+		if c.Created {
+			from = "/dev/null"
+		}
+		if _, err := fmt.Fprintf(w, "--- %s\n+++ b/%s\n%s", from, name, c.Diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func auditCast(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit cast", flag.ContinueOnError)
+	var (
+		dbPath     string
+		sessionID  string
+		terminalID string
+		outPath    string
+		cols, rows int
+		keyFile    string
+	)
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.StringVar(&sessionID, "session", "", "session the terminal belongs to (required)")
+	fs.StringVar(&terminalID, "terminal", "", "terminal id to export (required)")
+	fs.StringVar(&outPath, "o", "", "write to this file instead of stdout")
+	fs.IntVar(&cols, "cols", 80, "terminal width recorded in the header")
+	fs.IntVar(&rows, "rows", 24, "terminal height recorded in the header")
+	fs.StringVar(&keyFile, "audit-key-file", "", auditKeyFileUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sessionID == "" || terminalID == "" {
+		return fmt.Errorf("missing required flags: -session and -terminal")
+	}
+
+	store, err := openAuditDB(ctx, dbPath, keyFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	terms, err := store.Terminals(ctx, audit.TerminalFilter{SessionID: sessionID, ID: terminalID})
+	if err != nil {
+		return err
+	}
+	if len(terms) == 0 {
+		return fmt.Errorf("no terminal %q recorded for session %q", terminalID, sessionID)
+	}
+	t := terms[0]
+	if t.Sealed {
+		return fmt.Errorf("terminal %q has an encrypted command; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", terminalID)
+	}
+	output, err := store.TerminalOutput(ctx, sessionID, terminalID)
+	if err != nil {
+		return err
+	}
+	// Output is only recorded when the agent polls it, so events are timed
+	// by the polls rather than by when the command printed.
+	events := make([]asciicast.Event, 0, len(output))
+	for _, o := range output {
+		if o.Sealed {
+			return fmt.Errorf("terminal %q has encrypted output; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", terminalID)
+		}
+		data := strings.ReplaceAll(strings.ReplaceAll(o.Data, "\r\n", "\n"), "\n", "\r\n")
+		if o.Reset {
+			data = "\x1b[2J\x1b[H" + data
+		}
+		events = append(events, asciicast.Event{Time: max(o.Time.Sub(t.Created).Seconds(), 0), Data: data})
+	}
+	h := asciicast.Header{
+		Width:     cols,
+		Height:    rows,
+		Timestamp: t.Created.Unix(),
+		Command:   strings.Join(append([]string{t.Command}, t.Args...), " "),
+		Title:     sessionID + " " + terminalID,
+	}
+
+	var w io.Writer = os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return asciicast.Write(w, h, events)
+}
+
+// eventJSON is the JSON lines shape printed by "audit events -json".
+type eventJSON struct {
+	ID        int64           `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Direction audit.Direction `json:"direction"`
+	Kind      string          `json:"kind"`
+	Status    audit.Status    `json:"status,omitempty"`
+	Sealed    bool            `json:"sealed,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	CorrID    string          `json:"corrId,omitempty"`
+	ConnID    string          `json:"connId,omitempty"`
+	Seq       int64           `json:"seq,omitempty"`
+	LatencyMs *int64          `json:"latencyMs,omitempty"`
+	UserText  string          `json:"userText,omitempty"`
+	AgentText string          `json:"agentText,omitempty"`
+	Error     *eventErrorJSON `json:"error,omitempty"`
+	Raw       json.RawMessage `json:"raw,omitempty"`
+	// Snippet is only set by audit search.
+	Snippet string `json:"snippet,omitempty"`
+}
+
+type eventErrorJSON struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func auditBlob(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit blob", flag.ContinueOnError)
+	var (
+		dbPath  string
+		hash    string
+		outPath string
+		keyFile string
+	)
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.StringVar(&hash, "sha256", "", "hex SHA-256 of the blob, as in the "+audit.BlobRefPrefix+"<hash> references in raw JSON (required)")
+	fs.StringVar(&outPath, "o", "", "write to this file instead of stdout")
+	fs.StringVar(&keyFile, "audit-key-file", "", auditKeyFileUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	hash = strings.TrimPrefix(hash, audit.BlobRefPrefix)
+	if hash == "" {
+		return fmt.Errorf("missing required flag: -sha256")
+	}
+
+	store, err := openAuditDB(ctx, dbPath, keyFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	b, err := store.Blob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if b.Sealed {
+		return fmt.Errorf("blob %s is encrypted; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", hash)
+	}
+	if outPath == "" {
+		if isTerminal(os.Stdout) {
+			return fmt.Errorf("blob %s is %d bytes of %s; pass -o to write it to a file", hash, b.Size, b.MimeType)
+		}
+		_, err = os.Stdout.Write(b.Data)
+		return err
+	}
+	return os.WriteFile(outPath, b.Data, 0o600)
+}
+
+func newEventJSON(r audit.Record) eventJSON {
+	ev := eventJSON{
+		ID:        r.RowID,
+		Timestamp: r.Timestamp,
+		Direction: r.Direction,
+		Kind:      recordKind(r),
+		Status:    r.Status,
+		Sealed:    r.Sealed,
+		SessionID: r.SessionID,
+		Method:    r.Method,
+		CorrID:    r.CorrelationID,
+		ConnID:    r.ConnID,
+		Seq:       r.Seq,
+		UserText:  r.UserText,
+		AgentText: r.AgentText,
+	}
+	if !r.IsRequest && !r.IsNotify && r.CorrelationID != "" {
+		ms := r.Latency.Milliseconds()
+		ev.LatencyMs = &ms
+	}
+	if r.Error != nil {
+		ev.Error = &eventErrorJSON{Code: r.Error.Code, Message: r.Error.Message}
+		if json.Valid(r.Error.Data) {
+			ev.Error.Data = r.Error.Data
+		}
+	}
+	if json.Valid(r.Raw) {
+		ev.Raw = r.Raw
+	}
+	return ev
+}
+
+func recordKind(r audit.Record) string {
+	switch {
+	case r.IsNotify:
+		return "notify"
+	case r.IsRequest && r.Status != "" && r.Status != audit.StatusCompleted:
+		return "request (" + string(r.Status) + ")"
+	case r.IsRequest:
+		return "request"
+	default:
+		return "response"
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04:05.000")
+}
+
+func formatSeq(seq int64) string {
+	if seq == 0 {
+		return ""
+	}
+	return fmt.Sprint(seq)
+}
+
+func formatLatency(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+// oneLine collapses whitespace and truncates s to at most n runes.
+func oneLine(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+func auditMigrate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit migrate", flag.ContinueOnError)
+	var (
+		dbPath     string
+		dryRun     bool
+		backup     bool
+		backupPath string
+	)
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.BoolVar(&dryRun, "dry-run", false, "only list the migrations that would be applied")
+	fs.BoolVar(&backup, "backup", true, "copy the DB before migrating")
+	fs.StringVar(&backupPath, "backup-path", "", "where to write the backup (default: <audit-db>.v<version>.bak)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := audit.CheckSchema(ctx, dbPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: schema version %d, this binary writes version %d\n", dbPath, st.Current, audit.SchemaVersion())
+	if len(st.Pending) == 0 {
+		fmt.Println("up to date")
+		return nil
+	}
+	for _, m := range st.Pending {
+		fmt.Printf("  %d  %s\n", m.Version, m.Name)
+	}
+	if dryRun {
+		return nil
+	}
+
+	if backup {
+		if backupPath == "" {
+			backupPath = fmt.Sprintf("%s.v%d.bak", dbPath, st.Current)
+		}
+		if _, err := os.Stat(backupPath); err == nil {
+			return fmt.Errorf("backup %s already exists", backupPath)
+		}
+		if err := audit.Backup(ctx, dbPath, backupPath); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+		fmt.Printf("backup written to %s\n", backupPath)
+	}
+	store, err := audit.Open(ctx, dbPath)
+	if err != nil {
+		return err
+	}
+	if err := store.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("migrated to version %d\n", audit.SchemaVersion())
+	return nil
+}
+
+// retentionFlags holds the retention limits shared by "audit prune" and
+// the proxy's periodic pruning.
+type retentionFlags struct {
+	maxAge    ageFlag
+	rawMaxAge ageFlag
+	maxRows   int64
+	maxSize   sizeFlag
+}
+
+func (rf *retentionFlags) register(fs *flag.FlagSet, prefix string) {
+	fs.Var(&rf.maxAge, prefix+"max-age", "delete events older than this (e.g. 30d, 720h)")
+	fs.Var(&rf.rawMaxAge, prefix+"raw-max-age", "clear raw_json on events older than this, keeping the extracted text")
+	fs.Int64Var(&rf.maxRows, prefix+"max-rows", 0, "keep at most this many of the newest events (0 for no limit)")
+	fs.Var(&rf.maxSize, prefix+"max-size", "delete the oldest events until the data fits in this size (e.g. 500MB)")
+}
+
+func (rf *retentionFlags) retention() audit.Retention {
+	return audit.Retention{
+		MaxAge:    time.Duration(rf.maxAge),
+		RawMaxAge: time.Duration(rf.rawMaxAge),
+		MaxRows:   rf.maxRows,
+		MaxBytes:  int64(rf.maxSize),
+	}
+}
+
+// ageFlag is a duration that also accepts a whole number of days ("30d").
+type ageFlag time.Duration
+
+func (a *ageFlag) String() string {
+	if *a == 0 {
+		return ""
+	}
+	return time.Duration(*a).String()
+}
+
+func (a *ageFlag) Set(v string) error {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of days %q", v)
+		}
+		*a = ageFlag(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid age %q (want a duration like 720h or days like 30d)", v)
+	}
+	*a = ageFlag(d)
+	return nil
+}
+
+// sizeFlag is a byte count with an optional KB, MB or GB suffix (powers of
+// 1024).
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	if *s == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(v string) error {
+	num, mult := strings.ToUpper(strings.TrimSpace(v)), int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if n, ok := strings.CutSuffix(num, u.suffix); ok {
+			num, mult = strings.TrimSpace(n), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q (want bytes or a number with KB, MB or GB)", v)
+	}
+	*s = sizeFlag(n * mult)
+	return nil
+}
+
+func auditPrune(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit prune", flag.ContinueOnError)
+	var (
+		dbPath string
+		rf     retentionFlags
+		vacuum bool
+	)
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	rf.register(fs, "")
+	fs.BoolVar(&vacuum, "vacuum", false, "rewrite the DB with a full VACUUM if it does not use incremental vacuum yet")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r := rf.retention()
+	if r.IsZero() && !vacuum {
+		return fmt.Errorf("nothing to do: set at least one of -max-age, -raw-max-age, -max-rows, -max-size or -vacuum")
+	}
+
+	store, err := openAuditDB(ctx, dbPath, "")
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	res, err := store.Prune(ctx, r, time.Now(), audit.PruneOptions{Vacuum: vacuum})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted %d events, cleared raw_json on %d, freed %d bytes\n", res.Deleted, res.Stripped, res.Freed)
+	return nil
+}
+
+func auditKeygen(args []string) error {
+	fs := flag.NewFlagSet("audit keygen", flag.ContinueOnError)
+	signing := fs.Bool("signing", false, "generate an Ed25519 checkpoint signing key; the public key is printed to stderr")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *signing {
+		priv, pub, err := audit.GenerateSigningKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(priv)
+		fmt.Fprintf(os.Stderr, "public key: %s\n", pub)
+		return nil
+	}
+	line, err := audit.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func auditRekey(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit rekey", flag.ContinueOnError)
+	var dbPath, keyFile string
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.StringVar(&keyFile, "audit-key-file", "", auditKeyFileUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store, err := openAuditDB(ctx, dbPath, keyFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	n, err := store.Rekey(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rewrapped %d data keys\n", n)
+	return nil
+}
+
+func auditVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	var dbPath, pubKey string
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.StringVar(&pubKey, "pubkey", "", "base64 Ed25519 public key, or a file holding it, to check checkpoint signatures")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var pub ed25519.PublicKey
+	if pubKey != "" {
+		data := []byte(pubKey)
+		if b, err := os.ReadFile(pubKey); err == nil {
+			data = b
+		}
+		var err error
+		if pub, err = audit.ParsePublicKey(data); err != nil {
+			return err
+		}
+	}
+
+	store, err := openAuditDB(ctx, dbPath, "")
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	rep, err := store.Verify(ctx, pub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("checked %d rows (%d-%d), %d before the chain began; %d checkpoints, %d signatures verified\n",
+		rep.Rows, rep.FirstRowID, rep.LastRowID, rep.Unchained, rep.Checkpoints, rep.Signed)
+	if rep.Checkpoints > 0 && pub == nil {
+		fmt.Println("checkpoint signatures not checked: pass -pubkey")
+	}
+	for _, p := range rep.Problems {
+		fmt.Println(p)
+	}
+	if !rep.OK() {
+		return fmt.Errorf("%d problems found, first at row %d", len(rep.Problems), rep.Problems[0].RowID)
+	}
+	fmt.Println("ok")
+	return nil
+}
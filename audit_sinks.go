@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"acp-gate/internal/audit"
+	"acp-gate/internal/config"
+	"acp-gate/internal/redact"
+)
+
+const auditSinkUsage = "audit destination, repeatable: sqlite, jsonl:<file>, stdout, stderr, syslog or syslog:<socket> (default: sqlite, or audit_sinks from the config)"
+
+// auditSetup holds the audit settings shared by server and local mode.
+type auditSetup struct {
+	sinks []config.AuditSink
+
+	dbPath     string
+	queue      int
+	overflow   string
+	spillPath  string
+	turns      audit.TurnMode
+	retention  audit.Retention
+	pruneEvery time.Duration
+	cpEvery    time.Duration
+
+	redactor *redact.Redactor
+	keyring  *audit.Keyring
+	signer   ed25519.PrivateKey
+
+	// agentName is recorded with each session; see audit.Store.SetAgentName.
+	agentName string
+}
+
+// auditSinkSpecs returns the sinks selected by -audit-sink flags, or by the
+// config file when there are none. The default is the SQLite database.
+func auditSinkSpecs(flags []string, cfg []config.AuditSink) ([]config.AuditSink, error) {
+	specs := cfg
+	if len(flags) > 0 {
+		specs = nil
+		for _, f := range flags {
+			kind, arg, _ := strings.Cut(f, ":")
+			spec := config.AuditSink{Type: kind}
+			switch kind {
+			case "jsonl":
+				spec.Path = arg
+			case "syslog":
+				spec.Address = arg
+			default:
+				if arg != "" {
+					return nil, fmt.Errorf("-audit-sink %q: %s takes no argument", f, kind)
+				}
+			}
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		return []config.AuditSink{{Type: "sqlite"}}, nil
+	}
+	seen := map[string]bool{}
+	for _, s := range specs {
+		switch s.Type {
+		case "sqlite", "stdout", "stderr", "syslog":
+		case "jsonl":
+			if s.Path == "" {
+				return nil, fmt.Errorf("audit sink jsonl: missing file path")
+			}
+		default:
+			return nil, fmt.Errorf("unknown audit sink %q", s.Type)
+		}
+		if s.Type == "sqlite" && seen[s.Type] {
+			return nil, fmt.Errorf("audit sink sqlite given twice")
+		}
+		seen[s.Type] = true
+	}
+	return specs, nil
+}
+
+// open opens every selected sink. Background maintenance of the SQLite
+// store runs until ctx is done. In local mode stdout carries the ACP
+// stream to the editor and cannot be used as a sink.
+func (a auditSetup) open(ctx context.Context, local bool) (audit.Sink, error) {
+	var sinks []audit.Sink
+	for _, spec := range a.sinks {
+		s, err := a.openSink(ctx, spec, local)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close()
+			}
+			return nil, fmt.Errorf("audit sink %s: %w", spec.Type, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return audit.Fanout(sinks...), nil
+}
+
+func (a auditSetup) openSink(ctx context.Context, spec config.AuditSink, local bool) (audit.Sink, error) {
+	switch spec.Type {
+	case "sqlite":
+		return a.openStore(ctx)
+	case "jsonl":
+		s, err := audit.OpenFileSink(spec.Path, audit.FileSinkOptions{MaxBytes: spec.MaxSizeMB << 20, MaxBackups: spec.MaxBackups})
+		if err != nil {
+			return nil, err
+		}
+		return audit.Redacted(s, a.redactor), nil
+	case "stdout":
+		if local {
+			return nil, fmt.Errorf("stdout carries the ACP stream in local mode; use stderr")
+		}
+		return audit.Redacted(audit.NewWriterSink(os.Stdout), a.redactor), nil
+	case "stderr":
+		return audit.Redacted(audit.NewWriterSink(os.Stderr), a.redactor), nil
+	case "syslog":
+		s, err := audit.DialSyslog(audit.SyslogOptions{Address: spec.Address, Tag: spec.Tag, Facility: spec.Facility})
+		if err != nil {
+			return nil, err
+		}
+		return audit.Redacted(s, a.redactor), nil
+	}
+	return nil, fmt.Errorf("unknown audit sink %q", spec.Type)
+}
+
+func (a auditSetup) openStore(ctx context.Context) (*audit.Store, error) {
+	store, err := audit.Open(ctx, a.dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("open audit db: %w", err)
+	}
+	store.SetRedactor(a.redactor)
+	if a.keyring != nil {
+		store.SetKeyring(a.keyring)
+	}
+	if a.signer != nil {
+		store.SetSigner(a.signer)
+	}
+	store.SetAgentName(a.agentName)
+	store.SetTurns(a.turns)
+	if err := startAuditWriter(store, a.dbPath, a.queue, a.overflow, a.spillPath); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("start audit writer: %w", err)
+	}
+	go store.EnforceRetention(ctx, a.retention, a.pruneEvery, logPrune)
+	go store.RunCheckpoints(ctx, a.cpEvery, logCheckpoint)
+	go store.ReportDropped(ctx, time.Minute, logDropped)
+	return store, nil
+}
@@ -0,0 +1,61 @@
+package acpinspect
+
+import "encoding/json"
+
+// Blob is the base64 payload of an image, audio or embedded blob resource
+// content block.
+type Blob struct {
+	Type     string // "image", "audio" or "resource"
+	MimeType string
+	URI      string // set for resources
+	Data     string // base64, as it appears in the message
+}
+
+// Blobs returns the binary payloads of the content blocks anywhere in the
+// JSON document raw. Blocks are recognized by their shape rather than by
+// method, so prompts, message chunks, tool call content and unknown
+// methods are all covered. The order of the result is unspecified.
+func Blobs(raw []byte) []Blob {
+	var v any
+	if json.Unmarshal(raw, &v) != nil {
+		return nil
+	}
+	var out []Blob
+	collectBlobs(v, &out)
+	return out
+}
+
+func collectBlobs(v any, out *[]Blob) {
+	switch v := v.(type) {
+	case map[string]any:
+		if b, ok := blobOf(v); ok {
+			*out = append(*out, b)
+		}
+		for _, c := range v {
+			collectBlobs(c, out)
+		}
+	case []any:
+		for _, c := range v {
+			collectBlobs(c, out)
+		}
+	}
+}
+
+// blobOf recognizes {"type":"image"|"audio","data":...,"mimeType":...} and
+// {"type":"resource","resource":{"uri":...,"blob":...,"mimeType":...}}.
+func blobOf(m map[string]any) (Blob, bool) {
+	typ, _ := m["type"].(string)
+	switch typ {
+	case "image", "audio":
+		data, _ := m["data"].(string)
+		mime, _ := m["mimeType"].(string)
+		return Blob{Type: typ, MimeType: mime, Data: data}, data != ""
+	case "resource":
+		res, _ := m["resource"].(map[string]any)
+		data, _ := res["blob"].(string)
+		mime, _ := res["mimeType"].(string)
+		uri, _ := res["uri"].(string)
+		return Blob{Type: typ, MimeType: mime, URI: uri, Data: data}, data != ""
+	}
+	return Blob{}, false
+}
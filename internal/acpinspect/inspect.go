@@ -21,63 +21,224 @@ type AnyMessage struct {
 	Error   json.RawMessage  `json:"error,omitempty"`
 }
 
-// Extract returns (sessionID, method, userText, agentText).
-// It best-effort parses known ACP methods and leaves everything else empty.
-func Extract(msg AnyMessage) (string, string, string, string) {
-	method := msg.Method
+// Content is what Inspect finds in a message.
+type Content struct {
+	SessionID string
+	Method    string
+	UserText  string
+	AgentText string
+
+	// Attachments are the non-text content blocks of prompts, message
+	// chunks and tool call content: resource links, embedded resources,
+	// images and audio.
+	Attachments []Attachment
+	// Update is the sessionUpdate kind of a session/update notification,
+	// such as "plan" or "available_commands_update".
+	Update string
+	// Plan is the complete plan sent by a plan update.
+	Plan []PlanEntry
+	// Commands are the commands sent by an available_commands_update,
+	// which replace the previous ones.
+	Commands []Command
+	// Mode is the mode requested by session/set_mode or reported by a
+	// current_mode_update.
+	Mode string
+}
+
+// Attachment is a non-text content block.
+type Attachment struct {
+	// Source is where the block appeared: "prompt", "user_message",
+	// "agent_message", "agent_thought" or "tool_call".
+	Source string
+	// Kind is the block type: "resource_link", "resource", "image" or
+	// "audio".
+	Kind     string
+	URI      string
+	Name     string // resource links only
+	MimeType string
+	// Size is the size a resource link declares, or the decoded size of
+	// an inline payload.
+	Size int64
+	// Text is the content of an embedded text resource.
+	Text string
+	// Data is the base64 payload of images, audio and blob resources.
+	Data string
+}
+
+// PlanEntry is one task of an agent plan.
+type PlanEntry struct {
+	Content  string `json:"content"`
+	Priority string `json:"priority,omitempty"`
+	Status   string `json:"status,omitempty"`
+}
+
+// Command is a command the agent offers, such as /create_plan.
+type Command struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Hint        string `json:"hint,omitempty"`
+}
 
-	// Requests/notifications carry method+params.
-	if method != "" {
-		sid, userText, agentText := extractFromParams(method, msg.Params)
-		return sid, method, userText, agentText
+// Inspect best-effort parses known ACP methods and leaves everything else
+// empty. Responses don't carry a method, so nothing is extracted from
+// them.
+func Inspect(msg AnyMessage) Content {
+	if msg.Method == "" {
+		return Content{}
 	}
+	c := Content{Method: msg.Method}
+	inspectParams(&c, msg.Params)
+	return c
+}
 
-	// Responses don't carry method. We still persist raw, but extraction is empty.
-	return "", "", "", ""
+// Extract returns (sessionID, method, userText, agentText); see Inspect
+// for the rest of the content.
+func Extract(msg AnyMessage) (string, string, string, string) {
+	c := Inspect(msg)
+	return c.SessionID, c.Method, c.UserText, c.AgentText
 }
 
-func extractFromParams(method string, params json.RawMessage) (string, string, string) {
-	switch method {
+func inspectParams(c *Content, params json.RawMessage) {
+	switch c.Method {
 	case acp.AgentMethodSessionPrompt:
 		var p acp.PromptRequest
 		if json.Unmarshal(params, &p) != nil {
-			return "", "", ""
+			return
+		}
+		c.SessionID = string(p.SessionId)
+		c.UserText = joinTextFromContentBlocks(p.Prompt)
+		for _, b := range p.Prompt {
+			c.attach("prompt", b)
 		}
-		return string(p.SessionId), joinTextFromContentBlocks(p.Prompt), ""
 
 	case acp.ClientMethodSessionUpdate:
 		var n acp.SessionNotification
 		if json.Unmarshal(params, &n) != nil {
-			return "", "", ""
+			return
 		}
+		c.SessionID = string(n.SessionId)
+		u := n.Update
 		switch {
-		case n.Update.AgentMessageChunk != nil:
-			return string(n.SessionId), "", textFromContentBlock(n.Update.AgentMessageChunk.Content)
-		case n.Update.UserMessageChunk != nil:
-			return string(n.SessionId), textFromContentBlock(n.Update.UserMessageChunk.Content), ""
-		case n.Update.AgentThoughtChunk != nil:
-			return string(n.SessionId), "", textFromContentBlock(n.Update.AgentThoughtChunk.Content)
-		case n.Update.ToolCall != nil:
+		case u.AgentMessageChunk != nil:
+			c.Update = u.AgentMessageChunk.SessionUpdate
+			c.AgentText = textFromContentBlock(u.AgentMessageChunk.Content)
+			c.attach("agent_message", u.AgentMessageChunk.Content)
+		case u.UserMessageChunk != nil:
+			c.Update = u.UserMessageChunk.SessionUpdate
+			c.UserText = textFromContentBlock(u.UserMessageChunk.Content)
+			c.attach("user_message", u.UserMessageChunk.Content)
+		case u.AgentThoughtChunk != nil:
+			c.Update = u.AgentThoughtChunk.SessionUpdate
+			c.AgentText = textFromContentBlock(u.AgentThoughtChunk.Content)
+			c.attach("agent_thought", u.AgentThoughtChunk.Content)
+		case u.ToolCall != nil:
 			// Best-effort: capture any text content produced by tools.
-			return string(n.SessionId), "", joinTextFromToolCallContent(n.Update.ToolCall.Content)
-		case n.Update.ToolCallUpdate != nil:
-			return string(n.SessionId), "", joinTextFromToolCallContent(n.Update.ToolCallUpdate.Content)
-		default:
-			return string(n.SessionId), "", ""
+			c.Update = u.ToolCall.SessionUpdate
+			c.AgentText = joinTextFromToolCallContent(u.ToolCall.Content)
+			c.attachToolCall(u.ToolCall.Content)
+		case u.ToolCallUpdate != nil:
+			c.Update = u.ToolCallUpdate.SessionUpdate
+			c.AgentText = joinTextFromToolCallContent(u.ToolCallUpdate.Content)
+			c.attachToolCall(u.ToolCallUpdate.Content)
+		case u.Plan != nil:
+			c.Update = u.Plan.SessionUpdate
+			c.Plan = make([]PlanEntry, 0, len(u.Plan.Entries))
+			for _, e := range u.Plan.Entries {
+				c.Plan = append(c.Plan, PlanEntry{Content: e.Content, Priority: string(e.Priority), Status: string(e.Status)})
+			}
+		case u.AvailableCommandsUpdate != nil:
+			c.Update = u.AvailableCommandsUpdate.SessionUpdate
+			c.Commands = make([]Command, 0, len(u.AvailableCommandsUpdate.AvailableCommands))
+			for _, ac := range u.AvailableCommandsUpdate.AvailableCommands {
+				cmd := Command{Name: ac.Name, Description: ac.Description}
+				if ac.Input != nil && ac.Input.UnstructuredCommandInput != nil {
+					cmd.Hint = ac.Input.UnstructuredCommandInput.Hint
+				}
+				c.Commands = append(c.Commands, cmd)
+			}
+		case u.CurrentModeUpdate != nil:
+			c.Update = u.CurrentModeUpdate.SessionUpdate
+			c.Mode = string(u.CurrentModeUpdate.CurrentModeId)
 		}
 
+	case acp.AgentMethodSessionSetMode:
+		var p acp.SetSessionModeRequest
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		c.SessionID, c.Mode = string(p.SessionId), string(p.ModeId)
+
 	default:
 		// Many ACP requests include sessionId; try a generic parse.
 		var any struct {
 			SessionID string `json:"sessionId"`
 		}
 		if json.Unmarshal(params, &any) == nil {
-			return any.SessionID, "", ""
+			c.SessionID = any.SessionID
+		}
+	}
+}
+
+// attach records b if it is not text.
+func (c *Content) attach(source string, b acp.ContentBlock) {
+	a := Attachment{Source: source}
+	switch {
+	case b.ResourceLink != nil:
+		l := b.ResourceLink
+		a.Kind, a.URI, a.Name = l.Type, l.Uri, l.Name
+		a.MimeType = deref(l.MimeType)
+		if l.Size != nil {
+			a.Size = int64(*l.Size)
+		}
+	case b.Resource != nil:
+		a.Kind = b.Resource.Type
+		switch r := b.Resource.Resource; {
+		case r.TextResourceContents != nil:
+			a.URI, a.MimeType, a.Text = r.TextResourceContents.Uri, deref(r.TextResourceContents.MimeType), r.TextResourceContents.Text
+			a.Size = int64(len(a.Text))
+		case r.BlobResourceContents != nil:
+			a.URI, a.MimeType, a.Data = r.BlobResourceContents.Uri, deref(r.BlobResourceContents.MimeType), r.BlobResourceContents.Blob
+			a.Size = decodedLen(a.Data)
+		}
+	case b.Image != nil:
+		a.Kind, a.URI, a.MimeType, a.Data = b.Image.Type, deref(b.Image.Uri), b.Image.MimeType, b.Image.Data
+		a.Size = decodedLen(a.Data)
+	case b.Audio != nil:
+		a.Kind, a.MimeType, a.Data = b.Audio.Type, b.Audio.MimeType, b.Audio.Data
+		a.Size = decodedLen(a.Data)
+	default:
+		return
+	}
+	c.Attachments = append(c.Attachments, a)
+}
+
+func (c *Content) attachToolCall(items []acp.ToolCallContent) {
+	for _, it := range items {
+		if it.Content != nil {
+			c.attach("tool_call", it.Content.Content)
 		}
-		return "", "", ""
 	}
 }
 
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// decodedLen is the number of bytes the padded base64 string s decodes to.
+func decodedLen(s string) int64 {
+	n := int64(len(s)) / 4 * 3
+	switch {
+	case strings.HasSuffix(s, "=="):
+		n -= 2
+	case strings.HasSuffix(s, "="):
+		n--
+	}
+	return n
+}
+
 func joinTextFromContentBlocks(blocks []acp.ContentBlock) string {
 	var parts []string
 	for _, b := range blocks {
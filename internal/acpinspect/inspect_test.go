@@ -42,3 +42,66 @@ func TestExtract_SessionUpdateAgentMessageChunk(t *testing.T) {
 		t.Fatalf("unexpected agentText: %q", agentText)
 	}
 }
+
+func TestBlobs(t *testing.T) {
+	raw := []byte(`{"sessionId":"s","prompt":[{"type":"text","text":"look"},{"type":"image","mimeType":"image/png","data":"iVBO"},` +
+		`{"type":"resource","resource":{"uri":"file:///a.pdf","mimeType":"application/pdf","blob":"JVBE"}},` +
+		`{"type":"resource","resource":{"uri":"file:///a.txt","text":"hi"}}]}`)
+	blobs := Blobs(raw)
+	if len(blobs) != 2 {
+		t.Fatalf("expected 2 blobs, got %+v", blobs)
+	}
+	if blobs[0].Type == "resource" {
+		blobs[0], blobs[1] = blobs[1], blobs[0]
+	}
+	if blobs[0] != (Blob{Type: "image", MimeType: "image/png", Data: "iVBO"}) ||
+		blobs[1] != (Blob{Type: "resource", MimeType: "application/pdf", URI: "file:///a.pdf", Data: "JVBE"}) {
+		t.Fatalf("unexpected blobs: %+v", blobs)
+	}
+}
+
+func TestInspect_PromptAttachments(t *testing.T) {
+	params := []byte(`{"sessionId":"s","prompt":[{"type":"text","text":"review"},` +
+		`{"type":"resource_link","uri":"file:///src/main.go","name":"main.go","mimeType":"text/x-go","size":1200},` +
+		`{"type":"resource","resource":{"uri":"file:///notes.md","mimeType":"text/markdown","text":"# Notes"}},` +
+		`{"type":"image","mimeType":"image/png","data":"iVBORw=="}]}`)
+	c := Inspect(AnyMessage{Method: "session/prompt", Params: params})
+	if c.SessionID != "s" || c.UserText != "review" {
+		t.Fatalf("unexpected content: %+v", c)
+	}
+	want := []Attachment{
+		{Source: "prompt", Kind: "resource_link", URI: "file:///src/main.go", Name: "main.go", MimeType: "text/x-go", Size: 1200},
+		{Source: "prompt", Kind: "resource", URI: "file:///notes.md", MimeType: "text/markdown", Size: 7, Text: "# Notes"},
+		{Source: "prompt", Kind: "image", MimeType: "image/png", Size: 4, Data: "iVBORw=="},
+	}
+	if len(c.Attachments) != len(want) {
+		t.Fatalf("unexpected attachments: %+v", c.Attachments)
+	}
+	for i := range want {
+		if c.Attachments[i] != want[i] {
+			t.Fatalf("attachment %d: got %+v, want %+v", i, c.Attachments[i], want[i])
+		}
+	}
+}
+
+func TestInspect_SessionUpdates(t *testing.T) {
+	update := func(u string) Content {
+		return Inspect(AnyMessage{Method: "session/update", Params: []byte(`{"sessionId":"s","update":` + u + `}`)})
+	}
+	c := update(`{"sessionUpdate":"plan","entries":[{"content":"write tests","priority":"high","status":"in_progress"}]}`)
+	if c.Update != "plan" || len(c.Plan) != 1 || c.Plan[0] != (PlanEntry{Content: "write tests", Priority: "high", Status: "in_progress"}) {
+		t.Fatalf("unexpected plan: %+v", c)
+	}
+	c = update(`{"sessionUpdate":"available_commands_update","availableCommands":[{"name":"web","description":"Search","input":{"hint":"query"}}]}`)
+	if c.Update != "available_commands_update" || len(c.Commands) != 1 || c.Commands[0] != (Command{Name: "web", Description: "Search", Hint: "query"}) {
+		t.Fatalf("unexpected commands: %+v", c)
+	}
+	c = update(`{"sessionUpdate":"current_mode_update","currentModeId":"code"}`)
+	if c.Update != "current_mode_update" || c.Mode != "code" {
+		t.Fatalf("unexpected mode: %+v", c)
+	}
+	c = Inspect(AnyMessage{Method: "session/set_mode", Params: []byte(`{"sessionId":"s","modeId":"ask"}`)})
+	if c.SessionID != "s" || c.Mode != "ask" {
+		t.Fatalf("unexpected set_mode: %+v", c)
+	}
+}
@@ -0,0 +1,46 @@
+// Package asciicast writes terminal recordings in the asciicast v2 format
+// played by asciinema.
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// Header is the first line of a recording.
+type Header struct {
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Duration  float64           `json:"duration,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is output written to the terminal Time seconds into the recording.
+type Event struct {
+	Time float64
+	Data string
+}
+
+// Write writes a recording with header h and the output events. Events
+// must be in time order.
+func Write(w io.Writer, h Header, events []Event) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(struct {
+		Version int `json:"version"`
+		Header
+	}{2, h}); err != nil {
+		return err
+	}
+	for _, e := range events {
+		if err := enc.Encode([]any{e.Time, "o", e.Data}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
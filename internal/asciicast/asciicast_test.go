@@ -0,0 +1,21 @@
+package asciicast
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	var sb strings.Builder
+	h := Header{Width: 80, Height: 24, Timestamp: 1700000000, Command: "make test", Env: map[string]string{"TERM": "xterm"}}
+	if err := Write(&sb, h, []Event{{0.5, "ok <a>\r\n"}, {1.25, "\x1b[2J"}}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	want := `{"version":2,"width":80,"height":24,"timestamp":1700000000,"command":"make test","env":{"TERM":"xterm"}}
+[0.5,"o","ok <a>\r\n"]
+[1.25,"o","\u001b[2J"]
+`
+	if sb.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", sb.String(), want)
+	}
+}
@@ -0,0 +1,316 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"acp-gate/internal/acpinspect"
+)
+
+// The attachments table has one row per non-text content block of a
+// prompt, message chunk or tool call: resource links, embedded resources,
+// images and audio. It answers "which files did the user attach" without
+// parsing raw_json. Payloads moved to the blobs table are linked by hash;
+// the text of embedded text resources is kept, and encrypted like the
+// payload it was taken from on encrypted stores.
+//
+// The latest plan and available commands of a session are kept in the
+// plan and commands columns of sessions; see sessionTracker.
+
+const attachmentsSchema = `
+CREATE TABLE IF NOT EXISTS attachments (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT,
+  conn_id TEXT,
+  corr_id TEXT,
+  ts_unix_ms INTEGER NOT NULL,
+  direction TEXT NOT NULL,
+  source TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  uri TEXT,
+  name TEXT,
+  mime_type TEXT,
+  size INTEGER,
+  text TEXT,
+  blob_sha256 TEXT,
+  key_id TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_session ON attachments(session_id, id);
+CREATE INDEX IF NOT EXISTS idx_attachments_uri ON attachments(uri);
+CREATE INDEX IF NOT EXISTS idx_attachments_ts ON attachments(ts_unix_ms);`
+
+// Attachment is one row of the attachments table.
+type Attachment struct {
+	ID            int64
+	SessionID     string
+	ConnID        string
+	CorrelationID string
+	Time          time.Time
+	Direction     Direction
+	// Source is where the block appeared: prompt, user_message,
+	// agent_message, agent_thought or tool_call.
+	Source string
+	// Kind is resource_link, resource, image or audio.
+	Kind     string
+	URI      string
+	Name     string
+	MimeType string
+	// Size is -1 when unknown.
+	Size int64
+	// Text is the content of an embedded text resource.
+	Text string
+	// BlobSHA256 names the payload in the blobs table; see Store.Blob.
+	BlobSHA256 string
+	// Sealed is set when Text is encrypted with a key that is not
+	// available.
+	Sealed bool
+}
+
+type attachmentUpdate struct {
+	SessionID, ConnID, CorrID string
+	At                        int64
+	Direction                 Direction
+	Source, Kind              string
+	URI, Name, MimeType       string
+	Size                      int64 // -1 when unknown
+	Text                      string
+	BlobSHA256                string
+	KeyID                     string
+}
+
+// attachmentUpdates returns the attachments of r. blobs are the payloads
+// extracted from r, which give the size of the blocks they replaced.
+func attachmentUpdates(r Record, blobs []blobUpdate) []attachmentUpdate {
+	if !(r.IsRequest && r.Method == "session/prompt") && !(r.IsNotify && r.Method == "session/update") {
+		return nil
+	}
+	c := acpinspect.Inspect(acpinspect.AnyMessage{Method: r.Method, Params: r.Raw})
+	if len(c.Attachments) == 0 {
+		return nil
+	}
+	ups := make([]attachmentUpdate, 0, len(c.Attachments))
+	for _, a := range c.Attachments {
+		u := attachmentUpdate{SessionID: c.SessionID, ConnID: r.ConnID, CorrID: r.CorrelationID, At: r.Timestamp.UnixMilli(),
+			Direction: r.Direction, Source: a.Source, Kind: a.Kind, URI: a.URI, Name: a.Name, MimeType: a.MimeType, Size: a.Size, Text: a.Text}
+		if hash, ok := strings.CutPrefix(a.Data, BlobRefPrefix); ok {
+			u.BlobSHA256, u.Size = hash, -1
+			for _, b := range blobs {
+				if b.SHA256 == hash {
+					u.Size = b.Size
+				}
+			}
+		}
+		ups = append(ups, u)
+	}
+	return ups
+}
+
+func (s *Store) sealAttachments(ctx context.Context, ups []attachmentUpdate) error {
+	dk, err := s.writeKey(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range ups {
+		u := &ups[i]
+		if u.Text == "" {
+			continue
+		}
+		if u.Text, err = seal(dk.aead, "attachment_text", []byte(u.Text)); err != nil {
+			return err
+		}
+		u.KeyID = dk.id
+	}
+	return nil
+}
+
+func applyAttachments(ctx context.Context, db dbtx, ups []attachmentUpdate) error {
+	for _, u := range ups {
+		var size any
+		if u.Size >= 0 {
+			size = u.Size
+		}
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO attachments(session_id, conn_id, corr_id, ts_unix_ms, direction, source, kind, uri, name, mime_type, size, text, blob_sha256, key_id)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`, nullIfEmpty(u.SessionID), nullIfEmpty(u.ConnID), nullIfEmpty(u.CorrID), u.At, string(u.Direction), u.Source, u.Kind,
+			nullIfEmpty(u.URI), nullIfEmpty(u.Name), nullIfEmpty(u.MimeType), size, nullIfEmpty(u.Text), nullIfEmpty(u.BlobSHA256),
+			nullIfEmpty(u.KeyID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneAttachments deletes the attachments recorded before cutoff, as
+// retention does with their events.
+func pruneAttachments(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM attachments WHERE ts_unix_ms < ?`, cutoff)
+	return err
+}
+
+// AttachmentFilter selects attachments. Zero-valued fields are ignored.
+type AttachmentFilter struct {
+	SessionID string
+	// URI selects the attachments of one resource, or of the resources
+	// below it when it ends with a slash.
+	URI string
+	// Source selects where the blocks appeared, such as "prompt" for the
+	// files the user attached.
+	Source string
+	Kind   string
+	Since  time.Time
+	Until  time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f AttachmentFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.SessionID != "" {
+		conds = append(conds, "session_id = ?")
+		args = append(args, f.SessionID)
+	}
+	if strings.HasSuffix(f.URI, "/") {
+		conds = append(conds, "substr(uri, 1, ?) = ?")
+		args = append(args, len(f.URI), f.URI)
+	} else if f.URI != "" {
+		conds = append(conds, "uri = ?")
+		args = append(args, f.URI)
+	}
+	if f.Source != "" {
+		conds = append(conds, "source = ?")
+		args = append(args, f.Source)
+	}
+	if f.Kind != "" {
+		conds = append(conds, "kind = ?")
+		args = append(args, f.Kind)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "ts_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "ts_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Attachments returns the attachments matching f in the order they were
+// sent.
+func (s *Store) Attachments(ctx context.Context, f AttachmentFilter) ([]Attachment, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, session_id, conn_id, corr_id, ts_unix_ms, direction, source, kind, uri, name, mime_type, size, text, blob_sha256, key_id
+FROM attachments`+where+`
+ORDER BY id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Attachment
+	for rows.Next() {
+		var (
+			a                     Attachment
+			session, conn, corr   sql.NullString
+			uri, name, mime, text sql.NullString
+			hash, keyID           sql.NullString
+			ts                    int64
+			dir                   string
+			size                  sql.NullInt64
+		)
+		if err := rows.Scan(&a.ID, &session, &conn, &corr, &ts, &dir, &a.Source, &a.Kind, &uri, &name, &mime, &size, &text,
+			&hash, &keyID); err != nil {
+			return nil, err
+		}
+		a.SessionID, a.ConnID, a.CorrelationID = session.String, conn.String, corr.String
+		a.Time, a.Direction = time.UnixMilli(ts), Direction(dir)
+		a.URI, a.Name, a.MimeType, a.Text, a.BlobSHA256 = uri.String, name.String, mime.String, text.String, hash.String
+		a.Size = -1
+		if size.Valid {
+			a.Size = size.Int64
+		}
+		if keyID.Valid && text.Valid {
+			s.openAttachment(ctx, keyID.String, &a)
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// openAttachment decrypts the text of a. If the data key is not available
+// the text is cleared and a.Sealed is set.
+func (s *Store) openAttachment(ctx context.Context, keyID string, a *Attachment) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		if text, err := openField(aead, "attachment_text", a.Text); err == nil {
+			a.Text = string(text)
+			return
+		}
+	}
+	a.Text, a.Sealed = "", true
+}
+
+// backfillContent derives the attachments, plans and available commands
+// of the plaintext events recorded before their tables existed.
+func backfillContent(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+SELECT ts_unix_ms, direction, method, is_request, is_notify, session_id, corr_id, conn_id, raw_json
+FROM audit_events
+WHERE ((method = 'session/prompt' AND is_request = 1) OR (method = 'session/update' AND is_notify = 1))
+  AND key_id IS NULL AND session_id IS NOT NULL
+ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var (
+		ups      []attachmentUpdate
+		sessions []sessionUpdate
+	)
+	for rows.Next() {
+		var (
+			r               Record
+			ts              int64
+			dir, raw        string
+			isReq, isNotify int
+			corr, conn      sql.NullString
+		)
+		if err := rows.Scan(&ts, &dir, &r.Method, &isReq, &isNotify, &r.SessionID, &corr, &conn, &raw); err != nil {
+			rows.Close()
+			return err
+		}
+		r.Timestamp, r.Direction = time.UnixMilli(ts), Direction(dir)
+		r.IsRequest, r.IsNotify = isReq != 0, isNotify != 0
+		r.CorrelationID, r.ConnID, r.Raw = corr.String, conn.String, []byte(raw)
+		ups = append(ups, attachmentUpdates(r, nil)...)
+		if u, ok := contentSessionUpdate(r); ok {
+			sessions = append(sessions, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := applyAttachments(ctx, tx, ups); err != nil {
+		return err
+	}
+	if err := applySessions(ctx, tx, sessions); err != nil {
+		return err
+	}
+	// Payloads already moved to the blobs table have their size there.
+	_, err = tx.ExecContext(ctx, `
+UPDATE attachments SET size = (SELECT size FROM blobs WHERE blobs.sha256 = attachments.blob_sha256)
+WHERE size IS NULL AND blob_sha256 IS NOT NULL`)
+	return err
+}
@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// contentRecords are a prompt attaching a file, a directory entry and a
+// screenshot, followed by a plan and the agent's commands.
+func contentRecords() []Record {
+	png := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x89, 'P'}, 300))
+	return []Record{
+		{Direction: DirectionUpstreamToDownstream, SessionID: "s1", Method: "session/prompt", IsRequest: true,
+			Raw: []byte(`{"sessionId":"s1","prompt":[{"type":"text","text":"fix"},
+{"type":"resource","resource":{"uri":"file:///p/main.go","mimeType":"text/x-go","text":"package main"}},
+{"type":"resource_link","uri":"file:///p/docs","name":"docs","size":42},
+{"type":"image","mimeType":"image/png","data":"` + png + `"}]}`)},
+		{Direction: DirectionDownstreamToUpstream, SessionID: "s1", Method: "session/update", IsNotify: true,
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"plan","entries":[{"content":"read main.go","priority":"high","status":"pending"}]}}`)},
+		{Direction: DirectionDownstreamToUpstream, SessionID: "s1", Method: "session/update", IsNotify: true,
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"available_commands_update","availableCommands":[{"name":"test","description":"run tests"}]}}`)},
+	}
+}
+
+func writeContent(t *testing.T, s *Store) {
+	t.Helper()
+	for _, r := range contentRecords() {
+		r.Timestamp = time.Now()
+		if err := s.Write(context.Background(), r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+}
+
+func checkContent(t *testing.T, s *Store, sealed bool) {
+	t.Helper()
+	ctx := context.Background()
+	atts, err := s.Attachments(ctx, AttachmentFilter{SessionID: "s1", Source: "prompt"})
+	if err != nil {
+		t.Fatalf("Attachments: %v", err)
+	}
+	if len(atts) != 3 {
+		t.Fatalf("expected 3 attachments, got %+v", atts)
+	}
+	text := "package main"
+	if sealed {
+		text = ""
+	}
+	if a := atts[0]; a.Kind != "resource" || a.URI != "file:///p/main.go" || a.MimeType != "text/x-go" || a.Text != text ||
+		a.Sealed != sealed || a.Size != int64(len("package main")) {
+		t.Fatalf("unexpected resource: %+v", a)
+	}
+	if a := atts[1]; a.Kind != "resource_link" || a.Name != "docs" || a.Size != 42 {
+		t.Fatalf("unexpected link: %+v", a)
+	}
+	if a := atts[2]; a.Kind != "image" || a.Size != 600 || a.BlobSHA256 == "" {
+		t.Fatalf("unexpected image: %+v", a)
+	}
+	if atts, err = s.Attachments(ctx, AttachmentFilter{URI: "file:///p/"}); err != nil || len(atts) != 2 {
+		t.Fatalf("expected 2 attachments below file:///p/, got %d (%v)", len(atts), err)
+	}
+
+	sessions, err := s.ListSessions(ctx, SessionFilter{ID: "s1"})
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("ListSessions: %v %+v", err, sessions)
+	}
+	ss := sessions[0]
+	plan := `[{"content":"read main.go","priority":"high","status":"pending"}]`
+	if sealed {
+		plan = ""
+	}
+	if string(ss.Plan) != plan || ss.PlanSealed != sealed ||
+		string(ss.Commands) != `[{"name":"test","description":"run tests"}]` {
+		t.Fatalf("unexpected plan or commands: %s %v %s", ss.Plan, ss.PlanSealed, ss.Commands)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	s := openTestStore(t)
+	writeContent(t, s)
+	checkContent(t, s, false)
+}
+
+func TestAttachmentsEncrypted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	keyring := mustKeyring(t, mustKey(t))
+	s.SetKeyring(keyring)
+	writeContent(t, s)
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM attachments WHERE text LIKE '%package%'`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("attachment text stored in plaintext: %d %v", n, err)
+	}
+	checkContent(t, s, false)
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	checkContent(t, s, true)
+}
+
+func TestAttachmentsBackfill(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	writeContent(t, s)
+	s = reopenBefore(t, s, path, "attachments, plans and commands", `DROP TABLE attachments`,
+		`ALTER TABLE sessions DROP COLUMN plan`, `ALTER TABLE sessions DROP COLUMN plan_key_id`, `ALTER TABLE sessions DROP COLUMN commands`)
+	checkContent(t, s, false)
+}
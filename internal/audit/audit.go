@@ -2,11 +2,16 @@ package audit
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"acp-gate/internal/redact"
 	_ "modernc.org/sqlite"
 )
 
@@ -17,82 +22,371 @@ const (
 	DirectionDownstreamToUpstream Direction = "downstream_to_upstream"
 )
 
+// Status is the lifecycle state of a request row.
+type Status string
+
+const (
+	// StatusPending marks a request that has been forwarded but not yet
+	// answered.
+	StatusPending   Status = "pending"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	// StatusAbandoned marks a request whose connection went away before a
+	// response was received.
+	StatusAbandoned Status = "abandoned"
+)
+
 type Record struct {
+	// RowID is the audit_events primary key. It is only set on records
+	// returned by Query and ignored by Write.
+	RowID int64
+
 	Timestamp time.Time
 	Direction Direction
 	SessionID string
 	Method    string
 	IsRequest bool
 	IsNotify  bool
-	ID        json.RawMessage
-	Raw       json.RawMessage
+	// ID is the JSON-RPC id as seen on the wire, when the writer knows it.
+	// The proxies work on decoded calls and correlate rows via
+	// CorrelationID instead.
+	ID  json.RawMessage
+	Raw json.RawMessage
+
+	// CorrelationID is shared by a request row and its response row.
+	CorrelationID string
+	// Seq is the per-connection sequence number of the call.
+	Seq int64
+	// ConnID links the row to its connection; see Connection.
+	ConnID string
+	// Latency is the time between the request and its response; it is
+	// only set on response rows.
+	Latency time.Duration
+
+	// Status is only meaningful for request rows; see Store.Finish.
+	Status Status
 
 	// Optional extracted user/agent text, if any.
 	UserText  string
 	AgentText string
+
+	// Error is set when the call failed. For requests it is carried by the
+	// response row; for notifications by the notification row itself.
+	Error *RPCError
+
+	// FileChange is set on fs/write_text_file requests whose Raw leaves out
+	// the written content; the change is stored in file_changes instead.
+	// Query does not return it; see FileChanges.
+	FileChange *FileChange
+
+	// KeyID names the data key that encrypted Raw, UserText and AgentText
+	// in the database; empty for plaintext rows. Query decrypts these
+	// fields when the store has a matching keyring.
+	KeyID string
+	// Sealed is set on records returned by Query whose payload could not be
+	// decrypted; Raw, UserText and AgentText are then empty.
+	Sealed bool
+}
+
+// RPCError is a JSON-RPC error object as returned by the peer (or
+// synthesized by the SDK for transport failures).
+type RPCError struct {
+	Code    int
+	Message string
+	Data    json.RawMessage
 }
 
 type Store struct {
 	db *sql.DB
+	// w, when set, owns all writes; see StartWriter.
+	w *batchWriter
+	// redactor scrubs records before they leave Write.
+	redactor *redact.Redactor
+
+	// insertMu serializes direct (non-queued) inserts; see Write.
+	insertMu sync.Mutex
+	// failed counts direct inserts that could not be written; see Dropped.
+	failed atomic.Uint64
+
+	// signer signs chain checkpoints; see chain.go.
+	signer ed25519.PrivateKey
+
+	// sess tracks what deriving the sessions table needs to remember
+	// between records; see sessions.go and derive.go.
+	sess sessionTracker
+	// term does the same for the terminals tables; see terminals.go.
+	term terminalTracker
+	// turns accumulates the chunks of open prompt turns; see turns.go.
+	turns turnTracker
+
+	// Payload encryption; see crypto.go.
+	keyring *Keyring
+	keyMu   sync.Mutex
+	wkey    dataKey
+	rkeys   map[string]cipher.AEAD
 }
 
 func Open(ctx context.Context, path string) (*Store, error) {
-	db, err := sql.Open("sqlite", path)
+	db, err := sql.Open("sqlite", dsn(path))
 	if err != nil {
 		return nil, err
 	}
-	// Keep it simple; callers can tune via DSN if needed.
-	if err := initSchema(ctx, db); err != nil {
+	// Incremental vacuum lets Prune return space to the OS. It only takes
+	// effect on new databases; Prune converts older ones on request. WAL
+	// mode is persistent, so setting it once covers every connection; it
+	// has to follow auto_vacuum, which cannot change once the file has a
+	// header. Another process may hold the lock for longer than the busy
+	// timeout while it creates or migrates the database.
+	err = retryBusy(ctx, func() error {
+		if _, err := db.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `PRAGMA journal_mode = WAL`)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := migrate(ctx, db); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
 	return &Store{db: db}, nil
 }
 
-func (s *Store) Close() error {
+// SetRedactor makes Write redact secrets from raw_json, the extracted text
+// and error details before anything is persisted. Set it before the store
+// is shared.
+func (s *Store) SetRedactor(r *redact.Redactor) {
+	s.redactor = r
+}
+
+// StartWriter moves writes onto a background goroutine. Afterwards Write
+// and Finish only queue their change; it is committed together with other
+// queued changes in one transaction. Close flushes the queue.
+func (s *Store) StartWriter(opts WriterOptions) error {
 	if s == nil || s.db == nil {
+		return fmt.Errorf("audit store not initialized")
+	}
+	if s.w != nil {
+		return fmt.Errorf("audit writer already started")
+	}
+	w, err := newBatchWriter(s.db, opts)
+	if err != nil {
+		return err
+	}
+	s.w = w
+	go w.run()
+	return nil
+}
+
+// Flush waits until every change queued so far has been committed. It is a
+// no-op for stores without a background writer.
+func (s *Store) Flush(ctx context.Context) error {
+	if s == nil || s.w == nil {
 		return nil
 	}
-	return s.db.Close()
+	return s.w.flush(ctx)
 }
 
-func initSchema(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, `
-CREATE TABLE IF NOT EXISTS audit_events (
-  id INTEGER PRIMARY KEY AUTOINCREMENT,
-  ts_unix_ms INTEGER NOT NULL,
-  direction TEXT NOT NULL,
-  session_id TEXT,
-  method TEXT,
-  is_request INTEGER NOT NULL,
-  is_notify INTEGER NOT NULL,
-  rpc_id TEXT,
-  raw_json TEXT NOT NULL,
-  user_text TEXT,
-  agent_text TEXT
-);
-CREATE INDEX IF NOT EXISTS idx_audit_events_ts ON audit_events(ts_unix_ms);
-CREATE INDEX IF NOT EXISTS idx_audit_events_session ON audit_events(session_id);
-CREATE INDEX IF NOT EXISTS idx_audit_events_method ON audit_events(method);
-`)
-	return err
+// exclusive runs fn with the database once no other write is in progress.
+func (s *Store) exclusive(ctx context.Context, fn func(*sql.DB) error) error {
+	if s.w != nil {
+		return s.w.exclusive(ctx, fn)
+	}
+	return retryBusy(ctx, func() error { return fn(s.db) })
+}
+
+// Dropped reports how many records never reached the database: those
+// discarded under OverflowDrop and those whose write still failed after
+// retrying.
+func (s *Store) Dropped() uint64 {
+	if s == nil {
+		return 0
+	}
+	n := s.failed.Load()
+	if s.w != nil {
+		n += s.w.dropped.Load() + s.w.failed.Load()
+	}
+	return n
+}
+
+// ReportDropped checks Dropped every interval until ctx is done and calls
+// report with the number of records lost since the previous call, if any.
+func (s *Store) ReportDropped(ctx context.Context, interval time.Duration, report func(n uint64)) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var last uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if n := s.Dropped(); n > last {
+			report(n - last)
+			last = n
+		}
+	}
+}
+
+func (s *Store) Close() error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	if s.signer != nil {
+		_, _ = s.Checkpoint(context.Background())
+	}
+	if s.w != nil {
+		s.w.close()
+	}
+	return s.db.Close()
 }
 
 func (s *Store) Write(ctx context.Context, r Record) error {
 	if s == nil || s.db == nil {
 		return fmt.Errorf("audit store not initialized")
 	}
+	if s.redactor != nil {
+		r = redactRecord(s.redactor, r)
+	}
+	// Binary payloads are stored once, in the blobs table.
+	var blobs []blobUpdate
+	r.Raw, blobs = extractBlobs(r.Raw, r.Timestamp)
+	d, err := s.derive(ctx, r, blobs)
+	if err != nil {
+		return err
+	}
+	// The file change now lives in d, encrypted on encrypted stores; the
+	// copy in r would reach the spill file in plaintext.
+	r.FileChange = nil
+	if s.keyring != nil {
+		if r, err = s.encrypt(ctx, r); err != nil {
+			return err
+		}
+	}
+	if s.w != nil {
+		if d.drop {
+			return s.w.enqueue(ctx, op{derived: d})
+		}
+		return s.w.enqueue(ctx, op{rec: &r, derived: d})
+	}
+	if d.drop {
+		return s.inTx(ctx, func(tx *sql.Tx) error { return d.apply(ctx, tx) })
+	}
+	// The chain hash depends on the previous row, so direct inserts are
+	// serialized and each runs in its own transaction.
+	s.insertMu.Lock()
+	defer s.insertMu.Unlock()
+	err = s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := insertRecord(ctx, tx, r); err != nil {
+			return err
+		}
+		return d.apply(ctx, tx)
+	})
+	if err != nil {
+		s.failed.Add(1)
+	}
+	return err
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func insertRecord(ctx context.Context, tx *sql.Tx, r Record) error {
 	rawStr := string(r.Raw)
-	rpcID := ""
-	if len(r.ID) > 0 {
-		rpcID = string(r.ID)
+	row := chainRow{
+		ts:        r.Timestamp.UnixMilli(),
+		direction: string(r.Direction),
+		sessionID: r.SessionID,
+		method:    r.Method,
+		isRequest: r.IsRequest,
+		isNotify:  r.IsNotify,
+		rpcID:     string(r.ID),
+		rawDigest: digest(rawStr),
+		userText:  r.UserText,
+		agentText: r.AgentText,
+		corrID:    r.CorrelationID,
+		keyID:     r.KeyID,
+		connID:    r.ConnID,
+	}
+	var errCode, errMsg, errData any
+	if r.Error != nil {
+		errCode = r.Error.Code
+		errMsg = r.Error.Message
+		errData = nullIfEmpty(string(r.Error.Data))
+		row.errCode = sql.NullInt64{Int64: int64(r.Error.Code), Valid: true}
+		row.errMessage, row.errData = r.Error.Message, string(r.Error.Data)
+	}
+	var seq, latency any
+	if r.Seq != 0 {
+		seq = r.Seq
+		row.seq = sql.NullInt64{Int64: r.Seq, Valid: true}
+	}
+	if !r.IsRequest && !r.IsNotify && r.CorrelationID != "" {
+		latency = r.Latency.Milliseconds()
+		row.latency = sql.NullInt64{Int64: r.Latency.Milliseconds(), Valid: true}
+	}
+	prev, err := lastHash(ctx, tx)
+	if err != nil {
+		return err
 	}
 
-	_, err := s.db.ExecContext(ctx, `
+	_, err = tx.ExecContext(ctx, `
 INSERT INTO audit_events(
-  ts_unix_ms, direction, session_id, method, is_request, is_notify, rpc_id, raw_json, user_text, agent_text
-) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
-`, r.Timestamp.UnixMilli(), string(r.Direction), nullIfEmpty(r.SessionID), nullIfEmpty(r.Method), boolInt(r.IsRequest), boolInt(r.IsNotify), nullIfEmpty(rpcID), rawStr, nullIfEmpty(r.UserText), nullIfEmpty(r.AgentText))
+  ts_unix_ms, direction, session_id, method, is_request, is_notify, rpc_id, raw_json, user_text, agent_text,
+  error_code, error_message, error_data, corr_id, seq, latency_ms, status, key_id, conn_id,
+  raw_digest, prev_hash, row_hash
+) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`, row.ts, row.direction, nullIfEmpty(r.SessionID), nullIfEmpty(r.Method), boolInt(r.IsRequest), boolInt(r.IsNotify), nullIfEmpty(row.rpcID), rawStr, nullIfEmpty(r.UserText), nullIfEmpty(r.AgentText),
+		errCode, errMsg, errData, nullIfEmpty(r.CorrelationID), seq, latency, nullIfEmpty(string(r.Status)), nullIfEmpty(r.KeyID), nullIfEmpty(r.ConnID),
+		row.rawDigest, prev, row.hash(prev))
+	return err
+}
+
+// Finish moves the pending request row with the given correlation id to
+// status. Rows that are no longer pending are left untouched, so whichever
+// of completion and abandonment is recorded first wins.
+func (s *Store) Finish(ctx context.Context, corrID string, status Status) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("audit store not initialized")
+	}
+	if status != StatusCompleted {
+		s.sess.forget(corrID)
+		s.term.forget(corrID)
+	}
+	now := time.Now()
+	d := derived{Permissions: abandonPermission(corrID, status, now)}
+	if status != StatusCompleted {
+		d.Turns = s.turns.finish(corrID, status, now)
+		if s.keyring != nil && len(d.Turns) > 0 {
+			if err := s.sealTurns(ctx, d.Turns); err != nil {
+				return err
+			}
+		}
+	}
+	if s.w != nil {
+		return s.w.enqueue(ctx, op{corrID: corrID, status: status, derived: d})
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := finishRequest(ctx, tx, corrID, status); err != nil {
+			return err
+		}
+		return d.apply(ctx, tx)
+	})
+}
+
+func finishRequest(ctx context.Context, db execer, corrID string, status Status) error {
+	_, err := db.ExecContext(ctx, `
+UPDATE audit_events SET status = ?
+WHERE corr_id = ? AND is_request = 1 AND status = 'pending';
+`, string(status), corrID)
 	return err
 }
 
@@ -0,0 +1,230 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"acp-gate/internal/acpinspect"
+)
+
+// Images, audio and embedded blob resources in content blocks are stored
+// once in the blobs table, keyed by the SHA-256 of their decoded bytes.
+// Write replaces each base64 payload in raw_json with a reference string
+// naming the hash, so a screenshot attached to every prompt of a session
+// takes space once. Rehydrate puts the payloads back.
+//
+// raw_digest covers the references, and a blob cannot change without
+// changing its hash, so the hash chain still covers the payloads. Events
+// written before the table existed keep their payloads inline; moving them
+// would change raw_digest.
+//
+// On encrypted stores the data is encrypted with the data key named in
+// key_id. The hash stays in the clear, which tells someone who already
+// has a file whether it was sent.
+
+const blobsSchema = `
+CREATE TABLE IF NOT EXISTS blobs (
+  sha256 TEXT PRIMARY KEY,
+  mime_type TEXT,
+  size INTEGER NOT NULL,
+  data BLOB NOT NULL,
+  key_id TEXT,
+  first_unix_ms INTEGER NOT NULL,
+  last_unix_ms INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_blobs_last ON blobs(last_unix_ms);`
+
+// minBlobSize is the shortest base64 payload moved to the blobs table.
+// Shorter ones are hardly longer than the reference that would replace
+// them.
+const minBlobSize = 256
+
+// BlobRefPrefix starts the string that replaces a payload in raw_json; the
+// hex SHA-256 of the decoded payload follows.
+const BlobRefPrefix = "acp-gate-blob:sha256:"
+
+var blobRefPattern = regexp.MustCompile(`"` + regexp.QuoteMeta(BlobRefPrefix) + `([0-9a-f]{64})"`)
+
+// ErrBlobNotFound is returned by Blob for hashes the store does not hold,
+// for example because retention removed them.
+var ErrBlobNotFound = errors.New("audit blob not found")
+
+// Blob is one row of the blobs table.
+type Blob struct {
+	SHA256   string
+	MimeType string
+	Size     int64
+	// Data is nil when Sealed is set.
+	Data      []byte
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Sealed is set when Data is encrypted with a key that is not
+	// available.
+	Sealed bool
+}
+
+// blobUpdate stores one payload, or marks it as used again.
+type blobUpdate struct {
+	SHA256   string
+	MimeType string `json:",omitempty"`
+	Size     int64
+	Data     []byte
+	At       int64
+	KeyID    string `json:",omitempty"`
+}
+
+// extractBlobs replaces the binary payloads in raw with references and
+// returns the blobs to store. Payloads that are not canonical base64 are
+// left inline, since they could not be restored byte for byte.
+func extractBlobs(raw []byte, at time.Time) ([]byte, []blobUpdate) {
+	if !bytes.Contains(raw, []byte(`"image"`)) && !bytes.Contains(raw, []byte(`"audio"`)) && !bytes.Contains(raw, []byte(`"blob"`)) {
+		return raw, nil
+	}
+	var ups []blobUpdate
+	seen := map[string]bool{}
+	for _, b := range acpinspect.Blobs(raw) {
+		if len(b.Data) < minBlobSize || seen[b.Data] {
+			continue
+		}
+		seen[b.Data] = true
+		data, err := base64.StdEncoding.DecodeString(b.Data)
+		if err != nil || base64.StdEncoding.EncodeToString(data) != b.Data {
+			continue
+		}
+		// Go and most encoders leave base64 unescaped; anything else is
+		// left inline.
+		quoted := []byte(`"` + b.Data + `"`)
+		if !bytes.Contains(raw, quoted) {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		raw = bytes.ReplaceAll(raw, quoted, []byte(`"`+BlobRefPrefix+hash+`"`))
+		ups = append(ups, blobUpdate{SHA256: hash, MimeType: b.MimeType, Size: int64(len(data)), Data: data, At: at.UnixMilli()})
+	}
+	return raw, ups
+}
+
+func (s *Store) sealBlobs(ctx context.Context, ups []blobUpdate) error {
+	dk, err := s.writeKey(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range ups {
+		u := &ups[i]
+		sealed, err := seal(dk.aead, "blobs:"+u.SHA256, u.Data)
+		if err != nil {
+			return err
+		}
+		u.Data, u.KeyID = []byte(sealed), dk.id
+	}
+	return nil
+}
+
+// applyBlobs inserts new blobs. A blob that is already stored keeps its
+// data; only its last use moves forward.
+func applyBlobs(ctx context.Context, db dbtx, ups []blobUpdate) error {
+	for _, u := range ups {
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO blobs(sha256, mime_type, size, data, key_id, first_unix_ms, last_unix_ms)
+VALUES(?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(sha256) DO UPDATE SET last_unix_ms = MAX(last_unix_ms, excluded.last_unix_ms);
+`, u.SHA256, nullIfEmpty(u.MimeType), u.Size, u.Data, nullIfEmpty(u.KeyID), u.At, u.At); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBlobs deletes the blobs that no remaining raw_json can refer to:
+// those last used before the first event that still has its payload.
+// Events are not strictly in timestamp order, hence the minute of slack.
+func pruneBlobs(ctx context.Context, db execer) error {
+	_, err := db.ExecContext(ctx, `
+DELETE FROM blobs WHERE last_unix_ms < COALESCE(
+  (SELECT ts_unix_ms - 60000 FROM audit_events WHERE raw_json <> '' ORDER BY id LIMIT 1), 9223372036854775807)`)
+	return err
+}
+
+// Blob returns the blob with the given hex SHA-256.
+func (s *Store) Blob(ctx context.Context, hash string) (Blob, error) {
+	if s == nil || s.db == nil {
+		return Blob{}, fmt.Errorf("audit store not initialized")
+	}
+	var (
+		b           Blob
+		mime, keyID sql.NullString
+		first, last int64
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT sha256, mime_type, size, data, key_id, first_unix_ms, last_unix_ms FROM blobs WHERE sha256 = ?`, hash).
+		Scan(&b.SHA256, &mime, &b.Size, &b.Data, &keyID, &first, &last)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Blob{}, fmt.Errorf("%w: %s", ErrBlobNotFound, hash)
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+	b.MimeType = mime.String
+	b.FirstSeen, b.LastSeen = time.UnixMilli(first), time.UnixMilli(last)
+	if keyID.Valid {
+		s.openBlob(ctx, keyID.String, &b)
+		if b.Sealed {
+			return b, nil
+		}
+	}
+	if sum := sha256.Sum256(b.Data); hex.EncodeToString(sum[:]) != b.SHA256 {
+		return Blob{}, fmt.Errorf("audit blob %s does not match its hash", b.SHA256)
+	}
+	return b, nil
+}
+
+func (s *Store) openBlob(ctx context.Context, keyID string, b *Blob) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		if data, err := unseal(aead, "blobs:"+b.SHA256, string(b.Data)); err == nil {
+			b.Data = data
+			return
+		}
+	}
+	b.Data, b.Sealed = nil, true
+}
+
+// Rehydrate returns raw with every blob reference replaced by the payload
+// it stands for. References to blobs the store no longer holds are left
+// as they are. It fails with ErrNoKey if a blob is encrypted with a key
+// that is not available.
+func (s *Store) Rehydrate(ctx context.Context, raw []byte) ([]byte, error) {
+	if !bytes.Contains(raw, []byte(BlobRefPrefix)) {
+		return raw, nil
+	}
+	var err error
+	out := blobRefPattern.ReplaceAllFunc(raw, func(ref []byte) []byte {
+		if err != nil {
+			return ref
+		}
+		hash := string(blobRefPattern.FindSubmatch(ref)[1])
+		b, berr := s.Blob(ctx, hash)
+		switch {
+		case errors.Is(berr, ErrBlobNotFound):
+			return ref
+		case berr != nil:
+			err = berr
+			return ref
+		case b.Sealed:
+			err = fmt.Errorf("%w: audit blob %s is encrypted", ErrNoKey, hash)
+			return ref
+		}
+		return []byte(`"` + base64.StdEncoding.EncodeToString(b.Data) + `"`)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blobPrompt is a prompt carrying the image png and the PDF resource pdf.
+func blobPrompt(at time.Time, png, pdf []byte) Record {
+	raw := `{"sessionId":"s1","prompt":[{"type":"text","text":"see"},{"type":"image","mimeType":"image/png","data":"` +
+		base64.StdEncoding.EncodeToString(png) + `"}`
+	if pdf != nil {
+		raw += `,{"type":"resource","resource":{"uri":"file:///r.pdf","mimeType":"application/pdf","blob":"` +
+			base64.StdEncoding.EncodeToString(pdf) + `"}}`
+	}
+	raw += `]}`
+	return Record{Timestamp: at, Direction: DirectionUpstreamToDownstream, SessionID: "s1", Method: "session/prompt",
+		IsRequest: true, UserText: "see", Raw: []byte(raw)}
+}
+
+func TestBlobs(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStore(t)
+	png, pdf := bytes.Repeat([]byte{0x89, 'P'}, 600), bytes.Repeat([]byte("%PDF"), 300)
+	now := time.Now()
+	records := []Record{blobPrompt(now, png, pdf), blobPrompt(now.Add(time.Millisecond), png, nil)}
+	for _, r := range records {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	got, err := s.Query(ctx, Filter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(got))
+	}
+	for i, r := range got {
+		if !bytes.Contains(r.Raw, []byte(BlobRefPrefix)) || len(r.Raw) > 600 {
+			t.Fatalf("payload of event %d stored inline: %s", i, r.Raw)
+		}
+		full, err := s.Rehydrate(ctx, r.Raw)
+		if err != nil {
+			t.Fatalf("Rehydrate: %v", err)
+		}
+		if !bytes.Equal(full, records[i].Raw) {
+			t.Fatalf("rehydrated event %d differs:\n%s\n%s", i, full, records[i].Raw)
+		}
+	}
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM blobs`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 distinct blobs, got %d", n)
+	}
+	rep, err := s.Verify(ctx, nil)
+	if err != nil || !rep.OK() {
+		t.Fatalf("Verify: %v %+v", err, rep.Problems)
+	}
+
+	// The PDF is only used by the older event, so it goes with it.
+	if _, err := s.db.ExecContext(ctx, `UPDATE blobs SET last_unix_ms = last_unix_ms - 7200000, first_unix_ms = first_unix_ms - 7200000
+WHERE mime_type = 'application/pdf'`); err != nil {
+		t.Fatalf("age blob: %v", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `UPDATE audit_events SET raw_json = '' WHERE id = ?`, got[0].RowID); err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	if _, err := s.Prune(ctx, Retention{MaxRows: 10}, now, PruneOptions{}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM blobs`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected the unused blob to be pruned, %d left", n)
+	}
+	if full, err := s.Rehydrate(ctx, got[1].Raw); err != nil || !bytes.Equal(full, records[1].Raw) {
+		t.Fatalf("Rehydrate after prune: %v", err)
+	}
+}
+
+func TestBlobsEncrypted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	png := bytes.Repeat([]byte("secret image "), 40)
+	r := blobPrompt(time.Now(), png, nil)
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, `SELECT data FROM blobs`).Scan(&data); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("blob stored in plaintext")
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if full, err := s.Rehydrate(ctx, got[0].Raw); err != nil || !bytes.Equal(full, r.Raw) {
+		t.Fatalf("Rehydrate: %v", err)
+	}
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	raw := []byte(`{"data":"` + BlobRefPrefix + strings.Repeat("0", 64) + `"}`)
+	if full, err := s.Rehydrate(ctx, raw); err != nil || !bytes.Equal(full, raw) {
+		t.Fatalf("unknown blob should be left as a reference: %s %v", full, err)
+	}
+	var hash string
+	if err := s.db.QueryRowContext(ctx, `SELECT sha256 FROM blobs`).Scan(&hash); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	b, err := s.Blob(ctx, hash)
+	if err != nil || !b.Sealed || b.Data != nil || b.Size != int64(len(png)) {
+		t.Fatalf("expected a sealed blob without key: %+v %v", b, err)
+	}
+	if _, err := s.Rehydrate(ctx, []byte(`{"data":"`+BlobRefPrefix+hash+`"}`)); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Several acp-gate processes may share one audit DB, as when an editor
+// launches a local-mode instance per project. Open switches the database
+// to WAL mode so readers never block the writer, every connection waits up
+// to busyTimeout for a lock, and write transactions take the write lock
+// when they begin (BEGIN IMMEDIATE): a deferred transaction that read the
+// chain head before another process appended a row could not commit
+// anyway. What still fails with SQLITE_BUSY is retried by retryBusy.
+
+const busyTimeout = 5 * time.Second
+
+// Retries back off from busyBackoff, doubling up to busyMaxBackoff, for at
+// most busyAttempts attempts.
+var (
+	busyAttempts   = 8
+	busyBackoff    = 20 * time.Millisecond
+	busyMaxBackoff = 2 * time.Second
+)
+
+// dsn returns the data source name that opens path with the settings
+// above. Settings already given in a query string on path are kept.
+func dsn(path string) string {
+	name, query, _ := strings.Cut(path, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return path
+	}
+	set := map[string]bool{}
+	for _, p := range q["_pragma"] {
+		key, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(p)), "(")
+		key, _, _ = strings.Cut(key, "=")
+		set[strings.TrimSpace(key)] = true
+	}
+	for _, p := range []struct{ name, value string }{
+		{"busy_timeout", "busy_timeout(" + strconv.FormatInt(busyTimeout.Milliseconds(), 10) + ")"},
+		{"synchronous", "synchronous(NORMAL)"},
+	} {
+		if !set[p.name] {
+			q.Add("_pragma", p.value)
+		}
+	}
+	if q.Get("_txlock") == "" {
+		q.Set("_txlock", "immediate")
+	}
+	return name + "?" + q.Encode()
+}
+
+// isBusy reports whether err means the database was locked by another
+// connection.
+func isBusy(err error) bool {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// retryBusy runs fn until it succeeds, fails with an error other than a
+// busy database, or runs out of attempts. fn must be safe to run again
+// after a busy error, which holds for a transaction that was rolled back.
+func retryBusy(ctx context.Context, fn func() error) error {
+	wait := busyBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusy(err) || attempt == busyAttempts {
+			return err
+		}
+		// Jitter keeps competing processes from retrying in lockstep.
+		t := time.NewTimer(wait/2 + rand.N(wait/2+1))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		wait = min(2*wait, busyMaxBackoff)
+	}
+}
+
+// inTx runs fn in a transaction on the store's database, retrying the
+// whole transaction while the database is busy. It is used for writes made
+// without a background writer.
+func (s *Store) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return retryBusy(ctx, func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
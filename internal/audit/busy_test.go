@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenWAL(t *testing.T) {
+	s := openTestStore(t)
+	var mode string
+	if err := s.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil {
+		t.Fatalf("journal_mode: %v", err)
+	}
+	var timeout int
+	if err := s.db.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout); err != nil {
+		t.Fatalf("busy_timeout: %v", err)
+	}
+	if mode != "wal" || timeout != int(busyTimeout.Milliseconds()) {
+		t.Fatalf("journal_mode %q, busy_timeout %d", mode, timeout)
+	}
+}
+
+func TestDSN(t *testing.T) {
+	got := dsn("/tmp/a.db?_pragma=busy_timeout%28100%29&_txlock=deferred")
+	if !strings.HasPrefix(got, "/tmp/a.db?") || strings.Count(got, "busy_timeout") != 1 ||
+		!strings.Contains(got, "busy_timeout%28100%29") || !strings.Contains(got, "_txlock=deferred") ||
+		!strings.Contains(got, "synchronous%28NORMAL%29") {
+		t.Fatalf("dsn kept the wrong settings: %s", got)
+	}
+}
+
+// The concurrency test runs this file's helper test in several processes
+// that all write to one database.
+const (
+	concurrentDBEnv     = "ACP_GATE_AUDIT_CONCURRENT_DB"
+	concurrentWriterEnv = "ACP_GATE_AUDIT_CONCURRENT_WRITER"
+	concurrentRecords   = 200
+)
+
+func TestConcurrentProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several processes")
+	}
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	const procs = 8
+	cmds := make([]*exec.Cmd, procs)
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestConcurrentProcessesHelper$")
+		// Half the processes queue their writes, half write directly.
+		cmd.Env = append(os.Environ(), concurrentDBEnv+"="+path, concurrentWriterEnv+"="+strconv.Itoa(i%2))
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start writer %d: %v", i, err)
+		}
+		cmds[i] = cmd
+	}
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("writer %d: %v", i, err)
+		}
+	}
+
+	ctx := context.Background()
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_events`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != procs*concurrentRecords {
+		t.Fatalf("expected %d rows, got %d", procs*concurrentRecords, n)
+	}
+	rep, err := s.Verify(ctx, nil)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !rep.OK() {
+		t.Fatalf("chain broken by concurrent writers: %+v", rep.Problems)
+	}
+}
+
+// TestConcurrentProcessesHelper is one writer process of
+// TestConcurrentProcesses; it does nothing when run on its own.
+func TestConcurrentProcessesHelper(t *testing.T) {
+	path := os.Getenv(concurrentDBEnv)
+	if path == "" {
+		t.Skip("run by TestConcurrentProcesses")
+	}
+	ctx := context.Background()
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if os.Getenv(concurrentWriterEnv) == "1" {
+		if err := s.StartWriter(WriterOptions{BatchSize: 16, OnError: func(err error) { t.Errorf("writer: %v", err) }}); err != nil {
+			t.Fatalf("StartWriter: %v", err)
+		}
+	}
+	pid := strconv.Itoa(os.Getpid())
+	for i := 0; i < concurrentRecords; i++ {
+		r := Record{Timestamp: time.Now(), Direction: DirectionDownstreamToUpstream, SessionID: "s" + pid, Method: "session/update",
+			IsNotify: true, Raw: []byte(fmt.Sprintf(`{"n":%d}`, i))}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := s.Dropped(); n != 0 {
+		t.Fatalf("%d records lost", n)
+	}
+}
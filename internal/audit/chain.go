@@ -0,0 +1,453 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Every row written by Store.Write carries row_hash, a SHA-256 over the
+// previous row's hash and the row's own columns, so editing, inserting or
+// deleting a row breaks the chain from that point on. raw_json enters the
+// hash through raw_digest, which lets retention clear old payloads without
+// breaking the chain. The status column is updated after insert by design
+// and is not covered.
+//
+// Checkpoints sign the hash of the newest row with an Ed25519 key. They
+// detect a chain that was recomputed after tampering, and truncation of the
+// newest rows, which a chain alone cannot reveal.
+
+// chainRow holds the chained columns of a row as stored. NULL and empty
+// strings hash alike; nullable integers hash with their validity.
+type chainRow struct {
+	ts                           int64
+	direction, sessionID, method string
+	isRequest, isNotify          bool
+	rpcID, rawDigest             string
+	userText, agentText          string
+	errCode                      sql.NullInt64
+	errMessage, errData, corrID  string
+	seq, latency                 sql.NullInt64
+	keyID                        string
+	connID                       string
+}
+
+func (c chainRow) hash(prev string) string {
+	h := sha256.New()
+	var buf [8]byte
+	str := func(s string) {
+		binary.BigEndian.PutUint64(buf[:], uint64(len(s)))
+		h.Write(buf[:])
+		h.Write([]byte(s))
+	}
+	num := func(n int64) {
+		binary.BigEndian.PutUint64(buf[:], uint64(n))
+		h.Write(buf[:])
+	}
+	nullNum := func(n sql.NullInt64) {
+		if !n.Valid {
+			h.Write([]byte{0})
+			return
+		}
+		h.Write([]byte{1})
+		num(n.Int64)
+	}
+	flag := func(b bool) {
+		if b {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	}
+	str("acp-gate/audit/v1")
+	str(prev)
+	num(c.ts)
+	str(c.direction)
+	str(c.sessionID)
+	str(c.method)
+	flag(c.isRequest)
+	flag(c.isNotify)
+	str(c.rpcID)
+	str(c.rawDigest)
+	str(c.userText)
+	str(c.agentText)
+	nullNum(c.errCode)
+	str(c.errMessage)
+	str(c.errData)
+	str(c.corrID)
+	nullNum(c.seq)
+	nullNum(c.latency)
+	str(c.keyID)
+	// conn_id came after the first rows were chained; it is only hashed
+	// when set so that those rows keep their hash.
+	if c.connID != "" {
+		str(c.connID)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// lastHash returns the hash of the newest row, or "" to start a chain.
+func lastHash(ctx context.Context, tx *sql.Tx) (string, error) {
+	var h sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT row_hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&h)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return h.String, err
+}
+
+// deleteThrough deletes every row with id <= cut, first recording the hash
+// of row cut as an anchor so that the remaining chain still verifies.
+func deleteThrough(ctx context.Context, db *sql.DB, cut int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `
+INSERT OR REPLACE INTO audit_chain_anchors(through_id, row_hash, ts_unix_ms)
+SELECT id, row_hash, ? FROM audit_events WHERE id = ? AND row_hash IS NOT NULL`, time.Now().UnixMilli(), cut); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM audit_events WHERE id <= ?`, cut)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// ParseSigningKey reads an Ed25519 private key encoded as base64, either
+// the 32-byte seed or the 64-byte key.
+func ParseSigningKey(data []byte) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, fmt.Errorf("signing key must be a base64 Ed25519 seed or private key")
+}
+
+// ParsePublicKey reads a base64 Ed25519 public key.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// LoadSigningKey reads a key file written by GenerateSigningKey.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSigningKey(b)
+}
+
+// GenerateSigningKey returns a new Ed25519 seed and its public key, both
+// base64 encoded.
+func GenerateSigningKey() (private, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Seed()), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+func signerID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Checkpoint is a signed statement of the chain head.
+type Checkpoint struct {
+	Time      time.Time
+	LastRowID int64
+	RowHash   string
+	KeyID     string
+	Signature []byte
+}
+
+func (c Checkpoint) message() []byte {
+	var b []byte
+	b = append(b, "acp-gate/audit/checkpoint/v1\x00"...)
+	b = binary.BigEndian.AppendUint64(b, uint64(c.Time.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(c.LastRowID))
+	return append(b, c.RowHash...)
+}
+
+// SetSigner enables Checkpoint. Close writes a final checkpoint.
+func (s *Store) SetSigner(key ed25519.PrivateKey) {
+	s.signer = key
+}
+
+// Checkpoint signs the current chain head. It does nothing (and returns a
+// zero Checkpoint) when no row was added since the last checkpoint.
+func (s *Store) Checkpoint(ctx context.Context) (Checkpoint, error) {
+	if s.signer == nil {
+		return Checkpoint{}, fmt.Errorf("no audit signing key set")
+	}
+	var cp Checkpoint
+	err := s.exclusive(ctx, func(db *sql.DB) error {
+		var head sql.NullString
+		var id int64
+		err := db.QueryRowContext(ctx, `SELECT id, row_hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&id, &head)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !head.Valid) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var last sql.NullInt64
+		if err := db.QueryRowContext(ctx, `SELECT MAX(last_row_id) FROM audit_checkpoints`).Scan(&last); err != nil {
+			return err
+		}
+		if last.Valid && last.Int64 >= id {
+			return nil
+		}
+		c := Checkpoint{Time: time.UnixMilli(time.Now().UnixMilli()), LastRowID: id, RowHash: head.String, KeyID: signerID(s.signer.Public().(ed25519.PublicKey))}
+		c.Signature = ed25519.Sign(s.signer, c.message())
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO audit_checkpoints(ts_unix_ms, last_row_id, row_hash, key_id, signature) VALUES(?, ?, ?, ?, ?)`,
+			c.Time.UnixMilli(), c.LastRowID, c.RowHash, c.KeyID, base64.StdEncoding.EncodeToString(c.Signature)); err != nil {
+			return err
+		}
+		cp = c
+		return nil
+	})
+	return cp, err
+}
+
+// RunCheckpoints writes a checkpoint every interval until ctx is done,
+// passing each outcome to report.
+func (s *Store) RunCheckpoints(ctx context.Context, interval time.Duration, report func(Checkpoint, error)) {
+	if s.signer == nil || interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cp, err := s.Checkpoint(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if report != nil {
+			report(cp, err)
+		}
+	}
+}
+
+// Problem is one integrity violation found by Verify.
+type Problem struct {
+	RowID  int64
+	Kind   string
+	Detail string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("row %d: %s: %s", p.RowID, p.Kind, p.Detail)
+}
+
+// Problem kinds reported by Verify.
+const (
+	ProblemAltered    = "altered"      // row contents do not match row_hash
+	ProblemRawAltered = "raw altered"  // raw_json does not match raw_digest
+	ProblemBrokenLink = "broken link"  // prev_hash does not match the previous row
+	ProblemMissing    = "missing rows" // a gap in row ids
+	ProblemUnchained  = "unchained"    // a row without hash inside the chain
+	ProblemCheckpoint = "checkpoint"   // a checkpoint does not match the chain
+	ProblemSignature  = "signature"    // a checkpoint signature does not verify
+	ProblemTruncated  = "truncated"    // rows covered by a checkpoint are gone
+	ProblemUnanchored = "unanchored"   // the chain starts mid-way without a prune anchor
+)
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Rows        int64 // rows checked
+	Unchained   int64 // rows written before hashing was introduced
+	FirstRowID  int64
+	LastRowID   int64
+	Checkpoints int
+	Signed      int // checkpoints whose signature was checked
+	Problems    []Problem
+}
+
+// OK reports whether no problem was found.
+func (r VerifyReport) OK() bool { return len(r.Problems) == 0 }
+
+// Verify walks the chain and the checkpoints. Checkpoint signatures are
+// checked against pub when it is set.
+func (s *Store) Verify(ctx context.Context, pub ed25519.PublicKey) (VerifyReport, error) {
+	var rep VerifyReport
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, ts_unix_ms, direction, session_id, method, is_request, is_notify, rpc_id, raw_json, user_text, agent_text,
+  error_code, error_message, error_data, corr_id, seq, latency_ms, key_id, conn_id, raw_digest, prev_hash, row_hash
+FROM audit_events ORDER BY id`)
+	if err != nil {
+		return rep, err
+	}
+	defer rows.Close()
+
+	hashes := map[int64]string{} // row hashes at checkpointed ids
+	cps, err := s.checkpoints(ctx)
+	if err != nil {
+		return rep, err
+	}
+	for _, cp := range cps {
+		hashes[cp.LastRowID] = ""
+	}
+
+	var (
+		started  bool
+		lastID   int64
+		lastHash string
+	)
+	for rows.Next() {
+		var (
+			id                             int64
+			c                              chainRow
+			isReq, isNotify                int
+			sid, method, rpcID, ut, at     sql.NullString
+			raw                            string
+			errMsg, errData, corrID, keyID sql.NullString
+			connID                         sql.NullString
+			rawDigest, prevHash, rowHash   sql.NullString
+		)
+		if err := rows.Scan(&id, &c.ts, &c.direction, &sid, &method, &isReq, &isNotify, &rpcID, &raw, &ut, &at,
+			&c.errCode, &errMsg, &errData, &corrID, &c.seq, &c.latency, &keyID, &connID, &rawDigest, &prevHash, &rowHash); err != nil {
+			return rep, err
+		}
+		c.connID = connID.String
+		c.sessionID, c.method, c.rpcID, c.userText, c.agentText = sid.String, method.String, rpcID.String, ut.String, at.String
+		c.isRequest, c.isNotify = isReq != 0, isNotify != 0
+		c.errMessage, c.errData, c.corrID, c.keyID, c.rawDigest = errMsg.String, errData.String, corrID.String, keyID.String, rawDigest.String
+
+		rep.Rows++
+		if rep.FirstRowID == 0 {
+			rep.FirstRowID = id
+		}
+		rep.LastRowID = id
+		if _, ok := hashes[id]; ok {
+			hashes[id] = rowHash.String
+		}
+		if !rowHash.Valid {
+			if started {
+				rep.Problems = append(rep.Problems, Problem{id, ProblemUnchained, "row has no hash"})
+			} else {
+				rep.Unchained++
+			}
+			lastID = id
+			continue
+		}
+		if raw != "" && digest(raw) != c.rawDigest {
+			rep.Problems = append(rep.Problems, Problem{id, ProblemRawAltered, "raw_json does not match raw_digest"})
+		}
+		if c.hash(prevHash.String) != rowHash.String {
+			rep.Problems = append(rep.Problems, Problem{id, ProblemAltered, "row contents do not match row_hash"})
+		}
+		switch {
+		case !started:
+			if prevHash.String != "" {
+				ok, err := s.isAnchor(ctx, prevHash.String)
+				if err != nil {
+					return rep, err
+				}
+				if !ok {
+					rep.Problems = append(rep.Problems, Problem{id, ProblemUnanchored, "chain starts after rows that were removed without a prune anchor"})
+				}
+			}
+		case id != lastID+1:
+			rep.Problems = append(rep.Problems, Problem{id, ProblemMissing, fmt.Sprintf("rows %d-%d are missing", lastID+1, id-1)})
+		case prevHash.String != lastHash:
+			rep.Problems = append(rep.Problems, Problem{id, ProblemBrokenLink, "prev_hash does not match the previous row"})
+		}
+		started = true
+		lastID, lastHash = id, rowHash.String
+	}
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+
+	for _, cp := range cps {
+		rep.Checkpoints++
+		if pub != nil {
+			if cp.KeyID != signerID(pub) {
+				rep.Problems = append(rep.Problems, Problem{cp.LastRowID, ProblemSignature, fmt.Sprintf("checkpoint signed by key %s, not %s", cp.KeyID, signerID(pub))})
+			} else if !ed25519.Verify(pub, cp.message(), cp.Signature) {
+				rep.Problems = append(rep.Problems, Problem{cp.LastRowID, ProblemSignature, "checkpoint signature does not verify"})
+			} else {
+				rep.Signed++
+			}
+		}
+		h := hashes[cp.LastRowID]
+		switch {
+		case h != "" && h != cp.RowHash:
+			rep.Problems = append(rep.Problems, Problem{cp.LastRowID, ProblemCheckpoint, "row hash differs from the signed checkpoint"})
+		case h == "" && cp.LastRowID > rep.LastRowID:
+			rep.Problems = append(rep.Problems, Problem{cp.LastRowID, ProblemTruncated, fmt.Sprintf("checkpoint covers rows up to %d but the log ends at %d", cp.LastRowID, rep.LastRowID)})
+		case h == "" && cp.LastRowID >= rep.FirstRowID:
+			rep.Problems = append(rep.Problems, Problem{cp.LastRowID, ProblemMissing, "checkpointed row is missing"})
+		}
+	}
+	return rep, nil
+}
+
+func (s *Store) checkpoints(ctx context.Context) ([]Checkpoint, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT ts_unix_ms, last_row_id, row_hash, key_id, signature FROM audit_checkpoints ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Checkpoint
+	for rows.Next() {
+		var (
+			c   Checkpoint
+			ts  int64
+			sig string
+		)
+		if err := rows.Scan(&ts, &c.LastRowID, &c.RowHash, &c.KeyID, &sig); err != nil {
+			return nil, err
+		}
+		c.Time = time.UnixMilli(ts)
+		if c.Signature, err = base64.StdEncoding.DecodeString(sig); err != nil {
+			return nil, fmt.Errorf("checkpoint %d: %w", c.LastRowID, err)
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) isAnchor(ctx context.Context, hash string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_chain_anchors WHERE row_hash = ?`, hash).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openChained(t *testing.T, n int) *Store {
+	t.Helper()
+	ctx := context.Background()
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < n; i++ {
+		r := testRecord(i)
+		r.Timestamp = base.Add(time.Duration(i) * time.Second)
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	return s
+}
+
+func verify(t *testing.T, s *Store, pub ed25519.PublicKey) VerifyReport {
+	t.Helper()
+	rep, err := s.Verify(context.Background(), pub)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	return rep
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	s := openChained(t, 10)
+	if rep := verify(t, s, nil); !rep.OK() || rep.Rows != 10 {
+		t.Fatalf("fresh chain should verify: %+v", rep)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `UPDATE audit_events SET agent_text = 'edited' WHERE id = 4`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	rep := verify(t, s, nil)
+	if len(rep.Problems) != 1 || rep.Problems[0].RowID != 4 || rep.Problems[0].Kind != ProblemAltered {
+		t.Fatalf("expected row 4 altered, got %v", rep.Problems)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `UPDATE audit_events SET raw_json = '{}' WHERE id = 6`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	rep = verify(t, s, nil)
+	if len(rep.Problems) != 2 || rep.Problems[1].RowID != 6 || rep.Problems[1].Kind != ProblemRawAltered {
+		t.Fatalf("expected raw_json of row 6 altered, got %v", rep.Problems)
+	}
+}
+
+func TestVerifyReportsMissingRange(t *testing.T) {
+	ctx := context.Background()
+	s := openChained(t, 10)
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM audit_events WHERE id BETWEEN 3 AND 5`); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	rep := verify(t, s, nil)
+	if len(rep.Problems) != 1 || rep.Problems[0].Kind != ProblemMissing || !strings.Contains(rep.Problems[0].Detail, "rows 3-5") {
+		t.Fatalf("expected rows 3-5 missing, got %v", rep.Problems)
+	}
+
+	// Deleting the oldest rows by hand leaves the chain without an anchor.
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM audit_events WHERE id <= 5`); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	rep = verify(t, s, nil)
+	if len(rep.Problems) != 1 || rep.Problems[0].Kind != ProblemUnanchored {
+		t.Fatalf("expected unanchored chain, got %v", rep.Problems)
+	}
+}
+
+func TestVerifyAcceptsPrunedChain(t *testing.T) {
+	ctx := context.Background()
+	s := openChained(t, 20)
+	res, err := s.Prune(ctx, Retention{MaxRows: 8, RawMaxAge: time.Minute}, time.Now(), PruneOptions{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if res.Deleted != 12 || res.Stripped != 20 {
+		t.Fatalf("unexpected prune result: %+v", res)
+	}
+	if rep := verify(t, s, nil); !rep.OK() || rep.FirstRowID != 13 {
+		t.Fatalf("pruned chain should verify: %+v", rep)
+	}
+	if err := s.Write(ctx, testRecord(20)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if rep := verify(t, s, nil); !rep.OK() || rep.Rows != 9 {
+		t.Fatalf("chain should continue after prune: %+v", rep)
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	s := openChained(t, 5)
+	priv, pubB64, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("GenerateSigningKey: %v", err)
+	}
+	key, err := ParseSigningKey([]byte(priv))
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+	pub, err := ParsePublicKey([]byte(pubB64))
+	if err != nil {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+	s.SetSigner(key)
+	cp, err := s.Checkpoint(ctx)
+	if err != nil || cp.LastRowID != 5 {
+		t.Fatalf("Checkpoint: %+v %v", cp, err)
+	}
+	if cp, err := s.Checkpoint(ctx); err != nil || cp.LastRowID != 0 {
+		t.Fatalf("expected no checkpoint without new rows: %+v %v", cp, err)
+	}
+	if rep := verify(t, s, pub); !rep.OK() || rep.Checkpoints != 1 || rep.Signed != 1 {
+		t.Fatalf("checkpoint should verify: %+v", rep)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if rep := verify(t, s, other); rep.OK() || rep.Problems[0].Kind != ProblemSignature {
+		t.Fatalf("expected signature problem with the wrong key: %+v", rep)
+	}
+
+	// Dropping the newest rows keeps the chain intact, but not the
+	// checkpoint.
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM audit_events WHERE id >= 4`); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	rep := verify(t, s, pub)
+	if len(rep.Problems) != 1 || rep.Problems[0].Kind != ProblemTruncated {
+		t.Fatalf("expected truncation, got %v", rep.Problems)
+	}
+}
@@ -0,0 +1,336 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The connections table has one row per editor connection or tunnel for
+// which acp-gate launched an agent: who connected, through which hops,
+// and the agent process. audit_events rows carry the id of their
+// connection in conn_id.
+
+const connectionsSchema = `
+CREATE TABLE IF NOT EXISTS connections (
+  id TEXT PRIMARY KEY,
+  mode TEXT NOT NULL,
+  peer TEXT,
+  hops TEXT,
+  command TEXT,
+  args TEXT,
+  env_diff TEXT,
+  pid INTEGER,
+  started_unix_ms INTEGER NOT NULL,
+  ended_unix_ms INTEGER,
+  exit_code INTEGER,
+  close_reason TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_connections_started ON connections(started_unix_ms);
+CREATE INDEX IF NOT EXISTS idx_audit_events_conn ON audit_events(conn_id) WHERE conn_id IS NOT NULL;`
+
+// Connection modes.
+const (
+	// ConnLocal is an editor talking to acp-gate over stdio.
+	ConnLocal = "local"
+	// ConnTunnel is a gRPC tunnel served by launching an agent.
+	ConnTunnel = "tunnel"
+)
+
+// Close reasons recorded by the proxies.
+const (
+	// CloseUpstream means the editor, or the previous hop, went away.
+	CloseUpstream = "upstream_closed"
+	// CloseDownstream means the agent, or the next hop, closed its side.
+	CloseDownstream = "downstream_closed"
+	// CloseAgentExit means the agent process exited.
+	CloseAgentExit = "agent_exited"
+	// CloseShutdown means acp-gate itself was stopped.
+	CloseShutdown = "shutdown"
+)
+
+// Connection describes one connection and the agent launched for it.
+type Connection struct {
+	ID string
+	// Mode is ConnLocal or ConnTunnel.
+	Mode string
+	// Peer is the address of the immediate peer; empty for stdio.
+	Peer string
+	// Hops lists the addresses the tunnel came through, starting with the
+	// original client; the last one is Peer.
+	Hops []string
+
+	// Command, Args and PID describe the launched agent process.
+	Command string
+	Args    []string
+	// EnvDiff holds the environment variables the agent got on top of
+	// acp-gate's own environment, and EnvRemoved those it did not get;
+	// see EnvDiff and EnvRemoved.
+	EnvDiff    map[string]string
+	EnvRemoved []string
+	PID        int
+
+	Started time.Time
+	// Ended is zero while the connection is open.
+	Ended time.Time
+	// ExitCode is the agent's exit code, -1 if it was killed by a signal,
+	// or nil if it is unknown.
+	ExitCode *int
+	// CloseReason is one of the Close constants.
+	CloseReason string
+}
+
+// ConnectionEnd describes how a connection ended.
+type ConnectionEnd struct {
+	Time     time.Time
+	ExitCode *int
+	Reason   string
+}
+
+// NewConnectionID returns a random connection id.
+func NewConnectionID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// EnvDiff returns the variables of env that are missing from base or set
+// to a different value there. Values of variables whose name suggests a
+// secret are replaced; the others are redacted when the connection is
+// recorded.
+func EnvDiff(base, env []string) map[string]string {
+	before, after := parseEnv(base), parseEnv(env)
+	diff := map[string]string{}
+	for k, v := range after {
+		if old, ok := before[k]; ok && old == v {
+			continue
+		}
+		if secretName(k) {
+			v = "[REDACTED]"
+		}
+		diff[k] = v
+	}
+	return diff
+}
+
+// EnvRemoved returns the sorted names of the variables of base that are
+// missing from env.
+func EnvRemoved(base, env []string) []string {
+	after := parseEnv(env)
+	var removed []string
+	for k := range parseEnv(base) {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+func parseEnv(vars []string) map[string]string {
+	m := make(map[string]string, len(vars))
+	for _, kv := range vars {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func secretName(name string) bool {
+	name = strings.ToUpper(name)
+	for _, s := range []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "AUTH"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartConnection records the start of c.
+func (s *Store) StartConnection(ctx context.Context, c Connection) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("audit store not initialized")
+	}
+	if c.Started.IsZero() {
+		c.Started = time.Now()
+	}
+	var hops, args, env any
+	if len(c.Hops) > 0 {
+		hops = jsonString(c.Hops)
+	}
+	if c.Command != "" {
+		args = jsonString(append([]string{}, c.Args...))
+	}
+	if len(c.EnvDiff) > 0 || len(c.EnvRemoved) > 0 {
+		// Removed variables are stored as null.
+		diff := make(map[string]*string, len(c.EnvDiff)+len(c.EnvRemoved))
+		for _, k := range c.EnvRemoved {
+			diff[k] = nil
+		}
+		for k, v := range c.EnvDiff {
+			if s.redactor != nil {
+				v = s.redactor.Text(v)
+			}
+			diff[k] = &v
+		}
+		env = jsonString(diff)
+	}
+	var pid any
+	if c.PID != 0 {
+		pid = c.PID
+	}
+	return s.exclusive(ctx, func(db *sql.DB) error {
+		_, err := db.ExecContext(ctx, `
+INSERT INTO connections(id, mode, peer, hops, command, args, env_diff, pid, started_unix_ms)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?);
+`, c.ID, c.Mode, nullIfEmpty(c.Peer), hops, nullIfEmpty(c.Command), args, env, pid, c.Started.UnixMilli())
+		return err
+	})
+}
+
+// FinishConnection records how the connection with the given id ended.
+// Rows written for the connection before the call are committed first.
+func (s *Store) FinishConnection(ctx context.Context, id string, end ConnectionEnd) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("audit store not initialized")
+	}
+	if end.Time.IsZero() {
+		end.Time = time.Now()
+	}
+	var code any
+	if end.ExitCode != nil {
+		code = *end.ExitCode
+	}
+	return s.exclusive(ctx, func(db *sql.DB) error {
+		_, err := db.ExecContext(ctx, `
+UPDATE connections SET ended_unix_ms = ?, exit_code = ?, close_reason = ? WHERE id = ?;
+`, end.Time.UnixMilli(), code, nullIfEmpty(end.Reason), id)
+		return err
+	})
+}
+
+// pruneConnections deletes the connections that ended before cutoff, and
+// those that never recorded an end, started before cutoff and have no
+// events left.
+func pruneConnections(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `
+DELETE FROM connections WHERE COALESCE(ended_unix_ms, started_unix_ms) < ?
+  AND (ended_unix_ms IS NOT NULL OR NOT EXISTS (SELECT 1 FROM audit_events WHERE conn_id = connections.id))`, cutoff)
+	return err
+}
+
+func jsonString(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// ConnectionFilter selects connections. Zero-valued fields are ignored.
+type ConnectionFilter struct {
+	ID   string
+	Mode string
+	// Active selects connections that have not ended.
+	Active bool
+	// Since and Until bound the start of a connection.
+	Since time.Time
+	Until time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f ConnectionFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.ID != "" {
+		conds = append(conds, "id = ?")
+		args = append(args, f.ID)
+	}
+	if f.Mode != "" {
+		conds = append(conds, "mode = ?")
+		args = append(args, f.Mode)
+	}
+	if f.Active {
+		conds = append(conds, "ended_unix_ms IS NULL")
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "started_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "started_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ListConnections returns the connections matching f, most recent first.
+func (s *Store) ListConnections(ctx context.Context, f ConnectionFilter) ([]Connection, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, mode, peer, hops, command, args, env_diff, pid, started_unix_ms, ended_unix_ms, exit_code, close_reason
+FROM connections`+where+`
+ORDER BY started_unix_ms DESC, id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Connection
+	for rows.Next() {
+		var (
+			c                            Connection
+			started                      int64
+			peer, hops, command, cmdArgs sql.NullString
+			env, reason                  sql.NullString
+			pid, ended, code             sql.NullInt64
+		)
+		if err := rows.Scan(&c.ID, &c.Mode, &peer, &hops, &command, &cmdArgs, &env, &pid, &started, &ended, &code, &reason); err != nil {
+			return nil, err
+		}
+		c.Peer, c.Command, c.CloseReason = peer.String, command.String, reason.String
+		if hops.Valid {
+			_ = json.Unmarshal([]byte(hops.String), &c.Hops)
+		}
+		if cmdArgs.Valid {
+			_ = json.Unmarshal([]byte(cmdArgs.String), &c.Args)
+		}
+		if env.Valid {
+			var diff map[string]*string
+			_ = json.Unmarshal([]byte(env.String), &diff)
+			for k, v := range diff {
+				if v == nil {
+					c.EnvRemoved = append(c.EnvRemoved, k)
+					continue
+				}
+				if c.EnvDiff == nil {
+					c.EnvDiff = map[string]string{}
+				}
+				c.EnvDiff[k] = *v
+			}
+			sort.Strings(c.EnvRemoved)
+		}
+		c.PID = int(pid.Int64)
+		c.Started = time.UnixMilli(started)
+		if ended.Valid {
+			c.Ended = time.UnixMilli(ended.Int64)
+		}
+		if code.Valid {
+			n := int(code.Int64)
+			c.ExitCode = &n
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
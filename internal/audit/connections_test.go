@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"acp-gate/internal/redact"
+)
+
+func TestConnections(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	red, err := redact.New(redact.Options{Patterns: []redact.Pattern{{Name: "internal-host", Regex: `db\.internal`}}})
+	if err != nil {
+		t.Fatalf("redact.New: %v", err)
+	}
+	s.SetRedactor(red)
+	if err := s.StartWriter(WriterOptions{}); err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+
+	base := []string{"HOME=/home/me", "PATH=/bin", "OLD=1"}
+	agentEnv := []string{"HOME=/home/me", "PATH=/usr/bin", "API_TOKEN=sk-123", "DB_HOST=db.internal", "EMPTY="}
+	env, removed := EnvDiff(base, agentEnv), EnvRemoved(base, agentEnv)
+	if v, ok := env["EMPTY"]; env["API_TOKEN"] != "[REDACTED]" || env["PATH"] != "/usr/bin" || !ok || v != "" || len(env) != 4 {
+		t.Fatalf("unexpected env diff: %v", env)
+	}
+	if len(removed) != 1 || removed[0] != "OLD" {
+		t.Fatalf("unexpected removed variables: %v", removed)
+	}
+
+	start := time.UnixMilli(time.Now().Add(-time.Minute).UnixMilli())
+	a, b := NewConnectionID(), NewConnectionID()
+	for _, c := range []Connection{
+		{ID: a, Mode: ConnTunnel, Peer: "10.0.0.2:5000", Hops: []string{"10.0.0.1:4000", "10.0.0.2:5000"},
+			Command: "claude-code", Args: []string{"--acp"}, EnvDiff: env, EnvRemoved: removed, PID: 42, Started: start},
+		{ID: b, Mode: ConnLocal, Command: "gemini", PID: 43, Started: start.Add(time.Second)},
+	} {
+		if err := StartConnection(ctx, Fanout(s), c); err != nil {
+			t.Fatalf("StartConnection: %v", err)
+		}
+	}
+	for i, conn := range []string{a, b, a} {
+		r := Record{Timestamp: start.Add(time.Duration(i) * time.Second), Direction: DirectionUpstreamToDownstream,
+			Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`), ConnID: conn}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	code := 3
+	if err := s.FinishConnection(ctx, a, ConnectionEnd{Time: start.Add(time.Minute), ExitCode: &code, Reason: CloseAgentExit}); err != nil {
+		t.Fatalf("FinishConnection: %v", err)
+	}
+
+	conns, err := s.ListConnections(ctx, ConnectionFilter{})
+	if err != nil {
+		t.Fatalf("ListConnections: %v", err)
+	}
+	if len(conns) != 2 || conns[0].ID != b || conns[1].ID != a {
+		t.Fatalf("unexpected connections: %+v", conns)
+	}
+	got := conns[1]
+	if got.Peer != "10.0.0.2:5000" || len(got.Hops) != 2 || got.Command != "claude-code" || len(got.Args) != 1 || got.PID != 42 {
+		t.Fatalf("unexpected connection: %+v", got)
+	}
+	if got.EnvDiff["DB_HOST"] == "db.internal" || got.EnvDiff["API_TOKEN"] != "[REDACTED]" {
+		t.Fatalf("env diff not redacted: %v", got.EnvDiff)
+	}
+	if v, ok := got.EnvDiff["EMPTY"]; !ok || v != "" || len(got.EnvRemoved) != 1 || got.EnvRemoved[0] != "OLD" {
+		t.Fatalf("removed variable not told apart from an empty one: %v, %v", got.EnvDiff, got.EnvRemoved)
+	}
+	if got.ExitCode == nil || *got.ExitCode != 3 || got.CloseReason != CloseAgentExit || !got.Ended.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected end: %+v", got)
+	}
+	if active, _ := s.ListConnections(ctx, ConnectionFilter{Active: true}); len(active) != 1 || active[0].ID != b {
+		t.Fatalf("unexpected active connections: %+v", active)
+	}
+
+	rows, err := s.Query(ctx, Filter{ConnID: a})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(rows) != 2 || rows[0].ConnID != a {
+		t.Fatalf("expected the 2 rows of connection %s, got %+v", a, rows)
+	}
+	rep, err := s.Verify(ctx, nil)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !rep.OK() {
+		t.Fatalf("chain with connection ids does not verify: %+v", rep.Problems)
+	}
+}
@@ -0,0 +1,387 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Payload encryption uses two levels of keys. Master keys come from a
+// keyring supplied by the operator and never touch the database. Each
+// store that writes encrypted records generates a random data key, stores
+// it in audit_keys wrapped (encrypted) with the active master key, and
+// records the data key id on every row it encrypts. Rotating the master
+// key therefore only requires rewrapping the data keys; see Rekey.
+//
+// Payloads, error data, and the text, diffs, output, plans, tool
+// locations, terminal commands and MCP servers taken from payloads are
+// encrypted. The columns the audit commands filter, group or join by stay
+// in plaintext:
+//   - tool call and permission titles and kinds, and permission options
+//   - session working directories, client info, modes, models and slash
+//     commands
+//   - file change paths and attachment URIs, names and MIME types
+//   - the command, args and environment changes of connections, which
+//     the operator configured rather than the agent sent
+//   - ids, methods, times, statuses, and error codes and messages
+
+// ErrNoKey is returned when a data key cannot be unwrapped with any key in
+// the keyring.
+var ErrNoKey = errors.New("no matching audit key")
+
+// Keyring holds AES-256 master keys. The first key wraps new data keys;
+// every key can unwrap existing ones.
+type Keyring struct {
+	keys []masterKey
+}
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// ParseKeyring reads one key per line, as "id:key" or just "key", where key
+// is 32 bytes encoded as base64 or hex. Without an explicit id, the id is
+// derived from the key. Blank lines and lines starting with # are ignored.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	k := &Keyring{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, enc, ok := strings.Cut(line, ":")
+		if !ok {
+			id, enc = "", line
+		}
+		key, err := decodeKey(enc)
+		if err != nil {
+			return nil, fmt.Errorf("audit key line %d: %w", n, err)
+		}
+		if id == "" {
+			id = KeyID(key)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, masterKey{id: id, aead: aead})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("audit keyring is empty")
+	}
+	return k, nil
+}
+
+// LoadKeyring reads a keyring file; see ParseKeyring.
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(b)
+}
+
+// GenerateKey returns a new random master key line for a keyring file.
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return KeyID(key) + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// KeyID derives the default id of a master key.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, fmt.Errorf("key must be 32 bytes, base64 or hex encoded")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *Keyring) active() masterKey { return k.keys[0] }
+
+func (k *Keyring) find(id string) (masterKey, bool) {
+	for _, m := range k.keys {
+		if m.id == id {
+			return m, true
+		}
+	}
+	return masterKey{}, false
+}
+
+// seal encrypts plaintext with aead, binding it to label, and returns
+// base64(nonce || ciphertext).
+func seal(aead cipher.AEAD, label string, plaintext []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := aead.Seal(nonce, nonce, plaintext, []byte(label))
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func unseal(aead cipher.AEAD, label, sealed string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed value too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, b[:n], b[n:], []byte(label))
+}
+
+// dataKey is an unwrapped data key.
+type dataKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// SetKeyring enables payload encryption for records written from now on
+// and decryption of encrypted rows returned by queries. Set it before the
+// store is shared.
+func (s *Store) SetKeyring(k *Keyring) {
+	s.keyring = k
+}
+
+// writeKey returns the data key for new records, creating and storing it on
+// first use.
+func (s *Store) writeKey(ctx context.Context) (dataKey, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if s.wkey.aead != nil {
+		return s.wkey, nil
+	}
+	raw := make([]byte, 32)
+	idb := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return dataKey{}, err
+	}
+	if _, err := rand.Read(idb); err != nil {
+		return dataKey{}, err
+	}
+	id := hex.EncodeToString(idb)
+	kek := s.keyring.active()
+	wrapped, err := seal(kek.aead, "audit_keys:"+id, raw)
+	if err != nil {
+		return dataKey{}, err
+	}
+	err = s.exclusive(ctx, func(db *sql.DB) error {
+		_, err := db.ExecContext(context.WithoutCancel(ctx), `INSERT INTO audit_keys(id, kek_id, wrapped, created_unix_ms) VALUES(?, ?, ?, ?)`,
+			id, kek.id, wrapped, time.Now().UnixMilli())
+		return err
+	})
+	if err != nil {
+		return dataKey{}, fmt.Errorf("store audit data key: %w", err)
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return dataKey{}, err
+	}
+	s.wkey = dataKey{id: id, aead: aead}
+	return s.wkey, nil
+}
+
+// readKey returns the data key with the given id, unwrapping it with the
+// keyring on first use.
+func (s *Store) readKey(ctx context.Context, id string) (cipher.AEAD, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if aead, ok := s.rkeys[id]; ok {
+		return aead, nil
+	}
+	if s.keyring == nil {
+		return nil, ErrNoKey
+	}
+	var kekID, wrapped string
+	err := s.db.QueryRowContext(ctx, `SELECT kek_id, wrapped FROM audit_keys WHERE id = ?`, id).Scan(&kekID, &wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("load audit data key %s: %w", id, err)
+	}
+	kek, ok := s.keyring.find(kekID)
+	if !ok {
+		return nil, fmt.Errorf("%w: data key %s is wrapped with master key %s", ErrNoKey, id, kekID)
+	}
+	raw, err := unseal(kek.aead, "audit_keys:"+id, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap audit data key %s: %w", id, err)
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	if s.rkeys == nil {
+		s.rkeys = map[string]cipher.AEAD{}
+	}
+	s.rkeys[id] = aead
+	return aead, nil
+}
+
+// encrypt seals the payload fields of r.
+func (s *Store) encrypt(ctx context.Context, r Record) (Record, error) {
+	dk, err := s.writeKey(ctx)
+	if err != nil {
+		return r, err
+	}
+	sealField := func(label string, v []byte) (string, error) {
+		if len(v) == 0 {
+			return "", nil
+		}
+		return seal(dk.aead, label, v)
+	}
+	raw, err := sealField("raw_json", r.Raw)
+	if err != nil {
+		return r, err
+	}
+	ut, err := sealField("user_text", []byte(r.UserText))
+	if err != nil {
+		return r, err
+	}
+	at, err := sealField("agent_text", []byte(r.AgentText))
+	if err != nil {
+		return r, err
+	}
+	if r.Error != nil && len(r.Error.Data) > 0 {
+		e := *r.Error
+		data, err := sealField("error_data", e.Data)
+		if err != nil {
+			return r, err
+		}
+		e.Data, r.Error = []byte(data), &e
+	}
+	r.Raw, r.UserText, r.AgentText, r.KeyID = []byte(raw), ut, at, dk.id
+	return r, nil
+}
+
+// decrypt opens the payload fields of an encrypted row. If the data key
+// is not available the payload is cleared and r.Sealed is set.
+func (s *Store) decrypt(ctx context.Context, r *Record) {
+	// Error data written before it was encrypted is JSON, which a sealed
+	// value never is.
+	sealedErr := r.Error != nil && len(r.Error.Data) > 0 && !json.Valid(r.Error.Data)
+	aead, err := s.readKey(ctx, r.KeyID)
+	if err == nil {
+		var raw, ut, at, data []byte
+		if raw, err = openField(aead, "raw_json", string(r.Raw)); err == nil {
+			if ut, err = openField(aead, "user_text", r.UserText); err == nil {
+				at, err = openField(aead, "agent_text", r.AgentText)
+			}
+		}
+		if err == nil && sealedErr {
+			data, err = openField(aead, "error_data", string(r.Error.Data))
+		}
+		if err == nil {
+			r.Raw, r.UserText, r.AgentText = raw, string(ut), string(at)
+			if sealedErr {
+				r.Error.Data = data
+			}
+			return
+		}
+	}
+	r.Raw, r.UserText, r.AgentText, r.Sealed = nil, "", "", true
+	if sealedErr {
+		r.Error.Data = nil
+	}
+}
+
+func openField(aead cipher.AEAD, label, v string) ([]byte, error) {
+	if v == "" {
+		return nil, nil
+	}
+	return unseal(aead, label, v)
+}
+
+// Rekey rewraps every data key with the active master key, so that older
+// master keys can be removed from the keyring. It returns the number of
+// data keys rewrapped.
+func (s *Store) Rekey(ctx context.Context) (int, error) {
+	if s.keyring == nil {
+		return 0, fmt.Errorf("no audit keyring set")
+	}
+	kek := s.keyring.active()
+	n := 0
+	err := s.exclusive(ctx, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `SELECT id, kek_id, wrapped FROM audit_keys WHERE kek_id <> ?`, kek.id)
+		if err != nil {
+			return err
+		}
+		type rewrap struct{ id, wrapped string }
+		var todo []rewrap
+		for rows.Next() {
+			var id, kekID, wrapped string
+			if err := rows.Scan(&id, &kekID, &wrapped); err != nil {
+				rows.Close()
+				return err
+			}
+			old, ok := s.keyring.find(kekID)
+			if !ok {
+				rows.Close()
+				return fmt.Errorf("%w: data key %s is wrapped with master key %s", ErrNoKey, id, kekID)
+			}
+			raw, err := unseal(old.aead, "audit_keys:"+id, wrapped)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("unwrap audit data key %s: %w", id, err)
+			}
+			w, err := seal(kek.aead, "audit_keys:"+id, raw)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			todo = append(todo, rewrap{id, w})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, t := range todo {
+			if _, err := tx.ExecContext(ctx, `UPDATE audit_keys SET kek_id = ?, wrapped = ? WHERE id = ?`, kek.id, t.wrapped, t.id); err != nil {
+				return err
+			}
+		}
+		n = len(todo)
+		return tx.Commit()
+	})
+	return n, err
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustKeyring(t *testing.T, lines ...string) *Keyring {
+	t.Helper()
+	k, err := ParseKeyring([]byte(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	return k
+}
+
+func mustKey(t *testing.T) string {
+	t.Helper()
+	line, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return line
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	oldKey, newKey := mustKey(t), mustKey(t)
+
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, oldKey))
+	r := Record{Timestamp: time.Now(), Direction: DirectionUpstreamToDownstream, SessionID: "a", Method: "session/prompt", IsRequest: true,
+		Raw: []byte(`{"prompt":"top secret"}`), UserText: "top secret"}
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var raw, ut string
+	if err := s.db.QueryRowContext(ctx, `SELECT raw_json, user_text FROM audit_events`).Scan(&raw, &ut); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.Contains(raw+ut, "secret") {
+		t.Fatalf("payload stored in plaintext: %q %q", raw, ut)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 1 || string(got[0].Raw) != `{"prompt":"top secret"}` || got[0].UserText != "top secret" || got[0].KeyID == "" || got[0].Sealed {
+		t.Fatalf("unexpected decrypted record: %+v", got)
+	}
+	s.Close()
+
+	// Without the key the payload stays sealed but the metadata is readable.
+	s, err = Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err = s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 1 || !got[0].Sealed || got[0].Raw != nil || got[0].SessionID != "a" {
+		t.Fatalf("expected sealed record, got %+v", got)
+	}
+
+	// Rotate: rewrap with the new key, then drop the old one.
+	s.SetKeyring(mustKeyring(t, newKey, oldKey))
+	if n, err := s.Rekey(ctx); err != nil || n != 1 {
+		t.Fatalf("Rekey: %d, %v", n, err)
+	}
+	s.Close()
+
+	s, err = Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	s.SetKeyring(mustKeyring(t, newKey))
+	got, err = s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 1 || got[0].Sealed || got[0].UserText != "top secret" {
+		t.Fatalf("expected record readable with the new key only, got %+v", got)
+	}
+}
+
+func TestEncryptedErrorData(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	for i, data := range []string{`{"detail":"top secret"}`, `{"detail":"legacy"}`} {
+		r := Record{Timestamp: time.Now(), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/prompt",
+			CorrelationID: fmt.Sprintf("c-%d", i), Raw: []byte(`{}`), Error: &RPCError{Code: -32603, Message: "boom", Data: []byte(data)}}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	// Rows written before error data was encrypted kept it in plaintext.
+	if _, err := s.db.ExecContext(ctx, `UPDATE audit_events SET error_data = '{"detail":"legacy"}' WHERE corr_id = 'c-1'`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	var data string
+	if err := s.db.QueryRowContext(ctx, `SELECT error_data FROM audit_events WHERE corr_id = 'c-0'`).Scan(&data); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.Contains(data, "secret") {
+		t.Fatalf("error data stored in plaintext: %s", data)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 || string(got[0].Error.Data) != `{"detail":"top secret"}` || string(got[1].Error.Data) != `{"detail":"legacy"}` ||
+		got[0].Sealed || got[1].Sealed {
+		t.Fatalf("unexpected error data with key: %+v", got)
+	}
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	got, err = s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 || !got[0].Sealed || got[0].Error.Data != nil || got[0].Error.Message != "boom" {
+		t.Fatalf("unexpected error without key: %+v", got[0].Error)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	hexKey := strings.Repeat("ab", 32)
+	k := mustKeyring(t, "# comment", "", "prod-2024:"+hexKey, hexKey)
+	if len(k.keys) != 2 || k.active().id != "prod-2024" || k.keys[1].id == "" {
+		t.Fatalf("unexpected keyring: %+v", k.keys)
+	}
+	for _, bad := range []string{"", "# only comments", "id:short", "not base64!"} {
+		if _, err := ParseKeyring([]byte(bad)); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
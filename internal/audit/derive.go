@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+)
+
+// derived holds the changes one record makes to the tables derived from
+// the audit trail, such as sessions, tool_calls, permissions, terminals
+// and turns, and the file changes, attachments and blobs recorded with
+// them. They are applied in the transaction that inserts the record.
+// Fields are exported to JSON for the spill file.
+type derived struct {
+	Sessions    []sessionUpdate    `json:",omitempty"`
+	ToolCalls   []toolCallUpdate   `json:",omitempty"`
+	Permissions []permissionUpdate `json:",omitempty"`
+	FileChanges []fileChangeUpdate `json:",omitempty"`
+	Terminals   []terminalUpdate   `json:",omitempty"`
+	Turns       []turnUpdate       `json:",omitempty"`
+	Attachments []attachmentUpdate `json:",omitempty"`
+	Blobs       []blobUpdate       `json:",omitempty"`
+
+	// drop is set when the record itself is not inserted, because its
+	// text is kept in turns; see TurnsDrop.
+	drop bool
+}
+
+// dbtx is implemented by *sql.DB and *sql.Tx.
+type dbtx interface {
+	execer
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// derive returns the derived changes of r, which must not be encrypted
+// yet, and of the blobs extracted from it. Payloads copied into derived
+// tables are encrypted like the record.
+func (s *Store) derive(ctx context.Context, r Record, blobs []blobUpdate) (derived, error) {
+	d := derived{
+		Sessions:    s.sess.observe(r),
+		ToolCalls:   toolCallUpdates(r),
+		Permissions: permissionUpdates(r),
+		FileChanges: fileChangeUpdates(r),
+		Terminals:   s.term.observe(r),
+		Attachments: attachmentUpdates(r, blobs),
+		Blobs:       blobs,
+	}
+	var chunk bool
+	d.Turns, chunk = s.turns.observe(r)
+	d.drop = chunk && s.turns.mode == TurnsDrop
+	if s.keyring != nil && len(d.ToolCalls) > 0 {
+		if err := s.sealToolCalls(ctx, d.ToolCalls); err != nil {
+			return d, err
+		}
+	}
+	if s.keyring != nil && len(d.FileChanges) > 0 {
+		if err := s.sealFileChanges(ctx, d.FileChanges); err != nil {
+			return d, err
+		}
+	}
+	if s.keyring != nil && len(d.Terminals) > 0 {
+		if err := s.sealTerminals(ctx, d.Terminals); err != nil {
+			return d, err
+		}
+	}
+	if s.keyring != nil && len(d.Turns) > 0 {
+		if err := s.sealTurns(ctx, d.Turns); err != nil {
+			return d, err
+		}
+	}
+	if s.keyring != nil && len(d.Attachments) > 0 {
+		if err := s.sealAttachments(ctx, d.Attachments); err != nil {
+			return d, err
+		}
+	}
+	if s.keyring != nil && len(d.Blobs) > 0 {
+		if err := s.sealBlobs(ctx, d.Blobs); err != nil {
+			return d, err
+		}
+	}
+	if s.keyring != nil {
+		if err := s.sealSessions(ctx, d.Sessions); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+// empty reports whether d changes nothing.
+func (d derived) empty() bool {
+	return len(d.Sessions) == 0 && len(d.ToolCalls) == 0 && len(d.Permissions) == 0 && len(d.FileChanges) == 0 &&
+		len(d.Terminals) == 0 && len(d.Turns) == 0 && len(d.Attachments) == 0 && len(d.Blobs) == 0
+}
+
+func (d derived) apply(ctx context.Context, db dbtx) error {
+	if err := applySessions(ctx, db, d.Sessions); err != nil {
+		return err
+	}
+	if err := applyToolCalls(ctx, db, d.ToolCalls); err != nil {
+		return err
+	}
+	if err := applyPermissions(ctx, db, d.Permissions); err != nil {
+		return err
+	}
+	if err := applyFileChanges(ctx, db, d.FileChanges); err != nil {
+		return err
+	}
+	if err := applyTerminals(ctx, db, d.Terminals); err != nil {
+		return err
+	}
+	if err := applyTurns(ctx, db, d.Turns); err != nil {
+		return err
+	}
+	if err := applyAttachments(ctx, db, d.Attachments); err != nil {
+		return err
+	}
+	return applyBlobs(ctx, db, d.Blobs)
+}
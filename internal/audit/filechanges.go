@@ -0,0 +1,308 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"acp-gate/internal/textdiff"
+)
+
+// The file_changes table has one row per fs/write_text_file request the
+// proxy recorded as a diff: the unified diff from the content the proxy
+// last saw for the file to the written content. The request row itself
+// keeps the path but not the content.
+//
+// On encrypted stores the diff is encrypted with the data key named in
+// key_id, like the payload of its request.
+
+const fileChangesSchema = `
+CREATE TABLE IF NOT EXISTS file_changes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  corr_id TEXT,
+  conn_id TEXT,
+  session_id TEXT,
+  path TEXT NOT NULL,
+  ts_unix_ms INTEGER NOT NULL,
+  created INTEGER NOT NULL,
+  added INTEGER NOT NULL,
+  removed INTEGER NOT NULL,
+  size INTEGER NOT NULL,
+  sha256 TEXT NOT NULL,
+  diff TEXT,
+  key_id TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_file_changes_session ON file_changes(session_id, id);
+CREATE INDEX IF NOT EXISTS idx_file_changes_ts ON file_changes(ts_unix_ms);`
+
+// FileChange is the change a file write made. The proxy sets it on the
+// fs/write_text_file request records it writes; the store returns it from
+// FileChanges.
+type FileChange struct {
+	// ID, CorrelationID, ConnID, SessionID and Time are only set by
+	// FileChanges; the rest comes from the request record.
+	ID            int64
+	CorrelationID string
+	ConnID        string
+	SessionID     string
+	Time          time.Time
+
+	Path string
+	// Created is set when the file did not exist before the write.
+	Created bool
+	// Diff holds the hunks of a unified diff with three lines of context,
+	// without the ---/+++ header; empty if the write changed nothing.
+	Diff    string
+	Added   int
+	Removed int
+	// Size and SHA256 describe the written content.
+	Size   int
+	SHA256 string
+
+	// Status is the status of the write request; a failed write did not
+	// change the file.
+	Status Status
+	// Sealed is set when Diff is encrypted with a key the store does not
+	// have.
+	Sealed bool
+}
+
+// NewFileChange returns the change that writing content to path makes to
+// a file that held old, or did not exist if created is set.
+func NewFileChange(path, old, content string, created bool) FileChange {
+	diff, stat := textdiff.Unified(old, content, 3)
+	sum := sha256.Sum256([]byte(content))
+	return FileChange{
+		Path:    path,
+		Created: created,
+		Diff:    diff,
+		Added:   stat.Added,
+		Removed: stat.Removed,
+		Size:    len(content),
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+}
+
+// fileChangeUpdate is one row to insert into file_changes.
+type fileChangeUpdate struct {
+	CorrID, ConnID, SessionID string
+	At                        int64
+	Change                    FileChange
+	KeyID                     string
+}
+
+// fileChangeUpdates returns the file change recorded with r.
+func fileChangeUpdates(r Record) []fileChangeUpdate {
+	if r.FileChange == nil || !r.IsRequest {
+		return nil
+	}
+	return []fileChangeUpdate{{
+		CorrID:    r.CorrelationID,
+		ConnID:    r.ConnID,
+		SessionID: r.SessionID,
+		At:        r.Timestamp.UnixMilli(),
+		Change:    *r.FileChange,
+	}}
+}
+
+// sealFileChanges encrypts the diffs of ups.
+func (s *Store) sealFileChanges(ctx context.Context, ups []fileChangeUpdate) error {
+	dk, err := s.writeKey(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range ups {
+		u := &ups[i]
+		if u.Change.Diff == "" {
+			continue
+		}
+		if u.Change.Diff, err = seal(dk.aead, "file_diff", []byte(u.Change.Diff)); err != nil {
+			return err
+		}
+		u.KeyID = dk.id
+	}
+	return nil
+}
+
+func applyFileChanges(ctx context.Context, db dbtx, ups []fileChangeUpdate) error {
+	for _, u := range ups {
+		c := u.Change
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO file_changes(corr_id, conn_id, session_id, path, ts_unix_ms, created, added, removed, size, sha256, diff, key_id)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`, nullIfEmpty(u.CorrID), nullIfEmpty(u.ConnID), nullIfEmpty(u.SessionID), c.Path, u.At, boolInt(c.Created),
+			c.Added, c.Removed, c.Size, c.SHA256, nullIfEmpty(c.Diff), nullIfEmpty(u.KeyID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneFileChanges deletes the changes recorded before cutoff, as retention
+// does with their events.
+func pruneFileChanges(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM file_changes WHERE ts_unix_ms < ?`, cutoff)
+	return err
+}
+
+// FileChangeFilter selects file changes. Zero-valued fields are ignored.
+type FileChangeFilter struct {
+	SessionID string
+	// Path selects the changes of one file, or of the files below it when
+	// it ends with a slash.
+	Path  string
+	Since time.Time
+	Until time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f FileChangeFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.SessionID != "" {
+		conds = append(conds, "f.session_id = ?")
+		args = append(args, f.SessionID)
+	}
+	if strings.HasSuffix(f.Path, "/") {
+		conds = append(conds, "substr(f.path, 1, ?) = ?")
+		args = append(args, len(f.Path), f.Path)
+	} else if f.Path != "" {
+		conds = append(conds, "f.path = ?")
+		args = append(args, f.Path)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "f.ts_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "f.ts_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// FileChanges returns the file changes matching f in the order they were
+// made.
+func (s *Store) FileChanges(ctx context.Context, f FileChangeFilter) ([]FileChange, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT f.id, f.corr_id, f.conn_id, f.session_id, f.path, f.ts_unix_ms, f.created, f.added, f.removed, f.size, f.sha256,
+  f.diff, f.key_id, e.status
+FROM file_changes f LEFT JOIN audit_events e ON e.corr_id = f.corr_id AND e.is_request = 1`+where+`
+ORDER BY f.id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []FileChange
+	for rows.Next() {
+		var (
+			c                   FileChange
+			corr, conn, session sql.NullString
+			diff, keyID, status sql.NullString
+			ts                  int64
+			created             int
+		)
+		if err := rows.Scan(&c.ID, &corr, &conn, &session, &c.Path, &ts, &created, &c.Added, &c.Removed, &c.Size, &c.SHA256,
+			&diff, &keyID, &status); err != nil {
+			return nil, err
+		}
+		c.CorrelationID, c.ConnID, c.SessionID = corr.String, conn.String, session.String
+		c.Time, c.Created = time.UnixMilli(ts), created != 0
+		c.Diff, c.Status = diff.String, Status(status.String)
+		if keyID.Valid && diff.Valid {
+			s.openFileChange(ctx, keyID.String, &c)
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// openFileChange decrypts the diff of c. If the data key is not available
+// the diff is cleared and c.Sealed is set.
+func (s *Store) openFileChange(ctx context.Context, keyID string, c *FileChange) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		if diff, err := openField(aead, "file_diff", c.Diff); err == nil {
+			c.Diff = string(diff)
+			return
+		}
+	}
+	c.Diff, c.Sealed = "", true
+}
+
+// backfillFileChanges derives file changes from the plaintext events
+// recorded before the table existed. The content a write replaced is only
+// known when the session read or wrote the whole file before, so earlier
+// writes are left out.
+func backfillFileChanges(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+SELECT q.ts_unix_ms, q.method, q.session_id, q.corr_id, q.conn_id, q.raw_json, r.raw_json
+FROM audit_events q LEFT JOIN audit_events r ON r.corr_id = q.corr_id AND r.is_request = 0 AND r.is_notify = 0
+WHERE q.method IN ('fs/read_text_file', 'fs/write_text_file') AND q.is_request = 1 AND q.key_id IS NULL
+  AND q.session_id IS NOT NULL AND (r.id IS NULL OR r.key_id IS NULL)
+ORDER BY q.id`)
+	if err != nil {
+		return err
+	}
+	type fileKey struct{ session, path string }
+	seen := map[fileKey]string{}
+	var ups []fileChangeUpdate
+	for rows.Next() {
+		var (
+			ts              int64
+			method, session string
+			corr, conn, res sql.NullString
+			req             string
+		)
+		if err := rows.Scan(&ts, &method, &session, &corr, &conn, &req, &res); err != nil {
+			rows.Close()
+			return err
+		}
+		var p struct {
+			Path    string  `json:"path"`
+			Content *string `json:"content"`
+			Line    *int    `json:"line"`
+			Limit   *int    `json:"limit"`
+		}
+		if json.Unmarshal([]byte(req), &p) != nil || p.Path == "" {
+			continue
+		}
+		key := fileKey{session, p.Path}
+		if method == "fs/read_text_file" {
+			var out struct {
+				Content *string `json:"content"`
+			}
+			if p.Line == nil && p.Limit == nil && res.Valid && json.Unmarshal([]byte(res.String), &out) == nil && out.Content != nil {
+				seen[key] = *out.Content
+			}
+			continue
+		}
+		if p.Content == nil {
+			continue
+		}
+		if old, ok := seen[key]; ok {
+			c := NewFileChange(p.Path, old, *p.Content, false)
+			ups = append(ups, fileChangeUpdate{CorrID: corr.String, ConnID: conn.String, SessionID: session, At: ts, Change: c})
+		}
+		seen[key] = *p.Content
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return applyFileChanges(ctx, tx, ups)
+}
@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileChangesEncrypted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	change := NewFileChange("/w/main.go", "package main\n", "package main\n\nfunc main() {}\n", false)
+	if change.Added != 2 || change.Removed != 0 || change.Size != 29 || len(change.SHA256) != 64 {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	r := Record{Timestamp: time.Now(), Direction: DirectionDownstreamToUpstream, SessionID: "s1", Method: "fs/write_text_file",
+		IsRequest: true, CorrelationID: "c1-1", Status: StatusPending, Raw: []byte(`{"sessionId":"s1","path":"/w/main.go"}`), FileChange: &change}
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var diff string
+	if err := s.db.QueryRowContext(ctx, `SELECT diff FROM file_changes`).Scan(&diff); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.Contains(diff, "func main") {
+		t.Fatalf("diff stored in plaintext: %s", diff)
+	}
+	got, err := s.FileChanges(ctx, FileChangeFilter{Path: "/w/"})
+	if err != nil {
+		t.Fatalf("FileChanges: %v", err)
+	}
+	if len(got) != 1 || got[0].Diff != change.Diff || got[0].CorrelationID != "c1-1" || got[0].Status != StatusPending {
+		t.Fatalf("unexpected changes with key: %+v", got)
+	}
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	got, err = s.FileChanges(ctx, FileChangeFilter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("FileChanges: %v", err)
+	}
+	if len(got) != 1 || !got[0].Sealed || got[0].Diff != "" || got[0].SHA256 != change.SHA256 {
+		t.Fatalf("unexpected changes without key: %+v", got)
+	}
+}
+
+func TestFileChangesBackfill(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	down, up := DirectionDownstreamToUpstream, DirectionUpstreamToDownstream
+	records := []Record{
+		// A write to a file the session never read cannot be diffed.
+		{Direction: down, SessionID: "s1", Method: "fs/write_text_file", IsRequest: true, CorrelationID: "c1-1",
+			Raw: []byte(`{"sessionId":"s1","path":"/w/a.txt","content":"x\n"}`)},
+		{Direction: down, SessionID: "s1", Method: "fs/read_text_file", IsRequest: true, CorrelationID: "c1-2",
+			Raw: []byte(`{"sessionId":"s1","path":"/w/b.txt"}`)},
+		{Direction: up, SessionID: "s1", Method: "fs/read_text_file", CorrelationID: "c1-2", Raw: []byte(`{"content":"1\n2\n"}`)},
+		{Direction: down, SessionID: "s1", Method: "fs/write_text_file", IsRequest: true, CorrelationID: "c1-3",
+			Raw: []byte(`{"sessionId":"s1","path":"/w/b.txt","content":"1\n3\n"}`)},
+		{Direction: down, SessionID: "s1", Method: "fs/write_text_file", IsRequest: true, CorrelationID: "c1-4",
+			Raw: []byte(`{"sessionId":"s1","path":"/w/a.txt","content":"y\n"}`)},
+	}
+	for _, r := range records {
+		r.Timestamp = time.Now()
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	s = reopenBefore(t, s, path, "file changes table", `DROP TABLE file_changes`)
+	got, err := s.FileChanges(ctx, FileChangeFilter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("FileChanges: %v", err)
+	}
+	if len(got) != 2 || got[0].Path != "/w/b.txt" || got[0].Diff != "@@ -1,2 +1,2 @@\n 1\n-2\n+3\n" ||
+		got[1].Path != "/w/a.txt" || got[1].Diff != "@@ -1,1 +1,1 @@\n-x\n+y\n" {
+		t.Fatalf("unexpected backfilled changes: %+v", got)
+	}
+}
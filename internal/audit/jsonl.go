@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileSinkOptions configures OpenFileSink.
+type FileSinkOptions struct {
+	// MaxBytes rotates the file once it would grow beyond this size
+	// (0 never rotates).
+	MaxBytes int64
+	// MaxBackups is the number of rotated files to keep (0 keeps all).
+	// Rotated files are named path.1 (newest), path.2, and so on.
+	MaxBackups int
+}
+
+// FileSink appends JSON lines to a file, rotating it by size.
+type FileSink struct {
+	path string
+	opts FileSinkOptions
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenFileSink opens path for appending, creating it if necessary.
+func OpenFileSink(path string, opts FileSinkOptions) (*FileSink, error) {
+	s := &FileSink{path: path, opts: opts}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+func (s *FileSink) Write(ctx context.Context, r Record) error {
+	return s.writeLine(NewLine(r))
+}
+
+func (s *FileSink) Finish(ctx context.Context, corrID string, status Status) error {
+	return s.writeLine(statusLine(corrID, status))
+}
+
+func (s *FileSink) writeLine(l Line) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return ErrClosed
+	}
+	if s.opts.MaxBytes > 0 && s.size > 0 && s.size+int64(len(b)) > s.opts.MaxBytes {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("rotate %s: %w", s.path, err)
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N to path.N+1, dropping the ones beyond MaxBackups,
+// moves the current file to path.1 and starts a new one.
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	n := 1
+	for ; ; n++ {
+		if _, err := os.Stat(s.backup(n)); err != nil {
+			break
+		}
+	}
+	for ; n > 1; n-- {
+		if s.opts.MaxBackups > 0 && n > s.opts.MaxBackups {
+			if err := os.Remove(s.backup(n - 1)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(s.backup(n-1), s.backup(n)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.backup(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,276 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrSchemaTooNew is returned by Open when the database was written by a
+// newer acp-gate whose schema this binary does not know.
+var ErrSchemaTooNew = errors.New("audit database schema is newer than this binary supports")
+
+// Migration is one step of the audit schema history. The schema version
+// of a database is kept in PRAGMA user_version and equals the version of
+// the last migration applied to it.
+type Migration struct {
+	Version int
+	Name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Append new entries; never
+// edit or reorder ones that have shipped. Each step must also be safe to
+// run against databases created before versioning existed (user_version
+// 0), which may already contain some of its tables or columns.
+var migrations = []Migration{
+	{1, "create audit_events", execSQL(`
+CREATE TABLE IF NOT EXISTS audit_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  ts_unix_ms INTEGER NOT NULL,
+  direction TEXT NOT NULL,
+  session_id TEXT,
+  method TEXT,
+  is_request INTEGER NOT NULL,
+  is_notify INTEGER NOT NULL,
+  rpc_id TEXT,
+  raw_json TEXT NOT NULL,
+  user_text TEXT,
+  agent_text TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_ts ON audit_events(ts_unix_ms);
+CREATE INDEX IF NOT EXISTS idx_audit_events_session ON audit_events(session_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_method ON audit_events(method);
+`)},
+	{2, "record JSON-RPC errors", steps(
+		addColumns("audit_events", column{"error_code", "INTEGER"}, column{"error_message", "TEXT"}, column{"error_data", "TEXT"}),
+		execSQL(`CREATE INDEX IF NOT EXISTS idx_audit_events_error ON audit_events(error_code) WHERE error_code IS NOT NULL;`),
+	)},
+	{3, "correlate requests and responses", steps(
+		addColumns("audit_events", column{"corr_id", "TEXT"}, column{"seq", "INTEGER"}, column{"latency_ms", "INTEGER"}),
+		execSQL(`CREATE INDEX IF NOT EXISTS idx_audit_events_corr ON audit_events(corr_id);`),
+	)},
+	{4, "track request status", steps(
+		addColumns("audit_events", column{"status", "TEXT"}),
+		execSQL(`CREATE INDEX IF NOT EXISTS idx_audit_events_status ON audit_events(status) WHERE status = 'pending';`),
+	)},
+	{5, "encrypt payloads at rest", steps(
+		addColumns("audit_events", column{"key_id", "TEXT"}),
+		execSQL(`
+CREATE TABLE IF NOT EXISTS audit_keys (
+  id TEXT PRIMARY KEY,
+  kek_id TEXT NOT NULL,
+  wrapped TEXT NOT NULL,
+  created_unix_ms INTEGER NOT NULL
+);`),
+	)},
+	{6, "hash chain and checkpoints", steps(
+		addColumns("audit_events", column{"raw_digest", "TEXT"}, column{"prev_hash", "TEXT"}, column{"row_hash", "TEXT"}),
+		execSQL(`
+CREATE TABLE IF NOT EXISTS audit_checkpoints (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  ts_unix_ms INTEGER NOT NULL,
+  last_row_id INTEGER NOT NULL,
+  row_hash TEXT NOT NULL,
+  key_id TEXT NOT NULL,
+  signature TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit_chain_anchors (
+  through_id INTEGER PRIMARY KEY,
+  row_hash TEXT NOT NULL,
+  ts_unix_ms INTEGER NOT NULL
+);`),
+	)},
+	{7, "full-text search index", execSQL(searchSchema)},
+	{8, "sessions table", execSQL(sessionsSchema)},
+	{9, "connections table", steps(
+		addColumns("audit_events", column{"conn_id", "TEXT"}),
+		execSQL(connectionsSchema),
+	)},
+	{10, "tool call tables", steps(execSQL(toolCallsSchema), toolCallKeyColumns, backfillToolCalls)},
+	{11, "permission ledger", steps(execSQL(permissionsSchema), backfillPermissions)},
+	{12, "file changes table", steps(execSQL(fileChangesSchema), backfillFileChanges)},
+	{13, "terminals tables", steps(execSQL(terminalsSchema), terminalKeyColumns, backfillTerminals)},
+	{14, "turns table", execSQL(turnsSchema)},
+	{15, "blobs table", execSQL(blobsSchema)},
+	{16, "attachments, plans and commands", steps(
+		execSQL(attachmentsSchema),
+		addColumns("sessions", column{"plan", "TEXT"}, column{"plan_key_id", "TEXT"}, column{"commands", "TEXT"}),
+		sessionKeyColumns,
+		backfillContent,
+	)},
+	{17, "encrypted locations, terminal commands and MCP servers", steps(toolCallKeyColumns, terminalKeyColumns, sessionKeyColumns)},
+}
+
+// The key columns of version 17 are also added by the migrations whose
+// backfill writes the table, as the backfill stores rows with them.
+var (
+	toolCallKeyColumns = addColumns("tool_calls", column{"locations_key_id", "TEXT"})
+	terminalKeyColumns = addColumns("terminals", column{"key_id", "TEXT"})
+	sessionKeyColumns  = addColumns("sessions", column{"mcp_servers_key_id", "TEXT"})
+)
+
+// SchemaVersion is the schema version written by this binary.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationStatus describes the schema of an audit database.
+type MigrationStatus struct {
+	Current int
+	Pending []Migration
+}
+
+// CheckSchema reports the schema version of the database at path and the
+// migrations Open would apply to it, without changing anything.
+func CheckSchema(ctx context.Context, path string) (MigrationStatus, error) {
+	if _, err := os.Stat(path); err != nil {
+		return MigrationStatus{}, err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	defer db.Close()
+	v, err := userVersion(ctx, db)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	st := MigrationStatus{Current: v}
+	if v > SchemaVersion() {
+		return st, fmt.Errorf("%w (database version %d, supported %d)", ErrSchemaTooNew, v, SchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.Version > v {
+			st.Pending = append(st.Pending, m)
+		}
+	}
+	return st, nil
+}
+
+// Backup writes a consistent copy of the database at path to dest, which
+// must not exist yet.
+func Backup(ctx context.Context, path, dest string) error {
+	db, err := sql.Open("sqlite", dsn(path))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, `VACUUM INTO ?`, dest)
+	return err
+}
+
+// migrate brings db up to SchemaVersion. Each migration runs in its own
+// transaction together with the user_version bump, so an interrupted
+// upgrade leaves the database at the last completed version.
+func migrate(ctx context.Context, db *sql.DB) error {
+	var v int
+	err := retryBusy(ctx, func() error {
+		var err error
+		v, err = userVersion(ctx, db)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if v > SchemaVersion() {
+		return fmt.Errorf("%w (database version %d, supported %d)", ErrSchemaTooNew, v, SchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.Version <= v {
+			continue
+		}
+		err := retryBusy(ctx, func() error { return applyMigration(ctx, db, m) })
+		if err != nil {
+			return fmt.Errorf("migrate audit schema to version %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Another process may have migrated in the meantime.
+	var v int
+	if err := tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&v); err != nil {
+		return err
+	}
+	if v >= m.Version {
+		return nil
+	}
+	if err := m.up(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, m.Version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func userVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&v)
+	return v, err
+}
+
+func execSQL(query string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+}
+
+func steps(fns ...func(context.Context, *sql.Tx) error) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, fn := range fns {
+			if err := fn(ctx, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type column struct {
+	name string
+	decl string
+}
+
+// addColumns adds the columns table does not have yet.
+func addColumns(table string, cols ...column) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+		if err != nil {
+			return err
+		}
+		have := map[string]bool{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			have[strings.ToLower(name)] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, c := range cols {
+			if have[c.name] {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c.name, c.decl)); err != nil {
+				return fmt.Errorf("add column %s.%s: %w", table, c.name, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reopenBefore pretends the events in s were recorded before the named
+// migration: it runs drops to undo what the migration created, sets the
+// schema version to the one before it, and returns the store at path
+// reopened, which migrates it again.
+func reopenBefore(t *testing.T, s *Store, path, migration string, drops ...string) *Store {
+	t.Helper()
+	ctx := context.Background()
+	version := 0
+	for _, m := range migrations {
+		if m.Name == migration {
+			version = m.Version
+		}
+	}
+	if version == 0 {
+		t.Fatalf("no migration %q", migration)
+	}
+	for _, q := range append(drops, fmt.Sprintf("PRAGMA user_version = %d", version-1)) {
+		if _, err := s.db.ExecContext(ctx, q); err != nil {
+			t.Fatalf("downgrade: %s: %v", q, err)
+		}
+	}
+	s.Close()
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestOpenSetsSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.Close()
+
+	st, err := CheckSchema(ctx, path)
+	if err != nil {
+		t.Fatalf("CheckSchema: %v", err)
+	}
+	if st.Current != SchemaVersion() || len(st.Pending) != 0 {
+		t.Fatalf("unexpected status for fresh DB: %+v", st)
+	}
+}
+
+func TestMigratePartiallyUpgradedDB(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+
+	// An unversioned DB that already had some later columns added.
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	_, err = db.ExecContext(ctx, `
+CREATE TABLE audit_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  ts_unix_ms INTEGER NOT NULL,
+  direction TEXT NOT NULL,
+  session_id TEXT,
+  method TEXT,
+  is_request INTEGER NOT NULL,
+  is_notify INTEGER NOT NULL,
+  rpc_id TEXT,
+  raw_json TEXT NOT NULL,
+  user_text TEXT,
+  agent_text TEXT,
+  error_code INTEGER,
+  corr_id TEXT
+);`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("create partial schema: %v", err)
+	}
+
+	st, err := CheckSchema(ctx, path)
+	if err != nil {
+		t.Fatalf("CheckSchema: %v", err)
+	}
+	if st.Current != 0 || len(st.Pending) != len(migrations) {
+		t.Fatalf("unexpected status before upgrade: %+v", st)
+	}
+
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	r := Record{Timestamp: time.Now(), Direction: DirectionUpstreamToDownstream, IsRequest: true, Raw: []byte(`{}`), CorrelationID: "c-1", Status: StatusPending, Error: &RPCError{Code: 1}}
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write after upgrade: %v", err)
+	}
+	if v, err := userVersion(ctx, s.db); err != nil || v != SchemaVersion() {
+		t.Fatalf("expected version %d, got %d (%v)", SchemaVersion(), v, err)
+	}
+}
+
+func TestOpenRefusesNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `PRAGMA user_version = 999`); err != nil {
+		t.Fatalf("set user_version: %v", err)
+	}
+	s.Close()
+
+	if _, err := Open(ctx, path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+	if _, err := CheckSchema(ctx, path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew from CheckSchema, got %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := Open(ctx, filepath.Join(dir, "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.Write(ctx, testRecord(0)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	s.Close()
+
+	dest := filepath.Join(dir, "backup.sqlite")
+	if err := Backup(ctx, filepath.Join(dir, "audit.sqlite"), dest); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	b, err := Open(ctx, dest)
+	if err != nil {
+		t.Fatalf("Open backup: %v", err)
+	}
+	defer b.Close()
+	got, err := b.Query(ctx, Filter{})
+	if err != nil || len(got) != 1 {
+		t.Fatalf("expected 1 row in backup, got %d (%v)", len(got), err)
+	}
+}
@@ -0,0 +1,494 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The permissions table is a ledger of session/request_permission calls,
+// keyed by the correlation id of the request: the tool call the agent asked
+// about, the options it offered, and how and when the request was decided.
+
+const permissionsSchema = `
+CREATE TABLE IF NOT EXISTS permissions (
+  corr_id TEXT PRIMARY KEY,
+  conn_id TEXT,
+  session_id TEXT,
+  tool_call_id TEXT,
+  title TEXT,
+  tool_kind TEXT,
+  options TEXT,
+  requested_unix_ms INTEGER NOT NULL,
+  decided_unix_ms INTEGER,
+  decision_ms INTEGER,
+  outcome TEXT,
+  option_id TEXT,
+  option_kind TEXT,
+  decided_by TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_permissions_requested ON permissions(requested_unix_ms);
+CREATE INDEX IF NOT EXISTS idx_permissions_tool_call ON permissions(session_id, tool_call_id);`
+
+// Permission outcomes. A request without an outcome is still pending.
+const (
+	// PermissionSelected means the editor answered with one of the options.
+	PermissionSelected = "selected"
+	// PermissionCancelled means the editor answered with a cancelled outcome.
+	PermissionCancelled = "cancelled"
+	// PermissionFailed means the editor answered with an error.
+	PermissionFailed = "failed"
+	// PermissionAbandoned means the connection ended before an answer.
+	PermissionAbandoned = "abandoned"
+)
+
+// Deciders of a permission request.
+const (
+	// DecidedByUser means an option was picked in the editor, normally by
+	// the user in a prompt.
+	DecidedByUser = "user"
+	// DecidedBySessionCancel means the request was cancelled because the
+	// prompt turn was cancelled with session/cancel.
+	DecidedBySessionCancel = "session_cancel"
+	// DecidedByEditor means the editor cancelled or failed the request on
+	// its own.
+	DecidedByEditor = "editor"
+	// DecidedByDisconnect means the connection went away.
+	DecidedByDisconnect = "disconnect"
+)
+
+// Permission is one row of the permission ledger.
+type Permission struct {
+	CorrelationID string
+	ConnID        string
+	SessionID     string
+	ToolCallID    string
+	// Title and ToolKind come from the request, or from the tool call it
+	// refers to when the request leaves them out.
+	Title    string
+	ToolKind string
+	Options  []PermissionOption
+
+	Requested time.Time
+	// Decided is zero while the request is pending, or if it was abandoned
+	// in an audit trail recorded before the ledger existed.
+	Decided time.Time
+	// DecisionTime is the time from request to decision.
+	DecisionTime time.Duration
+	// Outcome is one of the Permission constants, or empty while pending.
+	Outcome    string
+	OptionID   string
+	OptionKind string
+	// DecidedBy is one of the DecidedBy constants.
+	DecidedBy string
+}
+
+// PermissionOption is an option offered by the agent.
+type PermissionOption struct {
+	ID   string `json:"optionId"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+// Selected returns the option that was picked, if any.
+func (p Permission) Selected() (PermissionOption, bool) {
+	for _, o := range p.Options {
+		if o.ID == p.OptionID && p.Outcome == PermissionSelected {
+			return o, true
+		}
+	}
+	return PermissionOption{}, false
+}
+
+// permissionUpdate records a permission request when Request is set, and
+// its outcome otherwise. At is 0 when the decision time is unknown.
+type permissionUpdate struct {
+	CorrID string
+	At     int64
+
+	Request                       bool
+	ConnID, SessionID, ToolCallID string
+	Title, ToolKind, Options      string
+	Outcome, OptionID             string
+}
+
+// permissionUpdates returns the ledger changes of r.
+func permissionUpdates(r Record) []permissionUpdate {
+	if r.Method != "session/request_permission" || r.IsNotify || r.CorrelationID == "" {
+		return nil
+	}
+	u := permissionUpdate{CorrID: r.CorrelationID, At: r.Timestamp.UnixMilli()}
+	switch {
+	case r.IsRequest:
+		var p struct {
+			SessionID string             `json:"sessionId"`
+			ToolCall  toolCallJSON       `json:"toolCall"`
+			Options   []PermissionOption `json:"options"`
+		}
+		if json.Unmarshal(r.Raw, &p) != nil {
+			return nil
+		}
+		u.Request = true
+		u.ConnID, u.SessionID = r.ConnID, p.SessionID
+		u.ToolCallID, u.Title, u.ToolKind = p.ToolCall.ToolCallID, p.ToolCall.Title, p.ToolCall.Kind
+		if p.Options == nil {
+			p.Options = []PermissionOption{}
+		}
+		u.Options = jsonString(p.Options)
+	case r.Error != nil:
+		u.Outcome = PermissionFailed
+	default:
+		var res struct {
+			Outcome struct {
+				Outcome  string `json:"outcome"`
+				OptionID string `json:"optionId"`
+			} `json:"outcome"`
+		}
+		if json.Unmarshal(r.Raw, &res) != nil || res.Outcome.Outcome == "" {
+			return nil
+		}
+		u.Outcome, u.OptionID = res.Outcome.Outcome, res.Outcome.OptionID
+	}
+	return []permissionUpdate{u}
+}
+
+func applyPermissions(ctx context.Context, db dbtx, ups []permissionUpdate) error {
+	for _, u := range ups {
+		if u.Request {
+			if _, err := db.ExecContext(ctx, `
+INSERT OR IGNORE INTO permissions(corr_id, conn_id, session_id, tool_call_id, title, tool_kind, options, requested_unix_ms)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?);
+`, u.CorrID, nullIfEmpty(u.ConnID), nullIfEmpty(u.SessionID), nullIfEmpty(u.ToolCallID), nullIfEmpty(u.Title),
+				nullIfEmpty(u.ToolKind), u.Options, u.At); err != nil {
+				return err
+			}
+			continue
+		}
+		var (
+			session, outcome sql.NullString
+			options          string
+			requested        int64
+		)
+		err := db.QueryRowContext(ctx, `SELECT session_id, options, requested_unix_ms, outcome FROM permissions WHERE corr_id = ?`,
+			u.CorrID).Scan(&session, &options, &requested, &outcome)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// A request abandoned because the agent went away also has an
+		// error response; the disconnect is the better explanation.
+		if outcome.Valid && !(u.Outcome == PermissionAbandoned && outcome.String == PermissionFailed) {
+			continue
+		}
+		var optionKind any
+		var offered []PermissionOption
+		_ = json.Unmarshal([]byte(options), &offered)
+		for _, o := range offered {
+			if u.Outcome == PermissionSelected && o.ID == u.OptionID {
+				optionKind = nullIfEmpty(o.Kind)
+			}
+		}
+		by := DecidedByEditor
+		switch u.Outcome {
+		case PermissionSelected:
+			by = DecidedByUser
+		case PermissionAbandoned:
+			by = DecidedByDisconnect
+		case PermissionCancelled:
+			var cancelled bool
+			if err := db.QueryRowContext(ctx, `
+SELECT EXISTS(SELECT 1 FROM audit_events
+WHERE session_id = ? AND method = 'session/cancel' AND is_notify = 1 AND ts_unix_ms >= ? AND ts_unix_ms <= ?)`,
+				session.String, requested, u.At).Scan(&cancelled); err != nil {
+				return err
+			}
+			if cancelled {
+				by = DecidedBySessionCancel
+			}
+		}
+		var decided, spent any
+		if u.At != 0 {
+			decided, spent = u.At, max(u.At-requested, 0)
+		}
+		if _, err := db.ExecContext(ctx, `
+UPDATE permissions SET decided_unix_ms = ?, decision_ms = ?, outcome = ?, option_id = ?, option_kind = ?, decided_by = ?
+WHERE corr_id = ?;
+`, decided, spent, u.Outcome, nullIfEmpty(u.OptionID), optionKind, by, u.CorrID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abandonPermission returns the update for a request finished with status.
+func abandonPermission(corrID string, status Status, at time.Time) []permissionUpdate {
+	if status != StatusAbandoned {
+		return nil
+	}
+	return []permissionUpdate{{CorrID: corrID, At: at.UnixMilli(), Outcome: PermissionAbandoned}}
+}
+
+// backfillPermissions derives the ledger from the plaintext events recorded
+// before it existed. The decision time of abandoned requests is unknown.
+func backfillPermissions(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+SELECT ts_unix_ms, corr_id, is_request, raw_json, error_code, error_message, status, conn_id FROM audit_events
+WHERE method = 'session/request_permission' AND corr_id IS NOT NULL AND is_notify = 0 AND key_id IS NULL
+ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var ups, abandoned []permissionUpdate
+	for rows.Next() {
+		var (
+			r             Record
+			ts            int64
+			isReq         int
+			raw           string
+			code          sql.NullInt64
+			msg, st, conn sql.NullString
+		)
+		if err := rows.Scan(&ts, &r.CorrelationID, &isReq, &raw, &code, &msg, &st, &conn); err != nil {
+			rows.Close()
+			return err
+		}
+		r.Method, r.Timestamp, r.IsRequest = "session/request_permission", time.UnixMilli(ts), isReq != 0
+		r.Raw, r.ConnID = []byte(raw), conn.String
+		if code.Valid {
+			r.Error = &RPCError{Code: int(code.Int64), Message: msg.String}
+		}
+		ups = append(ups, permissionUpdates(r)...)
+		if r.IsRequest && Status(st.String) == StatusAbandoned {
+			abandoned = append(abandoned, permissionUpdate{CorrID: r.CorrelationID, Outcome: PermissionAbandoned})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return applyPermissions(ctx, tx, append(ups, abandoned...))
+}
+
+// prunePermissions deletes the requests made before cutoff, as retention
+// does with their events.
+func prunePermissions(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM permissions WHERE requested_unix_ms < ?`, cutoff)
+	return err
+}
+
+// PermissionFilter selects permission requests. Zero-valued fields are
+// ignored.
+type PermissionFilter struct {
+	SessionID  string
+	ToolCallID string
+	// Outcome is one of the Permission constants, or "pending".
+	Outcome   string
+	DecidedBy string
+	// Since and Until bound the time of the request.
+	Since time.Time
+	Until time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f PermissionFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	for _, c := range []struct{ col, v string }{
+		{"p.session_id", f.SessionID}, {"p.tool_call_id", f.ToolCallID}, {"p.decided_by", f.DecidedBy},
+	} {
+		if c.v != "" {
+			conds = append(conds, c.col+" = ?")
+			args = append(args, c.v)
+		}
+	}
+	switch f.Outcome {
+	case "":
+	case "pending":
+		conds = append(conds, "p.outcome IS NULL")
+	default:
+		conds = append(conds, "p.outcome = ?")
+		args = append(args, f.Outcome)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "p.requested_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "p.requested_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// permissionsFrom joins the ledger with the tool calls it refers to.
+const permissionsFrom = `
+FROM permissions p LEFT JOIN tool_calls c ON c.session_id = p.session_id AND c.tool_call_id = p.tool_call_id`
+
+// Permissions returns the permission requests matching f in the order they
+// were made.
+func (s *Store) Permissions(ctx context.Context, f PermissionFilter) ([]Permission, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT p.corr_id, p.conn_id, p.session_id, p.tool_call_id, COALESCE(p.title, c.title), COALESCE(p.tool_kind, c.kind), p.options,
+  p.requested_unix_ms, p.decided_unix_ms, p.decision_ms, p.outcome, p.option_id, p.option_kind, p.decided_by`+permissionsFrom+where+`
+ORDER BY p.requested_unix_ms, p.corr_id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Permission
+	for rows.Next() {
+		var (
+			p                                        Permission
+			conn, session, toolCall, title, kind     sql.NullString
+			options                                  string
+			requested                                int64
+			decided, spent                           sql.NullInt64
+			outcome, optionID, optionKind, decidedBy sql.NullString
+		)
+		if err := rows.Scan(&p.CorrelationID, &conn, &session, &toolCall, &title, &kind, &options,
+			&requested, &decided, &spent, &outcome, &optionID, &optionKind, &decidedBy); err != nil {
+			return nil, err
+		}
+		p.ConnID, p.SessionID, p.ToolCallID, p.Title, p.ToolKind = conn.String, session.String, toolCall.String, title.String, kind.String
+		_ = json.Unmarshal([]byte(options), &p.Options)
+		p.Requested = time.UnixMilli(requested)
+		if decided.Valid {
+			p.Decided = time.UnixMilli(decided.Int64)
+		}
+		p.DecisionTime = time.Duration(spent.Int64) * time.Millisecond
+		p.Outcome, p.OptionID, p.OptionKind, p.DecidedBy = outcome.String, optionID.String, optionKind.String, decidedBy.String
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// PermissionStats counts the permission requests of one tool.
+type PermissionStats struct {
+	Tool     string
+	Requests int
+	// Selected counts the options picked by kind (allow_once,
+	// allow_always, reject_once, reject_always).
+	Selected  map[string]int
+	Cancelled int
+	Failed    int
+	Abandoned int
+	Pending   int
+	// AvgDecision is the mean time users took to pick an option.
+	AvgDecision time.Duration
+}
+
+// Approvals returns how many selections allowed the tool call.
+func (ps PermissionStats) Approvals() int {
+	return ps.Selected["allow_once"] + ps.Selected["allow_always"]
+}
+
+// PermissionReport groups the permission requests matching f by tool and
+// returns the tools that triggered the most requests first, along with
+// the totals over all tools. by is "kind" to group by tool kind or "title" to group by
+// tool call title; requests that do not say fall back to the tool call.
+func (s *Store) PermissionReport(ctx context.Context, f PermissionFilter, by string) ([]PermissionStats, PermissionStats, error) {
+	if s == nil || s.db == nil {
+		return nil, PermissionStats{}, fmt.Errorf("audit store not initialized")
+	}
+	var key string
+	switch by {
+	case "", "kind":
+		key = "COALESCE(p.tool_kind, c.kind, '')"
+	case "title":
+		key = "COALESCE(p.title, c.title, '')"
+	default:
+		return nil, PermissionStats{}, fmt.Errorf("unknown grouping %q (want kind or title)", by)
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT `+key+`, p.outcome, p.option_kind, COUNT(*), SUM(CASE WHEN p.decided_by = 'user' THEN p.decision_ms ELSE 0 END)`+
+		permissionsFrom+where+`
+GROUP BY 1, 2, 3`, args...)
+	if err != nil {
+		return nil, PermissionStats{}, err
+	}
+	defer rows.Close()
+
+	total := PermissionStats{Selected: map[string]int{}}
+	var totalMs int64
+	byTool := map[string]*PermissionStats{}
+	userMs := map[string]int64{}
+	var order []string
+	for rows.Next() {
+		var (
+			tool                string
+			outcome, optionKind sql.NullString
+			n                   int
+			ms                  sql.NullInt64
+		)
+		if err := rows.Scan(&tool, &outcome, &optionKind, &n, &ms); err != nil {
+			return nil, PermissionStats{}, err
+		}
+		ps := byTool[tool]
+		if ps == nil {
+			ps = &PermissionStats{Tool: tool, Selected: map[string]int{}}
+			byTool[tool] = ps
+			order = append(order, tool)
+		}
+		userMs[tool] += ms.Int64
+		totalMs += ms.Int64
+		for _, st := range []*PermissionStats{ps, &total} {
+			st.Requests += n
+			switch outcome.String {
+			case PermissionSelected:
+				st.Selected[optionKind.String] += n
+			case PermissionCancelled:
+				st.Cancelled += n
+			case PermissionFailed:
+				st.Failed += n
+			case PermissionAbandoned:
+				st.Abandoned += n
+			default:
+				st.Pending += n
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, PermissionStats{}, err
+	}
+
+	avg := func(ms int64, ps *PermissionStats) {
+		picked := 0
+		for _, n := range ps.Selected {
+			picked += n
+		}
+		if picked > 0 {
+			ps.AvgDecision = time.Duration(ms/int64(picked)) * time.Millisecond
+		}
+	}
+	out := make([]PermissionStats, 0, len(order))
+	for _, tool := range order {
+		avg(userMs[tool], byTool[tool])
+		out = append(out, *byTool[tool])
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Requests != out[j].Requests {
+			return out[i].Requests > out[j].Requests
+		}
+		return out[i].Tool < out[j].Tool
+	})
+	avg(totalMs, &total)
+	return out, total, nil
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const permissionOptions = `"options":[{"optionId":"once","name":"Allow","kind":"allow_once"},{"optionId":"always","name":"Always","kind":"allow_always"},{"optionId":"no","name":"Reject","kind":"reject_once"}]`
+
+// permissionRecords is the trail of four permission requests: one allowed
+// always, one cancelled by session/cancel, one the editor failed and one
+// still open.
+func permissionRecords(base time.Time) []Record {
+	down, up := DirectionDownstreamToUpstream, DirectionUpstreamToDownstream
+	ask := func(corr, call, title string) Record {
+		return Record{Direction: down, SessionID: "s1", Method: "session/request_permission", IsRequest: true, CorrelationID: corr, ConnID: "c1",
+			Status: StatusPending, Raw: []byte(`{"sessionId":"s1","toolCall":{"toolCallId":"` + call + `","title":"` + title + `"},` + permissionOptions + `}`)}
+	}
+	answer := func(corr, raw string) Record {
+		return Record{Direction: up, SessionID: "s1", Method: "session/request_permission", CorrelationID: corr, ConnID: "c1", Raw: []byte(raw)}
+	}
+	records := []Record{
+		{Direction: down, SessionID: "s1", Method: "session/update", IsNotify: true, ConnID: "c1",
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call","toolCallId":"t1","title":"Edit main.go","kind":"edit"}}`)},
+		ask("c1-1", "t1", "Edit main.go"),
+		answer("c1-1", `{"outcome":{"outcome":"selected","optionId":"always"}}`),
+		ask("c1-2", "t2", "Run make"),
+		{Direction: up, SessionID: "s1", Method: "session/cancel", IsNotify: true, CorrelationID: "c1-3", ConnID: "c1", Raw: []byte(`{"sessionId":"s1"}`)},
+		answer("c1-2", `{"outcome":{"outcome":"cancelled"}}`),
+		ask("c1-4", "t3", "Run make"),
+		{Direction: up, SessionID: "s1", Method: "session/request_permission", CorrelationID: "c1-4", ConnID: "c1",
+			Error: &RPCError{Code: -32603, Message: "dialog closed"}},
+		ask("c1-5", "t4", "Run make"),
+	}
+	for i := range records {
+		records[i].Timestamp = base.Add(time.Duration(i) * time.Second)
+	}
+	return records
+}
+
+func TestPermissions(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	if err := s.StartWriter(WriterOptions{}); err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	base := time.UnixMilli(time.Now().Add(-time.Hour).UnixMilli())
+	for _, r := range permissionRecords(base) {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	perms, err := s.Permissions(ctx, PermissionFilter{})
+	if err != nil {
+		t.Fatalf("Permissions: %v", err)
+	}
+	if len(perms) != 4 {
+		t.Fatalf("expected 4 requests, got %+v", perms)
+	}
+	allowed := perms[0]
+	if allowed.ToolCallID != "t1" || allowed.ToolKind != "edit" || len(allowed.Options) != 3 || allowed.ConnID != "c1" {
+		t.Fatalf("unexpected request: %+v", allowed)
+	}
+	if o, ok := allowed.Selected(); !ok || o.Kind != "allow_always" || allowed.OptionKind != "allow_always" || allowed.DecidedBy != DecidedByUser {
+		t.Fatalf("unexpected decision: %+v", allowed)
+	}
+	if !allowed.Decided.Equal(base.Add(2*time.Second)) || allowed.DecisionTime != time.Second {
+		t.Fatalf("unexpected decision time: %+v", allowed)
+	}
+	for i, want := range []struct{ outcome, by string }{
+		{PermissionCancelled, DecidedBySessionCancel},
+		{PermissionFailed, DecidedByEditor},
+		{"", ""},
+	} {
+		if p := perms[i+1]; p.Outcome != want.outcome || p.DecidedBy != want.by {
+			t.Fatalf("request %s: outcome %q by %q, want %q by %q", p.CorrelationID, p.Outcome, p.DecidedBy, want.outcome, want.by)
+		}
+	}
+
+	// The connection goes away before the last request is answered.
+	if err := s.Finish(ctx, "c1-5", StatusAbandoned); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got, _ := s.Permissions(ctx, PermissionFilter{Outcome: PermissionAbandoned}); len(got) != 1 || got[0].DecidedBy != DecidedByDisconnect || got[0].Decided.IsZero() {
+		t.Fatalf("unexpected abandoned requests: %+v", got)
+	}
+	if got, _ := s.Permissions(ctx, PermissionFilter{Outcome: "pending"}); len(got) != 0 {
+		t.Fatalf("unexpected pending requests: %+v", got)
+	}
+
+	tools, total, err := s.PermissionReport(ctx, PermissionFilter{}, "title")
+	if err != nil {
+		t.Fatalf("PermissionReport: %v", err)
+	}
+	if len(tools) != 2 || tools[0].Tool != "Run make" || tools[0].Requests != 3 || tools[1].Selected["allow_always"] != 1 {
+		t.Fatalf("unexpected report: %+v", tools)
+	}
+	if total.Requests != 4 || total.Approvals() != 1 || total.Cancelled != 1 || total.Failed != 1 || total.Abandoned != 1 || total.AvgDecision != time.Second {
+		t.Fatalf("unexpected totals: %+v", total)
+	}
+	if _, _, err := s.PermissionReport(ctx, PermissionFilter{}, "agent"); err == nil {
+		t.Fatalf("expected an error for an unknown grouping")
+	}
+}
+
+func TestPermissionsBackfill(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	base := time.UnixMilli(time.Now().Add(-time.Hour).UnixMilli())
+	for _, r := range permissionRecords(base) {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Finish(ctx, "c1-5", StatusAbandoned); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	s = reopenBefore(t, s, path, "permission ledger", `DROP TABLE permissions`)
+	perms, err := s.Permissions(ctx, PermissionFilter{})
+	if err != nil {
+		t.Fatalf("Permissions: %v", err)
+	}
+	if len(perms) != 4 {
+		t.Fatalf("expected 4 requests, got %+v", perms)
+	}
+	for i, want := range []struct{ outcome, by string }{
+		{PermissionSelected, DecidedByUser},
+		{PermissionCancelled, DecidedBySessionCancel},
+		{PermissionFailed, DecidedByEditor},
+		{PermissionAbandoned, DecidedByDisconnect},
+	} {
+		if p := perms[i]; p.Outcome != want.outcome || p.DecidedBy != want.by {
+			t.Fatalf("request %s: outcome %q by %q, want %q by %q", p.CorrelationID, p.Outcome, p.DecidedBy, want.outcome, want.by)
+		}
+	}
+	if perms[0].DecisionTime != time.Second || !perms[3].Decided.IsZero() {
+		t.Fatalf("unexpected decision times: %+v", perms)
+	}
+}
@@ -0,0 +1,291 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Filter selects audit events. Zero-valued fields are ignored.
+type Filter struct {
+	SessionID string
+	Method    string
+	Direction Direction
+	Since     time.Time
+	Until     time.Time
+
+	// CorrelationID selects the rows of a single call.
+	CorrelationID string
+	// ConnID selects the rows of one connection.
+	ConnID string
+	// Status selects request rows in the given lifecycle state.
+	Status Status
+
+	// ErrorsOnly restricts the result to rows carrying a JSON-RPC error.
+	ErrorsOnly bool
+
+	// Limit caps the number of returned rows (0 means no limit).
+	Limit  int
+	Offset int
+}
+
+// SessionSummary aggregates the events recorded for one session.
+type SessionSummary struct {
+	SessionID string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Events    int
+	Prompts   int
+	Errors    int
+}
+
+func (f Filter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.SessionID != "" {
+		conds = append(conds, "session_id = ?")
+		args = append(args, f.SessionID)
+	}
+	if f.Method != "" {
+		conds = append(conds, "method = ?")
+		args = append(args, f.Method)
+	}
+	if f.Direction != "" {
+		conds = append(conds, "direction = ?")
+		args = append(args, string(f.Direction))
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "ts_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "ts_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if f.CorrelationID != "" {
+		conds = append(conds, "corr_id = ?")
+		args = append(args, f.CorrelationID)
+	}
+	if f.ConnID != "" {
+		conds = append(conds, "conn_id = ?")
+		args = append(args, f.ConnID)
+	}
+	if f.Status != "" {
+		conds = append(conds, "status = ?")
+		args = append(args, string(f.Status))
+	}
+	if f.ErrorsOnly {
+		conds = append(conds, "error_code IS NOT NULL")
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (f Filter) page() string {
+	if f.Limit <= 0 && f.Offset <= 0 {
+		return ""
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", limit, f.Offset)
+}
+
+// Query returns the events matching f in the order they were written.
+func (s *Store) Query(ctx context.Context, f Filter) ([]Record, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+recordColumns+` FROM audit_events`+where+` ORDER BY id`+f.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Record
+	for rows.Next() {
+		r, err := s.scanRecord(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+const recordColumns = `id, ts_unix_ms, direction, session_id, method, is_request, is_notify, rpc_id, raw_json, user_text, agent_text,
+  error_code, error_message, error_data, corr_id, seq, latency_ms, status, key_id, conn_id`
+
+// scanRecord scans a row selected with recordColumns, followed by extra.
+func (s *Store) scanRecord(ctx context.Context, rows *sql.Rows, extra ...any) (Record, error) {
+	var (
+		r                          Record
+		ts                         int64
+		dir                        string
+		isReq, isNotify            int
+		sid, method, rpcID, ut, at sql.NullString
+		raw                        string
+		errCode                    sql.NullInt64
+		errMsg, errData, corrID    sql.NullString
+		seq, latency               sql.NullInt64
+		status, keyID, connID      sql.NullString
+	)
+	dest := []any{&r.RowID, &ts, &dir, &sid, &method, &isReq, &isNotify, &rpcID, &raw, &ut, &at,
+		&errCode, &errMsg, &errData, &corrID, &seq, &latency, &status, &keyID, &connID}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return r, err
+	}
+	r.Timestamp = time.UnixMilli(ts)
+	r.Direction = Direction(dir)
+	r.SessionID = sid.String
+	r.Method = method.String
+	r.IsRequest = isReq != 0
+	r.IsNotify = isNotify != 0
+	if rpcID.Valid {
+		r.ID = []byte(rpcID.String)
+	}
+	r.Raw = []byte(raw)
+	r.UserText = ut.String
+	r.AgentText = at.String
+	r.CorrelationID = corrID.String
+	r.Seq = seq.Int64
+	r.ConnID = connID.String
+	r.Latency = time.Duration(latency.Int64) * time.Millisecond
+	r.Status = Status(status.String)
+	if errCode.Valid {
+		r.Error = &RPCError{Code: int(errCode.Int64), Message: errMsg.String}
+		if errData.Valid {
+			r.Error.Data = []byte(errData.String)
+		}
+	}
+	if keyID.Valid {
+		r.KeyID = keyID.String
+		s.decrypt(ctx, &r)
+	}
+	return r, nil
+}
+
+// Sessions summarizes every session with at least one event matching f.
+// Sessions are ordered by most recent activity first.
+func (s *Store) Sessions(ctx context.Context, f Filter) ([]SessionSummary, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	f.SessionID = ""
+	where, args := f.where()
+	if where == "" {
+		where = " WHERE session_id IS NOT NULL"
+	} else {
+		where += " AND session_id IS NOT NULL"
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT session_id, MIN(ts_unix_ms), MAX(ts_unix_ms), COUNT(*),
+  SUM(CASE WHEN method = 'session/prompt' AND is_request = 1 THEN 1 ELSE 0 END),
+  SUM(CASE WHEN error_code IS NOT NULL THEN 1 ELSE 0 END)
+FROM audit_events`+where+`
+GROUP BY session_id
+ORDER BY MAX(ts_unix_ms) DESC`+f.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []SessionSummary
+	for rows.Next() {
+		var (
+			sum         SessionSummary
+			first, last int64
+		)
+		if err := rows.Scan(&sum.SessionID, &first, &last, &sum.Events, &sum.Prompts, &sum.Errors); err != nil {
+			return nil, err
+		}
+		sum.FirstSeen = time.UnixMilli(first)
+		sum.LastSeen = time.UnixMilli(last)
+		out = append(out, sum)
+	}
+	return out, rows.Err()
+}
+
+// Call pairs a request row with its response row.
+type Call struct {
+	Request Record
+	// Response is nil while the call has no recorded response.
+	Response *Record
+}
+
+// Latency returns the recorded round-trip time, or 0 if there is no response.
+func (c Call) Latency() time.Duration {
+	if c.Response == nil {
+		return 0
+	}
+	return c.Response.Latency
+}
+
+// Calls returns the correlated requests matching f, each paired with its
+// response. Filter fields apply to the request rows.
+func (s *Store) Calls(ctx context.Context, f Filter) ([]Call, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	if where == "" {
+		where = " WHERE is_request = 1 AND corr_id IS NOT NULL"
+	} else {
+		where += " AND is_request = 1 AND corr_id IS NOT NULL"
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+recordColumns+` FROM audit_events`+where+` ORDER BY id`+f.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	var calls []Call
+	index := map[string]int{}
+	for rows.Next() {
+		r, err := s.scanRecord(ctx, rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[r.CorrelationID] = len(calls)
+		calls = append(calls, Call{Request: r})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Fetch responses in batches to stay below SQLite's variable limit.
+	const batch = 500
+	for start := 0; start < len(calls); start += batch {
+		end := min(start+batch, len(calls))
+		ids := make([]any, 0, end-start)
+		for _, c := range calls[start:end] {
+			ids = append(ids, c.Request.CorrelationID)
+		}
+		rows, err := s.db.QueryContext(ctx, `SELECT `+recordColumns+` FROM audit_events
+WHERE is_request = 0 AND is_notify = 0 AND corr_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, ids...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			r, err := s.scanRecord(ctx, rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if i, ok := index[r.CorrelationID]; ok {
+				calls[i].Response = &r
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return calls, nil
+}
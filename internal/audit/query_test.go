@@ -0,0 +1,303 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"acp-gate/internal/redact"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(context.Background(), filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestQueryFilters(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	base := time.UnixMilli(1_700_000_000_000)
+
+	records := []Record{
+		{Timestamp: base, Direction: DirectionUpstreamToDownstream, SessionID: "a", Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`), UserText: "hello"},
+		{Timestamp: base.Add(time.Second), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/update", IsNotify: true, Raw: []byte(`{}`), AgentText: "hi"},
+		{Timestamp: base.Add(2 * time.Second), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/prompt", Raw: []byte(`{}`)},
+		{Timestamp: base.Add(3 * time.Second), Direction: DirectionUpstreamToDownstream, SessionID: "b", Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`)},
+	}
+	for _, r := range records {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	got, err := s.Query(ctx, Filter{SessionID: "a"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 3 || got[0].UserText != "hello" || got[1].AgentText != "hi" || !got[1].IsNotify {
+		t.Fatalf("unexpected session a events: %+v", got)
+	}
+	if got[0].RowID == 0 || got[0].RowID >= got[1].RowID {
+		t.Fatalf("expected increasing row ids, got %d, %d", got[0].RowID, got[1].RowID)
+	}
+
+	got, err = s.Query(ctx, Filter{Method: "session/prompt", Direction: DirectionUpstreamToDownstream})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 prompt requests, got %d", len(got))
+	}
+
+	got, err = s.Query(ctx, Filter{Since: base.Add(time.Second), Until: base.Add(3 * time.Second)})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 || got[0].Method != "session/update" {
+		t.Fatalf("unexpected time range result: %+v", got)
+	}
+
+	got, err = s.Query(ctx, Filter{Limit: 2, Offset: 1})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 || got[0].Method != "session/update" {
+		t.Fatalf("unexpected page: %+v", got)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	base := time.UnixMilli(1_700_000_000_000)
+
+	for i, sid := range []string{"a", "a", "b", ""} {
+		r := Record{Timestamp: base.Add(time.Duration(i) * time.Second), Direction: DirectionUpstreamToDownstream, SessionID: sid, Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`)}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	got, err := s.Sessions(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Sessions: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", got)
+	}
+	if got[0].SessionID != "b" || got[1].SessionID != "a" {
+		t.Fatalf("expected most recent session first, got %+v", got)
+	}
+	if got[1].Events != 2 || got[1].Prompts != 2 || !got[1].FirstSeen.Equal(base) {
+		t.Fatalf("unexpected summary for a: %+v", got[1])
+	}
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+
+	ok := Record{Timestamp: time.Now(), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/prompt", Raw: []byte(`{"stopReason":"end_turn"}`)}
+	failed := Record{Timestamp: time.Now(), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/prompt", Raw: []byte(`{"code":-32602}`),
+		Error: &RPCError{Code: -32602, Message: "Invalid params", Data: []byte(`{"why":"x"}`)}}
+	for _, r := range []Record{ok, failed} {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	got, err := s.Query(ctx, Filter{ErrorsOnly: true})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 1 || got[0].Error == nil {
+		t.Fatalf("expected one failed row, got %+v", got)
+	}
+	if e := got[0].Error; e.Code != -32602 || e.Message != "Invalid params" || string(e.Data) != `{"why":"x"}` {
+		t.Fatalf("unexpected error: %+v", e)
+	}
+
+	sessions, err := s.Sessions(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Sessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Errors != 1 {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestOpenUpgradesLegacySchema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "legacy.sqlite")
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	_, err = db.ExecContext(ctx, `
+CREATE TABLE audit_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  ts_unix_ms INTEGER NOT NULL,
+  direction TEXT NOT NULL,
+  session_id TEXT,
+  method TEXT,
+  is_request INTEGER NOT NULL,
+  is_notify INTEGER NOT NULL,
+  rpc_id TEXT,
+  raw_json TEXT NOT NULL,
+  user_text TEXT,
+  agent_text TEXT
+);
+INSERT INTO audit_events(ts_unix_ms, direction, session_id, method, is_request, is_notify, raw_json)
+VALUES (1, 'upstream_to_downstream', 'old', 'session/prompt', 1, 0, '{}');`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("create legacy schema: %v", err)
+	}
+
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open legacy DB: %v", err)
+	}
+	defer s.Close()
+	if err := s.Write(ctx, Record{Timestamp: time.Now(), Direction: DirectionDownstreamToUpstream, Raw: []byte(`{}`), Error: &RPCError{Code: 1}}); err != nil {
+		t.Fatalf("Write after upgrade: %v", err)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 || got[0].SessionID != "old" || got[1].Error == nil {
+		t.Fatalf("unexpected rows after upgrade: %+v", got)
+	}
+}
+
+func TestCallsPairsRequestsWithResponses(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	base := time.UnixMilli(1_700_000_000_000)
+
+	records := []Record{
+		{Timestamp: base, Direction: DirectionUpstreamToDownstream, SessionID: "a", Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`), CorrelationID: "c-1", Seq: 1},
+		{Timestamp: base.Add(time.Second), Direction: DirectionUpstreamToDownstream, SessionID: "a", Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`), CorrelationID: "c-2", Seq: 2},
+		{Timestamp: base.Add(2 * time.Second), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/update", IsNotify: true, Raw: []byte(`{}`), CorrelationID: "d-1", Seq: 1},
+		{Timestamp: base.Add(3 * time.Second), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/prompt", Raw: []byte(`{}`), CorrelationID: "c-1", Seq: 1, Latency: 3 * time.Second},
+	}
+	for _, r := range records {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	calls, err := s.Calls(ctx, Filter{SessionID: "a"})
+	if err != nil {
+		t.Fatalf("Calls: %v", err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got %+v", calls)
+	}
+	if calls[0].Response == nil || calls[0].Latency() != 3*time.Second || calls[0].Response.Seq != 1 {
+		t.Fatalf("unexpected first call: %+v", calls[0])
+	}
+	if calls[1].Request.CorrelationID != "c-2" || calls[1].Response != nil {
+		t.Fatalf("expected second call without response, got %+v", calls[1])
+	}
+
+	rows, err := s.Query(ctx, Filter{CorrelationID: "c-1"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(rows) != 2 || !rows[0].IsRequest || rows[1].IsRequest {
+		t.Fatalf("unexpected rows for c-1: %+v", rows)
+	}
+}
+
+func TestFinishUpdatesPendingRequests(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"c-1", "c-2"} {
+		r := Record{Timestamp: time.Now(), Direction: DirectionUpstreamToDownstream, Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`), CorrelationID: id, Status: StatusPending}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Finish(ctx, "c-1", StatusCompleted); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if err := s.Finish(ctx, "c-2", StatusAbandoned); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	// A late response must not overwrite a request that was already abandoned.
+	if err := s.Finish(ctx, "c-2", StatusCompleted); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 || got[0].Status != StatusCompleted || got[1].Status != StatusAbandoned {
+		t.Fatalf("unexpected statuses: %+v", got)
+	}
+
+	pending, err := s.Query(ctx, Filter{Status: StatusAbandoned})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(pending) != 1 || pending[0].CorrelationID != "c-2" {
+		t.Fatalf("unexpected status filter result: %+v", pending)
+	}
+}
+
+func TestWriteRedacts(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	red, err := redact.New(redact.Options{Paths: []redact.PathRule{{Method: "authenticate", Path: "$.methodId"}}})
+	if err != nil {
+		t.Fatalf("redact.New: %v", err)
+	}
+	s.SetRedactor(red)
+
+	const key = "sk-ant-REDACTED"
+	errData := []byte(`{"detail":"bad key ` + key + `"}`)
+	records := []Record{
+		{Timestamp: time.Now(), Direction: DirectionUpstreamToDownstream, SessionID: "a", Method: "session/prompt", IsRequest: true,
+			Raw: []byte(`{"prompt":[{"type":"text","text":"my key is ` + key + `"}]}`), UserText: "my key is " + key},
+		{Timestamp: time.Now(), Direction: DirectionUpstreamToDownstream, Method: "authenticate", IsRequest: true, Raw: []byte(`{"methodId":"hunter2"}`)},
+		{Timestamp: time.Now(), Direction: DirectionDownstreamToUpstream, Method: "session/prompt", Raw: []byte(`{}`), Error: &RPCError{Code: 1, Message: key, Data: errData}},
+	}
+	for _, r := range records {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if !strings.Contains(string(records[2].Error.Data), key) {
+		t.Fatalf("Write modified the caller's error")
+	}
+
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	for _, r := range got {
+		all := string(r.Raw) + r.UserText + r.AgentText
+		if r.Error != nil {
+			all += r.Error.Message + string(r.Error.Data)
+		}
+		if strings.Contains(all, key) || strings.Contains(all, "hunter2") {
+			t.Fatalf("secret persisted: %+v", r)
+		}
+	}
+	if !strings.Contains(got[0].UserText, "[REDACTED:api_key:") {
+		t.Fatalf("expected placeholder in user text, got %q", got[0].UserText)
+	}
+}
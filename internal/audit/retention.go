@@ -0,0 +1,275 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Retention limits how much audit history is kept. Zero fields are not
+// enforced.
+type Retention struct {
+	// MaxAge deletes events older than this, including their extracted
+	// text, and the rows derived from them: tool calls, permissions, file
+	// changes, terminals, turns and attachments, sessions last active and
+	// connections ended before then. Events are deleted oldest id first,
+	// so an event that was written slightly out of timestamp order may go
+	// with its neighbours.
+	MaxAge time.Duration
+	// RawMaxAge clears raw_json on events older than this while keeping
+	// the rest of the row, including the extracted user/agent text.
+	RawMaxAge time.Duration
+	// MaxRows keeps at most this many of the newest events. Derived rows
+	// older than the oldest event left are deleted with them.
+	MaxRows int64
+	// MaxBytes deletes the oldest events, and derived rows as for MaxRows,
+	// until the data in the database file fits in this many bytes. Prune
+	// fails if it does not fit with every event deleted.
+	MaxBytes int64
+}
+
+// IsZero reports whether r enforces nothing.
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// PruneResult summarizes one Prune run.
+type PruneResult struct {
+	Deleted  int64 // events deleted
+	Stripped int64 // events whose raw_json was cleared
+	Freed    int64 // bytes returned to the file system by vacuuming
+}
+
+// PruneOptions controls how Prune reclaims space.
+type PruneOptions struct {
+	// Vacuum converts a database created without incremental auto-vacuum
+	// with a full VACUUM, which rewrites the whole file. Databases that
+	// already use incremental vacuum are always vacuumed incrementally.
+	Vacuum bool
+}
+
+// pruneChunk bounds the number of events deleted per statement while
+// enforcing MaxBytes.
+const pruneChunk = 1000
+
+// Prune enforces r relative to now, then releases the freed pages.
+func (s *Store) Prune(ctx context.Context, r Retention, now time.Time, opts PruneOptions) (PruneResult, error) {
+	var res PruneResult
+	err := s.exclusive(ctx, func(db *sql.DB) error {
+		var err error
+		res, err = prune(ctx, db, r, now, opts)
+		return err
+	})
+	return res, err
+}
+
+func prune(ctx context.Context, db *sql.DB, r Retention, now time.Time, opts PruneOptions) (PruneResult, error) {
+	var res PruneResult
+	exec := func(query string, args ...any) (int64, error) {
+		out, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return out.RowsAffected()
+	}
+	// Events are only ever deleted as a prefix of the table, so that what
+	// is left still forms one hash chain; see deleteThrough.
+	deleteUpTo := func(query string, args ...any) (int64, error) {
+		var cut sql.NullInt64
+		err := db.QueryRowContext(ctx, query, args...).Scan(&cut)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !cut.Valid) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return deleteThrough(ctx, db, cut.Int64)
+	}
+
+	if r.MaxAge > 0 {
+		cutoff := now.Add(-r.MaxAge).UnixMilli()
+		n, err := deleteUpTo(`SELECT MAX(id) FROM audit_events WHERE ts_unix_ms < ?`, cutoff)
+		if err != nil {
+			return res, err
+		}
+		res.Deleted += n
+		if err := pruneDerived(ctx, db, cutoff); err != nil {
+			return res, err
+		}
+	}
+	if r.RawMaxAge > 0 {
+		cutoff := now.Add(-r.RawMaxAge).UnixMilli()
+		n, err := exec(`UPDATE audit_events SET raw_json = '' WHERE ts_unix_ms < ? AND raw_json <> ''`, cutoff)
+		if err != nil {
+			return res, err
+		}
+		res.Stripped += n
+		// Raw tool input and output, file diffs, terminal output and the
+		// text of attached resources are copies of raw_json.
+		if _, err := exec(`UPDATE tool_calls SET raw_input = NULL, raw_output = NULL
+WHERE updated_unix_ms < ? AND (raw_input IS NOT NULL OR raw_output IS NOT NULL)`, cutoff); err != nil {
+			return res, err
+		}
+		if _, err := exec(`UPDATE file_changes SET diff = NULL WHERE ts_unix_ms < ? AND diff IS NOT NULL`, cutoff); err != nil {
+			return res, err
+		}
+		if _, err := exec(`DELETE FROM terminal_output WHERE ts_unix_ms < ?`, cutoff); err != nil {
+			return res, err
+		}
+		if _, err := exec(`UPDATE attachments SET text = NULL WHERE ts_unix_ms < ? AND text IS NOT NULL`, cutoff); err != nil {
+			return res, err
+		}
+	}
+	if r.MaxRows > 0 {
+		n, err := deleteUpTo(`SELECT id FROM audit_events ORDER BY id DESC LIMIT 1 OFFSET ?`, r.MaxRows)
+		if err != nil {
+			return res, err
+		}
+		res.Deleted += n
+		if n > 0 {
+			if err := pruneBeforeEvents(ctx, db); err != nil {
+				return res, err
+			}
+		}
+	}
+	if r.MaxBytes > 0 {
+		// emptied is set once every event and derived row is gone.
+		emptied := false
+		for {
+			used, err := usedBytes(ctx, db)
+			if err != nil {
+				return res, err
+			}
+			if used <= r.MaxBytes {
+				break
+			}
+			n, err := deleteUpTo(`SELECT MAX(id) FROM (SELECT id FROM audit_events ORDER BY id LIMIT ?)`, pruneChunk)
+			if err != nil {
+				return res, err
+			}
+			if n == 0 && emptied {
+				return res, fmt.Errorf("audit DB still holds %d bytes with every event deleted, over the limit of %d", used, r.MaxBytes)
+			}
+			emptied = n == 0
+			res.Deleted += n
+			if err := pruneBeforeEvents(ctx, db); err != nil {
+				return res, err
+			}
+			if err := pruneBlobs(ctx, db); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := pruneBlobs(ctx, db); err != nil {
+		return res, err
+	}
+
+	before, err := fileBytes(ctx, db)
+	if err != nil {
+		return res, err
+	}
+	var mode int
+	if err := db.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return res, err
+	}
+	switch {
+	case mode == 2: // incremental
+		err = incrementalVacuum(ctx, db)
+	case opts.Vacuum:
+		// Switching to incremental takes effect with the next VACUUM.
+		if _, err = db.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err == nil {
+			_, err = db.ExecContext(ctx, `VACUUM`)
+		}
+	}
+	if err != nil {
+		return res, err
+	}
+	after, err := fileBytes(ctx, db)
+	if err != nil {
+		return res, err
+	}
+	res.Freed = before - after
+	return res, nil
+}
+
+// pruneDerived deletes the rows derived from events older than cutoff.
+func pruneDerived(ctx context.Context, db execer, cutoff int64) error {
+	for _, prune := range []func(context.Context, execer, int64) error{
+		pruneToolCalls, prunePermissions, pruneFileChanges, pruneTerminals, pruneTurns, pruneAttachments,
+		pruneSessions, pruneConnections,
+	} {
+		if err := prune(ctx, db, cutoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBeforeEvents deletes the derived rows older than the oldest event
+// left, or all of them if no event is left.
+func pruneBeforeEvents(ctx context.Context, db *sql.DB) error {
+	var oldest sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MIN(ts_unix_ms) FROM audit_events`).Scan(&oldest); err != nil {
+		return err
+	}
+	cutoff := int64(math.MaxInt64)
+	if oldest.Valid {
+		cutoff = oldest.Int64
+	}
+	return pruneDerived(ctx, db, cutoff)
+}
+
+// incrementalVacuum frees every page on the free list. The pragma frees
+// one page per result row, so the rows have to be read to the end.
+func incrementalVacuum(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `PRAGMA incremental_vacuum`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	return rows.Err()
+}
+
+// usedBytes is the size of the pages holding data, excluding free pages.
+func usedBytes(ctx context.Context, db *sql.DB) (int64, error) {
+	var n int64
+	err := db.QueryRowContext(ctx, `
+SELECT (p.page_count - f.freelist_count) * s.page_size
+FROM pragma_page_count() p, pragma_freelist_count() f, pragma_page_size() s`).Scan(&n)
+	return n, err
+}
+
+func fileBytes(ctx context.Context, db *sql.DB) (int64, error) {
+	var n int64
+	err := db.QueryRowContext(ctx, `SELECT p.page_count * s.page_size FROM pragma_page_count() p, pragma_page_size() s`).Scan(&n)
+	return n, err
+}
+
+// EnforceRetention prunes the store every interval until ctx is done,
+// passing each outcome to report.
+func (s *Store) EnforceRetention(ctx context.Context, r Retention, interval time.Duration, report func(PruneResult, error)) {
+	if r.IsZero() || interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		res, err := s.Prune(ctx, r, time.Now(), PruneOptions{})
+		if ctx.Err() != nil {
+			return
+		}
+		if report != nil {
+			report(res, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
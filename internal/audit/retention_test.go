@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeAged(t *testing.T, s *Store, now time.Time, ages ...time.Duration) {
+	t.Helper()
+	for _, age := range ages {
+		r := Record{Timestamp: now.Add(-age), Direction: DirectionUpstreamToDownstream, SessionID: "a", Method: "session/prompt", IsRequest: true, Raw: []byte(`{"prompt":"secret"}`), UserText: "secret"}
+		if err := s.Write(context.Background(), r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+}
+
+func TestPruneMaxAgeAndRaw(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	day := 24 * time.Hour
+	writeAged(t, s, now, 40*day, 10*day, time.Hour)
+
+	res, err := s.Prune(ctx, Retention{MaxAge: 30 * day, RawMaxAge: 7 * day}, now, PruneOptions{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if res.Deleted != 1 || res.Stripped != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(got))
+	}
+	if len(got[0].Raw) != 0 || got[0].UserText != "secret" {
+		t.Fatalf("expected raw cleared and text kept on the 10 day old row: %+v", got[0])
+	}
+	if string(got[1].Raw) != `{"prompt":"secret"}` {
+		t.Fatalf("recent row should keep raw_json: %+v", got[1])
+	}
+}
+
+func TestPruneMaxRows(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	writeAged(t, s, now, 5*time.Hour, 4*time.Hour, 3*time.Hour, 2*time.Hour, time.Hour)
+
+	res, err := s.Prune(ctx, Retention{MaxRows: 2}, now, PruneOptions{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if res.Deleted != 3 || len(got) != 2 || !got[1].Timestamp.Equal(time.UnixMilli(now.Add(-time.Hour).UnixMilli())) {
+		t.Fatalf("expected the 2 newest rows to remain, got %d rows (%+v)", len(got), res)
+	}
+}
+
+func TestPruneMaxBytesVacuums(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	big := strings.Repeat("x", 4096)
+	for i := 0; i < 500; i++ {
+		r := Record{Timestamp: now.Add(time.Duration(i) * time.Millisecond), Direction: DirectionDownstreamToUpstream, Method: "session/update", IsNotify: true, Raw: []byte(`"` + big + `"`)}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.StartWriter(WriterOptions{}); err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+
+	const limit = 512 << 10
+	res, err := s.Prune(ctx, Retention{MaxBytes: limit}, now, PruneOptions{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if res.Deleted == 0 || res.Freed <= 0 {
+		t.Fatalf("expected rows deleted and space freed: %+v", res)
+	}
+	size, err := fileBytes(ctx, s.db)
+	if err != nil {
+		t.Fatalf("fileBytes: %v", err)
+	}
+	if size > limit {
+		t.Fatalf("database still %d bytes after pruning to %d", size, limit)
+	}
+}
+
+func TestPruneMaxAgeSessionsAndConnections(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	day := 24 * time.Hour
+	writeAged(t, s, now, 40*day)
+	r := Record{Timestamp: now, Direction: DirectionUpstreamToDownstream, SessionID: "b", Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`)}
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for _, c := range []Connection{
+		{ID: "ended", Mode: ConnLocal, Started: now.Add(-41 * day)},
+		{ID: "crashed", Mode: ConnLocal, Started: now.Add(-41 * day)},
+		{ID: "open", Mode: ConnLocal, Started: now.Add(-day)},
+	} {
+		if err := s.StartConnection(ctx, c); err != nil {
+			t.Fatalf("StartConnection: %v", err)
+		}
+	}
+	if err := s.FinishConnection(ctx, "ended", ConnectionEnd{Time: now.Add(-40 * day)}); err != nil {
+		t.Fatalf("FinishConnection: %v", err)
+	}
+
+	if _, err := s.Prune(ctx, Retention{MaxAge: 30 * day}, now, PruneOptions{}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	sessions, err := s.ListSessions(ctx, SessionFilter{})
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "b" {
+		t.Fatalf("expected only the recent session to remain, got %+v", sessions)
+	}
+	conns, err := s.ListConnections(ctx, ConnectionFilter{})
+	if err != nil {
+		t.Fatalf("ListConnections: %v", err)
+	}
+	if len(conns) != 1 || conns[0].ID != "open" {
+		t.Fatalf("expected only the recent connection to remain, got %+v", conns)
+	}
+}
+
+func TestPruneMaxRowsDerived(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	for i, id := range []string{"old", "new"} {
+		r := Record{Timestamp: now.Add(time.Duration(i-2) * time.Hour), Direction: DirectionDownstreamToUpstream, SessionID: id, Method: "session/update", IsNotify: true,
+			Raw: []byte(`{"sessionId":"` + id + `","update":{"sessionUpdate":"tool_call","toolCallId":"t","title":"Read","status":"pending","rawInput":{"path":"secret"}}}`)}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if _, err := s.Prune(ctx, Retention{MaxRows: 1}, now, PruneOptions{}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	calls, err := s.ToolCalls(ctx, ToolCallFilter{})
+	if err != nil {
+		t.Fatalf("ToolCalls: %v", err)
+	}
+	sessions, err := s.ListSessions(ctx, SessionFilter{})
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(calls) != 1 || calls[0].SessionID != "new" || len(sessions) != 1 || sessions[0].ID != "new" {
+		t.Fatalf("expected only the rows of the newest event to remain, got %+v and %+v", calls, sessions)
+	}
+}
+
+func TestPruneMaxBytesUnreachable(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	writeAged(t, s, now, 2*time.Hour, time.Hour)
+
+	res, err := s.Prune(ctx, Retention{MaxBytes: 1}, now, PruneOptions{})
+	if err == nil {
+		t.Fatal("expected an error for a limit that cannot be met")
+	}
+	if res.Deleted != 2 {
+		t.Fatalf("expected every event deleted, got %+v", res)
+	}
+}
@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// audit_search is an FTS5 index over the extracted text of each event and
+// the title of tool calls. Triggers on audit_events keep it in sync, so
+// retention deletes indexed text together with its event. Encrypted rows
+// are not indexed: the index would hold their text in plaintext.
+//
+// Row ids of audit_search are audit_events ids.
+
+// toolTitle extracts the title of a tool_call or tool_call_update
+// notification from the event row aliased as r.
+const toolTitle = `CASE WHEN r.method = 'session/update' AND json_valid(r.raw_json)
+  THEN json_extract(r.raw_json, '$.update.title') END`
+
+// searchIndexInsert indexes the event row aliased as row, unless it is
+// encrypted or has no text.
+func searchIndexInsert(row string) string {
+	return strings.ReplaceAll(`
+INSERT INTO audit_search(rowid, user_text, agent_text, title)
+SELECT r.id, r.user_text, r.agent_text, t.title FROM (SELECT `+toolTitle+` AS title) t
+WHERE r.key_id IS NULL AND COALESCE(r.user_text, r.agent_text, t.title) IS NOT NULL;`, "r.", row+".")
+}
+
+var searchSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS audit_search USING fts5(user_text, agent_text, title);
+
+CREATE TRIGGER IF NOT EXISTS audit_search_insert AFTER INSERT ON audit_events BEGIN` + searchIndexInsert("new") + `
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_search_delete AFTER DELETE ON audit_events BEGIN
+  DELETE FROM audit_search WHERE rowid = old.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_search_update AFTER UPDATE OF user_text, agent_text, key_id ON audit_events BEGIN
+  DELETE FROM audit_search WHERE rowid = old.id;` + searchIndexInsert("new") + `
+END;
+
+DELETE FROM audit_search;
+INSERT INTO audit_search(rowid, user_text, agent_text, title)
+SELECT e.id, e.user_text, e.agent_text, e.title FROM (
+  SELECT r.id, r.user_text, r.agent_text, ` + toolTitle + ` AS title
+  FROM audit_events r WHERE r.key_id IS NULL
+) e
+WHERE COALESCE(e.user_text, e.agent_text, e.title) IS NOT NULL;`
+
+// SearchHit is one event matching a Search query.
+type SearchHit struct {
+	Record
+	// Snippet is the best matching fragment of the event's text, with
+	// matches wrapped in the SearchOptions markers.
+	Snippet string
+}
+
+// SearchOptions controls how Search renders snippets.
+type SearchOptions struct {
+	// Filter narrows the matching events. Its Limit and Offset page
+	// through the hits.
+	Filter
+	// Open and Close surround each match in the snippet ("[" and "]" when
+	// empty).
+	Open, Close string
+	// Tokens is the approximate snippet length in tokens (default 16).
+	Tokens int
+}
+
+// Search returns the events whose extracted text or tool call title
+// matches query, best matches first. query uses the FTS5 query syntax;
+// see QuoteSearch for matching plain words.
+func (s *Store) Search(ctx context.Context, query string, opts SearchOptions) ([]SearchHit, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	open, close := opts.Open, opts.Close
+	if open == "" && close == "" {
+		open, close = "[", "]"
+	}
+	tokens := opts.Tokens
+	if tokens <= 0 {
+		tokens = 16
+	}
+	where, args := opts.Filter.where()
+	args = append([]any{open, close, min(tokens, 64), query}, args...)
+	rows, err := s.db.QueryContext(ctx, `
+SELECT `+recordColumns+`, h.snip FROM audit_events
+JOIN (
+  SELECT rowid AS hit_id, snippet(audit_search, -1, ?, ?, '…', ?) AS snip, rank AS hit_rank
+  FROM audit_search WHERE audit_search MATCH ?
+) h ON h.hit_id = audit_events.id`+where+`
+ORDER BY h.hit_rank, audit_events.id`+opts.Filter.page(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("search %q: %w", query, err)
+	}
+	defer rows.Close()
+
+	var out []SearchHit
+	for rows.Next() {
+		var h SearchHit
+		if h.Record, err = s.scanRecord(ctx, rows, &h.Snippet); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// QuoteSearch turns plain words into an FTS5 query that matches events
+// containing all of them, so that punctuation such as "-" or ":" is not
+// read as query syntax.
+func QuoteSearch(words string) string {
+	fields := strings.Fields(words)
+	for i, f := range fields {
+		fields[i] = `"` + strings.ReplaceAll(f, `"`, `""`) + `"`
+	}
+	return strings.Join(fields, " ")
+}
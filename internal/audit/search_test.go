@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	base := time.Now().Add(-time.Hour)
+	records := []Record{
+		{SessionID: "a", Method: "session/prompt", IsRequest: true, Raw: []byte(`{}`), UserText: "please rename migrate_users"},
+		{SessionID: "a", Method: "session/update", IsNotify: true, Raw: []byte(`{}`), AgentText: "I will edit the migrate_users script now."},
+		{SessionID: "b", Method: "session/update", IsNotify: true, AgentText: "unrelated output",
+			Raw: []byte(`{"sessionId":"b","update":{"sessionUpdate":"tool_call","toolCallId":"c1","title":"Run migrate_users.sh"}}`)},
+		{SessionID: "b", Method: "session/update", IsNotify: true, Raw: []byte(`{}`), AgentText: "nothing to see"},
+	}
+	for i, r := range records {
+		r.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		r.Direction = DirectionDownstreamToUpstream
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	hits, err := s.Search(ctx, QuoteSearch("migrate_users"), SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(hits) != 3 {
+		t.Fatalf("expected 3 hits, got %+v", hits)
+	}
+	for _, h := range hits {
+		if h.RowID == 3 && h.Snippet != "Run [migrate_users].sh" {
+			t.Fatalf("unexpected tool title snippet %q", h.Snippet)
+		}
+	}
+
+	hits, err = s.Search(ctx, QuoteSearch("migrate_users"), SearchOptions{Filter: Filter{SessionID: "a", Since: base.Add(30 * time.Second)}, Open: "<", Close: ">"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(hits) != 1 || hits[0].RowID != 2 || hits[0].Snippet != "I will edit the <migrate_users> script now." {
+		t.Fatalf("unexpected filtered hits: %+v", hits)
+	}
+
+	// Deleted events leave the index.
+	if _, err := s.Prune(ctx, Retention{MaxRows: 2}, time.Now(), PruneOptions{}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if hits, err = s.Search(ctx, "migrate_users", SearchOptions{}); err != nil || len(hits) != 1 || hits[0].RowID != 3 {
+		t.Fatalf("expected only the tool call after prune: %+v %v", hits, err)
+	}
+}
+
+func TestSearchSkipsEncryptedRows(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	r := Record{Timestamp: time.Now(), Direction: DirectionUpstreamToDownstream, SessionID: "a", Method: "session/prompt", IsRequest: true,
+		Raw: []byte(`{}`), UserText: "top secret plan"}
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_search`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("encrypted row was indexed: %d %v", n, err)
+	}
+}
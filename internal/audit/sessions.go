@@ -0,0 +1,632 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"acp-gate/internal/acpinspect"
+)
+
+// The sessions table keeps one row per ACP session so that sessions can be
+// listed and filtered without scanning audit_events. Store.Write derives
+// the rows from the records it is given, before they are encrypted:
+//
+//   - initialize supplies the client info and capabilities of a connection
+//   - session/new and session/load create the session with its cwd and MCP
+//     servers, and their results supply the current mode and model
+//   - session/set_mode, session/set_model and current_mode_update
+//     notifications track the mode and model
+//   - session/prompt counts turns and its result supplies the stop reason
+//   - plan and available_commands_update notifications supply the latest
+//     plan and slash commands
+//
+// On encrypted stores the plan and the MCP servers are encrypted. The
+// working directory stays in plaintext so that sessions can be filtered
+// by it.
+//
+// Connections are identified by the conn_id of their rows or, for rows
+// without one, by the prefix of their correlation ids. A session ends when
+// its connection ends; see EndConnection.
+
+const sessionsSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+  session_id TEXT PRIMARY KEY,
+  created_unix_ms INTEGER NOT NULL,
+  last_active_unix_ms INTEGER NOT NULL,
+  ended_unix_ms INTEGER,
+  origin TEXT,
+  cwd TEXT,
+  mcp_servers TEXT,
+  agent_name TEXT,
+  client_info TEXT,
+  client_capabilities TEXT,
+  protocol_version INTEGER,
+  mode TEXT,
+  model TEXT,
+  turns INTEGER NOT NULL DEFAULT 0,
+  last_stop_reason TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_last_active ON sessions(last_active_unix_ms);
+
+INSERT OR IGNORE INTO sessions(session_id, created_unix_ms, last_active_unix_ms, turns)
+SELECT session_id, MIN(ts_unix_ms), MAX(ts_unix_ms),
+  SUM(CASE WHEN method = 'session/prompt' AND is_request = 1 THEN 1 ELSE 0 END)
+FROM audit_events WHERE session_id IS NOT NULL
+GROUP BY session_id;
+
+UPDATE sessions SET (origin, cwd, created_unix_ms) = (
+  SELECT 'new', json_extract(q.raw_json, '$.cwd'), MIN(sessions.created_unix_ms, q.ts_unix_ms)
+  FROM audit_events r JOIN audit_events q ON q.corr_id = r.corr_id AND q.is_request = 1
+  WHERE r.method = 'session/new' AND r.is_request = 0 AND r.error_code IS NULL
+    AND r.key_id IS NULL AND q.key_id IS NULL AND json_valid(r.raw_json) AND json_valid(q.raw_json)
+    AND json_extract(r.raw_json, '$.sessionId') = sessions.session_id
+)
+WHERE EXISTS (
+  SELECT 1 FROM audit_events r
+  WHERE r.method = 'session/new' AND r.is_request = 0 AND r.key_id IS NULL AND json_valid(r.raw_json)
+    AND json_extract(r.raw_json, '$.sessionId') = sessions.session_id
+);
+
+UPDATE sessions SET last_stop_reason = (
+  SELECT json_extract(raw_json, '$.stopReason') FROM audit_events
+  WHERE session_id = sessions.session_id AND method = 'session/prompt'
+    AND is_request = 0 AND is_notify = 0 AND error_code IS NULL AND key_id IS NULL AND json_valid(raw_json)
+  ORDER BY id DESC LIMIT 1
+);
+
+-- Sessions recorded before this table existed belong to connections that
+-- are gone by the time the migration runs.
+UPDATE sessions SET ended_unix_ms = last_active_unix_ms WHERE ended_unix_ms IS NULL;`
+
+// Session is one row of the sessions table.
+type Session struct {
+	ID string
+	// Origin is "new" or "load", depending on how the session was opened
+	// most recently; empty if that was not recorded.
+	Origin string
+	Cwd    string
+	// MCPServers is the JSON array of MCP servers passed to the session.
+	// Environment variables and HTTP headers are reduced to their names.
+	// MCPServersSealed is set when it is encrypted with a key that is not
+	// available.
+	MCPServers       json.RawMessage
+	MCPServersSealed bool
+	// AgentName is the agent server from the config that served the
+	// session; see Store.SetAgentName.
+	AgentName          string
+	ClientInfo         json.RawMessage
+	ClientCapabilities json.RawMessage
+	ProtocolVersion    int
+	Mode               string
+	Model              string
+
+	Created    time.Time
+	LastActive time.Time
+	// Ended is zero while the session's connection is open.
+	Ended time.Time
+
+	// Turns counts session/prompt requests.
+	Turns          int
+	LastStopReason string
+
+	// Plan is the JSON array of the latest plan entries the agent sent,
+	// and Commands that of its available slash commands; see
+	// acpinspect.PlanEntry and acpinspect.Command.
+	Plan     json.RawMessage
+	Commands json.RawMessage
+	// PlanSealed is set when Plan is encrypted with a key that is not
+	// available.
+	PlanSealed bool
+}
+
+// SessionFilter selects sessions. Zero-valued fields are ignored.
+type SessionFilter struct {
+	ID        string
+	AgentName string
+	// Cwd selects sessions whose working directory is Cwd or below it.
+	Cwd string
+	// Active selects sessions whose connection has not ended.
+	Active bool
+	// Since and Until bound the last activity of a session.
+	Since time.Time
+	Until time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f SessionFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.ID != "" {
+		conds = append(conds, "session_id = ?")
+		args = append(args, f.ID)
+	}
+	if f.AgentName != "" {
+		conds = append(conds, "agent_name = ?")
+		args = append(args, f.AgentName)
+	}
+	if f.Cwd != "" {
+		dir := strings.TrimSuffix(f.Cwd, "/")
+		conds = append(conds, "(cwd = ? OR substr(cwd, 1, ?) = ?)")
+		args = append(args, dir, len(dir)+1, dir+"/")
+	}
+	if f.Active {
+		conds = append(conds, "ended_unix_ms IS NULL")
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "last_active_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "last_active_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ListSessions returns the sessions matching f, most recently active first.
+func (s *Store) ListSessions(ctx context.Context, f SessionFilter) ([]Session, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT session_id, created_unix_ms, last_active_unix_ms, ended_unix_ms, origin, cwd, mcp_servers, mcp_servers_key_id, agent_name,
+  client_info, client_capabilities, protocol_version, mode, model, turns, last_stop_reason, plan, plan_key_id, commands
+FROM sessions`+where+`
+ORDER BY last_active_unix_ms DESC, session_id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Session
+	for rows.Next() {
+		var (
+			ss                                  Session
+			created, active                     int64
+			ended, proto                        sql.NullInt64
+			origin, cwd, mcp, mcpKeyID, agent   sql.NullString
+			info, caps, mode, model, stopReason sql.NullString
+			plan, planKeyID, commands           sql.NullString
+		)
+		if err := rows.Scan(&ss.ID, &created, &active, &ended, &origin, &cwd, &mcp, &mcpKeyID, &agent,
+			&info, &caps, &proto, &mode, &model, &ss.Turns, &stopReason, &plan, &planKeyID, &commands); err != nil {
+			return nil, err
+		}
+		ss.Created = time.UnixMilli(created)
+		ss.LastActive = time.UnixMilli(active)
+		if ended.Valid {
+			ss.Ended = time.UnixMilli(ended.Int64)
+		}
+		ss.Origin, ss.Cwd, ss.AgentName = origin.String, cwd.String, agent.String
+		ss.MCPServers = rawOrNil(mcp)
+		if mcpKeyID.Valid && mcp.Valid {
+			s.openMCPServers(ctx, mcpKeyID.String, &ss)
+		}
+		ss.ClientInfo = rawOrNil(info)
+		ss.ClientCapabilities = rawOrNil(caps)
+		ss.ProtocolVersion = int(proto.Int64)
+		ss.Mode, ss.Model, ss.LastStopReason = mode.String, model.String, stopReason.String
+		ss.Plan, ss.Commands = rawOrNil(plan), rawOrNil(commands)
+		if planKeyID.Valid && plan.Valid {
+			s.openPlan(ctx, planKeyID.String, &ss)
+		}
+		out = append(out, ss)
+	}
+	return out, rows.Err()
+}
+
+// openPlan decrypts the plan of ss. If the data key is not available the
+// plan is cleared and ss.PlanSealed is set.
+func (s *Store) openPlan(ctx context.Context, keyID string, ss *Session) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		if plan, err := openField(aead, "session_plan", string(ss.Plan)); err == nil {
+			ss.Plan = plan
+			return
+		}
+	}
+	ss.Plan, ss.PlanSealed = nil, true
+}
+
+// openMCPServers decrypts the MCP servers of ss. If the data key is not
+// available they are cleared and ss.MCPServersSealed is set.
+func (s *Store) openMCPServers(ctx context.Context, keyID string, ss *Session) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		if mcp, err := openField(aead, "session_mcp_servers", string(ss.MCPServers)); err == nil {
+			ss.MCPServers = mcp
+			return
+		}
+	}
+	ss.MCPServers, ss.MCPServersSealed = nil, true
+}
+
+func rawOrNil(v sql.NullString) json.RawMessage {
+	if !v.Valid {
+		return nil
+	}
+	return json.RawMessage(v.String)
+}
+
+// SetAgentName records name as the agent of the sessions opened from now
+// on. Set it before the store is shared.
+func (s *Store) SetAgentName(name string) {
+	s.sess.agentName = name
+}
+
+// sessionUpdate is one change to a sessions row. Empty fields leave the
+// column unchanged.
+type sessionUpdate struct {
+	ID string
+	At int64
+
+	Origin, Cwd, MCPServers, AgentName string
+	ClientInfo, ClientCapabilities     string
+	ProtocolVersion                    int
+	Mode, Model, StopReason            string
+	// Plan and Commands are JSON arrays; PlanKeyID is set when Plan is
+	// encrypted, and MCPServersKeyID when MCPServers is.
+	Plan, PlanKeyID, Commands string `json:",omitempty"`
+	MCPServersKeyID           string `json:",omitempty"`
+
+	Turns int
+	Ended bool
+}
+
+func applySessions(ctx context.Context, db execer, ups []sessionUpdate) error {
+	for _, u := range ups {
+		var ended any
+		if u.Ended {
+			ended = u.At
+		}
+		var proto any
+		if u.ProtocolVersion != 0 {
+			proto = u.ProtocolVersion
+		}
+		_, err := db.ExecContext(ctx, `
+INSERT INTO sessions(session_id, created_unix_ms, last_active_unix_ms, ended_unix_ms, origin, cwd, mcp_servers, mcp_servers_key_id,
+  agent_name, client_info, client_capabilities, protocol_version, mode, model, turns, last_stop_reason, plan, plan_key_id, commands)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(session_id) DO UPDATE SET
+  last_active_unix_ms = CASE WHEN excluded.ended_unix_ms IS NULL
+    THEN MAX(last_active_unix_ms, excluded.last_active_unix_ms) ELSE last_active_unix_ms END,
+  ended_unix_ms = excluded.ended_unix_ms,
+  origin = COALESCE(excluded.origin, origin),
+  cwd = COALESCE(excluded.cwd, cwd),
+  mcp_servers_key_id = CASE WHEN excluded.mcp_servers IS NULL THEN mcp_servers_key_id ELSE excluded.mcp_servers_key_id END,
+  mcp_servers = COALESCE(excluded.mcp_servers, mcp_servers),
+  agent_name = COALESCE(excluded.agent_name, agent_name),
+  client_info = COALESCE(excluded.client_info, client_info),
+  client_capabilities = COALESCE(excluded.client_capabilities, client_capabilities),
+  protocol_version = COALESCE(excluded.protocol_version, protocol_version),
+  mode = COALESCE(excluded.mode, mode),
+  model = COALESCE(excluded.model, model),
+  turns = turns + excluded.turns,
+  last_stop_reason = COALESCE(excluded.last_stop_reason, last_stop_reason),
+  plan_key_id = CASE WHEN excluded.plan IS NULL THEN plan_key_id ELSE excluded.plan_key_id END,
+  plan = COALESCE(excluded.plan, plan),
+  commands = COALESCE(excluded.commands, commands);
+`, u.ID, u.At, u.At, ended, nullIfEmpty(u.Origin), nullIfEmpty(u.Cwd), nullIfEmpty(u.MCPServers), nullIfEmpty(u.MCPServersKeyID),
+			nullIfEmpty(u.AgentName),
+			nullIfEmpty(u.ClientInfo), nullIfEmpty(u.ClientCapabilities), proto, nullIfEmpty(u.Mode), nullIfEmpty(u.Model), u.Turns, nullIfEmpty(u.StopReason),
+			nullIfEmpty(u.Plan), nullIfEmpty(u.PlanKeyID), nullIfEmpty(u.Commands))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneSessions deletes the sessions last active before cutoff.
+func pruneSessions(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM sessions WHERE last_active_unix_ms < ?`, cutoff)
+	return err
+}
+
+// sessionTracker holds what Store.Write needs to remember between records
+// to derive session updates.
+type sessionTracker struct {
+	agentName string
+
+	mu sync.Mutex
+	// conns maps a connection (correlation id prefix) to its state.
+	conns map[string]*connState
+	// pending holds the update of a request that only applies once its
+	// response reports success, keyed by correlation id.
+	pending map[string]sessionUpdate
+}
+
+type connState struct {
+	clientInfo, clientCaps string
+	protocolVersion        int
+	sessions               map[string]struct{}
+}
+
+// connOf returns the connection of r.
+func connOf(r Record) string {
+	if r.ConnID != "" {
+		return r.ConnID
+	}
+	if i := strings.LastIndexByte(r.CorrelationID, '-'); i > 0 {
+		return r.CorrelationID[:i]
+	}
+	return ""
+}
+
+func (t *sessionTracker) conn(id string) *connState {
+	if t.conns == nil {
+		t.conns = map[string]*connState{}
+	}
+	c := t.conns[id]
+	if c == nil {
+		c = &connState{sessions: map[string]struct{}{}}
+		t.conns[id] = c
+	}
+	return c
+}
+
+// observe returns the session updates implied by r.
+func (t *sessionTracker) observe(r Record) []sessionUpdate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at := r.Timestamp.UnixMilli()
+	var cs *connState
+	if id := connOf(r); id != "" {
+		cs = t.conn(id)
+	}
+	var ups []sessionUpdate
+	if r.SessionID != "" {
+		if cs != nil {
+			cs.sessions[r.SessionID] = struct{}{}
+		}
+		ups = append(ups, sessionUpdate{ID: r.SessionID, At: at})
+	}
+	var p struct {
+		SessionID          string          `json:"sessionId"`
+		Cwd                string          `json:"cwd"`
+		MCPServers         json.RawMessage `json:"mcpServers"`
+		ClientInfo         json.RawMessage `json:"clientInfo"`
+		ClientCapabilities json.RawMessage `json:"clientCapabilities"`
+		ProtocolVersion    int             `json:"protocolVersion"`
+		ModeID             string          `json:"modeId"`
+		ModelID            string          `json:"modelId"`
+		StopReason         string          `json:"stopReason"`
+		Modes              *struct {
+			CurrentModeID string `json:"currentModeId"`
+		} `json:"modes"`
+		Models *struct {
+			CurrentModelID string `json:"currentModelId"`
+		} `json:"models"`
+		Update struct {
+			SessionUpdate string `json:"sessionUpdate"`
+			CurrentModeID string `json:"currentModeId"`
+		} `json:"update"`
+	}
+	if r.Method == "" || json.Unmarshal(r.Raw, &p) != nil {
+		return ups
+	}
+
+	switch {
+	case r.IsNotify:
+		if r.Method != "session/update" || r.SessionID == "" {
+			return ups
+		}
+		switch p.Update.SessionUpdate {
+		case "current_mode_update":
+			ups[len(ups)-1].Mode = p.Update.CurrentModeID
+		case "plan", "available_commands_update":
+			if u, ok := contentSessionUpdate(r); ok {
+				ups[len(ups)-1].Plan, ups[len(ups)-1].Commands = u.Plan, u.Commands
+			}
+		}
+	case r.IsRequest:
+		u := sessionUpdate{ID: p.SessionID, At: at}
+		switch r.Method {
+		case "initialize":
+			if cs != nil {
+				cs.clientInfo = jsonOrEmpty(p.ClientInfo)
+				cs.clientCaps = jsonOrEmpty(p.ClientCapabilities)
+				cs.protocolVersion = p.ProtocolVersion
+			}
+			return ups
+		case "session/new", "session/load":
+			u.Origin = strings.TrimPrefix(r.Method, "session/")
+			u.Cwd = p.Cwd
+			u.MCPServers = mcpServers(p.MCPServers)
+			u.AgentName = t.agentName
+			if cs != nil {
+				u.ClientInfo, u.ClientCapabilities, u.ProtocolVersion = cs.clientInfo, cs.clientCaps, cs.protocolVersion
+			}
+		case "session/set_mode":
+			u.Mode = p.ModeID
+		case "session/set_model":
+			u.Model = p.ModelID
+		case "session/prompt":
+			if r.SessionID != "" {
+				ups[len(ups)-1].Turns = 1
+			}
+			return ups
+		default:
+			return ups
+		}
+		if r.CorrelationID != "" {
+			if t.pending == nil {
+				t.pending = map[string]sessionUpdate{}
+			}
+			t.pending[r.CorrelationID] = u
+		}
+	default:
+		u, ok := t.pending[r.CorrelationID]
+		delete(t.pending, r.CorrelationID)
+		if r.Error != nil {
+			return ups
+		}
+		if r.Method == "session/prompt" && r.SessionID != "" {
+			ups[len(ups)-1].StopReason = p.StopReason
+			return ups
+		}
+		if !ok {
+			return ups
+		}
+		if r.Method == "session/new" {
+			u.ID = p.SessionID
+		}
+		if u.ID == "" {
+			return ups
+		}
+		if p.Modes != nil {
+			u.Mode = p.Modes.CurrentModeID
+		}
+		if p.Models != nil {
+			u.Model = p.Models.CurrentModelID
+		}
+		u.At = at
+		if cs != nil {
+			cs.sessions[u.ID] = struct{}{}
+		}
+		ups = append(ups, u)
+	}
+	return ups
+}
+
+// sealSessions encrypts the plans and MCP servers set by ups.
+func (s *Store) sealSessions(ctx context.Context, ups []sessionUpdate) error {
+	for i := range ups {
+		u := &ups[i]
+		if u.Plan == "" && u.MCPServers == "" {
+			continue
+		}
+		dk, err := s.writeKey(ctx)
+		if err != nil {
+			return err
+		}
+		if u.Plan != "" {
+			if u.Plan, err = seal(dk.aead, "session_plan", []byte(u.Plan)); err != nil {
+				return err
+			}
+			u.PlanKeyID = dk.id
+		}
+		if u.MCPServers != "" {
+			if u.MCPServers, err = seal(dk.aead, "session_mcp_servers", []byte(u.MCPServers)); err != nil {
+				return err
+			}
+			u.MCPServersKeyID = dk.id
+		}
+	}
+	return nil
+}
+
+// contentSessionUpdate returns the update setting the plan or available
+// commands of r's session, if r is a plan or available_commands_update
+// notification.
+func contentSessionUpdate(r Record) (sessionUpdate, bool) {
+	if !r.IsNotify || r.Method != "session/update" {
+		return sessionUpdate{}, false
+	}
+	c := acpinspect.Inspect(acpinspect.AnyMessage{Method: r.Method, Params: r.Raw})
+	u := sessionUpdate{ID: c.SessionID, At: r.Timestamp.UnixMilli()}
+	switch c.Update {
+	case "plan":
+		u.Plan = jsonString(c.Plan)
+	case "available_commands_update":
+		u.Commands = jsonString(c.Commands)
+	default:
+		return u, false
+	}
+	return u, u.ID != ""
+}
+
+// forget drops the pending update of a request that will not complete.
+func (t *sessionTracker) forget(corrID string) {
+	t.mu.Lock()
+	delete(t.pending, corrID)
+	t.mu.Unlock()
+}
+
+// end returns the updates that end the sessions of conn and forgets it.
+func (t *sessionTracker) end(conn string, at time.Time) []sessionUpdate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cs := t.conns[conn]
+	if cs == nil {
+		return nil
+	}
+	delete(t.conns, conn)
+	var ups []sessionUpdate
+	for id := range cs.sessions {
+		ups = append(ups, sessionUpdate{ID: id, At: at.UnixMilli(), Ended: true})
+	}
+	return ups
+}
+
+// mcpServers returns the MCP server list with the values of environment
+// variables and HTTP headers removed; only their names are kept.
+func mcpServers(raw json.RawMessage) string {
+	var servers []map[string]any
+	if json.Unmarshal(raw, &servers) != nil {
+		return ""
+	}
+	for _, srv := range servers {
+		for _, key := range []string{"env", "headers"} {
+			vars, ok := srv[key].([]any)
+			if !ok {
+				continue
+			}
+			names := make([]any, 0, len(vars))
+			for _, v := range vars {
+				if m, ok := v.(map[string]any); ok {
+					names = append(names, m["name"])
+				}
+			}
+			srv[key] = names
+		}
+	}
+	b, err := json.Marshal(servers)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// jsonOrEmpty returns raw as a string, or "" if it is absent or null.
+func jsonOrEmpty(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
+
+// EndConnection marks the sessions of the connection conn as ended; conn
+// is a connection id or, for rows without one, a correlation id prefix.
+// The proxies call it once the connection has gone away. The connections
+// row itself is finished by FinishConnection.
+func (s *Store) EndConnection(ctx context.Context, conn string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("audit store not initialized")
+	}
+	s.term.end(conn)
+	now := time.Now()
+	d := derived{Sessions: s.sess.end(conn, now), Turns: s.turns.end(conn, now)}
+	if d.empty() {
+		return nil
+	}
+	if s.keyring != nil && len(d.Turns) > 0 {
+		if err := s.sealTurns(ctx, d.Turns); err != nil {
+			return err
+		}
+	}
+	if s.w != nil {
+		return s.w.enqueue(ctx, op{derived: d})
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error { return d.apply(ctx, tx) })
+}
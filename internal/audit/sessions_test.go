@@ -0,0 +1,212 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionRecords is the audit trail of one connection ("c1") that opens a
+// session, switches mode and runs two prompts.
+func sessionRecords(base time.Time) []Record {
+	up, down := DirectionUpstreamToDownstream, DirectionDownstreamToUpstream
+	records := []Record{
+		{Direction: up, Method: "initialize", IsRequest: true, CorrelationID: "c1-1",
+			Raw: []byte(`{"protocolVersion":1,"clientInfo":{"name":"zed","version":"1.0"},"clientCapabilities":{"terminal":true}}`)},
+		{Direction: down, Method: "initialize", CorrelationID: "c1-1", Raw: []byte(`{"protocolVersion":1}`)},
+		{Direction: up, Method: "session/new", IsRequest: true, CorrelationID: "c1-2",
+			Raw: []byte(`{"cwd":"/work/app","mcpServers":[{"name":"db","command":"mcp-db","args":[],"env":[{"name":"DB_PASSWORD","value":"hunter2"}]}]}`)},
+		{Direction: down, Method: "session/new", CorrelationID: "c1-2",
+			Raw: []byte(`{"sessionId":"s1","modes":{"currentModeId":"ask","availableModes":[]},"models":{"currentModelId":"small","availableModels":[]}}`)},
+		{Direction: up, SessionID: "s1", Method: "session/set_mode", IsRequest: true, CorrelationID: "c1-3", Raw: []byte(`{"sessionId":"s1","modeId":"code"}`)},
+		{Direction: down, SessionID: "s1", Method: "session/set_mode", CorrelationID: "c1-3", Raw: []byte(`{}`)},
+		{Direction: up, SessionID: "s1", Method: "session/set_model", IsRequest: true, CorrelationID: "c1-4", Raw: []byte(`{"sessionId":"s1","modelId":"large"}`)},
+		{Direction: down, SessionID: "s1", Method: "session/set_model", CorrelationID: "c1-4", Error: &RPCError{Code: -32601, Message: "not supported"}},
+		{Direction: up, SessionID: "s1", Method: "session/prompt", IsRequest: true, CorrelationID: "c1-5", Raw: []byte(`{"sessionId":"s1"}`)},
+		{Direction: down, SessionID: "s1", Method: "session/prompt", CorrelationID: "c1-5", Raw: []byte(`{"stopReason":"end_turn"}`)},
+		{Direction: down, SessionID: "s1", Method: "session/update", IsNotify: true, CorrelationID: "c2-1",
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"current_mode_update","currentModeId":"architect"}}`)},
+		{Direction: up, SessionID: "s1", Method: "session/prompt", IsRequest: true, CorrelationID: "c1-6", Raw: []byte(`{"sessionId":"s1"}`)},
+		{Direction: down, SessionID: "s1", Method: "session/prompt", CorrelationID: "c1-6", Raw: []byte(`{"stopReason":"cancelled"}`)},
+	}
+	for i := range records {
+		records[i].Timestamp = base.Add(time.Duration(i) * time.Second)
+	}
+	return records
+}
+
+func TestSessionsTable(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	s.SetAgentName("claude")
+	if err := s.StartWriter(WriterOptions{}); err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+
+	base := time.UnixMilli(time.Now().Add(-time.Hour).UnixMilli())
+	records := sessionRecords(base)
+	for _, r := range records {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	got, err := s.ListSessions(ctx, SessionFilter{Active: true})
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected one active session, got %+v", got)
+	}
+	ss := got[0]
+	if ss.ID != "s1" || ss.Origin != "new" || ss.Cwd != "/work/app" || ss.AgentName != "claude" || ss.ProtocolVersion != 1 {
+		t.Fatalf("unexpected session: %+v", ss)
+	}
+	if string(ss.ClientInfo) != `{"name":"zed","version":"1.0"}` || string(ss.ClientCapabilities) != `{"terminal":true}` {
+		t.Fatalf("unexpected client: %s %s", ss.ClientInfo, ss.ClientCapabilities)
+	}
+	if strings.Contains(string(ss.MCPServers), "hunter2") || !strings.Contains(string(ss.MCPServers), `"env":["DB_PASSWORD"]`) {
+		t.Fatalf("MCP servers not reduced to names: %s", ss.MCPServers)
+	}
+	// The failed set_model leaves the model from session/new.
+	if ss.Mode != "architect" || ss.Model != "small" {
+		t.Fatalf("mode/model = %q/%q", ss.Mode, ss.Model)
+	}
+	if ss.Turns != 2 || ss.LastStopReason != "cancelled" {
+		t.Fatalf("turns/stop = %d/%q", ss.Turns, ss.LastStopReason)
+	}
+	if !ss.Created.Equal(records[3].Timestamp) || !ss.LastActive.Equal(records[len(records)-1].Timestamp) || !ss.Ended.IsZero() {
+		t.Fatalf("unexpected times: %+v", ss)
+	}
+
+	if err := EndConnection(ctx, s, "c1"); err != nil {
+		t.Fatalf("EndConnection: %v", err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got, _ := s.ListSessions(ctx, SessionFilter{Active: true}); len(got) != 0 {
+		t.Fatalf("session still active after its connection ended: %+v", got)
+	}
+	for _, f := range []SessionFilter{{Cwd: "/work"}, {Cwd: "/work/app/"}, {AgentName: "claude"}, {Since: base}} {
+		if got, _ := s.ListSessions(ctx, f); len(got) != 1 || got[0].Ended.IsZero() {
+			t.Fatalf("filter %+v: got %+v", f, got)
+		}
+	}
+	for _, f := range []SessionFilter{{Cwd: "/work/ap"}, {AgentName: "other"}, {Until: base}} {
+		if got, _ := s.ListSessions(ctx, f); len(got) != 0 {
+			t.Fatalf("filter %+v: got %+v", f, got)
+		}
+	}
+
+	// Loading the session on a new connection reopens it.
+	load := []Record{
+		{Direction: DirectionUpstreamToDownstream, SessionID: "s1", Method: "session/load", IsRequest: true, CorrelationID: "c3-1",
+			Raw: []byte(`{"sessionId":"s1","cwd":"/work/app2","mcpServers":[]}`)},
+		{Direction: DirectionDownstreamToUpstream, SessionID: "s1", Method: "session/load", CorrelationID: "c3-1", Raw: []byte(`{}`)},
+	}
+	for _, r := range load {
+		r.Timestamp = time.Now()
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got, _ = s.ListSessions(ctx, SessionFilter{Active: true})
+	if len(got) != 1 || got[0].Origin != "load" || got[0].Cwd != "/work/app2" || got[0].Turns != 2 || !got[0].Created.Equal(ss.Created) {
+		t.Fatalf("unexpected session after load: %+v", got)
+	}
+}
+
+func TestSessionsEncrypted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	for _, r := range sessionRecords(time.Now()) {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	var mcp string
+	if err := s.db.QueryRowContext(ctx, `SELECT mcp_servers FROM sessions`).Scan(&mcp); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.Contains(mcp, "mcp-db") {
+		t.Fatalf("MCP servers stored in plaintext: %s", mcp)
+	}
+	got, err := s.ListSessions(ctx, SessionFilter{})
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(got) != 1 || got[0].MCPServersSealed || !strings.Contains(string(got[0].MCPServers), `"command":"mcp-db"`) {
+		t.Fatalf("unexpected session with key: %+v", got)
+	}
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	got, err = s.ListSessions(ctx, SessionFilter{})
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(got) != 1 || !got[0].MCPServersSealed || got[0].MCPServers != nil || got[0].Cwd != "/work/app" {
+		t.Fatalf("unexpected session without key: %+v", got)
+	}
+}
+
+func TestSessionsBackfill(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	base := time.UnixMilli(time.Now().Add(-time.Hour).UnixMilli())
+	records := sessionRecords(base)
+	for _, r := range records {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	s = reopenBefore(t, s, path, "sessions table", `DROP TABLE sessions`)
+	got, err := s.ListSessions(ctx, SessionFilter{})
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected one session, got %+v", got)
+	}
+	want := Session{
+		ID:             "s1",
+		Origin:         "new",
+		Cwd:            "/work/app",
+		Created:        records[2].Timestamp,
+		LastActive:     records[len(records)-1].Timestamp,
+		Ended:          records[len(records)-1].Timestamp,
+		Turns:          2,
+		LastStopReason: "cancelled",
+	}
+	gj, _ := json.Marshal(got[0])
+	wj, _ := json.Marshal(want)
+	if string(gj) != string(wj) {
+		t.Fatalf("backfilled session\n got %s\nwant %s", gj, wj)
+	}
+}
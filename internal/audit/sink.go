@@ -0,0 +1,286 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"acp-gate/internal/redact"
+)
+
+// Sink receives the audit trail written by the proxies. *Store, the SQLite
+// database, is one implementation; the others stream records elsewhere.
+type Sink interface {
+	// Write records one event.
+	Write(ctx context.Context, r Record) error
+	// Finish reports the final status of the request with the given
+	// correlation id; see Store.Finish.
+	Finish(ctx context.Context, corrID string, status Status) error
+	// Close flushes the sink and releases its resources.
+	Close() error
+}
+
+var _ Sink = (*Store)(nil)
+
+// connectionEnder is implemented by sinks that keep per-connection state.
+type connectionEnder interface {
+	EndConnection(ctx context.Context, conn string) error
+}
+
+// connectionRecorder is implemented by sinks that record connections.
+type connectionRecorder interface {
+	StartConnection(ctx context.Context, c Connection) error
+	FinishConnection(ctx context.Context, id string, end ConnectionEnd) error
+}
+
+// StartConnection records the start of c in s, if s records connections;
+// see Store.StartConnection.
+func StartConnection(ctx context.Context, s Sink, c Connection) error {
+	if r, ok := s.(connectionRecorder); ok {
+		return r.StartConnection(ctx, c)
+	}
+	return nil
+}
+
+// FinishConnection records the end of the connection with the given id in
+// s, if s records connections; see Store.FinishConnection.
+func FinishConnection(ctx context.Context, s Sink, id string, end ConnectionEnd) error {
+	if r, ok := s.(connectionRecorder); ok {
+		return r.FinishConnection(ctx, id, end)
+	}
+	return nil
+}
+
+// EndConnection tells s that the connection conn has ended, if s keeps
+// per-connection state; see Store.EndConnection.
+func EndConnection(ctx context.Context, s Sink, conn string) error {
+	if e, ok := s.(connectionEnder); ok {
+		return e.EndConnection(ctx, conn)
+	}
+	return nil
+}
+
+// Fanout returns a Sink that writes to every sink in order. Errors are
+// joined; a failing sink does not stop the others.
+func Fanout(sinks ...Sink) Sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return fanout(sinks)
+}
+
+type fanout []Sink
+
+func (f fanout) Write(ctx context.Context, r Record) error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, s.Write(ctx, r))
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) Finish(ctx context.Context, corrID string, status Status) error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, s.Finish(ctx, corrID, status))
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) EndConnection(ctx context.Context, conn string) error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, EndConnection(ctx, s, conn))
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) StartConnection(ctx context.Context, c Connection) error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, StartConnection(ctx, s, c))
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) FinishConnection(ctx context.Context, id string, end ConnectionEnd) error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, FinishConnection(ctx, s, id, end))
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) Close() error {
+	var errs []error
+	for _, s := range f {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted returns a Sink that redacts records with r before passing them
+// to s. Store applies its own redactor; see Store.SetRedactor.
+func Redacted(s Sink, r *redact.Redactor) Sink {
+	if r == nil {
+		return s
+	}
+	return redacted{s, r}
+}
+
+type redacted struct {
+	Sink
+	r *redact.Redactor
+}
+
+func (s redacted) Write(ctx context.Context, r Record) error {
+	return s.Sink.Write(ctx, redactRecord(s.r, r))
+}
+
+func (s redacted) EndConnection(ctx context.Context, conn string) error {
+	return EndConnection(ctx, s.Sink, conn)
+}
+
+func (s redacted) StartConnection(ctx context.Context, c Connection) error {
+	return StartConnection(ctx, s.Sink, c)
+}
+
+func (s redacted) FinishConnection(ctx context.Context, id string, end ConnectionEnd) error {
+	return FinishConnection(ctx, s.Sink, id, end)
+}
+
+func redactRecord(red *redact.Redactor, r Record) Record {
+	r.Raw = red.JSON(r.Method, r.Raw)
+	r.UserText = red.Text(r.UserText)
+	r.AgentText = red.Text(r.AgentText)
+	if r.Error != nil {
+		e := *r.Error
+		e.Message = red.Text(e.Message)
+		e.Data = red.JSON(r.Method, e.Data)
+		r.Error = &e
+	}
+	if r.FileChange != nil {
+		c := *r.FileChange
+		c.Diff = red.Text(c.Diff)
+		r.FileChange = &c
+	}
+	return r
+}
+
+// Line is the JSON form of one audit event, as written by the streaming
+// sinks. Records become lines of type request, response or notification;
+// Finish becomes a line of type status.
+type Line struct {
+	Type      string          `json:"type"`
+	Time      time.Time       `json:"ts"`
+	Direction Direction       `json:"direction,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	CorrID    string          `json:"corrId,omitempty"`
+	ConnID    string          `json:"connId,omitempty"`
+	Seq       int64           `json:"seq,omitempty"`
+	LatencyMs *int64          `json:"latencyMs,omitempty"`
+	Status    Status          `json:"status,omitempty"`
+	UserText  string          `json:"userText,omitempty"`
+	AgentText string          `json:"agentText,omitempty"`
+	Error     *LineError      `json:"error,omitempty"`
+	Raw       json.RawMessage `json:"raw,omitempty"`
+	// Diff is the unified diff of a file write; see FileChange.
+	Diff string `json:"diff,omitempty"`
+	// RawOmitted is set when Raw and Diff were left out to fit a size limit.
+	RawOmitted bool `json:"rawOmitted,omitempty"`
+}
+
+// LineError is the JSON-RPC error of a Line.
+type LineError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Line types.
+const (
+	LineRequest      = "request"
+	LineResponse     = "response"
+	LineNotification = "notification"
+	LineStatus       = "status"
+)
+
+// NewLine converts r to its JSON line form.
+func NewLine(r Record) Line {
+	l := Line{
+		Type:      LineResponse,
+		Time:      r.Timestamp,
+		Direction: r.Direction,
+		SessionID: r.SessionID,
+		Method:    r.Method,
+		CorrID:    r.CorrelationID,
+		ConnID:    r.ConnID,
+		Seq:       r.Seq,
+		Status:    r.Status,
+		UserText:  r.UserText,
+		AgentText: r.AgentText,
+	}
+	switch {
+	case r.IsRequest:
+		l.Type = LineRequest
+	case r.IsNotify:
+		l.Type = LineNotification
+	case r.CorrelationID != "":
+		ms := r.Latency.Milliseconds()
+		l.LatencyMs = &ms
+	}
+	if r.Error != nil {
+		l.Error = &LineError{Code: r.Error.Code, Message: r.Error.Message}
+		if json.Valid(r.Error.Data) {
+			l.Error.Data = r.Error.Data
+		}
+	}
+	if json.Valid(r.Raw) {
+		l.Raw = r.Raw
+	}
+	if r.FileChange != nil {
+		l.Diff = r.FileChange.Diff
+	}
+	return l
+}
+
+func statusLine(corrID string, status Status) Line {
+	return Line{Type: LineStatus, Time: time.Now(), CorrID: corrID, Status: status}
+}
+
+// WriterSink writes one JSON line per event to an io.Writer.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a sink writing JSON lines to w, such as os.Stderr.
+// Close does not close w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(ctx context.Context, r Record) error {
+	return s.writeLine(NewLine(r))
+}
+
+func (s *WriterSink) Finish(ctx context.Context, corrID string, status Status) error {
+	return s.writeLine(statusLine(corrID, status))
+}
+
+func (s *WriterSink) Close() error { return nil }
+
+func (s *WriterSink) writeLine(l Line) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
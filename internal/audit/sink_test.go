@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"acp-gate/internal/redact"
+)
+
+func TestFanoutWriterSink(t *testing.T) {
+	ctx := context.Background()
+	var a, b bytes.Buffer
+	red, err := redact.New(redact.Options{})
+	if err != nil {
+		t.Fatalf("redact.New: %v", err)
+	}
+	s := Fanout(NewWriterSink(&a), Redacted(NewWriterSink(&b), red))
+	r := Record{Timestamp: time.Now(), Direction: DirectionUpstreamToDownstream, SessionID: "s", Method: "session/prompt", IsRequest: true,
+		Raw: []byte(`{"prompt":"key sk-ant-REDACTED"}`), UserText: "hi", CorrelationID: "c-1", Seq: 1, Status: StatusPending}
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Finish(ctx, "c-1", StatusCompleted); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(a.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", a.String())
+	}
+	var req, status Line
+	if err := json.Unmarshal([]byte(lines[0]), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &status); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if req.Type != LineRequest || req.CorrID != "c-1" || req.Status != StatusPending || req.UserText != "hi" || !strings.Contains(string(req.Raw), "sk-ant") {
+		t.Fatalf("unexpected request line: %s", lines[0])
+	}
+	if status.Type != LineStatus || status.CorrID != "c-1" || status.Status != StatusCompleted {
+		t.Fatalf("unexpected status line: %s", lines[1])
+	}
+	if strings.Contains(b.String(), "sk-ant") || !strings.Contains(b.String(), "[REDACTED:") {
+		t.Fatalf("redacted sink got the secret: %s", b.String())
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	s, err := OpenFileSink(path, FileSinkOptions{MaxBytes: 1024, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("OpenFileSink: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.Write(ctx, testRecord(i)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if fi.Size() > 1024 {
+			t.Fatalf("%s is %d bytes, over the limit", p, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 backups, got %v", err)
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	dir, err := os.MkdirTemp("", "syslog")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "log")
+	conn, err := net.ListenPacket("unixgram", addr)
+	if err != nil {
+		t.Skipf("unixgram not supported: %v", err)
+	}
+	defer conn.Close()
+
+	s, err := DialSyslog(SyslogOptions{Address: addr, Facility: "local3", MaxMessage: 512})
+	if err != nil {
+		t.Fatalf("DialSyslog: %v", err)
+	}
+	defer s.Close()
+	r := testRecord(0)
+	r.Error = &RPCError{Code: -32603, Message: "boom"}
+	r.Raw = []byte(`{"big":"` + strings.Repeat("x", 1000) + `"}`)
+	if err := s.Write(context.Background(), r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	msg := string(buf[:n])
+	// local3 (19) * 8 + warning (4)
+	if !strings.HasPrefix(msg, "<156>") || !strings.Contains(msg, " acp-gate[") {
+		t.Fatalf("unexpected syslog header: %q", msg)
+	}
+	var l Line
+	if err := json.Unmarshal([]byte(msg[strings.Index(msg, "]: ")+3:]), &l); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if l.Type != LineNotification || l.Error == nil || l.Raw != nil || !l.RawOmitted {
+		t.Fatalf("unexpected line: %+v", l)
+	}
+}
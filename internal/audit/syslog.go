@@ -0,0 +1,161 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogOptions configures DialSyslog.
+type SyslogOptions struct {
+	// Address is the unix socket of the local syslog daemon. When empty
+	// the usual locations (/dev/log, /var/run/syslog, /var/run/log) are
+	// tried.
+	Address string
+	// Tag is the program name in each message (default "acp-gate").
+	Tag string
+	// Facility is a syslog facility name such as "user" (the default),
+	// "daemon", "auth" or "local0" to "local7".
+	Facility string
+	// MaxMessage bounds the size of one message in bytes (default 8192).
+	// Longer lines are sent without their raw payload.
+	MaxMessage int
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog severities used by SyslogSink.
+const (
+	sevWarning = 4
+	sevInfo    = 6
+)
+
+// SyslogSink sends one JSON line per event to the local syslog daemon.
+type SyslogSink struct {
+	opts     SyslogOptions
+	facility int
+	pid      int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	stream bool // conn needs newline-framed messages
+	closed bool
+}
+
+// DialSyslog connects to the local syslog daemon over its unix socket.
+func DialSyslog(opts SyslogOptions) (*SyslogSink, error) {
+	if opts.Tag == "" {
+		opts.Tag = "acp-gate"
+	}
+	if opts.Facility == "" {
+		opts.Facility = "user"
+	}
+	if opts.MaxMessage <= 0 {
+		opts.MaxMessage = 8192
+	}
+	facility, ok := syslogFacilities[strings.ToLower(opts.Facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", opts.Facility)
+	}
+	s := &SyslogSink{opts: opts, facility: facility, pid: os.Getpid()}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SyslogSink) connect() error {
+	addrs := []string{s.opts.Address}
+	if s.opts.Address == "" {
+		addrs = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+	}
+	var errs []error
+	for _, addr := range addrs {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.Dial(network, addr)
+			if err == nil {
+				s.conn, s.stream = conn, network == "unix"
+				return nil
+			}
+			errs = append(errs, err)
+		}
+	}
+	return fmt.Errorf("connect to syslog: %w", errors.Join(errs...))
+}
+
+func (s *SyslogSink) Write(ctx context.Context, r Record) error {
+	sev := sevInfo
+	if r.Error != nil {
+		sev = sevWarning
+	}
+	return s.send(sev, NewLine(r))
+}
+
+func (s *SyslogSink) Finish(ctx context.Context, corrID string, status Status) error {
+	sev := sevInfo
+	if status == StatusFailed || status == StatusAbandoned {
+		sev = sevWarning
+	}
+	return s.send(sev, statusLine(corrID, status))
+}
+
+func (s *SyslogSink) send(sev int, l Line) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("<%d>%s %s[%d]: ", s.facility*8+sev, time.Now().Format(time.Stamp), s.opts.Tag, s.pid)
+	if len(header)+len(b) > s.opts.MaxMessage && (l.Raw != nil || l.Diff != "") {
+		l.Raw, l.Diff, l.RawOmitted = nil, "", true
+		if b, err = json.Marshal(l); err != nil {
+			return err
+		}
+	}
+	msg := append([]byte(header), b...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	// Reconnect once if the daemon went away, e.g. after a restart.
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.connect(); err != nil {
+				return err
+			}
+		}
+		m := msg
+		if s.stream {
+			m = append(m, '\n')
+		}
+		_, err := s.conn.Write(m)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
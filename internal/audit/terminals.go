@@ -0,0 +1,672 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The terminals table has one row per terminal an agent created through
+// the editor, keyed by session and terminalId: the command, its args, cwd
+// and environment, and how it ended. terminal_output holds the output the
+// agent polled with terminal/output, stored as the bytes added since the
+// previous poll. When the editor truncated the output so that the new
+// snapshot does not continue the previous one, the whole snapshot is
+// stored and marked as a reset.
+//
+// On encrypted stores the output, and the command, args, cwd and env of a
+// terminal, are encrypted with the data key named in key_id, like the
+// payload of the event they came from.
+
+const terminalsSchema = `
+CREATE TABLE IF NOT EXISTS terminals (
+  session_id TEXT NOT NULL,
+  terminal_id TEXT NOT NULL,
+  conn_id TEXT,
+  tool_call_id TEXT,
+  command TEXT,
+  args TEXT,
+  cwd TEXT,
+  env TEXT,
+  output_byte_limit INTEGER,
+  created_unix_ms INTEGER NOT NULL,
+  exited_unix_ms INTEGER,
+  exit_code INTEGER,
+  signal TEXT,
+  killed_unix_ms INTEGER,
+  released_unix_ms INTEGER,
+  truncated INTEGER NOT NULL DEFAULT 0,
+  output_bytes INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (session_id, terminal_id)
+);
+CREATE INDEX IF NOT EXISTS idx_terminals_created ON terminals(created_unix_ms);
+
+CREATE TABLE IF NOT EXISTS terminal_output (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT NOT NULL,
+  terminal_id TEXT NOT NULL,
+  ts_unix_ms INTEGER NOT NULL,
+  data TEXT NOT NULL,
+  reset INTEGER NOT NULL,
+  truncated INTEGER NOT NULL,
+  key_id TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_terminal_output_terminal ON terminal_output(session_id, terminal_id, id);`
+
+// Terminal is one row of the terminals table.
+type Terminal struct {
+	SessionID string
+	ID        string
+	ConnID    string
+	// ToolCallID is the tool call that embedded the terminal, if any.
+	ToolCallID string
+
+	Command string
+	Args    []string
+	Cwd     string
+	// Env holds the variables set for the command. The values of variables
+	// whose name suggests a secret are not recorded.
+	Env             map[string]string
+	OutputByteLimit int
+	// Sealed is set when Command, Args, Cwd and Env are encrypted with a
+	// key the store does not have.
+	Sealed bool
+
+	Created time.Time
+	// Exited is zero until the exit status is known. ExitCode is nil if
+	// the command was killed by Signal.
+	Exited   time.Time
+	ExitCode *int
+	Signal   string
+	Killed   time.Time
+	Released time.Time
+
+	// Truncated is set if any output snapshot was truncated by the editor.
+	Truncated bool
+	// OutputBytes is the amount of output recorded.
+	OutputBytes int
+}
+
+// TerminalOutput is the output a terminal produced between two polls.
+type TerminalOutput struct {
+	Time time.Time
+	Data string
+	// Reset is set when Data is a whole snapshot that does not continue
+	// the previous one, because the editor dropped the beginning of the
+	// output.
+	Reset     bool
+	Truncated bool
+	// Sealed is set when Data is encrypted with a key the store does not
+	// have.
+	Sealed bool
+}
+
+// terminalUpdate is one change to a terminals row, with an output snapshot
+// when HasOutput is set.
+type terminalUpdate struct {
+	SessionID, TerminalID string
+	At                    int64
+
+	Create                  bool
+	ConnID                  string
+	Command, Args, Cwd, Env string
+	OutputByteLimit         *int
+	ToolCallID              string
+
+	HasOutput        bool
+	Output           string
+	OutputBytes      int
+	Reset, Truncated bool
+	KeyID            string
+
+	Exited   bool
+	ExitCode *int
+	Signal   string
+	Killed   bool
+	Released bool
+}
+
+// terminalTracker remembers what deriving the terminals tables needs
+// across records: the requests awaiting a response and the last output
+// seen for each terminal.
+type terminalTracker struct {
+	mu      sync.Mutex
+	pending map[string]terminalRequest
+	output  map[terminalKey]*terminalState
+}
+
+type terminalKey struct{ session, terminal string }
+
+type terminalState struct {
+	conn   string
+	output string
+}
+
+type terminalRequest struct {
+	method string
+	at     int64
+	params terminalParams
+}
+
+type terminalParams struct {
+	SessionID       string   `json:"sessionId"`
+	TerminalID      string   `json:"terminalId"`
+	Command         string   `json:"command"`
+	Args            []string `json:"args"`
+	Cwd             string   `json:"cwd"`
+	OutputByteLimit *int     `json:"outputByteLimit"`
+	Env             []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"env"`
+}
+
+// observe returns the terminal changes implied by r.
+func (t *terminalTracker) observe(r Record) []terminalUpdate {
+	switch {
+	case r.IsNotify:
+		if r.Method == "session/update" {
+			return terminalToolCalls(r)
+		}
+		return nil
+	case !strings.HasPrefix(r.Method, "terminal/") || r.CorrelationID == "":
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.IsRequest {
+		var p terminalParams
+		if json.Unmarshal(r.Raw, &p) != nil {
+			return nil
+		}
+		if t.pending == nil {
+			t.pending = map[string]terminalRequest{}
+		}
+		t.pending[r.CorrelationID] = terminalRequest{method: r.Method, at: r.Timestamp.UnixMilli(), params: p}
+		return nil
+	}
+	req, ok := t.pending[r.CorrelationID]
+	delete(t.pending, r.CorrelationID)
+	if !ok || r.Error != nil {
+		return nil
+	}
+	p := req.params
+	u := terminalUpdate{SessionID: p.SessionID, TerminalID: p.TerminalID, At: r.Timestamp.UnixMilli()}
+	var res struct {
+		TerminalID string  `json:"terminalId"`
+		Output     string  `json:"output"`
+		Truncated  bool    `json:"truncated"`
+		ExitCode   *int    `json:"exitCode"`
+		Signal     *string `json:"signal"`
+		ExitStatus *struct {
+			ExitCode *int    `json:"exitCode"`
+			Signal   *string `json:"signal"`
+		} `json:"exitStatus"`
+	}
+	_ = json.Unmarshal(r.Raw, &res)
+	exited := func(code *int, signal *string) {
+		u.Exited, u.ExitCode = true, code
+		if signal != nil {
+			u.Signal = *signal
+		}
+	}
+	switch req.method {
+	case "terminal/create":
+		if res.TerminalID == "" || p.SessionID == "" {
+			return nil
+		}
+		u.TerminalID, u.At = res.TerminalID, req.at
+		u.Create, u.ConnID = true, connOf(r)
+		u.Command, u.Cwd, u.OutputByteLimit = p.Command, p.Cwd, p.OutputByteLimit
+		u.Args = jsonString(append([]string{}, p.Args...))
+		if len(p.Env) > 0 {
+			env := make(map[string]string, len(p.Env))
+			for _, v := range p.Env {
+				if secretName(v.Name) {
+					v.Value = "[REDACTED]"
+				}
+				env[v.Name] = v.Value
+			}
+			u.Env = jsonString(env)
+		}
+		if t.output == nil {
+			t.output = map[terminalKey]*terminalState{}
+		}
+		t.output[terminalKey{p.SessionID, res.TerminalID}] = &terminalState{conn: u.ConnID}
+	case "terminal/output":
+		k := terminalKey{p.SessionID, p.TerminalID}
+		st := t.output[k]
+		if st == nil {
+			if t.output == nil {
+				t.output = map[terminalKey]*terminalState{}
+			}
+			st = &terminalState{conn: connOf(r)}
+			t.output[k] = st
+		}
+		delta, reset := outputDelta(st.output, res.Output)
+		st.output = res.Output
+		if delta != "" || reset {
+			u.HasOutput, u.Output, u.OutputBytes = true, delta, len(delta)
+			u.Reset, u.Truncated = reset, res.Truncated
+		}
+		if res.ExitStatus != nil {
+			exited(res.ExitStatus.ExitCode, res.ExitStatus.Signal)
+		}
+		if !u.HasOutput && !u.Exited {
+			return nil
+		}
+	case "terminal/wait_for_exit":
+		exited(res.ExitCode, res.Signal)
+	case "terminal/kill":
+		u.Killed = true
+	case "terminal/release":
+		u.Released = true
+		delete(t.output, terminalKey{p.SessionID, p.TerminalID})
+	default:
+		return nil
+	}
+	if p.SessionID == "" || u.TerminalID == "" {
+		return nil
+	}
+	return []terminalUpdate{u}
+}
+
+// outputDelta returns the part of the output snapshot cur that is new
+// since prev. If cur does not continue prev, it returns cur with reset set.
+func outputDelta(prev, cur string) (string, bool) {
+	if strings.HasPrefix(cur, prev) {
+		return cur[len(prev):], false
+	}
+	// The editor may have dropped the beginning of the output: find where
+	// cur starts in prev.
+	for off := 0; cur != "" && off < len(prev); {
+		i := strings.IndexByte(prev[off:], cur[0])
+		if i < 0 {
+			break
+		}
+		if p := off + i; strings.HasPrefix(cur, prev[p:]) {
+			return cur[len(prev)-p:], false
+		}
+		off += i + 1
+	}
+	return cur, true
+}
+
+// forget drops the pending request that will not complete.
+func (t *terminalTracker) forget(corrID string) {
+	t.mu.Lock()
+	delete(t.pending, corrID)
+	t.mu.Unlock()
+}
+
+// end forgets the terminals of conn.
+func (t *terminalTracker) end(conn string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, st := range t.output {
+		if st.conn == conn {
+			delete(t.output, k)
+		}
+	}
+}
+
+// terminalToolCalls links the terminals embedded in a tool call to it.
+func terminalToolCalls(r Record) []terminalUpdate {
+	if r.SessionID == "" || !strings.Contains(string(r.Raw), `"terminal"`) {
+		return nil
+	}
+	var p struct {
+		Update struct {
+			SessionUpdate string `json:"sessionUpdate"`
+			ToolCallID    string `json:"toolCallId"`
+			Content       []struct {
+				Type       string `json:"type"`
+				TerminalID string `json:"terminalId"`
+			} `json:"content"`
+		} `json:"update"`
+	}
+	if json.Unmarshal(r.Raw, &p) != nil || p.Update.ToolCallID == "" {
+		return nil
+	}
+	var ups []terminalUpdate
+	for _, c := range p.Update.Content {
+		if c.Type == "terminal" && c.TerminalID != "" {
+			ups = append(ups, terminalUpdate{SessionID: r.SessionID, TerminalID: c.TerminalID, At: r.Timestamp.UnixMilli(),
+				ToolCallID: p.Update.ToolCallID})
+		}
+	}
+	return ups
+}
+
+// sealTerminals encrypts the commands and output of ups.
+func (s *Store) sealTerminals(ctx context.Context, ups []terminalUpdate) error {
+	dk, err := s.writeKey(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range ups {
+		u := &ups[i]
+		if u.Create {
+			for _, f := range []struct {
+				label string
+				v     *string
+			}{
+				{"terminal_command", &u.Command}, {"terminal_args", &u.Args}, {"terminal_cwd", &u.Cwd}, {"terminal_env", &u.Env},
+			} {
+				if *f.v == "" {
+					continue
+				}
+				if *f.v, err = seal(dk.aead, f.label, []byte(*f.v)); err != nil {
+					return err
+				}
+			}
+			u.KeyID = dk.id
+		}
+		if !u.HasOutput {
+			continue
+		}
+		if u.Output, err = seal(dk.aead, "terminal_output", []byte(u.Output)); err != nil {
+			return err
+		}
+		u.KeyID = dk.id
+	}
+	return nil
+}
+
+func applyTerminals(ctx context.Context, db dbtx, ups []terminalUpdate) error {
+	for _, u := range ups {
+		var limit any
+		if u.OutputByteLimit != nil {
+			limit = *u.OutputByteLimit
+		}
+		// KeyID of other updates names the key of their output.
+		var createKey any
+		if u.Create {
+			createKey = nullIfEmpty(u.KeyID)
+		}
+		// Rows are created by terminal/create; a terminal first seen
+		// later, in an incomplete trail, gets a row without a command.
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO terminals(session_id, terminal_id, conn_id, command, args, cwd, env, key_id, output_byte_limit, created_unix_ms)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(session_id, terminal_id) DO UPDATE SET
+  conn_id = COALESCE(excluded.conn_id, conn_id),
+  key_id = COALESCE(excluded.key_id, key_id),
+  command = COALESCE(excluded.command, command),
+  args = COALESCE(excluded.args, args),
+  cwd = COALESCE(excluded.cwd, cwd),
+  env = COALESCE(excluded.env, env),
+  output_byte_limit = COALESCE(excluded.output_byte_limit, output_byte_limit);
+`, u.SessionID, u.TerminalID, nullIfEmpty(u.ConnID), nullIfEmpty(u.Command), nullIfEmpty(u.Args), nullIfEmpty(u.Cwd),
+			nullIfEmpty(u.Env), createKey, limit, u.At); err != nil {
+			return err
+		}
+		var exited, code, killed, released any
+		if u.Exited {
+			exited = u.At
+			if u.ExitCode != nil {
+				code = *u.ExitCode
+			}
+		}
+		if u.Killed {
+			killed = u.At
+		}
+		if u.Released {
+			released = u.At
+		}
+		if _, err := db.ExecContext(ctx, `
+UPDATE terminals SET
+  tool_call_id = COALESCE(tool_call_id, ?),
+  exit_code = CASE WHEN exited_unix_ms IS NULL AND ? IS NOT NULL THEN ? ELSE exit_code END,
+  signal = CASE WHEN exited_unix_ms IS NULL AND ? IS NOT NULL THEN ? ELSE signal END,
+  exited_unix_ms = COALESCE(exited_unix_ms, ?),
+  killed_unix_ms = COALESCE(killed_unix_ms, ?),
+  released_unix_ms = COALESCE(released_unix_ms, ?),
+  truncated = MAX(truncated, ?),
+  output_bytes = output_bytes + ?
+WHERE session_id = ? AND terminal_id = ?;
+`, nullIfEmpty(u.ToolCallID), exited, code, exited, nullIfEmpty(u.Signal), exited, killed, released,
+			boolInt(u.Truncated), u.OutputBytes, u.SessionID, u.TerminalID); err != nil {
+			return err
+		}
+		if !u.HasOutput {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO terminal_output(session_id, terminal_id, ts_unix_ms, data, reset, truncated, key_id) VALUES(?, ?, ?, ?, ?, ?, ?);
+`, u.SessionID, u.TerminalID, u.At, u.Output, boolInt(u.Reset), boolInt(u.Truncated), nullIfEmpty(u.KeyID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillTerminals derives the terminal tables from the plaintext events
+// recorded before they existed.
+func backfillTerminals(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+SELECT ts_unix_ms, session_id, method, is_request, is_notify, raw_json, corr_id, conn_id, error_code FROM audit_events
+WHERE (method LIKE 'terminal/%' OR method = 'session/update' AND raw_json LIKE '%"terminal"%') AND key_id IS NULL
+ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var (
+		t   terminalTracker
+		ups []terminalUpdate
+	)
+	for rows.Next() {
+		var (
+			r                   Record
+			ts                  int64
+			isReq, isNotify     int
+			raw                 string
+			session, corr, conn sql.NullString
+			code                sql.NullInt64
+		)
+		if err := rows.Scan(&ts, &session, &r.Method, &isReq, &isNotify, &raw, &corr, &conn, &code); err != nil {
+			rows.Close()
+			return err
+		}
+		r.Timestamp, r.IsRequest, r.IsNotify = time.UnixMilli(ts), isReq != 0, isNotify != 0
+		r.SessionID, r.CorrelationID, r.ConnID, r.Raw = session.String, corr.String, conn.String, []byte(raw)
+		if code.Valid {
+			r.Error = &RPCError{Code: int(code.Int64)}
+		}
+		ups = append(ups, t.observe(r)...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return applyTerminals(ctx, tx, ups)
+}
+
+// pruneTerminals deletes the terminals created before cutoff, as retention
+// does with their events.
+func pruneTerminals(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `
+DELETE FROM terminal_output WHERE (session_id, terminal_id) IN (
+  SELECT session_id, terminal_id FROM terminals WHERE created_unix_ms < ?);
+DELETE FROM terminals WHERE created_unix_ms < ?;`, cutoff, cutoff)
+	return err
+}
+
+// TerminalFilter selects terminals. Zero-valued fields are ignored.
+type TerminalFilter struct {
+	SessionID string
+	ID        string
+	// Since and Until bound the creation of a terminal.
+	Since time.Time
+	Until time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f TerminalFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.SessionID != "" {
+		conds = append(conds, "session_id = ?")
+		args = append(args, f.SessionID)
+	}
+	if f.ID != "" {
+		conds = append(conds, "terminal_id = ?")
+		args = append(args, f.ID)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "created_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "created_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Terminals returns the terminals matching f in the order they were
+// created.
+func (s *Store) Terminals(ctx context.Context, f TerminalFilter) ([]Terminal, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT session_id, terminal_id, conn_id, tool_call_id, command, args, cwd, env, key_id, output_byte_limit, created_unix_ms,
+  exited_unix_ms, exit_code, signal, killed_unix_ms, released_unix_ms, truncated, output_bytes
+FROM terminals`+where+`
+ORDER BY created_unix_ms, session_id, terminal_id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Terminal
+	for rows.Next() {
+		var (
+			t                             Terminal
+			conn, toolCall, command, argv sql.NullString
+			cwd, env, keyID, signal       sql.NullString
+			limit, exited, code           sql.NullInt64
+			killed, released              sql.NullInt64
+			created                       int64
+			truncated                     int
+		)
+		if err := rows.Scan(&t.SessionID, &t.ID, &conn, &toolCall, &command, &argv, &cwd, &env, &keyID, &limit, &created,
+			&exited, &code, &signal, &killed, &released, &truncated, &t.OutputBytes); err != nil {
+			return nil, err
+		}
+		if keyID.Valid {
+			s.openTerminal(ctx, keyID.String, &command, &argv, &cwd, &env, &t)
+		}
+		t.ConnID, t.ToolCallID, t.Command, t.Cwd, t.Signal = conn.String, toolCall.String, command.String, cwd.String, signal.String
+		if argv.Valid {
+			_ = json.Unmarshal([]byte(argv.String), &t.Args)
+		}
+		if env.Valid {
+			_ = json.Unmarshal([]byte(env.String), &t.Env)
+		}
+		t.OutputByteLimit = int(limit.Int64)
+		t.Created = time.UnixMilli(created)
+		if exited.Valid {
+			t.Exited = time.UnixMilli(exited.Int64)
+		}
+		if code.Valid {
+			n := int(code.Int64)
+			t.ExitCode = &n
+		}
+		if killed.Valid {
+			t.Killed = time.UnixMilli(killed.Int64)
+		}
+		if released.Valid {
+			t.Released = time.UnixMilli(released.Int64)
+		}
+		t.Truncated = truncated != 0
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// TerminalOutput returns the output recorded for a terminal, oldest first.
+func (s *Store) TerminalOutput(ctx context.Context, sessionID, terminalID string) ([]TerminalOutput, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT ts_unix_ms, data, reset, truncated, key_id FROM terminal_output
+WHERE session_id = ? AND terminal_id = ? ORDER BY id`, sessionID, terminalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []TerminalOutput
+	for rows.Next() {
+		var (
+			o                TerminalOutput
+			ts               int64
+			reset, truncated int
+			keyID            sql.NullString
+		)
+		if err := rows.Scan(&ts, &o.Data, &reset, &truncated, &keyID); err != nil {
+			return nil, err
+		}
+		o.Time, o.Reset, o.Truncated = time.UnixMilli(ts), reset != 0, truncated != 0
+		if keyID.Valid {
+			s.openTerminalOutput(ctx, keyID.String, &o)
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// openTerminal decrypts the command, args, cwd and env of t in place. If
+// the data key is not available they are cleared and t.Sealed is set.
+func (s *Store) openTerminal(ctx context.Context, keyID string, command, argv, cwd, env *sql.NullString, t *Terminal) {
+	fields := []struct {
+		label string
+		v     *sql.NullString
+	}{
+		{"terminal_command", command}, {"terminal_args", argv}, {"terminal_cwd", cwd}, {"terminal_env", env},
+	}
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		opened := make([][]byte, len(fields))
+		for i, f := range fields {
+			if opened[i], err = openField(aead, f.label, f.v.String); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			for i, f := range fields {
+				f.v.String = string(opened[i])
+			}
+			return
+		}
+	}
+	for _, f := range fields {
+		*f.v = sql.NullString{}
+	}
+	t.Sealed = true
+}
+
+// openTerminalOutput decrypts the data of o. If the data key is not
+// available the data is cleared and o.Sealed is set.
+func (s *Store) openTerminalOutput(ctx context.Context, keyID string, o *TerminalOutput) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		if data, err := openField(aead, "terminal_output", o.Data); err == nil {
+			o.Data = string(data)
+			return
+		}
+	}
+	o.Data, o.Sealed = "", true
+}
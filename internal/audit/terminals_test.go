@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// terminalRecords is an agent running a command, polling its output
+// twice, the second time after the editor dropped the first line, and
+// releasing the terminal.
+func terminalRecords() []Record {
+	down, up := DirectionDownstreamToUpstream, DirectionUpstreamToDownstream
+	return []Record{
+		{Direction: down, SessionID: "s1", Method: "terminal/create", IsRequest: true, CorrelationID: "c1-1", Status: StatusPending,
+			Raw: []byte(`{"sessionId":"s1","command":"make","args":["test"],"cwd":"/w","outputByteLimit":12,` +
+				`"env":[{"name":"CI","value":"1"},{"name":"API_TOKEN","value":"hunter2"}]}`)},
+		{Direction: up, SessionID: "s1", Method: "terminal/create", CorrelationID: "c1-1", Raw: []byte(`{"terminalId":"t1"}`)},
+		{Direction: up, SessionID: "s1", Method: "session/update", IsNotify: true,
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call","toolCallId":"call_1","content":[{"type":"terminal","terminalId":"t1"}]}}`)},
+		{Direction: down, SessionID: "s1", Method: "terminal/output", IsRequest: true, CorrelationID: "c1-2", Status: StatusPending,
+			Raw: []byte(`{"sessionId":"s1","terminalId":"t1"}`)},
+		{Direction: up, SessionID: "s1", Method: "terminal/output", CorrelationID: "c1-2", Raw: []byte(`{"output":"one\ntwo\n","truncated":false}`)},
+		{Direction: down, SessionID: "s1", Method: "terminal/output", IsRequest: true, CorrelationID: "c1-3", Status: StatusPending,
+			Raw: []byte(`{"sessionId":"s1","terminalId":"t1"}`)},
+		{Direction: up, SessionID: "s1", Method: "terminal/output", CorrelationID: "c1-3",
+			Raw: []byte(`{"output":"two\nthree\n","truncated":true,"exitStatus":{"exitCode":2}}`)},
+		{Direction: down, SessionID: "s1", Method: "terminal/release", IsRequest: true, CorrelationID: "c1-4", Status: StatusPending,
+			Raw: []byte(`{"sessionId":"s1","terminalId":"t1"}`)},
+		{Direction: up, SessionID: "s1", Method: "terminal/release", CorrelationID: "c1-4", Raw: []byte(`{}`)},
+	}
+}
+
+func checkTerminal(t *testing.T, s *Store) {
+	t.Helper()
+	ctx := context.Background()
+	terms, err := s.Terminals(ctx, TerminalFilter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("Terminals: %v", err)
+	}
+	if len(terms) != 1 {
+		t.Fatalf("expected 1 terminal, got %+v", terms)
+	}
+	term := terms[0]
+	if term.ID != "t1" || term.Command != "make" || strings.Join(term.Args, " ") != "test" || term.Cwd != "/w" ||
+		term.OutputByteLimit != 12 || term.ToolCallID != "call_1" {
+		t.Fatalf("unexpected terminal: %+v", term)
+	}
+	if term.Env["CI"] != "1" || term.Env["API_TOKEN"] != "[REDACTED]" {
+		t.Fatalf("unexpected env: %v", term.Env)
+	}
+	if term.ExitCode == nil || *term.ExitCode != 2 || term.Exited.IsZero() || term.Released.IsZero() || !term.Truncated ||
+		term.OutputBytes != len("one\ntwo\nthree\n") {
+		t.Fatalf("unexpected end of terminal: %+v", term)
+	}
+	out, err := s.TerminalOutput(ctx, "s1", "t1")
+	if err != nil {
+		t.Fatalf("TerminalOutput: %v", err)
+	}
+	if len(out) != 2 || out[0].Data != "one\ntwo\n" || out[1].Data != "three\n" || out[1].Reset || !out[1].Truncated {
+		t.Fatalf("unexpected output: %+v", out)
+	}
+}
+
+func TestTerminals(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	for _, r := range terminalRecords() {
+		r.Timestamp = time.Now()
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	var data string
+	if err := s.db.QueryRowContext(ctx, `SELECT data FROM terminal_output ORDER BY id LIMIT 1`).Scan(&data); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.Contains(data, "one") {
+		t.Fatalf("output stored in plaintext: %s", data)
+	}
+	var command, env string
+	if err := s.db.QueryRowContext(ctx, `SELECT command, env FROM terminals`).Scan(&command, &env); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if command == "make" || strings.Contains(env, "CI") {
+		t.Fatalf("command or env stored in plaintext: %s %s", command, env)
+	}
+	checkTerminal(t, s)
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	out, err := s.TerminalOutput(ctx, "s1", "t1")
+	if err != nil {
+		t.Fatalf("TerminalOutput: %v", err)
+	}
+	if len(out) != 2 || !out[0].Sealed || out[0].Data != "" {
+		t.Fatalf("unexpected output without key: %+v", out)
+	}
+	terms, err := s.Terminals(ctx, TerminalFilter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("Terminals: %v", err)
+	}
+	if len(terms) != 1 || !terms[0].Sealed || terms[0].Command != "" || terms[0].Env != nil || terms[0].OutputBytes == 0 {
+		t.Fatalf("unexpected terminal without key: %+v", terms)
+	}
+}
+
+func TestTerminalsBackfill(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, r := range terminalRecords() {
+		r.Timestamp = time.Now()
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	s = reopenBefore(t, s, path, "terminals tables", `DROP TABLE terminals`, `DROP TABLE terminal_output`)
+	checkTerminal(t, s)
+}
+
+func TestOutputDelta(t *testing.T) {
+	for _, tc := range []struct {
+		prev, cur, delta string
+		reset            bool
+	}{
+		{"", "a\n", "a\n", false},
+		{"a\n", "a\nb\n", "b\n", false},
+		{"a\nb\n", "b\nc\n", "c\n", false},
+		{"a\nb\n", "b\n", "", false},
+		{"a\nb\n", "x\n", "x\n", true},
+	} {
+		delta, reset := outputDelta(tc.prev, tc.cur)
+		if delta != tc.delta || reset != tc.reset {
+			t.Fatalf("outputDelta(%q, %q) = %q, %v; want %q, %v", tc.prev, tc.cur, delta, reset, tc.delta, tc.reset)
+		}
+	}
+}
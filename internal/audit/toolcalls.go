@@ -0,0 +1,465 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The tool_calls table has one row per tool call an agent reported, keyed
+// by session and toolCallId, with the latest title, kind, status,
+// locations and raw input/output. tool_call_transitions records every
+// status change. Both are derived from session/update notifications of
+// type tool_call and tool_call_update, and from the tool call carried by
+// session/request_permission.
+//
+// On encrypted stores raw_input and raw_output are encrypted with the data
+// key named in key_id, like the payload of the event they came from, and
+// locations with the one named in locations_key_id. Titles and kinds stay
+// in plaintext for the permission reports that group by them.
+
+const toolCallsSchema = `
+CREATE TABLE IF NOT EXISTS tool_calls (
+  session_id TEXT NOT NULL,
+  tool_call_id TEXT NOT NULL,
+  conn_id TEXT,
+  title TEXT,
+  kind TEXT,
+  status TEXT,
+  locations TEXT,
+  raw_input TEXT,
+  raw_output TEXT,
+  key_id TEXT,
+  created_unix_ms INTEGER NOT NULL,
+  updated_unix_ms INTEGER NOT NULL,
+  ended_unix_ms INTEGER,
+  duration_ms INTEGER,
+  PRIMARY KEY (session_id, tool_call_id)
+);
+CREATE INDEX IF NOT EXISTS idx_tool_calls_created ON tool_calls(created_unix_ms);
+
+CREATE TABLE IF NOT EXISTS tool_call_transitions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT NOT NULL,
+  tool_call_id TEXT NOT NULL,
+  status TEXT NOT NULL,
+  ts_unix_ms INTEGER NOT NULL,
+  duration_ms INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_tool_call_transitions_call ON tool_call_transitions(session_id, tool_call_id);`
+
+// Tool call statuses defined by ACP.
+const (
+	ToolPending    = "pending"
+	ToolInProgress = "in_progress"
+	ToolCompleted  = "completed"
+	ToolFailed     = "failed"
+)
+
+// ToolCall is one row of the tool_calls table.
+type ToolCall struct {
+	SessionID string
+	ID        string
+	ConnID    string
+	Title     string
+	Kind      string
+	Status    string
+	Locations []ToolCallLocation
+	RawInput  json.RawMessage
+	RawOutput json.RawMessage
+	// Sealed is set when RawInput, RawOutput or Locations are encrypted
+	// with a key the store does not have.
+	Sealed bool
+
+	Created time.Time
+	Updated time.Time
+	// Ended is when the call completed or failed; zero before that.
+	Ended time.Time
+	// Duration is the time from creation to Ended.
+	Duration time.Duration
+
+	Transitions []ToolCallTransition
+}
+
+// ToolCallLocation is a file affected by a tool call.
+type ToolCallLocation struct {
+	Path string `json:"path"`
+	Line *int   `json:"line,omitempty"`
+}
+
+// ToolCallTransition is a change of a tool call's status.
+type ToolCallTransition struct {
+	Status string
+	Time   time.Time
+	// Duration is the time spent in the previous status, or since the
+	// call was created for the first transition.
+	Duration time.Duration
+}
+
+// toolCallUpdate is one change to a tool_calls row. Empty fields leave the
+// column unchanged.
+type toolCallUpdate struct {
+	SessionID, ID, ConnID string
+	At                    int64
+
+	Title, Kind, Status string
+	Locations           string
+	RawInput, RawOutput string
+	// KeyID encrypts RawInput and RawOutput, LocationsKeyID Locations.
+	KeyID, LocationsKeyID string
+}
+
+// toolCallUpdates returns the tool call changes reported by r.
+func toolCallUpdates(r Record) []toolCallUpdate {
+	if r.SessionID == "" {
+		return nil
+	}
+	var call *toolCallJSON
+	switch {
+	case r.Method == "session/update" && r.IsNotify:
+		var p struct {
+			Update toolCallJSON `json:"update"`
+		}
+		if json.Unmarshal(r.Raw, &p) != nil {
+			return nil
+		}
+		if p.Update.SessionUpdate != "tool_call" && p.Update.SessionUpdate != "tool_call_update" {
+			return nil
+		}
+		call = &p.Update
+	case r.Method == "session/request_permission" && r.IsRequest:
+		var p struct {
+			ToolCall *toolCallJSON `json:"toolCall"`
+		}
+		if json.Unmarshal(r.Raw, &p) != nil || p.ToolCall == nil {
+			return nil
+		}
+		call = p.ToolCall
+	}
+	if call == nil || call.ToolCallID == "" {
+		return nil
+	}
+	u := toolCallUpdate{
+		SessionID: r.SessionID,
+		ID:        call.ToolCallID,
+		ConnID:    r.ConnID,
+		At:        r.Timestamp.UnixMilli(),
+		Title:     call.Title,
+		Kind:      call.Kind,
+		Status:    call.Status,
+		RawInput:  jsonOrEmpty(call.RawInput),
+		RawOutput: jsonOrEmpty(call.RawOutput),
+		Locations: jsonOrEmpty(call.Locations),
+	}
+	// A new tool call is pending unless it says otherwise.
+	if call.SessionUpdate == "tool_call" && u.Status == "" {
+		u.Status = ToolPending
+	}
+	return []toolCallUpdate{u}
+}
+
+type toolCallJSON struct {
+	SessionUpdate string          `json:"sessionUpdate"`
+	ToolCallID    string          `json:"toolCallId"`
+	Title         string          `json:"title"`
+	Kind          string          `json:"kind"`
+	Status        string          `json:"status"`
+	Locations     json.RawMessage `json:"locations"`
+	RawInput      json.RawMessage `json:"rawInput"`
+	RawOutput     json.RawMessage `json:"rawOutput"`
+}
+
+// sealToolCalls encrypts the locations and raw input and output of ups.
+func (s *Store) sealToolCalls(ctx context.Context, ups []toolCallUpdate) error {
+	dk, err := s.writeKey(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range ups {
+		u := &ups[i]
+		if u.Locations != "" {
+			if u.Locations, err = seal(dk.aead, "tool_locations", []byte(u.Locations)); err != nil {
+				return err
+			}
+			u.LocationsKeyID = dk.id
+		}
+		if u.RawInput == "" && u.RawOutput == "" {
+			continue
+		}
+		if u.RawInput != "" {
+			if u.RawInput, err = seal(dk.aead, "tool_raw_input", []byte(u.RawInput)); err != nil {
+				return err
+			}
+		}
+		if u.RawOutput != "" {
+			if u.RawOutput, err = seal(dk.aead, "tool_raw_output", []byte(u.RawOutput)); err != nil {
+				return err
+			}
+		}
+		u.KeyID = dk.id
+	}
+	return nil
+}
+
+func applyToolCalls(ctx context.Context, db dbtx, ups []toolCallUpdate) error {
+	for _, u := range ups {
+		var (
+			status  sql.NullString
+			created int64
+			last    sql.NullInt64
+		)
+		err := db.QueryRowContext(ctx, `
+SELECT status, created_unix_ms,
+  (SELECT MAX(ts_unix_ms) FROM tool_call_transitions t WHERE t.session_id = c.session_id AND t.tool_call_id = c.tool_call_id)
+FROM tool_calls c WHERE session_id = ? AND tool_call_id = ?`, u.SessionID, u.ID).Scan(&status, &created, &last)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if !exists {
+			created = u.At
+		}
+		changed := u.Status != "" && u.Status != status.String
+		var ended, duration any
+		if changed && (u.Status == ToolCompleted || u.Status == ToolFailed) {
+			ended, duration = u.At, u.At-created
+		}
+		_, err = db.ExecContext(ctx, `
+INSERT INTO tool_calls(session_id, tool_call_id, conn_id, title, kind, status, locations, locations_key_id, raw_input, raw_output, key_id,
+  created_unix_ms, updated_unix_ms, ended_unix_ms, duration_ms)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(session_id, tool_call_id) DO UPDATE SET
+  conn_id = COALESCE(excluded.conn_id, conn_id),
+  title = COALESCE(excluded.title, title),
+  kind = COALESCE(excluded.kind, kind),
+  status = COALESCE(excluded.status, status),
+  locations_key_id = CASE WHEN excluded.locations IS NULL THEN locations_key_id ELSE excluded.locations_key_id END,
+  locations = COALESCE(excluded.locations, locations),
+  raw_input = COALESCE(excluded.raw_input, raw_input),
+  raw_output = COALESCE(excluded.raw_output, raw_output),
+  key_id = COALESCE(excluded.key_id, key_id),
+  updated_unix_ms = MAX(updated_unix_ms, excluded.updated_unix_ms),
+  ended_unix_ms = COALESCE(excluded.ended_unix_ms, ended_unix_ms),
+  duration_ms = COALESCE(excluded.duration_ms, duration_ms);
+`, u.SessionID, u.ID, nullIfEmpty(u.ConnID), nullIfEmpty(u.Title), nullIfEmpty(u.Kind), nullIfEmpty(u.Status), nullIfEmpty(u.Locations),
+			nullIfEmpty(u.LocationsKeyID), nullIfEmpty(u.RawInput), nullIfEmpty(u.RawOutput), nullIfEmpty(u.KeyID), u.At, u.At, ended, duration)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		since := created
+		if last.Valid {
+			since = last.Int64
+		}
+		var spent any
+		if exists {
+			spent = u.At - since
+		}
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO tool_call_transitions(session_id, tool_call_id, status, ts_unix_ms, duration_ms) VALUES(?, ?, ?, ?, ?);
+`, u.SessionID, u.ID, u.Status, u.At, spent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillToolCalls derives the tool call tables from the plaintext events
+// recorded before they existed.
+func backfillToolCalls(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+SELECT ts_unix_ms, session_id, method, is_request, is_notify, raw_json, conn_id FROM audit_events
+WHERE method IN ('session/update', 'session/request_permission') AND session_id IS NOT NULL AND key_id IS NULL
+ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var ups []toolCallUpdate
+	for rows.Next() {
+		var (
+			r               Record
+			ts              int64
+			isReq, isNotify int
+			raw             string
+			conn            sql.NullString
+		)
+		if err := rows.Scan(&ts, &r.SessionID, &r.Method, &isReq, &isNotify, &raw, &conn); err != nil {
+			rows.Close()
+			return err
+		}
+		r.Timestamp, r.IsRequest, r.IsNotify = time.UnixMilli(ts), isReq != 0, isNotify != 0
+		r.Raw, r.ConnID = []byte(raw), conn.String
+		ups = append(ups, toolCallUpdates(r)...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return applyToolCalls(ctx, tx, ups)
+}
+
+// pruneToolCalls deletes the tool calls last updated before cutoff, as
+// retention does with their events.
+func pruneToolCalls(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `
+DELETE FROM tool_call_transitions WHERE (session_id, tool_call_id) IN (
+  SELECT session_id, tool_call_id FROM tool_calls WHERE updated_unix_ms < ?);
+DELETE FROM tool_calls WHERE updated_unix_ms < ?;`, cutoff, cutoff)
+	return err
+}
+
+// ToolCallFilter selects tool calls. Zero-valued fields are ignored.
+type ToolCallFilter struct {
+	SessionID string
+	ID        string
+	Kind      string
+	Status    string
+	// Since and Until bound the creation of a tool call.
+	Since time.Time
+	Until time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f ToolCallFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	for _, c := range []struct{ col, v string }{
+		{"session_id", f.SessionID}, {"tool_call_id", f.ID}, {"kind", f.Kind}, {"status", f.Status},
+	} {
+		if c.v != "" {
+			conds = append(conds, c.col+" = ?")
+			args = append(args, c.v)
+		}
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "created_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "created_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ToolCalls returns the tool calls matching f with their status
+// transitions, in the order they were created.
+func (s *Store) ToolCalls(ctx context.Context, f ToolCallFilter) ([]ToolCall, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT session_id, tool_call_id, conn_id, title, kind, status, locations, locations_key_id, raw_input, raw_output, key_id,
+  created_unix_ms, updated_unix_ms, ended_unix_ms, duration_ms
+FROM tool_calls`+where+`
+ORDER BY created_unix_ms, session_id, tool_call_id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	var out []ToolCall
+	for rows.Next() {
+		var (
+			c                               ToolCall
+			conn, title, kind, status, locs sql.NullString
+			locsKeyID, rawIn, rawOut, keyID sql.NullString
+			created, updated                int64
+			ended, duration                 sql.NullInt64
+		)
+		if err := rows.Scan(&c.SessionID, &c.ID, &conn, &title, &kind, &status, &locs, &locsKeyID, &rawIn, &rawOut, &keyID,
+			&created, &updated, &ended, &duration); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.ConnID, c.Title, c.Kind, c.Status = conn.String, title.String, kind.String, status.String
+		if locs.Valid && locsKeyID.Valid {
+			s.openLocations(ctx, locsKeyID.String, &locs.String, &c)
+		}
+		if locs.Valid {
+			_ = json.Unmarshal([]byte(locs.String), &c.Locations)
+		}
+		c.RawInput, c.RawOutput = rawOrNil(rawIn), rawOrNil(rawOut)
+		if keyID.Valid {
+			s.openToolCall(ctx, keyID.String, &c)
+		}
+		c.Created, c.Updated = time.UnixMilli(created), time.UnixMilli(updated)
+		if ended.Valid {
+			c.Ended = time.UnixMilli(ended.Int64)
+		}
+		c.Duration = time.Duration(duration.Int64) * time.Millisecond
+		out = append(out, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range out {
+		c := &out[i]
+		trows, err := s.db.QueryContext(ctx, `
+SELECT status, ts_unix_ms, duration_ms FROM tool_call_transitions
+WHERE session_id = ? AND tool_call_id = ? ORDER BY id`, c.SessionID, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		for trows.Next() {
+			var (
+				t     ToolCallTransition
+				ts    int64
+				spent sql.NullInt64
+			)
+			if err := trows.Scan(&t.Status, &ts, &spent); err != nil {
+				trows.Close()
+				return nil, err
+			}
+			t.Time = time.UnixMilli(ts)
+			t.Duration = time.Duration(spent.Int64) * time.Millisecond
+			c.Transitions = append(c.Transitions, t)
+		}
+		trows.Close()
+		if err := trows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// openToolCall decrypts the raw input and output of c. If the data key is
+// not available they are cleared and c.Sealed is set.
+func (s *Store) openToolCall(ctx context.Context, keyID string, c *ToolCall) {
+	aead, err := s.readKey(ctx, keyID)
+	if err == nil {
+		var in, out []byte
+		if in, err = openField(aead, "tool_raw_input", string(c.RawInput)); err == nil {
+			out, err = openField(aead, "tool_raw_output", string(c.RawOutput))
+		}
+		if err == nil {
+			c.RawInput, c.RawOutput = in, out
+			return
+		}
+	}
+	c.RawInput, c.RawOutput, c.Sealed = nil, nil, true
+}
+
+// openLocations decrypts the locations in *locs. If the data key is not
+// available *locs is cleared and c.Sealed is set.
+func (s *Store) openLocations(ctx context.Context, keyID string, locs *string, c *ToolCall) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		if b, err := openField(aead, "tool_locations", *locs); err == nil {
+			*locs = string(b)
+			return
+		}
+	}
+	*locs, c.Sealed = "", true
+}
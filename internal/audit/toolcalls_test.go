@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// toolCallRecords is the trail of a tool call that asks for permission,
+// runs and completes, plus a second call that fails.
+func toolCallRecords(base time.Time) []Record {
+	down := DirectionDownstreamToUpstream
+	records := []Record{
+		{Direction: down, SessionID: "s1", Method: "session/update", IsNotify: true, ConnID: "c1",
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call","toolCallId":"t1","title":"Edit main.go","kind":"edit","status":"pending","locations":[{"path":"/w/main.go","line":3}],"rawInput":{"path":"/w/main.go"}}}`)},
+		{Direction: down, SessionID: "s1", Method: "session/request_permission", IsRequest: true, ConnID: "c1",
+			Raw: []byte(`{"sessionId":"s1","toolCall":{"toolCallId":"t1","title":"Edit /w/main.go"},"options":[]}`)},
+		{Direction: down, SessionID: "s1", Method: "session/update", IsNotify: true, ConnID: "c1",
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call_update","toolCallId":"t1","status":"in_progress"}}`)},
+		{Direction: down, SessionID: "s1", Method: "session/update", IsNotify: true, ConnID: "c1",
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call","toolCallId":"t2","title":"Run tests","kind":"execute","status":"in_progress"}}`)},
+		{Direction: down, SessionID: "s1", Method: "session/update", IsNotify: true, ConnID: "c1",
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call_update","toolCallId":"t1","status":"completed","rawOutput":{"ok":true}}}`)},
+		{Direction: down, SessionID: "s1", Method: "session/update", IsNotify: true, ConnID: "c1",
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call_update","toolCallId":"t2","status":"failed"}}`)},
+	}
+	for i := range records {
+		records[i].Timestamp = base.Add(time.Duration(i) * time.Second)
+	}
+	return records
+}
+
+func TestToolCalls(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	if err := s.StartWriter(WriterOptions{}); err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	base := time.UnixMilli(time.Now().Add(-time.Hour).UnixMilli())
+	for _, r := range toolCallRecords(base) {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	calls, err := s.ToolCalls(ctx, ToolCallFilter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("ToolCalls: %v", err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 tool calls, got %+v", calls)
+	}
+	var t1 ToolCall
+	for _, c := range calls {
+		if c.ID == "t1" {
+			t1 = c
+		}
+	}
+	if t1.Title != "Edit /w/main.go" || t1.Kind != "edit" || t1.Status != ToolCompleted || t1.ConnID != "c1" {
+		t.Fatalf("unexpected tool call: %+v", t1)
+	}
+	if len(t1.Locations) != 1 || t1.Locations[0].Path != "/w/main.go" || t1.Locations[0].Line == nil || *t1.Locations[0].Line != 3 {
+		t.Fatalf("unexpected locations: %+v", t1.Locations)
+	}
+	if string(t1.RawInput) != `{"path":"/w/main.go"}` || string(t1.RawOutput) != `{"ok":true}` {
+		t.Fatalf("unexpected raw input/output: %s %s", t1.RawInput, t1.RawOutput)
+	}
+	if !t1.Created.Equal(base) || !t1.Ended.Equal(base.Add(4*time.Second)) || t1.Duration != 4*time.Second {
+		t.Fatalf("unexpected times: %+v", t1)
+	}
+	want := []ToolCallTransition{
+		{Status: ToolPending, Time: base},
+		{Status: ToolInProgress, Time: base.Add(2 * time.Second), Duration: 2 * time.Second},
+		{Status: ToolCompleted, Time: base.Add(4 * time.Second), Duration: 2 * time.Second},
+	}
+	if len(t1.Transitions) != len(want) {
+		t.Fatalf("unexpected transitions: %+v", t1.Transitions)
+	}
+	for i, tr := range t1.Transitions {
+		if tr.Status != want[i].Status || !tr.Time.Equal(want[i].Time) || tr.Duration != want[i].Duration {
+			t.Fatalf("transition %d = %+v, want %+v", i, tr, want[i])
+		}
+	}
+
+	for _, f := range []ToolCallFilter{{Kind: "execute"}, {Status: ToolFailed}, {ID: "t2"}} {
+		if got, _ := s.ToolCalls(ctx, f); len(got) != 1 || got[0].ID != "t2" || got[0].Duration != 2*time.Second {
+			t.Fatalf("filter %+v: got %+v", f, got)
+		}
+	}
+}
+
+func TestToolCallsEncrypted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	for _, r := range toolCallRecords(time.Now()) {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	var raw, locs string
+	if err := s.db.QueryRowContext(ctx, `SELECT raw_input, locations FROM tool_calls WHERE tool_call_id = 't1'`).Scan(&raw, &locs); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.Contains(raw+locs, "main.go") {
+		t.Fatalf("raw input or locations stored in plaintext: %s %s", raw, locs)
+	}
+	calls, err := s.ToolCalls(ctx, ToolCallFilter{ID: "t1"})
+	if err != nil {
+		t.Fatalf("ToolCalls: %v", err)
+	}
+	if len(calls) != 1 || calls[0].Sealed || string(calls[0].RawInput) != `{"path":"/w/main.go"}` ||
+		len(calls[0].Locations) != 1 || calls[0].Locations[0].Path != "/w/main.go" {
+		t.Fatalf("unexpected tool call with key: %+v", calls)
+	}
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	calls, err = s.ToolCalls(ctx, ToolCallFilter{ID: "t1"})
+	if err != nil {
+		t.Fatalf("ToolCalls: %v", err)
+	}
+	if len(calls) != 1 || !calls[0].Sealed || calls[0].RawInput != nil || calls[0].Locations != nil || calls[0].Title != "Edit /w/main.go" {
+		t.Fatalf("unexpected tool call without key: %+v", calls)
+	}
+}
+
+func TestToolCallsBackfill(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	base := time.UnixMilli(time.Now().Add(-time.Hour).UnixMilli())
+	for _, r := range toolCallRecords(base) {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	s = reopenBefore(t, s, path, "tool call tables", `DROP TABLE tool_calls`, `DROP TABLE tool_call_transitions`)
+	calls, err := s.ToolCalls(ctx, ToolCallFilter{ID: "t1"})
+	if err != nil {
+		t.Fatalf("ToolCalls: %v", err)
+	}
+	if len(calls) != 1 || calls[0].Status != ToolCompleted || calls[0].Duration != 4*time.Second || len(calls[0].Transitions) != 3 {
+		t.Fatalf("unexpected backfilled tool call: %+v", calls)
+	}
+	if string(calls[0].RawOutput) != `{"ok":true}` || len(calls[0].Locations) != 1 {
+		t.Fatalf("unexpected backfilled payloads: %+v", calls[0])
+	}
+}
@@ -0,0 +1,402 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The turns table has one row per prompt turn, written when the turn ends:
+// the prompt text, the agent message and thought chunks streamed during
+// the turn joined together, the stop reason and timing. Turns are only
+// recorded when enabled with SetTurns, which can also keep the chunks out
+// of audit_events.
+//
+// On encrypted stores the texts are encrypted with the data key named in
+// key_id, like the payloads they were taken from.
+
+const turnsSchema = `
+CREATE TABLE IF NOT EXISTS turns (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT NOT NULL,
+  conn_id TEXT,
+  corr_id TEXT,
+  started_unix_ms INTEGER NOT NULL,
+  first_chunk_unix_ms INTEGER,
+  ended_unix_ms INTEGER NOT NULL,
+  status TEXT NOT NULL,
+  stop_reason TEXT,
+  error_message TEXT,
+  chunks INTEGER NOT NULL,
+  user_text TEXT,
+  agent_text TEXT,
+  thought_text TEXT,
+  key_id TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_turns_session ON turns(session_id, id);
+CREATE INDEX IF NOT EXISTS idx_turns_started ON turns(started_unix_ms);`
+
+// TurnMode selects what the store records of the message chunks streamed
+// during a prompt turn.
+type TurnMode string
+
+const (
+	// TurnsOff records every chunk as an event and no turns.
+	TurnsOff TurnMode = ""
+	// TurnsKeep records every chunk as an event and each turn in turns.
+	TurnsKeep TurnMode = "keep"
+	// TurnsDrop records each turn in turns and leaves out the events of
+	// the text chunks it holds.
+	TurnsDrop TurnMode = "drop"
+)
+
+// ParseTurnMode parses the -audit-turns values off, keep and drop.
+func ParseTurnMode(v string) (TurnMode, error) {
+	switch v {
+	case "", "off":
+		return TurnsOff, nil
+	case string(TurnsKeep), string(TurnsDrop):
+		return TurnMode(v), nil
+	}
+	return TurnsOff, fmt.Errorf("unknown turn mode %q (want off, keep or drop)", v)
+}
+
+// SetTurns enables turn recording from now on. Set it before the store is
+// shared.
+func (s *Store) SetTurns(mode TurnMode) {
+	s.turns.mode = mode
+}
+
+// Turn is one row of the turns table.
+type Turn struct {
+	ID            int64
+	SessionID     string
+	ConnID        string
+	CorrelationID string
+
+	Started time.Time
+	// FirstChunk is when the first message or thought chunk arrived; zero
+	// if there was none.
+	FirstChunk time.Time
+	Ended      time.Time
+	Duration   time.Duration
+
+	// Status is completed, failed or abandoned.
+	Status       Status
+	StopReason   string
+	ErrorMessage string
+	// Chunks counts the message and thought chunks joined into the texts.
+	Chunks int
+
+	UserText    string
+	AgentText   string
+	ThoughtText string
+
+	// Sealed is set when the texts are encrypted with a key the store does
+	// not have.
+	Sealed bool
+}
+
+// turnUpdate is one row to insert into turns.
+type turnUpdate struct {
+	SessionID, ConnID, CorrID     string
+	Started, FirstChunk, Ended    int64
+	Status                        Status
+	StopReason, ErrorMessage      string
+	Chunks                        int
+	UserText, AgentText, Thoughts string
+	KeyID                         string
+}
+
+// turnTracker accumulates the chunks of the open turn of each session.
+type turnTracker struct {
+	mode TurnMode
+
+	mu   sync.Mutex
+	open map[string]*turnState
+}
+
+type turnState struct {
+	corrID, conn   string
+	started, first int64
+	user           string
+	agent, thought strings.Builder
+	chunks         int
+}
+
+// observe returns the turn r ends, if any, and reports whether r is a text
+// chunk that the turn holds.
+func (t *turnTracker) observe(r Record) (ups []turnUpdate, chunk bool) {
+	if t.mode == TurnsOff || r.SessionID == "" {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	at := r.Timestamp.UnixMilli()
+	switch {
+	case r.Method == "session/prompt" && r.IsRequest:
+		// A turn still open was never answered.
+		if st := t.open[r.SessionID]; st != nil {
+			ups = append(ups, st.close(r.SessionID, StatusAbandoned, at))
+		}
+		if t.open == nil {
+			t.open = map[string]*turnState{}
+		}
+		t.open[r.SessionID] = &turnState{corrID: r.CorrelationID, conn: connOf(r), started: at, user: r.UserText}
+	case r.Method == "session/prompt" && !r.IsNotify:
+		st := t.open[r.SessionID]
+		if st == nil || st.corrID != r.CorrelationID {
+			return nil, false
+		}
+		delete(t.open, r.SessionID)
+		if r.Error != nil {
+			u := st.close(r.SessionID, StatusFailed, at)
+			u.ErrorMessage = r.Error.Message
+			return []turnUpdate{u}, false
+		}
+		var res struct {
+			StopReason string `json:"stopReason"`
+		}
+		_ = json.Unmarshal(r.Raw, &res)
+		u := st.close(r.SessionID, StatusCompleted, at)
+		u.StopReason = res.StopReason
+		return []turnUpdate{u}, false
+	case r.Method == "session/update" && r.IsNotify:
+		st := t.open[r.SessionID]
+		if st == nil || !strings.Contains(string(r.Raw), "_chunk") {
+			return nil, false
+		}
+		var n struct {
+			Update struct {
+				SessionUpdate string `json:"sessionUpdate"`
+				Content       struct {
+					Type string  `json:"type"`
+					Text *string `json:"text"`
+				} `json:"content"`
+			} `json:"update"`
+		}
+		if json.Unmarshal(r.Raw, &n) != nil || n.Update.Content.Type != "text" || n.Update.Content.Text == nil {
+			return nil, false
+		}
+		// The chunk text is taken from the extracted agent text, which is
+		// redacted like the payload.
+		switch n.Update.SessionUpdate {
+		case "agent_message_chunk":
+			st.agent.WriteString(r.AgentText)
+		case "agent_thought_chunk":
+			st.thought.WriteString(r.AgentText)
+		default:
+			return nil, false
+		}
+		if st.chunks == 0 {
+			st.first = at
+		}
+		st.chunks++
+		return nil, true
+	}
+	return ups, false
+}
+
+func (st *turnState) close(session string, status Status, at int64) turnUpdate {
+	return turnUpdate{
+		SessionID:  session,
+		ConnID:     st.conn,
+		CorrID:     st.corrID,
+		Started:    st.started,
+		FirstChunk: st.first,
+		Ended:      at,
+		Status:     status,
+		Chunks:     st.chunks,
+		UserText:   st.user,
+		AgentText:  st.agent.String(),
+		Thoughts:   st.thought.String(),
+	}
+}
+
+// finish returns the turn of the prompt request corrID if it ended with
+// status without a response.
+func (t *turnTracker) finish(corrID string, status Status, at time.Time) []turnUpdate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for session, st := range t.open {
+		if st.corrID == corrID {
+			delete(t.open, session)
+			return []turnUpdate{st.close(session, status, at.UnixMilli())}
+		}
+	}
+	return nil
+}
+
+// end returns the open turns of conn as abandoned.
+func (t *turnTracker) end(conn string, at time.Time) []turnUpdate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ups []turnUpdate
+	for session, st := range t.open {
+		if st.conn == conn {
+			delete(t.open, session)
+			ups = append(ups, st.close(session, StatusAbandoned, at.UnixMilli()))
+		}
+	}
+	return ups
+}
+
+// sealTurns encrypts the texts of ups.
+func (s *Store) sealTurns(ctx context.Context, ups []turnUpdate) error {
+	dk, err := s.writeKey(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range ups {
+		u := &ups[i]
+		for _, f := range []struct {
+			label string
+			v     *string
+		}{{"turn_user_text", &u.UserText}, {"turn_agent_text", &u.AgentText}, {"turn_thought_text", &u.Thoughts}} {
+			if *f.v == "" {
+				continue
+			}
+			if *f.v, err = seal(dk.aead, f.label, []byte(*f.v)); err != nil {
+				return err
+			}
+		}
+		u.KeyID = dk.id
+	}
+	return nil
+}
+
+func applyTurns(ctx context.Context, db dbtx, ups []turnUpdate) error {
+	for _, u := range ups {
+		var first any
+		if u.FirstChunk != 0 {
+			first = u.FirstChunk
+		}
+		if _, err := db.ExecContext(ctx, `
+INSERT INTO turns(session_id, conn_id, corr_id, started_unix_ms, first_chunk_unix_ms, ended_unix_ms, status, stop_reason,
+  error_message, chunks, user_text, agent_text, thought_text, key_id)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`, u.SessionID, nullIfEmpty(u.ConnID), nullIfEmpty(u.CorrID), u.Started, first, u.Ended, string(u.Status),
+			nullIfEmpty(u.StopReason), nullIfEmpty(u.ErrorMessage), u.Chunks, nullIfEmpty(u.UserText), nullIfEmpty(u.AgentText),
+			nullIfEmpty(u.Thoughts), nullIfEmpty(u.KeyID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneTurns deletes the turns that started before cutoff, as retention
+// does with their events.
+func pruneTurns(ctx context.Context, db execer, cutoff int64) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM turns WHERE started_unix_ms < ?`, cutoff)
+	return err
+}
+
+// TurnFilter selects turns. Zero-valued fields are ignored.
+type TurnFilter struct {
+	SessionID string
+	// Since and Until bound the start of a turn.
+	Since time.Time
+	Until time.Time
+
+	Limit  int
+	Offset int
+}
+
+func (f TurnFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.SessionID != "" {
+		conds = append(conds, "session_id = ?")
+		args = append(args, f.SessionID)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "started_unix_ms >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "started_unix_ms < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Turns returns the turns matching f in the order they ended.
+func (s *Store) Turns(ctx context.Context, f TurnFilter) ([]Turn, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("audit store not initialized")
+	}
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, session_id, conn_id, corr_id, started_unix_ms, first_chunk_unix_ms, ended_unix_ms, status, stop_reason,
+  error_message, chunks, user_text, agent_text, thought_text, key_id
+FROM turns`+where+`
+ORDER BY id`+Filter{Limit: f.Limit, Offset: f.Offset}.page(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Turn
+	for rows.Next() {
+		var (
+			t                    Turn
+			conn, corr           sql.NullString
+			stopReason, errMsg   sql.NullString
+			user, agent, thought sql.NullString
+			keyID                sql.NullString
+			started, ended       int64
+			first                sql.NullInt64
+			status               string
+		)
+		if err := rows.Scan(&t.ID, &t.SessionID, &conn, &corr, &started, &first, &ended, &status, &stopReason,
+			&errMsg, &t.Chunks, &user, &agent, &thought, &keyID); err != nil {
+			return nil, err
+		}
+		t.ConnID, t.CorrelationID = conn.String, corr.String
+		t.Started, t.Ended = time.UnixMilli(started), time.UnixMilli(ended)
+		t.Duration = t.Ended.Sub(t.Started)
+		if first.Valid {
+			t.FirstChunk = time.UnixMilli(first.Int64)
+		}
+		t.Status, t.StopReason, t.ErrorMessage = Status(status), stopReason.String, errMsg.String
+		t.UserText, t.AgentText, t.ThoughtText = user.String, agent.String, thought.String
+		if keyID.Valid {
+			s.openTurn(ctx, keyID.String, &t)
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// openTurn decrypts the texts of t. If the data key is not available the
+// texts are cleared and t.Sealed is set.
+func (s *Store) openTurn(ctx context.Context, keyID string, t *Turn) {
+	if aead, err := s.readKey(ctx, keyID); err == nil {
+		ok := true
+		for _, f := range []struct {
+			label string
+			v     *string
+		}{{"turn_user_text", &t.UserText}, {"turn_agent_text", &t.AgentText}, {"turn_thought_text", &t.ThoughtText}} {
+			if *f.v == "" {
+				continue
+			}
+			b, err := openField(aead, f.label, *f.v)
+			if err != nil {
+				ok = false
+				break
+			}
+			*f.v = string(b)
+		}
+		if ok {
+			return
+		}
+	}
+	t.UserText, t.AgentText, t.ThoughtText, t.Sealed = "", "", "", true
+}
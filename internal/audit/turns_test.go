@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// turnRecords is one prompt turn of session s1: a thought, two message
+// chunks, an image chunk and a tool call, ended with end_turn.
+func turnRecords() []Record {
+	down, up := DirectionDownstreamToUpstream, DirectionUpstreamToDownstream
+	chunk := func(kind, text string) Record {
+		return Record{Direction: up, SessionID: "s1", Method: "session/update", IsNotify: true, AgentText: text,
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"` + kind + `","content":{"type":"text","text":"` + text + `"}}}`)}
+	}
+	return []Record{
+		{Direction: down, SessionID: "s1", Method: "session/prompt", IsRequest: true, CorrelationID: "c1-1", Status: StatusPending,
+			UserText: "fix it", Raw: []byte(`{"sessionId":"s1","prompt":[{"type":"text","text":"fix it"}]}`)},
+		chunk("agent_thought_chunk", "hmm"),
+		chunk("agent_message_chunk", "Done, "),
+		{Direction: up, SessionID: "s1", Method: "session/update", IsNotify: true,
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"agent_message_chunk","content":{"type":"image","data":"AA==","mimeType":"image/png"}}}`)},
+		{Direction: up, SessionID: "s1", Method: "session/update", IsNotify: true,
+			Raw: []byte(`{"sessionId":"s1","update":{"sessionUpdate":"tool_call","toolCallId":"call_1","title":"Edit"}}`)},
+		chunk("agent_message_chunk", "see diff."),
+		{Direction: up, SessionID: "s1", Method: "session/prompt", CorrelationID: "c1-1", Raw: []byte(`{"stopReason":"end_turn"}`)},
+	}
+}
+
+func writeTurn(t *testing.T, s *Store, records []Record) {
+	t.Helper()
+	start := time.Now()
+	for i, r := range records {
+		r.Timestamp = start.Add(time.Duration(i) * time.Millisecond)
+		if err := s.Write(context.Background(), r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+}
+
+func TestTurns(t *testing.T) {
+	ctx := context.Background()
+	s := openTestStore(t)
+	s.SetTurns(TurnsKeep)
+	writeTurn(t, s, turnRecords())
+
+	turns, err := s.Turns(ctx, TurnFilter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("Turns: %v", err)
+	}
+	if len(turns) != 1 {
+		t.Fatalf("expected 1 turn, got %+v", turns)
+	}
+	turn := turns[0]
+	if turn.UserText != "fix it" || turn.AgentText != "Done, see diff." || turn.ThoughtText != "hmm" || turn.Chunks != 3 ||
+		turn.Status != StatusCompleted || turn.StopReason != "end_turn" || turn.CorrelationID != "c1-1" {
+		t.Fatalf("unexpected turn: %+v", turn)
+	}
+	if turn.Duration != 6*time.Millisecond || turn.FirstChunk.Sub(turn.Started) != time.Millisecond {
+		t.Fatalf("unexpected turn timing: %+v", turn)
+	}
+	events, err := s.Query(ctx, Filter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(events) != len(turnRecords()) {
+		t.Fatalf("expected every event to be kept, got %d", len(events))
+	}
+}
+
+func TestTurnsDrop(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	s.SetTurns(TurnsDrop)
+	writeTurn(t, s, turnRecords())
+	// A second turn that never gets a response.
+	writeTurn(t, s, []Record{
+		{Direction: DirectionDownstreamToUpstream, SessionID: "s1", Method: "session/prompt", IsRequest: true, CorrelationID: "c1-2",
+			Status: StatusPending, UserText: "again", Raw: []byte(`{"sessionId":"s1","prompt":[{"type":"text","text":"again"}]}`)},
+		turnRecords()[2],
+	})
+	if err := s.Finish(ctx, "c1-2", StatusAbandoned); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	events, err := s.Query(ctx, Filter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	// Both prompt requests, the first response, the image chunk and the
+	// tool call remain.
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %d", len(events))
+	}
+	for _, e := range events {
+		if e.AgentText != "" {
+			t.Fatalf("text chunk not dropped: %+v", e)
+		}
+	}
+	var agent string
+	if err := s.db.QueryRowContext(ctx, `SELECT agent_text FROM turns ORDER BY id LIMIT 1`).Scan(&agent); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.Contains(agent, "diff") {
+		t.Fatalf("turn text stored in plaintext: %s", agent)
+	}
+	turns, err := s.Turns(ctx, TurnFilter{})
+	if err != nil {
+		t.Fatalf("Turns: %v", err)
+	}
+	if len(turns) != 2 || turns[0].AgentText != "Done, see diff." ||
+		turns[1].Status != StatusAbandoned || turns[1].UserText != "again" || turns[1].AgentText != "Done, " {
+		t.Fatalf("unexpected turns: %+v", turns)
+	}
+	s.Close()
+
+	if s, err = Open(ctx, path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if turns, err = s.Turns(ctx, TurnFilter{SessionID: "s1"}); err != nil {
+		t.Fatalf("Turns: %v", err)
+	}
+	if len(turns) != 2 || !turns[0].Sealed || turns[0].AgentText != "" || turns[0].Chunks != 3 {
+		t.Fatalf("unexpected turns without key: %+v", turns)
+	}
+}
@@ -0,0 +1,487 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Overflow selects what Store.Write does when the writer's queue is full.
+type Overflow string
+
+const (
+	// OverflowBlock makes Write wait for room in the queue.
+	OverflowBlock Overflow = "block"
+	// OverflowDrop discards the record and counts it.
+	OverflowDrop Overflow = "drop"
+	// OverflowSpill appends the record to a spill file that is replayed
+	// into the database once the queue has drained.
+	OverflowSpill Overflow = "spill"
+)
+
+var (
+	// ErrQueueFull is returned by Write when a record is dropped.
+	ErrQueueFull = errors.New("audit queue full")
+	// ErrClosed is returned by Write after the store has been closed.
+	ErrClosed = errors.New("audit store closed")
+)
+
+// WriterOptions configures the background writer started by
+// Store.StartWriter.
+type WriterOptions struct {
+	// QueueSize bounds the number of records waiting to be written.
+	// Defaults to 4096.
+	QueueSize int
+	// BatchSize caps the number of records committed per transaction.
+	// Defaults to 256.
+	BatchSize int
+	// Overflow defaults to OverflowBlock.
+	Overflow Overflow
+	// SpillPath is the spill file used by OverflowSpill.
+	SpillPath string
+	// OnError is called with errors the writer cannot return to a caller,
+	// such as a failed commit. It is called from the writer goroutine.
+	OnError func(error)
+}
+
+// op is one queued write: a record to insert, a status update for a
+// request row, a maintenance function, or a flush marker. Derived changes
+// are applied after the record, in the same transaction.
+type op struct {
+	rec     *Record
+	corrID  string
+	status  Status
+	derived derived
+	fn      func(*sql.DB) error
+	errc    chan error
+	done    chan struct{}
+}
+
+// batchWriter owns all writes to the database once started. Records are
+// queued by Store.Write and committed by a single goroutine, in batches,
+// so callers never wait on SQLite.
+type batchWriter struct {
+	db   *sql.DB
+	opts WriterOptions
+	ch   chan op
+
+	mu      sync.RWMutex // guards closed against sends on ch
+	closed  bool
+	stopped chan struct{}
+	dropped atomic.Uint64 // records discarded under OverflowDrop
+	failed  atomic.Uint64 // records whose batch could not be committed
+
+	spillMu  sync.Mutex
+	spilling bool
+	spillN   int
+	spill    *os.File
+}
+
+func newBatchWriter(db *sql.DB, opts WriterOptions) (*batchWriter, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 4096
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 256
+	}
+	switch opts.Overflow {
+	case "":
+		opts.Overflow = OverflowBlock
+	case OverflowBlock, OverflowDrop, OverflowSpill:
+	default:
+		return nil, fmt.Errorf("unknown audit overflow policy %q", opts.Overflow)
+	}
+	w := &batchWriter{
+		db:      db,
+		opts:    opts,
+		ch:      make(chan op, opts.QueueSize),
+		stopped: make(chan struct{}),
+	}
+	if opts.Overflow == OverflowSpill {
+		if opts.SpillPath == "" {
+			return nil, fmt.Errorf("audit overflow policy spill needs a spill path")
+		}
+		f, err := os.OpenFile(opts.SpillPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open audit spill file: %w", err)
+		}
+		w.spill = f
+		// Records spilled by a previous run are replayed on start.
+		if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+			w.spilling, w.spillN = true, 1
+		}
+	}
+	return w, nil
+}
+
+func (w *batchWriter) enqueue(ctx context.Context, o op) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	switch w.opts.Overflow {
+	case OverflowDrop:
+		select {
+		case w.ch <- o:
+			return nil
+		default:
+			w.dropped.Add(1)
+			return ErrQueueFull
+		}
+	case OverflowSpill:
+		w.spillMu.Lock()
+		defer w.spillMu.Unlock()
+		// Once spilling, everything goes to the spill file until it has
+		// been replayed, so records keep their order.
+		if !w.spilling {
+			select {
+			case w.ch <- o:
+				return nil
+			default:
+				w.spilling = true
+			}
+		}
+		return w.appendSpill(o)
+	default:
+		select {
+		case w.ch <- o:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// send queues o regardless of the overflow policy.
+func (w *batchWriter) send(ctx context.Context, o op) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	select {
+	case w.ch <- o:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush waits until everything queued before it has been committed.
+func (w *batchWriter) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	if err := w.send(ctx, op{done: done}); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exclusive runs fn on the writer goroutine after everything queued before
+// it has been committed, so maintenance never competes with batch writes.
+func (w *batchWriter) exclusive(ctx context.Context, fn func(*sql.DB) error) error {
+	errc := make(chan error, 1)
+	if err := w.send(ctx, op{fn: fn, errc: errc}); err != nil {
+		return err
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops accepting records and waits for the queue to be written.
+func (w *batchWriter) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.ch)
+	w.mu.Unlock()
+	<-w.stopped
+
+	if w.spill != nil {
+		_ = w.spill.Close()
+		if fi, err := os.Stat(w.opts.SpillPath); err == nil && fi.Size() == 0 {
+			_ = os.Remove(w.opts.SpillPath)
+		}
+	}
+	if n := w.dropped.Load(); n > 0 {
+		w.report(fmt.Errorf("audit: dropped %d records because the queue was full", n))
+	}
+	if n := w.failed.Load(); n > 0 {
+		w.report(fmt.Errorf("audit: lost %d records to failed writes", n))
+	}
+}
+
+func (w *batchWriter) run() {
+	defer close(w.stopped)
+	// Spilled records always follow the ones already queued.
+	if len(w.ch) == 0 {
+		w.replaySpill()
+	}
+	batch := make([]op, 0, w.opts.BatchSize)
+	for {
+		o, ok := <-w.ch
+		if !ok {
+			break
+		}
+		batch = append(batch[:0], o)
+		open := true
+	fill:
+		for len(batch) < w.opts.BatchSize {
+			select {
+			case o, ok := <-w.ch:
+				if !ok {
+					open = false
+					break fill
+				}
+				batch = append(batch, o)
+			default:
+				break fill
+			}
+		}
+		w.apply(batch)
+		if len(w.ch) == 0 {
+			w.replaySpill()
+		}
+		for _, o := range batch {
+			if o.done != nil {
+				close(o.done)
+			}
+		}
+		if !open {
+			break
+		}
+	}
+	w.replaySpill()
+}
+
+// apply commits ops in order, running maintenance functions between the
+// transactions.
+func (w *batchWriter) apply(ops []op) {
+	start := 0
+	for i, o := range ops {
+		if o.fn == nil {
+			continue
+		}
+		w.commit(ops[start:i])
+		o.errc <- retryBusy(context.Background(), func() error { return o.fn(w.db) })
+		start = i + 1
+	}
+	w.commit(ops[start:])
+}
+
+// commit writes ops in a single transaction. A batch that meets a busy
+// database is retried as a whole; one that still cannot be committed
+// counts its records as failed.
+func (w *batchWriter) commit(ops []op) {
+	if len(ops) == 0 {
+		return
+	}
+	var errs []error
+	err := retryBusy(context.Background(), func() error {
+		var err error
+		errs, err = w.commitOnce(ops)
+		return err
+	})
+	if err != nil {
+		for _, o := range ops {
+			if o.rec != nil {
+				w.failed.Add(1)
+			}
+		}
+		w.report(fmt.Errorf("audit: %w", err))
+		return
+	}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if ops[i].rec != nil {
+			w.failed.Add(1)
+		}
+		w.report(fmt.Errorf("audit: write: %w", err))
+	}
+}
+
+// commitOnce makes one attempt at commit. errs holds the error of each op
+// that failed on its own; err is set when the transaction as a whole
+// failed, including when an op found the database busy.
+func (w *batchWriter) commitOnce(ops []op) (errs []error, err error) {
+	ctx := context.Background()
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin batch: %w", err)
+	}
+	defer tx.Rollback()
+	errs = make([]error, len(ops))
+	for i, o := range ops {
+		var err error
+		switch {
+		case o.rec != nil:
+			err = insertRecord(ctx, tx, *o.rec)
+		case o.corrID != "":
+			err = finishRequest(ctx, tx, o.corrID, o.status)
+		}
+		if err == nil {
+			err = o.derived.apply(ctx, tx)
+		}
+		if isBusy(err) {
+			return nil, err
+		}
+		errs[i] = err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit batch: %w", err)
+	}
+	return errs, nil
+}
+
+func (w *batchWriter) report(err error) {
+	if w.opts.OnError != nil {
+		w.opts.OnError(err)
+	}
+}
+
+// spillEntry is the on-disk form of a spilled op. Byte fields are kept as
+// []byte so the payload round-trips exactly.
+type spillEntry struct {
+	Record    *Record `json:",omitempty"`
+	Raw       []byte  `json:",omitempty"`
+	ID        []byte  `json:",omitempty"`
+	ErrorData []byte  `json:",omitempty"`
+	CorrID    string  `json:",omitempty"`
+	Status    Status  `json:",omitempty"`
+
+	Derived *derived `json:",omitempty"`
+}
+
+// appendSpill writes o to the spill file. The caller holds spillMu.
+func (w *batchWriter) appendSpill(o op) error {
+	e := spillEntry{CorrID: o.corrID, Status: o.status}
+	if !o.derived.empty() {
+		e.Derived = &o.derived
+	}
+	if o.rec != nil {
+		r := *o.rec
+		e.Raw, e.ID = r.Raw, r.ID
+		r.Raw, r.ID = nil, nil
+		if r.Error != nil {
+			re := *r.Error
+			e.ErrorData, re.Data = re.Data, nil
+			r.Error = &re
+		}
+		e.Record = &r
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := w.spill.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	w.spillN++
+	return nil
+}
+
+// replaySpill moves spilled records into the database. The spill file is
+// swapped for an empty one before replaying so that writers can keep
+// spilling in the meantime; replay repeats until nothing new was spilled.
+func (w *batchWriter) replaySpill() {
+	if w.spill == nil {
+		return
+	}
+	replayPath := w.opts.SpillPath + ".replay"
+	// A replay interrupted by a crash is finished first.
+	if _, err := os.Stat(replayPath); err == nil {
+		w.replayFile(replayPath)
+	}
+	for {
+		w.spillMu.Lock()
+		if w.spillN == 0 {
+			w.spilling = false
+			w.spillMu.Unlock()
+			return
+		}
+		_ = w.spill.Close()
+		rerr := os.Rename(w.opts.SpillPath, replayPath)
+		f, err := os.OpenFile(w.opts.SpillPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+		if err != nil {
+			// Without a spill file there is nowhere to put overflow; the
+			// closed handle makes further appends fail.
+			w.report(fmt.Errorf("audit: reopen spill file: %w", err))
+			w.spillMu.Unlock()
+			return
+		}
+		w.spill = f
+		if rerr != nil {
+			// The records stay in the spill file for the next attempt.
+			w.spillMu.Unlock()
+			w.report(fmt.Errorf("audit: rotate spill file: %w", rerr))
+			return
+		}
+		w.spillN = 0
+		w.spillMu.Unlock()
+		w.replayFile(replayPath)
+	}
+}
+
+func (w *batchWriter) replayFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		w.report(fmt.Errorf("audit: open spill file: %w", err))
+		return
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	batch := make([]op, 0, w.opts.BatchSize)
+	for sc.Scan() {
+		var e spillEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			w.report(fmt.Errorf("audit: decode spill entry: %w", err))
+			continue
+		}
+		var d derived
+		if e.Derived != nil {
+			d = *e.Derived
+		}
+		o := op{corrID: e.CorrID, status: e.Status, derived: d}
+		if e.Record != nil {
+			r := *e.Record
+			r.Raw, r.ID = e.Raw, e.ID
+			if r.Error != nil {
+				r.Error.Data = e.ErrorData
+			}
+			o = op{rec: &r, derived: d}
+		}
+		batch = append(batch, o)
+		if len(batch) == cap(batch) {
+			w.commit(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		w.commit(batch)
+	}
+	if err := sc.Err(); err != nil {
+		w.report(fmt.Errorf("audit: read spill file: %w", err))
+	}
+	f.Close()
+	_ = os.Remove(path)
+}
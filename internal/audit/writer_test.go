@@ -0,0 +1,247 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testRecord(i int) Record {
+	return Record{Timestamp: time.UnixMilli(1_700_000_000_000 + int64(i)), Direction: DirectionDownstreamToUpstream, SessionID: "a", Method: "session/update", IsNotify: true, Raw: []byte(`{"n": 1}`)}
+}
+
+func TestWriterFlushesOnClose(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.sqlite")
+	s, err := Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.StartWriter(WriterOptions{BatchSize: 16}); err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.Write(ctx, testRecord(i)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := s.Write(ctx, testRecord(0)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+
+	s, err = Open(ctx, path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 100 || string(got[0].Raw) != `{"n": 1}` {
+		t.Fatalf("expected 100 rows after close, got %d", len(got))
+	}
+}
+
+func TestWriterKeepsFinishOrdered(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	if err := s.StartWriter(WriterOptions{}); err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	r := testRecord(0)
+	r.IsNotify, r.IsRequest, r.CorrelationID, r.Status = false, true, "c-1", StatusPending
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Finish(ctx, "c-1", StatusCompleted); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 1 || got[0].Status != StatusCompleted {
+		t.Fatalf("expected completed request, got %+v", got)
+	}
+}
+
+// stalledWriter installs a writer whose goroutine has not started yet, so
+// the queue fills up deterministically. Call start to let it run.
+func stalledWriter(t *testing.T, s *Store, opts WriterOptions) (start func()) {
+	t.Helper()
+	w, err := newBatchWriter(s.db, opts)
+	if err != nil {
+		t.Fatalf("newBatchWriter: %v", err)
+	}
+	s.w = w
+	return func() { go w.run() }
+}
+
+func TestWriterDropPolicy(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	start := stalledWriter(t, s, WriterOptions{QueueSize: 2, Overflow: OverflowDrop})
+
+	for i := 0; i < 5; i++ {
+		err := s.Write(ctx, testRecord(i))
+		if i < 2 && err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+		if i >= 2 && !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("Write %d: expected ErrQueueFull, got %v", i, err)
+		}
+	}
+	if n := s.Dropped(); n != 3 {
+		t.Fatalf("expected 3 dropped records, got %d", n)
+	}
+	start()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(got))
+	}
+}
+
+func TestWriterSpillPolicy(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	spill := filepath.Join(t.TempDir(), "audit.spill")
+	start := stalledWriter(t, s, WriterOptions{QueueSize: 2, Overflow: OverflowSpill, SpillPath: spill})
+
+	for i := 0; i < 10; i++ {
+		r := testRecord(i)
+		if i == 7 {
+			r.Error = &RPCError{Code: -32603, Message: "boom", Data: []byte(`{"a": 1}`)}
+		}
+		if i == 8 {
+			r.Method, r.IsNotify, r.IsRequest, r.CorrelationID = "session/request_permission", false, true, "perm-1"
+		}
+		if i == 9 {
+			c := NewFileChange("/w/a.txt", "", "a\n", true)
+			r.SessionID, r.IsRequest, r.FileChange = "", true, &c
+		}
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+	if fi, err := os.Stat(spill); err != nil || fi.Size() == 0 {
+		t.Fatalf("expected records in spill file, stat: %v", err)
+	}
+	start()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got, err := s.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(got) != 10 {
+		t.Fatalf("expected 10 rows, got %d", len(got))
+	}
+	for i, r := range got {
+		if !r.Timestamp.Equal(testRecord(i).Timestamp) || string(r.Raw) != `{"n": 1}` {
+			t.Fatalf("row %d out of order or altered: %+v", i, r)
+		}
+	}
+	if e := got[7].Error; e == nil || e.Code != -32603 || string(e.Data) != `{"a": 1}` {
+		t.Fatalf("spilled error not preserved: %+v", got[7].Error)
+	}
+	if perms, err := s.Permissions(ctx, PermissionFilter{}); err != nil || len(perms) != 1 {
+		t.Fatalf("spilled permission request not preserved: %+v, %v", perms, err)
+	}
+	if changes, err := s.FileChanges(ctx, FileChangeFilter{}); err != nil || len(changes) != 1 || changes[0].Path != "/w/a.txt" {
+		t.Fatalf("spilled file change not preserved: %+v, %v", changes, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(spill); !os.IsNotExist(err) {
+		t.Fatalf("expected empty spill file to be removed, stat: %v", err)
+	}
+}
+
+func TestWriterSpillEncrypted(t *testing.T) {
+	s := openTestStore(t)
+	s.SetKeyring(mustKeyring(t, mustKey(t)))
+	ctx := context.Background()
+	// The data key is stored by the writer, so create it before stalling.
+	if err := s.Write(ctx, testRecord(0)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	spill := filepath.Join(t.TempDir(), "audit.spill")
+	start := stalledWriter(t, s, WriterOptions{QueueSize: 1, Overflow: OverflowSpill, SpillPath: spill})
+
+	for i := 1; i <= 3; i++ {
+		r := testRecord(i)
+		c := NewFileChange("/w/a.txt", "", "top secret\n", true)
+		r.Method, r.IsNotify, r.IsRequest, r.FileChange = "fs/write_text_file", false, true, &c
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+	b, err := os.ReadFile(spill)
+	start()
+	if err != nil || len(b) == 0 {
+		t.Fatalf("expected records in spill file: %v", err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Fatalf("file change spilled in plaintext: %s", b)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	changes, err := s.FileChanges(ctx, FileChangeFilter{})
+	if err != nil || len(changes) != 3 || changes[2].Diff != "@@ -0,0 +1,1 @@\n+top secret\n" {
+		t.Fatalf("spilled file changes not preserved: %+v, %v", changes, err)
+	}
+}
+
+// BenchmarkWrite compares the time a caller spends in Write when it inserts
+// directly and when the record is handed to the background writer.
+func BenchmarkWrite(b *testing.B) {
+	ctx := context.Background()
+	for _, bc := range []struct {
+		name  string
+		start bool
+	}{{"sync", false}, {"batched", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			s, err := Open(ctx, filepath.Join(b.TempDir(), "audit.sqlite"))
+			if err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer s.Close()
+			if bc.start {
+				if err := s.StartWriter(WriterOptions{}); err != nil {
+					b.Fatalf("StartWriter: %v", err)
+				}
+			}
+			r := testRecord(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Write(ctx, r); err != nil {
+					b.Fatalf("Write: %v", err)
+				}
+			}
+			b.StopTimer()
+			if err := s.Flush(ctx); err != nil {
+				b.Fatalf("Flush: %v", err)
+			}
+		})
+	}
+}
@@ -19,6 +19,49 @@ type AgentServer struct {
 // Config is the root configuration file structure.
 type Config struct {
     AgentServers map[string]AgentServer `json:"agent_servers"`
+    Redaction    Redaction              `json:"redaction"`
+    AuditSinks   []AuditSink            `json:"audit_sinks"`
+}
+
+// AuditSink selects one destination for the audit trail. Type is one of
+// sqlite (the -audit-db database), jsonl, stdout, stderr or syslog; the
+// other fields apply to the types named in their comments.
+type AuditSink struct {
+    Type string `json:"type"`
+    // Path is the file written by jsonl.
+    Path string `json:"path"`
+    // MaxSizeMB rotates the jsonl file at this size; MaxBackups rotated
+    // files are kept (0 keeps all).
+    MaxSizeMB  int64 `json:"max_size_mb"`
+    MaxBackups int   `json:"max_backups"`
+    // Address is the syslog unix socket (default: /dev/log or the
+    // platform's equivalent).
+    Address  string `json:"address"`
+    Tag      string `json:"tag"`
+    Facility string `json:"facility"`
+}
+
+// Redaction configures how secrets are scrubbed from audit records before
+// they are stored. Built-in detectors are on unless disabled.
+type Redaction struct {
+    DisableBuiltin bool               `json:"disable_builtin"`
+    Patterns       []RedactionPattern `json:"patterns"`
+    JSONPaths      []RedactionPath    `json:"json_paths"`
+    // Salt keys the hash in the placeholders.
+    Salt string `json:"salt"`
+}
+
+// RedactionPattern is a named regular expression whose matches are redacted.
+type RedactionPattern struct {
+    Name  string `json:"name"`
+    Regex string `json:"regex"`
+}
+
+// RedactionPath redacts the value at a JSON path ($.a.b[*].c) in the
+// payloads of one method, or of every method if Method is empty.
+type RedactionPath struct {
+    Method string `json:"method"`
+    Path   string `json:"path"`
 }
 
 // Load reads and parses a configuration from a JSON file.
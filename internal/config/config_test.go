@@ -128,3 +128,48 @@ func TestFindExistingDefaultConfig(t *testing.T) {
         t.Fatalf("expected %q, got %q", p, got)
     }
 }
+
+func TestLoadRedaction(t *testing.T) {
+    json := `{
+        "agent_servers": {},
+        "redaction": {
+            "patterns": [{"name": "ticket", "regex": "TICKET-\\d+"}],
+            "json_paths": [{"method": "authenticate", "path": "$._meta"}],
+            "salt": "s"
+        }
+    }`
+    p := filepath.Join(t.TempDir(), "cfg.json")
+    if err := os.WriteFile(p, []byte(json), 0o644); err != nil {
+        t.Fatalf("write temp cfg: %v", err)
+    }
+    cfg, err := Load(p)
+    if err != nil {
+        t.Fatalf("Load: %v", err)
+    }
+    r := cfg.Redaction
+    if r.DisableBuiltin || len(r.Patterns) != 1 || r.Patterns[0].Regex != `TICKET-\d+` || len(r.JSONPaths) != 1 || r.JSONPaths[0].Method != "authenticate" || r.Salt != "s" {
+        t.Fatalf("unexpected redaction config: %+v", r)
+    }
+}
+
+func TestLoadAuditSinks(t *testing.T) {
+    json := `{
+        "audit_sinks": [
+            {"type": "sqlite"},
+            {"type": "jsonl", "path": "/var/log/acp-gate/audit.jsonl", "max_size_mb": 100, "max_backups": 5},
+            {"type": "syslog", "facility": "local0"}
+        ]
+    }`
+    p := filepath.Join(t.TempDir(), "cfg.json")
+    if err := os.WriteFile(p, []byte(json), 0o644); err != nil {
+        t.Fatalf("write temp cfg: %v", err)
+    }
+    cfg, err := Load(p)
+    if err != nil {
+        t.Fatalf("Load: %v", err)
+    }
+    s := cfg.AuditSinks
+    if len(s) != 3 || s[1].Type != "jsonl" || s[1].MaxSizeMB != 100 || s[1].MaxBackups != 5 || s[2].Facility != "local0" {
+        t.Fatalf("unexpected audit sinks: %+v", s)
+    }
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"container/list"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"acp-gate/internal/audit"
+	acp "github.com/coder/acp-go-sdk"
+)
+
+// maxDiffSize is the largest file, before or after a write, that is
+// recorded as a diff. Larger writes are recorded with their full content.
+const maxDiffSize = 1 << 20
+
+// maxCacheSize bounds the file content a connection keeps for diffs. The
+// least recently used files are forgotten first.
+const maxCacheSize = 16 << 20
+
+// fileCache keeps the most recent content seen for each file of each
+// session, from whole-file reads and successful writes, so that writes can
+// be recorded as diffs. The zero value is ready to use.
+type fileCache struct {
+	mu    sync.Mutex
+	files map[fileKey]*list.Element
+	// lru holds the cachedFiles, most recently used first.
+	lru  list.List
+	size int
+}
+
+type fileKey struct {
+	session acp.SessionId
+	path    string
+}
+
+type cachedFile struct {
+	key     fileKey
+	content string
+}
+
+// seen records the content of a file after a read or write.
+func (fc *fileCache) seen(session acp.SessionId, path, content string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	k := fileKey{session, path}
+	if e, ok := fc.files[k]; ok {
+		fc.remove(e)
+	}
+	if len(content) > maxDiffSize {
+		return
+	}
+	if fc.files == nil {
+		fc.files = map[fileKey]*list.Element{}
+	}
+	fc.files[k] = fc.lru.PushFront(&cachedFile{key: k, content: content})
+	fc.size += len(content)
+	for fc.size > maxCacheSize {
+		fc.remove(fc.lru.Back())
+	}
+}
+
+// remove forgets the file of e. The caller holds mu.
+func (fc *fileCache) remove(e *list.Element) {
+	f := fc.lru.Remove(e).(*cachedFile)
+	delete(fc.files, f.key)
+	fc.size -= len(f.content)
+}
+
+// change returns the change req makes, or nil if it cannot be recorded as
+// a diff. Only content the editor returned or was sent is used as the old
+// side: a file the session has not read or written yet is recorded as a
+// diff only if it does not exist. The agent host's disk is never read, as
+// the path may name a device, a pipe or a file the editor would not
+// disclose.
+func (fc *fileCache) change(req acp.WriteTextFileRequest) *audit.FileChange {
+	if len(req.Content) > maxDiffSize {
+		return nil
+	}
+	fc.mu.Lock()
+	var old string
+	e, ok := fc.files[fileKey{req.SessionId, req.Path}]
+	if ok {
+		fc.lru.MoveToFront(e)
+		old = e.Value.(*cachedFile).content
+	}
+	fc.mu.Unlock()
+	if !ok {
+		if _, err := os.Lstat(req.Path); !errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	c := audit.NewFileChange(req.Path, old, req.Content, !ok)
+	return &c
+}
+
+// clear forgets every file.
+func (fc *fileCache) clear() {
+	fc.mu.Lock()
+	fc.files = nil
+	fc.lru.Init()
+	fc.size = 0
+	fc.mu.Unlock()
+}
+
+// writeParams is what is recorded of a write whose change is recorded as a
+// diff: the request without its content.
+type writeParams struct {
+	Meta      any           `json:"_meta,omitempty"`
+	Path      string        `json:"path"`
+	SessionId acp.SessionId `json:"sessionId"`
+}
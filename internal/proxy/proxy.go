@@ -2,11 +2,8 @@ package proxy
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"time"
 
-	"acp-gate/internal/acpinspect"
 	"acp-gate/internal/audit"
 	acp "github.com/coder/acp-go-sdk"
 )
@@ -15,104 +12,91 @@ import (
 // It receives calls from the upstream editor and forwards them to the downstream real agent.
 type ProxyAgent struct {
 	downstream acp.Agent
-	store      *audit.Store
+	rec        recorder
 }
 
-func NewProxyAgent(downstream acp.Agent, store *audit.Store) *ProxyAgent {
-	return &ProxyAgent{downstream: downstream, store: store}
+func NewProxyAgent(downstream acp.Agent, sink audit.Sink) *ProxyAgent {
+	return &ProxyAgent{downstream: downstream, rec: recorder{sink: sink}}
 }
 
 func (a *ProxyAgent) SetDownstream(downstream acp.Agent) {
 	a.downstream = downstream
 }
 
-func (a *ProxyAgent) SetStore(store *audit.Store) {
-	a.store = store
+// SetSink sets where the audit trail of the calls from the editor goes.
+func (a *ProxyAgent) SetSink(sink audit.Sink) {
+	a.rec.sink = sink
 }
 
-func (a *ProxyAgent) audit(ctx context.Context, method string, params interface{}, result interface{}, err error) {
-	if a.store == nil {
-		return
-	}
-	// Client -> Agent (Upstream to Downstream)
-	rawParams, _ := json.Marshal(params)
-	var rawResult json.RawMessage
-	if result != nil {
-		rawResult, _ = json.Marshal(result)
-	}
+// SetConnection links the audit rows of the calls from the editor to the
+// connection with the given id.
+func (a *ProxyAgent) SetConnection(id string) {
+	a.rec.conn = id
+}
 
-	anyMsg := acpinspect.AnyMessage{
-		Method: method,
-		Params: rawParams,
-	}
-	sid, _, userText, agentText := acpinspect.Extract(anyMsg)
-
-	record := audit.Record{
-		Timestamp: time.Now(),
-		Direction: audit.DirectionUpstreamToDownstream,
-		SessionID: sid,
-		Method:    method,
-		IsRequest: true,
-		Raw:       rawParams,
-		UserText:  userText,
-		AgentText: agentText,
-	}
-	_ = a.store.Write(ctx, record)
-
-	if result != nil {
-		respRecord := audit.Record{
-			Timestamp: time.Now(),
-			Direction: audit.DirectionDownstreamToUpstream,
-			SessionID: sid,
-			Method:    method,
-			IsRequest: false,
-			Raw:       rawResult,
-		}
-		_ = a.store.Write(ctx, respRecord)
-	}
+// SetTracer makes the calls from the editor spans of t.
+func (a *ProxyAgent) SetTracer(t *Tracer) {
+	a.rec.trace = t
+}
+
+// Abandon marks requests from the editor that are still awaiting a response
+// as abandoned. Call it once the connection has ended.
+func (a *ProxyAgent) Abandon(ctx context.Context) {
+	a.rec.abandon(ctx)
+}
+
+// Client -> Agent (Upstream to Downstream)
+func (a *ProxyAgent) begin(ctx context.Context, method string, params any) call {
+	return a.rec.begin(ctx, audit.DirectionUpstreamToDownstream, method, params)
 }
 
 func (a *ProxyAgent) Initialize(ctx context.Context, req acp.InitializeRequest) (acp.InitializeResponse, error) {
+	c := a.begin(ctx, acp.AgentMethodInitialize, req)
 	res, err := a.downstream.Initialize(ctx, req)
-	a.audit(ctx, acp.AgentMethodInitialize, req, res, err)
+	a.rec.end(ctx, c, res, err)
 	return res, err
 }
 
 func (a *ProxyAgent) Authenticate(ctx context.Context, req acp.AuthenticateRequest) (acp.AuthenticateResponse, error) {
+	c := a.begin(ctx, acp.AgentMethodAuthenticate, req)
 	res, err := a.downstream.Authenticate(ctx, req)
-	a.audit(ctx, acp.AgentMethodAuthenticate, req, res, err)
+	a.rec.end(ctx, c, res, err)
 	return res, err
 }
 
 func (a *ProxyAgent) NewSession(ctx context.Context, req acp.NewSessionRequest) (acp.NewSessionResponse, error) {
+	c := a.begin(ctx, acp.AgentMethodSessionNew, req)
 	res, err := a.downstream.NewSession(ctx, req)
-	a.audit(ctx, acp.AgentMethodSessionNew, req, res, err)
+	a.rec.end(ctx, c, res, err)
 	return res, err
 }
 
 func (a *ProxyAgent) Prompt(ctx context.Context, req acp.PromptRequest) (acp.PromptResponse, error) {
+	c := a.begin(ctx, acp.AgentMethodSessionPrompt, req)
 	res, err := a.downstream.Prompt(ctx, req)
-	a.audit(ctx, acp.AgentMethodSessionPrompt, req, res, err)
+	a.rec.end(ctx, c, res, err)
 	return res, err
 }
 
 func (a *ProxyAgent) Cancel(ctx context.Context, req acp.CancelNotification) error {
 	err := a.downstream.Cancel(ctx, req)
-	a.audit(ctx, acp.AgentMethodSessionCancel, req, nil, err)
+	a.rec.notify(ctx, audit.DirectionUpstreamToDownstream, acp.AgentMethodSessionCancel, req, err)
 	return err
 }
 
 func (a *ProxyAgent) SetSessionMode(ctx context.Context, req acp.SetSessionModeRequest) (acp.SetSessionModeResponse, error) {
+	c := a.begin(ctx, acp.AgentMethodSessionSetMode, req)
 	res, err := a.downstream.SetSessionMode(ctx, req)
-	a.audit(ctx, acp.AgentMethodSessionSetMode, req, res, err)
+	a.rec.end(ctx, c, res, err)
 	return res, err
 }
 
 // LoadSession implements acp.AgentLoader.
 func (a *ProxyAgent) LoadSession(ctx context.Context, req acp.LoadSessionRequest) (acp.LoadSessionResponse, error) {
 	if loader, ok := a.downstream.(acp.AgentLoader); ok {
+		c := a.begin(ctx, acp.AgentMethodSessionLoad, req)
 		res, err := loader.LoadSession(ctx, req)
-		a.audit(ctx, acp.AgentMethodSessionLoad, req, res, err)
+		a.rec.end(ctx, c, res, err)
 		return res, err
 	}
 	return acp.LoadSessionResponse{}, fmt.Errorf("downstream does not support LoadSession")
@@ -121,8 +105,9 @@ func (a *ProxyAgent) LoadSession(ctx context.Context, req acp.LoadSessionRequest
 // SetSessionModel implements acp.AgentExperimental.
 func (a *ProxyAgent) SetSessionModel(ctx context.Context, req acp.SetSessionModelRequest) (acp.SetSessionModelResponse, error) {
 	if exp, ok := a.downstream.(acp.AgentExperimental); ok {
+		c := a.begin(ctx, acp.AgentMethodSessionSetModel, req)
 		res, err := exp.SetSessionModel(ctx, req)
-		a.audit(ctx, acp.AgentMethodSessionSetModel, req, res, err)
+		a.rec.end(ctx, c, res, err)
 		return res, err
 	}
 	return acp.SetSessionModelResponse{}, fmt.Errorf("downstream does not support SetSessionModel")
@@ -132,116 +117,121 @@ func (a *ProxyAgent) SetSessionModel(ctx context.Context, req acp.SetSessionMode
 // It receives calls from the downstream real agent and forwards them to the upstream editor.
 type ProxyClient struct {
 	upstream acp.Client
-	store    *audit.Store
+	rec      recorder
+	files    fileCache
 }
 
-func NewProxyClient(upstream acp.Client, store *audit.Store) *ProxyClient {
-	return &ProxyClient{upstream: upstream, store: store}
+func NewProxyClient(upstream acp.Client, sink audit.Sink) *ProxyClient {
+	return &ProxyClient{upstream: upstream, rec: recorder{sink: sink}}
 }
 
 func (c *ProxyClient) SetUpstream(upstream acp.Client) {
 	c.upstream = upstream
 }
 
-func (c *ProxyClient) SetStore(store *audit.Store) {
-	c.store = store
+// SetSink sets where the audit trail of the calls from the agent goes.
+func (c *ProxyClient) SetSink(sink audit.Sink) {
+	c.rec.sink = sink
 }
 
-func (c *ProxyClient) audit(ctx context.Context, method string, params interface{}, result interface{}, err error) {
-	if c.store == nil {
-		return
-	}
-	// Agent -> Client (Downstream to Upstream)
-	rawParams, _ := json.Marshal(params)
-	var rawResult json.RawMessage
-	if result != nil {
-		rawResult, _ = json.Marshal(result)
-	}
+// SetConnection links the audit rows of the calls from the agent to the
+// connection with the given id.
+func (c *ProxyClient) SetConnection(id string) {
+	c.rec.conn = id
+}
 
-	anyMsg := acpinspect.AnyMessage{
-		Method: method,
-		Params: rawParams,
-	}
-	sid, _, userText, agentText := acpinspect.Extract(anyMsg)
-
-	isNotify := (method == acp.ClientMethodSessionUpdate)
-
-	record := audit.Record{
-		Timestamp: time.Now(),
-		Direction: audit.DirectionDownstreamToUpstream,
-		SessionID: sid,
-		Method:    method,
-		IsRequest: !isNotify,
-		IsNotify:  isNotify,
-		Raw:       rawParams,
-		UserText:  userText,
-		AgentText: agentText,
-	}
-	_ = c.store.Write(ctx, record)
-
-	if result != nil {
-		respRecord := audit.Record{
-			Timestamp: time.Now(),
-			Direction: audit.DirectionUpstreamToDownstream,
-			SessionID: sid,
-			Method:    method,
-			IsRequest: false,
-			Raw:       rawResult,
-		}
-		_ = c.store.Write(ctx, respRecord)
-	}
+// SetTracer makes the calls from the agent spans of t.
+func (c *ProxyClient) SetTracer(t *Tracer) {
+	c.rec.trace = t
+}
+
+// Abandon marks requests from the agent that are still awaiting a response
+// as abandoned. Call it once the connection has ended.
+func (c *ProxyClient) Abandon(ctx context.Context) {
+	c.rec.abandon(ctx)
+	c.files.clear()
+}
+
+// Agent -> Client (Downstream to Upstream)
+func (c *ProxyClient) begin(ctx context.Context, method string, params any) call {
+	return c.rec.begin(ctx, audit.DirectionDownstreamToUpstream, method, params)
 }
 
 func (c *ProxyClient) ReadTextFile(ctx context.Context, req acp.ReadTextFileRequest) (acp.ReadTextFileResponse, error) {
+	cl := c.begin(ctx, acp.ClientMethodFsReadTextFile, req)
 	res, err := c.upstream.ReadTextFile(ctx, req)
-	c.audit(ctx, acp.ClientMethodFsReadTextFile, req, res, err)
+	c.rec.end(ctx, cl, res, err)
+	if err == nil && req.Line == nil && req.Limit == nil && c.rec.sink != nil {
+		c.files.seen(req.SessionId, req.Path, res.Content)
+	}
 	return res, err
 }
 
+// WriteTextFile records the write as a diff against the content last seen
+// for the file rather than with the whole new content.
 func (c *ProxyClient) WriteTextFile(ctx context.Context, req acp.WriteTextFileRequest) (acp.WriteTextFileResponse, error) {
+	var (
+		params any = req
+		change *audit.FileChange
+	)
+	if c.rec.sink != nil {
+		if change = c.files.change(req); change != nil {
+			params = writeParams{Meta: req.Meta, Path: req.Path, SessionId: req.SessionId}
+		}
+	}
+	cl := c.rec.beginChange(ctx, audit.DirectionDownstreamToUpstream, acp.ClientMethodFsWriteTextFile, params, change)
 	res, err := c.upstream.WriteTextFile(ctx, req)
-	c.audit(ctx, acp.ClientMethodFsWriteTextFile, req, res, err)
+	c.rec.end(ctx, cl, res, err)
+	if err == nil && c.rec.sink != nil {
+		c.files.seen(req.SessionId, req.Path, req.Content)
+	}
 	return res, err
 }
 
 func (c *ProxyClient) CreateTerminal(ctx context.Context, req acp.CreateTerminalRequest) (acp.CreateTerminalResponse, error) {
+	cl := c.begin(ctx, acp.ClientMethodTerminalCreate, req)
 	res, err := c.upstream.CreateTerminal(ctx, req)
-	c.audit(ctx, acp.ClientMethodTerminalCreate, req, res, err)
+	c.rec.end(ctx, cl, res, err)
 	return res, err
 }
 
 func (c *ProxyClient) KillTerminalCommand(ctx context.Context, req acp.KillTerminalCommandRequest) (acp.KillTerminalCommandResponse, error) {
+	cl := c.begin(ctx, acp.ClientMethodTerminalKill, req)
 	res, err := c.upstream.KillTerminalCommand(ctx, req)
-	c.audit(ctx, acp.ClientMethodTerminalKill, req, res, err)
+	c.rec.end(ctx, cl, res, err)
 	return res, err
 }
 
 func (c *ProxyClient) TerminalOutput(ctx context.Context, req acp.TerminalOutputRequest) (acp.TerminalOutputResponse, error) {
+	cl := c.begin(ctx, acp.ClientMethodTerminalOutput, req)
 	res, err := c.upstream.TerminalOutput(ctx, req)
-	c.audit(ctx, acp.ClientMethodTerminalOutput, req, res, err)
+	c.rec.end(ctx, cl, res, err)
 	return res, err
 }
 
 func (c *ProxyClient) ReleaseTerminal(ctx context.Context, req acp.ReleaseTerminalRequest) (acp.ReleaseTerminalResponse, error) {
+	cl := c.begin(ctx, acp.ClientMethodTerminalRelease, req)
 	res, err := c.upstream.ReleaseTerminal(ctx, req)
-	c.audit(ctx, acp.ClientMethodTerminalRelease, req, res, err)
+	c.rec.end(ctx, cl, res, err)
 	return res, err
 }
 
 func (c *ProxyClient) WaitForTerminalExit(ctx context.Context, req acp.WaitForTerminalExitRequest) (acp.WaitForTerminalExitResponse, error) {
+	cl := c.begin(ctx, acp.ClientMethodTerminalWaitForExit, req)
 	res, err := c.upstream.WaitForTerminalExit(ctx, req)
-	c.audit(ctx, acp.ClientMethodTerminalWaitForExit, req, res, err)
+	c.rec.end(ctx, cl, res, err)
 	return res, err
 }
 
 func (c *ProxyClient) RequestPermission(ctx context.Context, req acp.RequestPermissionRequest) (acp.RequestPermissionResponse, error) {
+	cl := c.begin(ctx, acp.ClientMethodSessionRequestPermission, req)
 	res, err := c.upstream.RequestPermission(ctx, req)
-	c.audit(ctx, acp.ClientMethodSessionRequestPermission, req, res, err)
+	c.rec.end(ctx, cl, res, err)
 	return res, err
 }
 
 func (c *ProxyClient) SessionUpdate(ctx context.Context, req acp.SessionNotification) error {
 	err := c.upstream.SessionUpdate(ctx, req)
-	c.audit(ctx, acp.ClientMethodSessionUpdate, req, nil, err)
+	c.rec.notify(ctx, audit.DirectionDownstreamToUpstream, acp.ClientMethodSessionUpdate, req, err)
 	return err
 }
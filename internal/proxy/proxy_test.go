@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"acp-gate/internal/audit"
+	acp "github.com/coder/acp-go-sdk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// nopClient accepts session updates and nothing else.
+type nopClient struct{ acp.Client }
+
+func (nopClient) SessionUpdate(context.Context, acp.SessionNotification) error { return nil }
+
+// BenchmarkForwardSessionUpdate measures how long forwarding a streamed
+// message chunk takes with the audit store writing inline and with the
+// background writer.
+func BenchmarkForwardSessionUpdate(b *testing.B) {
+	ctx := context.Background()
+	update := acp.SessionNotification{
+		SessionId: "sess_1",
+		Update:    acp.UpdateAgentMessageText("a chunk of streamed agent output"),
+	}
+	for _, bc := range []struct {
+		name    string
+		batched bool
+	}{{"sync", false}, {"batched", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			store, err := audit.Open(ctx, filepath.Join(b.TempDir(), "audit.sqlite"))
+			if err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer store.Close()
+			if bc.batched {
+				if err := store.StartWriter(audit.WriterOptions{}); err != nil {
+					b.Fatalf("StartWriter: %v", err)
+				}
+			}
+			c := NewProxyClient(nopClient{}, store)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.SessionUpdate(ctx, update); err != nil {
+					b.Fatalf("SessionUpdate: %v", err)
+				}
+			}
+			b.StopTimer()
+			_ = store.Flush(ctx)
+		})
+	}
+}
+
+func TestTracerNestsCallbacksUnderPrompt(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	ctx := context.Background()
+	tr := NewTracer(ctx)
+	agent := recorder{trace: tr}
+	client := recorder{trace: tr}
+
+	prompt := agent.begin(ctx, audit.DirectionUpstreamToDownstream, acp.AgentMethodSessionPrompt, acp.PromptRequest{SessionId: "s1"})
+	client.notify(ctx, audit.DirectionDownstreamToUpstream, acp.ClientMethodSessionUpdate, acp.SessionNotification{
+		SessionId: "s1",
+		Update:    acp.StartToolCall("call_1", "Read main.go", acp.WithStartKind(acp.ToolKindRead)),
+	}, nil)
+	read := client.begin(ctx, audit.DirectionDownstreamToUpstream, acp.ClientMethodFsReadTextFile, acp.ReadTextFileRequest{SessionId: "s1", Path: "/main.go"})
+	client.end(ctx, read, acp.ReadTextFileResponse{Content: "package main"}, nil)
+	client.begin(ctx, audit.DirectionDownstreamToUpstream, acp.ClientMethodFsWriteTextFile, acp.WriteTextFileRequest{SessionId: "s1", Path: "/main.go"})
+	agent.end(ctx, prompt, acp.PromptResponse{StopReason: acp.StopReasonEndTurn}, nil)
+	client.abandon(ctx)
+
+	spans := sr.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spans {
+		byName[s.Name()] = s
+	}
+	p := byName[acp.AgentMethodSessionPrompt]
+	if p == nil || p.Parent().IsValid() {
+		t.Fatalf("prompt span missing or not a root: %v", p)
+	}
+	for _, name := range []string{acp.ClientMethodFsReadTextFile, acp.ClientMethodFsWriteTextFile} {
+		s := byName[name]
+		if s == nil || s.Parent().SpanID() != p.SpanContext().SpanID() {
+			t.Fatalf("%s is not a child of the prompt span", name)
+		}
+	}
+	if byName[acp.ClientMethodFsWriteTextFile].Status().Code != codes.Error {
+		t.Fatalf("abandoned call should end with an error status")
+	}
+	events := p.Events()
+	if len(events) != 1 || events[0].Name != "tool_call" {
+		t.Fatalf("expected a tool_call event, got %v", events)
+	}
+	var stop string
+	for _, kv := range p.Attributes() {
+		if kv.Key == "acp.stop_reason" {
+			stop = kv.Value.AsString()
+		}
+	}
+	if stop != string(acp.StopReasonEndTurn) {
+		t.Fatalf("unexpected stop reason %q", stop)
+	}
+}
+
+// fileClient serves reads from and writes to an in-memory editor buffer.
+type fileClient struct {
+	acp.Client
+	buffers map[string]string
+}
+
+func (c fileClient) ReadTextFile(_ context.Context, req acp.ReadTextFileRequest) (acp.ReadTextFileResponse, error) {
+	return acp.ReadTextFileResponse{Content: c.buffers[req.Path]}, nil
+}
+
+func (c fileClient) WriteTextFile(_ context.Context, req acp.WriteTextFileRequest) (acp.WriteTextFileResponse, error) {
+	c.buffers[req.Path] = req.Content
+	return acp.WriteTextFileResponse{}, nil
+}
+
+func TestWriteTextFileRecordsDiff(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := audit.Open(ctx, filepath.Join(dir, "audit.sqlite"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer store.Close()
+
+	onDisk := filepath.Join(dir, "disk.txt")
+	if err := os.WriteFile(onDisk, []byte("one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	edited, created := filepath.Join(dir, "edited.txt"), filepath.Join(dir, "new.txt")
+	// The editor buffer differs from the file on disk; the read wins. The
+	// file on disk was never read, so its write keeps the whole content.
+	c := NewProxyClient(fileClient{buffers: map[string]string{edited: "a\nb\nc\n"}}, store)
+	if _, err := c.ReadTextFile(ctx, acp.ReadTextFileRequest{SessionId: "s1", Path: edited}); err != nil {
+		t.Fatalf("ReadTextFile: %v", err)
+	}
+	for _, w := range []acp.WriteTextFileRequest{
+		{SessionId: "s1", Path: edited, Content: "a\nB\nc\n"},
+		{SessionId: "s1", Path: edited, Content: "a\nB\nc\nd\n"},
+		{SessionId: "s1", Path: onDisk, Content: "one\n2\n"},
+		{SessionId: "s1", Path: created, Content: "hello\n"},
+	} {
+		if _, err := c.WriteTextFile(ctx, w); err != nil {
+			t.Fatalf("WriteTextFile: %v", err)
+		}
+	}
+
+	changes, err := store.FileChanges(ctx, audit.FileChangeFilter{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("FileChanges: %v", err)
+	}
+	want := []struct {
+		path    string
+		created bool
+		diff    string
+	}{
+		{edited, false, "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{edited, false, "@@ -1,3 +1,4 @@\n a\n B\n c\n+d\n"},
+		{created, true, "@@ -0,0 +1,1 @@\n+hello\n"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %+v", len(want), changes)
+	}
+	for i, w := range want {
+		ch := changes[i]
+		if ch.Path != w.path || ch.Created != w.created || ch.Diff != w.diff || ch.Status != audit.StatusCompleted {
+			t.Fatalf("change %d = %+v, want %+v", i, ch, w)
+		}
+	}
+
+	rows, err := store.Query(ctx, audit.Filter{Method: acp.ClientMethodFsWriteTextFile})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	for _, r := range rows {
+		if r.IsRequest && strings.Contains(string(r.Raw), "content") != strings.Contains(string(r.Raw), onDisk) {
+			t.Fatalf("write recorded with wrong content: %s", r.Raw)
+		}
+	}
+}
+
+func TestFileCacheEvicts(t *testing.T) {
+	var fc fileCache
+	big := strings.Repeat("x", maxDiffSize)
+	for i := 0; i <= maxCacheSize/maxDiffSize; i++ {
+		fc.seen("s1", fmt.Sprintf("/f%d", i), big)
+	}
+	if fc.size > maxCacheSize || len(fc.files) != maxCacheSize/maxDiffSize {
+		t.Fatalf("cache holds %d bytes in %d files", fc.size, len(fc.files))
+	}
+	if _, ok := fc.files[fileKey{"s1", "/f0"}]; ok {
+		t.Fatal("expected the least recently used file to be evicted")
+	}
+	fc.seen("s1", "/f1", "small")
+	if fc.size != (maxCacheSize/maxDiffSize-1)*maxDiffSize+len("small") {
+		t.Fatalf("unexpected size %d after replacing a file", fc.size)
+	}
+}
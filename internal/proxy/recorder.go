@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"acp-gate/internal/acpinspect"
+	"acp-gate/internal/audit"
+	acp "github.com/coder/acp-go-sdk"
+)
+
+// recorder writes the audit rows for the calls handled on one connection.
+// Request rows are written as soon as a call arrives, in pending state, and
+// finished when the response comes back; requests still in flight when the
+// connection ends are marked abandoned. The zero value records nothing
+// until a sink or tracer is set.
+type recorder struct {
+	sink  audit.Sink
+	trace *Tracer
+	seq   sequencer
+	// conn is the connection id stamped on every row; see audit.Connection.
+	conn string
+
+	mu       sync.Mutex
+	inflight map[string]struct{}
+}
+
+// call identifies one proxied call so that its audit rows can be correlated.
+type call struct {
+	id     string
+	seq    int64
+	start  time.Time
+	dir    audit.Direction
+	method string
+	sid    string
+}
+
+// begin records an incoming request travelling in direction dir and returns
+// the call handle to pass to end.
+func (r *recorder) begin(ctx context.Context, dir audit.Direction, method string, params any) call {
+	return r.beginChange(ctx, dir, method, params, nil)
+}
+
+// beginChange is begin for a file write whose change, if not nil, is
+// recorded along with params.
+func (r *recorder) beginChange(ctx context.Context, dir audit.Direction, method string, params any, change *audit.FileChange) call {
+	c := r.seq.next()
+	c.dir = dir
+	c.method = method
+	if r.sink == nil && r.trace == nil {
+		return c
+	}
+	rawParams, _ := json.Marshal(params)
+	var userText, agentText string
+	c.sid, _, userText, agentText = acpinspect.Extract(acpinspect.AnyMessage{Method: method, Params: rawParams})
+
+	r.mu.Lock()
+	if r.inflight == nil {
+		r.inflight = map[string]struct{}{}
+	}
+	r.inflight[c.id] = struct{}{}
+	r.mu.Unlock()
+
+	if r.trace != nil {
+		r.trace.begin(c, rawParams)
+	}
+	if r.sink == nil {
+		return c
+	}
+	_ = r.sink.Write(ctx, audit.Record{
+		Timestamp:     c.start,
+		Direction:     dir,
+		SessionID:     c.sid,
+		Method:        method,
+		IsRequest:     true,
+		Raw:           rawParams,
+		UserText:      userText,
+		AgentText:     agentText,
+		CorrelationID: c.id,
+		Seq:           c.seq,
+		ConnID:        r.conn,
+		Status:        audit.StatusPending,
+		FileChange:    change,
+	})
+	return c
+}
+
+// end records the response (or error) for c and finishes its request row.
+func (r *recorder) end(ctx context.Context, c call, result any, err error) {
+	if r.sink == nil && r.trace == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.inflight, c.id)
+	r.mu.Unlock()
+
+	now := time.Now()
+	resp := audit.Record{
+		Timestamp:     now,
+		Direction:     reverse(c.dir),
+		SessionID:     c.sid,
+		Method:        c.method,
+		CorrelationID: c.id,
+		Seq:           c.seq,
+		ConnID:        r.conn,
+		Latency:       now.Sub(c.start),
+	}
+	status := audit.StatusCompleted
+	if err != nil {
+		resp.Error, resp.Raw = rpcError(err)
+		status = audit.StatusFailed
+		if ctx.Err() != nil {
+			// The caller went away; the downstream error is a consequence.
+			status = audit.StatusAbandoned
+		}
+	} else {
+		resp.Raw, _ = json.Marshal(result)
+	}
+	if r.trace != nil {
+		r.trace.end(c, result, err, status)
+	}
+	if r.sink == nil {
+		return
+	}
+	// Write the response even if the request context is gone so the trail
+	// shows how the call ended.
+	wctx := context.WithoutCancel(ctx)
+	_ = r.sink.Write(wctx, resp)
+	_ = r.sink.Finish(wctx, c.id, status)
+}
+
+// notify records a notification travelling in direction dir after it has
+// been forwarded. Notifications have no response, so a forwarding error is
+// attached to the notification row itself.
+func (r *recorder) notify(ctx context.Context, dir audit.Direction, method string, params any, err error) {
+	c := r.seq.next()
+	if r.sink == nil && r.trace == nil {
+		return
+	}
+	rawParams, _ := json.Marshal(params)
+	sid, _, userText, agentText := acpinspect.Extract(acpinspect.AnyMessage{Method: method, Params: rawParams})
+	if r.trace != nil {
+		r.trace.notify(method, sid, rawParams)
+	}
+	if r.sink == nil {
+		return
+	}
+	rec := audit.Record{
+		Timestamp:     c.start,
+		Direction:     dir,
+		SessionID:     sid,
+		Method:        method,
+		IsNotify:      true,
+		Raw:           rawParams,
+		UserText:      userText,
+		AgentText:     agentText,
+		CorrelationID: c.id,
+		Seq:           c.seq,
+		ConnID:        r.conn,
+	}
+	rec.Error, _ = rpcError(err)
+	_ = r.sink.Write(ctx, rec)
+}
+
+// abandon marks every call still in flight as abandoned and tells the sink
+// that the connection has ended.
+func (r *recorder) abandon(ctx context.Context) {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.inflight))
+	for id := range r.inflight {
+		ids = append(ids, id)
+	}
+	r.inflight = nil
+	r.mu.Unlock()
+
+	if r.trace != nil {
+		r.trace.abandon(ids)
+	}
+	if r.sink == nil {
+		return
+	}
+	for _, id := range ids {
+		_ = r.sink.Finish(ctx, id, audit.StatusAbandoned)
+	}
+	conn := r.conn
+	if conn == "" {
+		conn = r.seq.conn()
+	}
+	_ = audit.EndConnection(ctx, r.sink, conn)
+}
+
+func reverse(d audit.Direction) audit.Direction {
+	if d == audit.DirectionUpstreamToDownstream {
+		return audit.DirectionDownstreamToUpstream
+	}
+	return audit.DirectionUpstreamToDownstream
+}
+
+// sequencer hands out monotonically increasing sequence numbers for one
+// connection. Correlation ids combine a random per-connection prefix with
+// the sequence number so they stay unique across connections and restarts.
+// The zero value is ready to use.
+type sequencer struct {
+	once   sync.Once
+	prefix string
+	n      atomic.Int64
+}
+
+func (s *sequencer) next() call {
+	n := s.n.Add(1)
+	return call{id: fmt.Sprintf("%s-%d", s.conn(), n), seq: n, start: time.Now()}
+}
+
+// conn returns the correlation id prefix of the connection.
+func (s *sequencer) conn() string {
+	s.once.Do(func() {
+		var b [6]byte
+		_, _ = rand.Read(b[:])
+		s.prefix = hex.EncodeToString(b[:])
+	})
+	return s.prefix
+}
+
+// rpcError converts an error returned by the SDK into its JSON-RPC form,
+// along with the error object as it appears on the wire. Errors that are not
+// already JSON-RPC errors are reported as internal errors, as the SDK does
+// when replying to the peer.
+func rpcError(err error) (*audit.RPCError, json.RawMessage) {
+	if err == nil {
+		return nil, nil
+	}
+	var re *acp.RequestError
+	if !errors.As(err, &re) {
+		re = acp.NewInternalError(map[string]any{"error": err.Error()})
+	}
+	out := &audit.RPCError{Code: re.Code, Message: re.Message}
+	if re.Data != nil {
+		out.Data, _ = json.Marshal(re.Data)
+	}
+	raw, _ := json.Marshal(re)
+	return out, raw
+}
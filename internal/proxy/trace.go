@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"acp-gate/internal/audit"
+	"acp-gate/internal/telemetry"
+	acp "github.com/coder/acp-go-sdk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer turns the calls of one connection into OpenTelemetry spans. Each
+// request becomes a span; requests from the agent (fs/*, terminal/*,
+// session/request_permission, ...) are children of the session/prompt
+// that is running in their session, and tool call updates are recorded as
+// events on it. Share one Tracer between the ProxyAgent and ProxyClient of
+// a connection.
+type Tracer struct {
+	parent context.Context
+	tracer trace.Tracer
+
+	mu      sync.Mutex
+	spans   map[string]trace.Span // by correlation id
+	prompts map[string]trace.Span // running session/prompt by session id
+}
+
+// NewTracer returns a Tracer whose top-level spans are children of the
+// span in parent, if any.
+func NewTracer(parent context.Context) *Tracer {
+	return &Tracer{
+		parent:  context.WithoutCancel(parent),
+		tracer:  telemetry.Tracer(),
+		spans:   map[string]trace.Span{},
+		prompts: map[string]trace.Span{},
+	}
+}
+
+func (t *Tracer) begin(c call, params json.RawMessage) {
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "jsonrpc"),
+		attribute.String("rpc.method", c.method),
+		attribute.String("acp.direction", string(c.dir)),
+		attribute.String("acp.corr_id", c.id),
+		attribute.Int64("acp.seq", c.seq),
+	}
+	if c.sid != "" {
+		attrs = append(attrs, attribute.String("acp.session_id", c.sid))
+	}
+	if c.method == acp.ClientMethodSessionRequestPermission {
+		var p acp.RequestPermissionRequest
+		if json.Unmarshal(params, &p) == nil {
+			attrs = append(attrs, attribute.String("acp.tool_call.id", string(p.ToolCall.ToolCallId)))
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent := t.parent
+	kind := trace.SpanKindServer
+	if c.dir == audit.DirectionDownstreamToUpstream {
+		kind = trace.SpanKindClient
+		if p, ok := t.prompts[c.sid]; ok {
+			parent = trace.ContextWithSpan(parent, p)
+		}
+	}
+	_, span := t.tracer.Start(parent, c.method, trace.WithTimestamp(c.start), trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	t.spans[c.id] = span
+	if c.method == acp.AgentMethodSessionPrompt && c.sid != "" {
+		t.prompts[c.sid] = span
+	}
+}
+
+func (t *Tracer) end(c call, result any, err error, status audit.Status) {
+	t.mu.Lock()
+	span, ok := t.spans[c.id]
+	delete(t.spans, c.id)
+	if ok && t.prompts[c.sid] == span {
+		delete(t.prompts, c.sid)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	switch r := result.(type) {
+	case acp.PromptResponse:
+		span.SetAttributes(attribute.String("acp.stop_reason", string(r.StopReason)))
+	case acp.RequestPermissionResponse:
+		switch {
+		case r.Outcome.Selected != nil:
+			span.SetAttributes(attribute.String("acp.permission.outcome", "selected"),
+				attribute.String("acp.permission.option_id", string(r.Outcome.Selected.OptionId)))
+		case r.Outcome.Cancelled != nil:
+			span.SetAttributes(attribute.String("acp.permission.outcome", "cancelled"))
+		}
+	}
+	if err != nil {
+		var re *acp.RequestError
+		if errors.As(err, &re) {
+			span.SetAttributes(attribute.Int("rpc.jsonrpc.error_code", re.Code))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, string(status))
+	}
+	span.End()
+}
+
+// notify records tool call updates as events on the running prompt.
+func (t *Tracer) notify(method, sid string, params json.RawMessage) {
+	if method != acp.ClientMethodSessionUpdate {
+		return
+	}
+	t.mu.Lock()
+	span, ok := t.prompts[sid]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	var n acp.SessionNotification
+	if json.Unmarshal(params, &n) != nil {
+		return
+	}
+	switch u := n.Update; {
+	case u.ToolCall != nil:
+		span.AddEvent("tool_call", trace.WithAttributes(
+			attribute.String("acp.tool_call.id", string(u.ToolCall.ToolCallId)),
+			attribute.String("acp.tool_call.title", u.ToolCall.Title),
+			attribute.String("acp.tool_call.kind", string(u.ToolCall.Kind)),
+			attribute.String("acp.tool_call.status", string(u.ToolCall.Status)),
+		))
+	case u.ToolCallUpdate != nil:
+		attrs := []attribute.KeyValue{attribute.String("acp.tool_call.id", string(u.ToolCallUpdate.ToolCallId))}
+		if u.ToolCallUpdate.Status != nil {
+			attrs = append(attrs, attribute.String("acp.tool_call.status", string(*u.ToolCallUpdate.Status)))
+		}
+		if u.ToolCallUpdate.Title != nil {
+			attrs = append(attrs, attribute.String("acp.tool_call.title", *u.ToolCallUpdate.Title))
+		}
+		span.AddEvent("tool_call_update", trace.WithAttributes(attrs...))
+	}
+}
+
+// abandon ends the spans of the given calls, which never got a response.
+func (t *Tracer) abandon(ids []string) {
+	t.mu.Lock()
+	var spans []trace.Span
+	for _, id := range ids {
+		if span, ok := t.spans[id]; ok {
+			spans = append(spans, span)
+			delete(t.spans, id)
+		}
+	}
+	for sid, span := range t.prompts {
+		for _, s := range spans {
+			if s == span {
+				delete(t.prompts, sid)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, span := range spans {
+		span.SetStatus(codes.Error, string(audit.StatusAbandoned))
+		span.End()
+	}
+}
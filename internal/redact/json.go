@@ -0,0 +1,267 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePath splits $.a.b[*].c into its segments: object keys, "*", and
+// array selectors "[*]" or "[n]".
+func parsePath(p string) ([]string, error) {
+	rest, ok := strings.CutPrefix(p, "$")
+	if !ok {
+		return nil, fmt.Errorf("redaction path %q must start with $", p)
+	}
+	var segs []string
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("redaction path %q has an empty key", p)
+			}
+			segs = append(segs, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("redaction path %q has an unclosed [", p)
+			}
+			idx := rest[1:end]
+			if idx != "*" {
+				if _, err := strconv.Atoi(idx); err != nil {
+					return nil, fmt.Errorf("redaction path %q: bad index %q", p, idx)
+				}
+			}
+			segs = append(segs, rest[:end+1])
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("redaction path %q: unexpected %q", p, rest[0])
+		}
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("redaction path %q selects the whole document", p)
+	}
+	return segs, nil
+}
+
+// walker copies a JSON document to out, replacing redacted values. It is a
+// minimal parser: it only needs to find value boundaries and track the
+// current path.
+type walker struct {
+	in      []byte
+	pos     int
+	out     []byte
+	copied  int // in[:copied] has been handled
+	r       *Redactor
+	rules   [][]string
+	path    []string
+	changed bool
+}
+
+func (w *walker) document() bool {
+	w.out = make([]byte, 0, len(w.in))
+	if !w.value() {
+		return false
+	}
+	w.space()
+	if w.pos != len(w.in) {
+		return false
+	}
+	w.out = append(w.out, w.in[w.copied:]...)
+	return true
+}
+
+// replace substitutes in[start:pos] with v.
+func (w *walker) replace(start int, v string) {
+	q, _ := json.Marshal(v)
+	w.out = append(w.out, w.in[w.copied:start]...)
+	w.out = append(w.out, q...)
+	w.copied = w.pos
+	w.changed = true
+}
+
+func (w *walker) matched() bool {
+	for _, rule := range w.rules {
+		if len(rule) != len(w.path) {
+			continue
+		}
+		ok := true
+		for i, seg := range rule {
+			p := w.path[i]
+			switch {
+			case seg == p:
+			case seg == "*" && !strings.HasPrefix(p, "["):
+			case seg == "[*]" && strings.HasPrefix(p, "["):
+			default:
+				ok = false
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *walker) space() {
+	for w.pos < len(w.in) {
+		switch w.in[w.pos] {
+		case ' ', '\t', '\n', '\r':
+			w.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (w *walker) value() bool {
+	w.space()
+	if w.pos >= len(w.in) {
+		return false
+	}
+	start := w.pos
+	hit := len(w.path) > 0 && w.matched()
+	outLen, copied := len(w.out), w.copied
+	var ok bool
+	switch w.in[w.pos] {
+	case '{':
+		ok = w.object()
+	case '[':
+		ok = w.array()
+	case '"':
+		var s string
+		s, ok = w.str()
+		if ok && !hit {
+			if red := w.r.Text(s); red != s {
+				w.replace(start, red)
+			}
+		}
+	default:
+		ok = w.literal()
+	}
+	if ok && hit {
+		// The whole value is replaced, including anything redacted inside it.
+		w.out, w.copied = w.out[:outLen], copied
+		w.replace(start, w.r.placeholder("path", string(w.in[start:w.pos])))
+	}
+	return ok
+}
+
+func (w *walker) object() bool {
+	w.pos++ // {
+	w.space()
+	if w.pos < len(w.in) && w.in[w.pos] == '}' {
+		w.pos++
+		return true
+	}
+	for {
+		w.space()
+		if w.pos >= len(w.in) || w.in[w.pos] != '"' {
+			return false
+		}
+		key, ok := w.str()
+		if !ok {
+			return false
+		}
+		w.space()
+		if w.pos >= len(w.in) || w.in[w.pos] != ':' {
+			return false
+		}
+		w.pos++
+		w.path = append(w.path, key)
+		ok = w.value()
+		w.path = w.path[:len(w.path)-1]
+		if !ok {
+			return false
+		}
+		w.space()
+		if w.pos >= len(w.in) {
+			return false
+		}
+		switch w.in[w.pos] {
+		case ',':
+			w.pos++
+		case '}':
+			w.pos++
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func (w *walker) array() bool {
+	w.pos++ // [
+	w.space()
+	if w.pos < len(w.in) && w.in[w.pos] == ']' {
+		w.pos++
+		return true
+	}
+	for i := 0; ; i++ {
+		w.path = append(w.path, "["+strconv.Itoa(i)+"]")
+		ok := w.value()
+		w.path = w.path[:len(w.path)-1]
+		if !ok {
+			return false
+		}
+		w.space()
+		if w.pos >= len(w.in) {
+			return false
+		}
+		switch w.in[w.pos] {
+		case ',':
+			w.pos++
+		case ']':
+			w.pos++
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// str consumes a string literal and returns its decoded value.
+func (w *walker) str() (string, bool) {
+	start := w.pos
+	w.pos++ // opening quote
+	escaped := false
+	for w.pos < len(w.in) {
+		c := w.in[w.pos]
+		w.pos++
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			var s string
+			if err := json.Unmarshal(w.in[start:w.pos], &s); err != nil {
+				return "", false
+			}
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func (w *walker) literal() bool {
+	start := w.pos
+	for w.pos < len(w.in) {
+		switch w.in[w.pos] {
+		case ',', '}', ']', ' ', '\t', '\n', '\r':
+			return w.pos > start
+		}
+		w.pos++
+	}
+	return w.pos > start
+}
@@ -0,0 +1,159 @@
+// Package redact removes secrets from audit payloads before they are
+// persisted. Matches are replaced with stable placeholders of the form
+// [REDACTED:<rule>:<hash>], where the hash is derived from the secret so
+// that repeated occurrences of one secret can still be correlated.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern is a named regular expression. If the expression has a group
+// named "secret", only that group is replaced; otherwise the whole match is.
+type Pattern struct {
+	Name  string
+	Regex string
+}
+
+// PathRule redacts the JSON value at Path, optionally only for one ACP
+// method. Paths are written as $.a.b[*].c, where * matches any object key
+// and [*] any array element.
+type PathRule struct {
+	Method string
+	Path   string
+}
+
+// Options configures a Redactor.
+type Options struct {
+	// DisableBuiltin turns off the built-in detectors.
+	DisableBuiltin bool
+	Patterns       []Pattern
+	Paths          []PathRule
+	// Salt keys the placeholder hash. Without a salt, placeholders of
+	// short secrets can be confirmed by guessing.
+	Salt string
+}
+
+// Builtin lists the detectors enabled unless Options.DisableBuiltin is set.
+var Builtin = []Pattern{
+	{"api_key", `\b(?:sk-[A-Za-z0-9_-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}|xox[abprs]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35})`},
+	{"private_key", `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	{"jwt", `\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]+`},
+	{"env", `(?m)^[ \t]*(?:export[ \t]+)?[A-Za-z_][A-Za-z0-9_]*(?:KEY|SECRET|TOKEN|PASSWORD|PASSWD|CREDENTIALS?)[ \t]*=[ \t]*(?P<secret>[^\s#]+)`},
+}
+
+type pattern struct {
+	name  string
+	re    *regexp.Regexp
+	group int // submatch to replace; 0 for the whole match
+}
+
+type pathRule struct {
+	method string
+	path   []string
+}
+
+// Redactor applies the configured rules. A nil *Redactor leaves its input
+// unchanged.
+type Redactor struct {
+	patterns []pattern
+	paths    []pathRule
+	salt     []byte
+}
+
+// New compiles opts.
+func New(opts Options) (*Redactor, error) {
+	r := &Redactor{salt: []byte(opts.Salt)}
+	var all []Pattern
+	if !opts.DisableBuiltin {
+		all = append(all, Builtin...)
+	}
+	all = append(all, opts.Patterns...)
+	for _, p := range all {
+		if p.Name == "" {
+			return nil, fmt.Errorf("redaction pattern %q has no name", p.Regex)
+		}
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %s: %w", p.Name, err)
+		}
+		r.patterns = append(r.patterns, pattern{name: p.Name, re: re, group: re.SubexpIndex("secret")})
+	}
+	for _, p := range opts.Paths {
+		path, err := parsePath(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		r.paths = append(r.paths, pathRule{method: p.Method, path: path})
+	}
+	return r, nil
+}
+
+// Text replaces every pattern match in s.
+func (r *Redactor) Text(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	for _, p := range r.patterns {
+		if p.group <= 0 {
+			s = p.re.ReplaceAllStringFunc(s, func(m string) string { return r.placeholder(p.name, m) })
+			continue
+		}
+		locs := p.re.FindAllStringSubmatchIndex(s, -1)
+		if len(locs) == 0 {
+			continue
+		}
+		var sb strings.Builder
+		last := 0
+		for _, loc := range locs {
+			start, end := loc[2*p.group], loc[2*p.group+1]
+			if start < 0 {
+				continue
+			}
+			sb.WriteString(s[last:start])
+			sb.WriteString(r.placeholder(p.name, s[start:end]))
+			last = end
+		}
+		sb.WriteString(s[last:])
+		s = sb.String()
+	}
+	return s
+}
+
+// JSON redacts the string values of raw and any values selected by path
+// rules for method. The rest of the document is kept byte for byte; raw is
+// returned as is when nothing matched or it is not valid JSON.
+func (r *Redactor) JSON(method string, raw []byte) []byte {
+	if r == nil || len(raw) == 0 {
+		return raw
+	}
+	var rules [][]string
+	for _, p := range r.paths {
+		if p.method == "" || p.method == method {
+			rules = append(rules, p.path)
+		}
+	}
+	w := &walker{in: raw, r: r, rules: rules}
+	if !w.document() || !w.changed {
+		return raw
+	}
+	return w.out
+}
+
+func (r *Redactor) placeholder(rule, secret string) string {
+	var sum []byte
+	if len(r.salt) > 0 {
+		m := hmac.New(sha256.New, r.salt)
+		m.Write([]byte(secret))
+		sum = m.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(secret))
+		sum = s[:]
+	}
+	return "[REDACTED:" + rule + ":" + hex.EncodeToString(sum[:4]) + "]"
+}
@@ -6,7 +6,13 @@ import (
     "testing"
     "time"
 
+    "acp-gate/internal/telemetry"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/propagation"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/trace"
     "google.golang.org/grpc"
+    "google.golang.org/grpc/credentials/insecure"
 )
 
 // echoGate is a simple GateServer that echoes any received bytes back to the client.
@@ -79,3 +85,99 @@ func TestPureProxyServerRelays(t *testing.T) {
         }
     }
 }
+
+// traceGate records the trace id it was reached with.
+type traceGate struct {
+    got chan trace.TraceID
+}
+
+func (g traceGate) Tunnel(stream Gate_TunnelServer) error {
+    g.got <- trace.SpanContextFromContext(telemetry.Incoming(stream.Context())).TraceID()
+    return nil
+}
+
+func TestPureProxyServerPropagatesTrace(t *testing.T) {
+    otel.SetTracerProvider(sdktrace.NewTracerProvider())
+    otel.SetTextMapPropagator(propagation.TraceContext{})
+    defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+    gate := traceGate{got: make(chan trace.TraceID, 1)}
+    upstreamAddr, upstreamStop := startGRPCServer(t, gate)
+    defer upstreamStop()
+    proxyAddr, proxyStop := startGRPCServer(t, &GateService{Cfg: ServerConfig{ConnectAddr: upstreamAddr}})
+    defer proxyStop()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    conn, err := grpc.NewClient(proxyAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithDefaultCallOptions(grpc.ForceCodec(RawCodec)))
+    if err != nil {
+        t.Fatalf("dial proxy: %v", err)
+    }
+    defer conn.Close()
+
+    ctx, span := telemetry.Tracer().Start(ctx, "client")
+    defer span.End()
+    stream, err := NewGateClient(conn).Tunnel(telemetry.Outgoing(ctx))
+    if err != nil {
+        t.Fatalf("open tunnel via proxy: %v", err)
+    }
+    defer stream.CloseSend()
+
+    select {
+    case id := <-gate.got:
+        if id != span.SpanContext().TraceID() {
+            t.Fatalf("server saw trace %s, want %s", id, span.SpanContext().TraceID())
+        }
+    case <-ctx.Done():
+        t.Fatalf("server was not reached")
+    }
+}
+
+// hopGate records the hop chain it was reached with.
+type hopGate struct {
+    got chan []string
+}
+
+func (g hopGate) Tunnel(stream Gate_TunnelServer) error {
+    _, hops := tunnelHops(stream.Context())
+    g.got <- hops
+    return nil
+}
+
+func TestPureProxyServerForwardsHops(t *testing.T) {
+    gate := hopGate{got: make(chan []string, 1)}
+    upstreamAddr, upstreamStop := startGRPCServer(t, gate)
+    defer upstreamStop()
+    relay2Addr, relay2Stop := startGRPCServer(t, &GateService{Cfg: ServerConfig{ConnectAddr: upstreamAddr}})
+    defer relay2Stop()
+    relay1Addr, relay1Stop := startGRPCServer(t, &GateService{Cfg: ServerConfig{ConnectAddr: relay2Addr}})
+    defer relay1Stop()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    conn, err := grpc.NewClient(relay1Addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithDefaultCallOptions(grpc.ForceCodec(RawCodec)))
+    if err != nil {
+        t.Fatalf("dial relay: %v", err)
+    }
+    defer conn.Close()
+    stream, err := NewGateClient(conn).Tunnel(ctx)
+    if err != nil {
+        t.Fatalf("open tunnel via relays: %v", err)
+    }
+    defer stream.CloseSend()
+
+    select {
+    case hops := <-gate.got:
+        // The client, then each relay as seen by the next server.
+        if len(hops) != 3 {
+            t.Fatalf("hops = %q, want 3 entries", hops)
+        }
+        for _, h := range hops {
+            if _, _, err := net.SplitHostPort(h); err != nil {
+                t.Fatalf("hop %q is not an address: %v", h, err)
+            }
+        }
+    case <-ctx.Done():
+        t.Fatalf("server was not reached")
+    }
+}
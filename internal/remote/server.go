@@ -1,25 +1,34 @@
 package remote
 
 import (
+    "context"
     "fmt"
     "io"
     "os"
     "os/exec"
+    "time"
 
     acp "github.com/coder/acp-go-sdk"
     "acp-gate/internal/audit"
     "acp-gate/internal/proxy"
+    "acp-gate/internal/telemetry"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
     "google.golang.org/grpc"
     "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
 )
 
-// ServerConfig provides downstream agent launch parameters and audit store.
+// ServerConfig provides downstream agent launch parameters and audit sink.
 type ServerConfig struct {
     Cmd  string
     Args []string
     Env  []string
 
-    Store *audit.Store
+    Sink audit.Sink
+    // Trace turns the proxied calls into spans (see telemetry.Setup).
+    Trace bool
 
     // ConnectAddr, if non-empty, enables pure-proxy mode: instead of launching
     // a local downstream agent process, the server will dial another acp-gate
@@ -27,13 +36,78 @@ type ServerConfig struct {
     ConnectAddr string
 }
 
+// hopMetadataKey carries the hop chain of a tunnel from a relay to the next
+// server: the addresses the tunnel came through, starting with the client.
+const hopMetadataKey = "acp-gate-hop"
+
+// tunnelHops returns the address of the immediate peer of an incoming
+// tunnel and the full hop chain, ending with that peer.
+func tunnelHops(ctx context.Context) (string, []string) {
+    hops := metadata.ValueFromIncomingContext(ctx, hopMetadataKey)
+    hops = append([]string{}, hops...)
+    var addr string
+    if p, ok := peer.FromContext(ctx); ok {
+        addr = p.Addr.String()
+        hops = append(hops, addr)
+    }
+    return addr, hops
+}
+
+// hopPairs returns hops as metadata key-value pairs.
+func hopPairs(hops []string) []string {
+    kv := make([]string, 0, 2*len(hops))
+    for _, h := range hops {
+        kv = append(kv, hopMetadataKey, h)
+    }
+    return kv
+}
+
+// agentExitGrace is how long an agent gets to exit after its stdin is
+// closed before it is killed.
+const agentExitGrace = 2 * time.Second
+
+// StopAgent closes the agent's stdin and waits for the process to exit,
+// killing it after a grace period. waitCh must deliver the result of
+// cmd.Wait.
+func StopAgent(cmd *exec.Cmd, stdin io.Closer, waitCh <-chan error) {
+    _ = stdin.Close()
+    select {
+    case <-waitCh:
+    case <-time.After(agentExitGrace):
+        _ = cmd.Process.Kill()
+        <-waitCh
+    }
+}
+
+// ExitCode returns the exit code of a process that has been waited for, or
+// nil if it has not. It is -1 for a process killed by a signal.
+func ExitCode(cmd *exec.Cmd) *int {
+    if cmd.ProcessState == nil {
+        return nil
+    }
+    code := cmd.ProcessState.ExitCode()
+    return &code
+}
+
 // GateService implements GateServer.
 type GateService struct {
     Cfg ServerConfig
 }
 
 func (s *GateService) Tunnel(stream Gate_TunnelServer) error {
-    ctx := stream.Context()
+    // Continue the trace of the previous hop; the span covers the tunnel.
+    name := "acp-gate/tunnel"
+    if s.Cfg.ConnectAddr != "" {
+        name = "acp-gate/relay"
+    }
+    var attrs []attribute.KeyValue
+    peerAddr, hops := tunnelHops(stream.Context())
+    if peerAddr != "" {
+        attrs = append(attrs, attribute.String("network.peer.address", peerAddr))
+    }
+    ctx, span := telemetry.Tracer().Start(telemetry.Incoming(stream.Context()), name,
+        trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+    defer span.End()
 
     // Pure proxy mode: forward to another server instead of spawning a process.
     if s.Cfg.ConnectAddr != "" {
@@ -47,7 +121,8 @@ func (s *GateService) Tunnel(stream Gate_TunnelServer) error {
         defer conn.Close()
 
         cli := NewGateClient(conn)
-        upStream, err := cli.Tunnel(ctx)
+        span.SetAttributes(attribute.String("acp_gate.next_hop", s.Cfg.ConnectAddr))
+        upStream, err := cli.Tunnel(metadata.AppendToOutgoingContext(telemetry.Outgoing(ctx), hopPairs(hops)...))
         if err != nil {
             return fmt.Errorf("open upstream tunnel: %w", err)
         }
@@ -100,11 +175,32 @@ func (s *GateService) Tunnel(stream Gate_TunnelServer) error {
     if err != nil { return err }
     if err := cmd.Start(); err != nil { return err }
 
+    connID := audit.NewConnectionID()
+    _ = audit.StartConnection(ctx, s.Cfg.Sink, audit.Connection{
+        ID:         connID,
+        Mode:       audit.ConnTunnel,
+        Peer:       peerAddr,
+        Hops:       hops,
+        Command:    s.Cfg.Cmd,
+        Args:       s.Cfg.Args,
+        EnvDiff:    audit.EnvDiff(os.Environ(), cmd.Env),
+        EnvRemoved: audit.EnvRemoved(os.Environ(), cmd.Env),
+        PID:        cmd.Process.Pid,
+    })
+
     // Proxies with server-side auditing.
     proxyAgent := &proxy.ProxyAgent{}
-    proxyAgent.SetStore(s.Cfg.Store)
+    proxyAgent.SetSink(s.Cfg.Sink)
+    proxyAgent.SetConnection(connID)
     proxyClient := &proxy.ProxyClient{}
-    proxyClient.SetStore(s.Cfg.Store)
+    proxyClient.SetSink(s.Cfg.Sink)
+    proxyClient.SetConnection(connID)
+    if s.Cfg.Trace {
+        span.SetAttributes(attribute.String("acp_gate.agent.command", s.Cfg.Cmd))
+        tracer := proxy.NewTracer(ctx)
+        proxyAgent.SetTracer(tracer)
+        proxyClient.SetTracer(tracer)
+    }
 
     // Upstream is the remote client via gRPC stream.
     upWriter := NewStreamWriter(stream.Send)
@@ -120,17 +216,31 @@ func (s *GateService) Tunnel(stream Gate_TunnelServer) error {
     waitCh := make(chan error, 1)
     go func() { waitCh <- cmd.Wait() }()
 
+    var (
+        reason string
+        runErr error
+        exited bool
+    )
     select {
     case <-ctx.Done():
-        return ctx.Err()
+        reason, runErr = audit.CloseUpstream, ctx.Err()
     case <-upstreamConn.Done():
-        return nil
+        reason = audit.CloseUpstream
     case <-downstreamConn.Done():
-        return nil
+        reason = audit.CloseDownstream
     case err := <-waitCh:
-        if err == io.EOF {
-            return nil
+        reason, exited = audit.CloseAgentExit, true
+        if err != io.EOF {
+            runErr = err
         }
-        return err
     }
+
+    // Requests still awaiting a response when the tunnel ends are recorded as abandoned.
+    proxyAgent.Abandon(context.Background())
+    proxyClient.Abandon(context.Background())
+    if !exited {
+        StopAgent(cmd, dsIn, waitCh)
+    }
+    _ = audit.FinishConnection(context.Background(), s.Cfg.Sink, connID, audit.ConnectionEnd{ExitCode: ExitCode(cmd), Reason: reason})
+    return runErr
 }
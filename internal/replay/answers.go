@@ -0,0 +1,130 @@
+package replay
+
+import (
+	"encoding/json"
+	"sync"
+
+	"acp-gate/internal/audit"
+	"acp-gate/internal/transcript"
+	acp "github.com/coder/acp-go-sdk"
+)
+
+// answers holds the recorded responses to the requests the agent made of
+// the client. Each response is given once, in the order it was recorded.
+type answers struct {
+	mu sync.Mutex
+	// calls maps a file or terminal request, see callKey, to the responses
+	// it got.
+	calls map[string][]audit.Record
+	perms []recordedPermission
+}
+
+type recordedPermission struct {
+	tool recordedTool
+	// outcome is the kind of the option the user picked, or "cancelled".
+	outcome string
+	used    bool
+}
+
+func newAnswers(rec Recording) *answers {
+	a := &answers{calls: map[string][]audit.Record{}}
+	reqs := map[string]audit.Record{}
+	for _, r := range rec.Records {
+		switch {
+		case !replayable(r.Method) || r.IsNotify || r.CorrelationID == "":
+		case r.IsRequest:
+			reqs[r.CorrelationID] = r
+		default:
+			if req, ok := reqs[r.CorrelationID]; ok {
+				delete(reqs, r.CorrelationID)
+				key := callKey(r.Method, req.Raw)
+				a.calls[key] = append(a.calls[key], r)
+			}
+		}
+	}
+
+	// Permission requests name tool calls by id, which differ between
+	// runs, so they are matched by the title and kind of the tool call.
+	// The tool call is often announced only after the request was made.
+	t := transcript.Build(rec.SessionID, rec.Records)
+	tools := map[string]recordedTool{}
+	for _, e := range t.Entries {
+		if e.Tool != nil {
+			tools[e.Tool.ID] = recordedTool{title: e.Tool.Title, kind: e.Tool.Kind}
+		}
+	}
+	for _, e := range t.Entries {
+		if p := e.Permission; p != nil {
+			var outcome string
+			if o, ok := p.Selected(); ok {
+				outcome = o.Kind
+			} else if p.Outcome == "cancelled" {
+				outcome = p.Outcome
+			} else {
+				continue
+			}
+			tool := tools[p.ToolCallID]
+			if p.Title != "" {
+				tool.title = p.Title
+			}
+			a.perms = append(a.perms, recordedPermission{tool: tool, outcome: outcome})
+		}
+	}
+	return a
+}
+
+// replayable reports whether requests of method are answered from calls.
+func replayable(method string) bool {
+	switch method {
+	case acp.ClientMethodFsReadTextFile, acp.ClientMethodFsWriteTextFile,
+		acp.ClientMethodTerminalCreate, acp.ClientMethodTerminalOutput, acp.ClientMethodTerminalWaitForExit,
+		acp.ClientMethodTerminalKill, acp.ClientMethodTerminalRelease:
+		return true
+	}
+	return false
+}
+
+// callKey identifies a request by its method and parameters, leaving out
+// the session id, which differs between runs.
+func callKey(method string, raw []byte) string {
+	var m map[string]any
+	if json.Unmarshal(raw, &m) != nil {
+		return method + " " + string(raw)
+	}
+	delete(m, "sessionId")
+	delete(m, "_meta")
+	b, _ := json.Marshal(m)
+	return method + " " + string(b)
+}
+
+// take returns the next recorded response to the request raw.
+func (a *answers) take(method string, raw []byte) (audit.Record, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := callKey(method, raw)
+	rs := a.calls[key]
+	if len(rs) == 0 {
+		return audit.Record{}, false
+	}
+	a.calls[key] = rs[1:]
+	return rs[0], true
+}
+
+// permission returns the outcome of the next recorded permission request
+// for a tool call with the title of t or, failing that, its kind.
+func (a *answers) permission(t recordedTool) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, match := range []func(recordedTool) bool{
+		func(r recordedTool) bool { return t.title != "" && r.title == t.title },
+		func(r recordedTool) bool { return t.kind != "" && r.kind == t.kind },
+	} {
+		for i := range a.perms {
+			if p := &a.perms[i]; !p.used && match(p.tool) {
+				p.used = true
+				return p.outcome, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,411 @@
+// Package replay sends the prompts of a recorded session to a live agent
+// and compares what the agent does with the recording. It is meant for
+// regression-testing agent upgrades.
+//
+// The agent runs in a fresh session: Run sends initialize, session/new and
+// then one session/prompt per recorded prompt. Requests the agent makes
+// of the client are answered from the recording. File reads and terminal
+// calls are answered when the recording has the same request. Permission
+// requests get the kind of option the user picked for the same tool call.
+// File writes are acknowledged but never performed. Requests the
+// recording cannot answer fail and are listed in the report.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"acp-gate/internal/acpinspect"
+	"acp-gate/internal/audit"
+	acp "github.com/coder/acp-go-sdk"
+)
+
+// Recording is the audit trail of the session to replay.
+type Recording struct {
+	SessionID string
+	// Cwd is the working directory of the recorded session.
+	Cwd string
+	// ClientCapabilities are those the original client announced; the
+	// replay announces the same so that the agent makes the same kind of
+	// requests. Nil announces file system and terminal support.
+	ClientCapabilities json.RawMessage
+	// Records are the rows of the session in the order they were written,
+	// with blob references resolved; see audit.Store.Rehydrate.
+	Records []audit.Record
+	// Turns supply the agent text of sessions recorded with -audit-turns
+	// drop; see transcript.BuildWithTurns.
+	Turns []audit.Turn
+}
+
+// Options configures Run.
+type Options struct {
+	// Cwd overrides the working directory of the recorded session.
+	Cwd string
+	// TurnTimeout cancels a prompt turn that takes longer; zero means no
+	// limit.
+	TurnTimeout time.Duration
+}
+
+// Run replays rec against the agent that reads agentIn and writes
+// agentOut. A prompt turn that fails is reported and the next prompt is
+// sent anyway; Run only fails if the session cannot be set up or ctx is
+// done.
+func Run(ctx context.Context, rec Recording, agentIn io.Writer, agentOut io.Reader, opts Options) (Report, error) {
+	prompts := recordedPrompts(rec.Records)
+	if len(prompts) == 0 {
+		return Report{}, fmt.Errorf("no prompts recorded for session %q", rec.SessionID)
+	}
+	c := newClient(rec)
+	conn := acp.NewClientSideConnection(c, agentIn, &tap{r: agentOut, c: c})
+
+	caps := acp.ClientCapabilities{Fs: acp.FileSystemCapability{ReadTextFile: true, WriteTextFile: true}, Terminal: true}
+	if len(rec.ClientCapabilities) > 0 {
+		caps = acp.ClientCapabilities{}
+		if err := json.Unmarshal(rec.ClientCapabilities, &caps); err != nil {
+			return Report{}, fmt.Errorf("recorded client capabilities: %w", err)
+		}
+	}
+	if _, err := conn.Initialize(ctx, acp.InitializeRequest{
+		ProtocolVersion:    acp.ProtocolVersionNumber,
+		ClientCapabilities: caps,
+		ClientInfo:         &acp.Implementation{Name: "acp-gate-replay"},
+	}); err != nil {
+		return Report{}, fmt.Errorf("initialize: %w", err)
+	}
+	cwd := rec.Cwd
+	if opts.Cwd != "" {
+		cwd = opts.Cwd
+	}
+	if cwd == "" {
+		return Report{}, fmt.Errorf("the working directory of session %q was not recorded; set one", rec.SessionID)
+	}
+	sess, err := conn.NewSession(ctx, acp.NewSessionRequest{Cwd: cwd, McpServers: []acp.McpServer{}})
+	if err != nil {
+		return Report{}, fmt.Errorf("session/new: %w", err)
+	}
+	c.setSession(string(sess.SessionId))
+
+	for i, blocks := range prompts {
+		req := acp.PromptRequest{SessionId: sess.SessionId, Prompt: blocks}
+		corr := "replay-prompt-" + strconv.Itoa(i)
+		c.request(corr, acp.AgentMethodSessionPrompt, audit.DirectionUpstreamToDownstream, req)
+		tctx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.TurnTimeout > 0 {
+			tctx, cancel = context.WithTimeout(ctx, opts.TurnTimeout)
+		}
+		resp, err := conn.Prompt(tctx, req)
+		cancel()
+		if ctx.Err() != nil {
+			return c.report(rec), ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("turn did not finish within %s", opts.TurnTimeout)
+		}
+		c.response(corr, acp.AgentMethodSessionPrompt, audit.DirectionDownstreamToUpstream, resp, err)
+	}
+	return c.report(rec), nil
+}
+
+// recordedPrompts returns the content of the session/prompt requests in
+// records.
+func recordedPrompts(records []audit.Record) [][]acp.ContentBlock {
+	var out [][]acp.ContentBlock
+	for _, r := range records {
+		if r.Method != acp.AgentMethodSessionPrompt || !r.IsRequest {
+			continue
+		}
+		var req acp.PromptRequest
+		if json.Unmarshal(r.Raw, &req) != nil {
+			continue
+		}
+		out = append(out, req.Prompt)
+	}
+	return out
+}
+
+// client is the acp.Client the agent talks to. It keeps the exchange in
+// the form of audit records, so that both sides of the report are built
+// the same way.
+type client struct {
+	answers *answers
+
+	mu      sync.Mutex
+	session string
+	records []audit.Record
+	// tools remembers the title and kind of the tool calls seen, for
+	// permission requests that only name the tool call id.
+	tools  map[string]recordedTool
+	nextID int
+	stats  Callbacks
+}
+
+type recordedTool struct {
+	title, kind string
+}
+
+func newClient(rec Recording) *client {
+	return &client{answers: newAnswers(rec), tools: map[string]recordedTool{}}
+}
+
+func (c *client) setSession(id string) {
+	c.mu.Lock()
+	c.session = id
+	c.mu.Unlock()
+}
+
+func (c *client) add(r audit.Record) {
+	r.Timestamp = time.Now()
+	r.SessionID = c.session
+	if r.IsRequest || r.IsNotify {
+		_, _, r.UserText, r.AgentText = acpinspect.Extract(acpinspect.AnyMessage{Method: r.Method, Params: r.Raw})
+	}
+	c.records = append(c.records, r)
+}
+
+func (c *client) request(corr, method string, dir audit.Direction, params any) {
+	raw, _ := json.Marshal(params)
+	c.mu.Lock()
+	c.add(audit.Record{Direction: dir, Method: method, IsRequest: true, Raw: raw, CorrelationID: corr})
+	c.mu.Unlock()
+}
+
+func (c *client) response(corr, method string, dir audit.Direction, result any, err error) {
+	r := audit.Record{Direction: dir, Method: method, CorrelationID: corr}
+	if err != nil {
+		r.Error = rpcError(err)
+	} else {
+		r.Raw, _ = json.Marshal(result)
+	}
+	c.mu.Lock()
+	c.add(r)
+	c.mu.Unlock()
+}
+
+func rpcError(err error) *audit.RPCError {
+	var re *acp.RequestError
+	if errors.As(err, &re) {
+		e := &audit.RPCError{Code: re.Code, Message: re.Message}
+		if re.Data != nil {
+			e.Data, _ = json.Marshal(re.Data)
+		}
+		return e
+	}
+	return &audit.RPCError{Code: -32603, Message: err.Error()}
+}
+
+// tap passes the agent's output on to the connection and records the
+// session updates in it. The connection handles each message on its own
+// goroutine, so updates are recorded here to keep them in the order the
+// agent sent them, and ahead of the requests and responses that follow.
+type tap struct {
+	r   io.Reader
+	c   *client
+	buf []byte
+}
+
+func (t *tap) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.buf = append(t.buf, p[:n]...)
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			break
+		}
+		t.c.line(t.buf[:i])
+		t.buf = t.buf[i+1:]
+	}
+	return n, err
+}
+
+// line records the message line if it is a session update.
+func (c *client) line(line []byte) {
+	var msg struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(line, &msg) != nil || msg.ID != nil || msg.Method != acp.ClientMethodSessionUpdate {
+		return
+	}
+	var n acp.SessionNotification
+	if json.Unmarshal(msg.Params, &n) != nil {
+		return
+	}
+	c.update(n)
+}
+
+// SessionUpdate does nothing; updates are recorded by tap.
+func (c *client) SessionUpdate(ctx context.Context, n acp.SessionNotification) error {
+	return nil
+}
+
+func (c *client) update(n acp.SessionNotification) {
+	raw, _ := json.Marshal(n)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch u := n.Update; {
+	case u.ToolCall != nil:
+		c.tools[string(u.ToolCall.ToolCallId)] = recordedTool{title: u.ToolCall.Title, kind: string(u.ToolCall.Kind)}
+	case u.ToolCallUpdate != nil:
+		t := c.tools[string(u.ToolCallUpdate.ToolCallId)]
+		if u.ToolCallUpdate.Title != nil {
+			t.title = *u.ToolCallUpdate.Title
+		}
+		if u.ToolCallUpdate.Kind != nil {
+			t.kind = string(*u.ToolCallUpdate.Kind)
+		}
+		c.tools[string(u.ToolCallUpdate.ToolCallId)] = t
+	}
+	c.add(audit.Record{Direction: audit.DirectionDownstreamToUpstream, Method: acp.ClientMethodSessionUpdate, IsNotify: true, Raw: raw})
+}
+
+func (c *client) RequestPermission(ctx context.Context, p acp.RequestPermissionRequest) (acp.RequestPermissionResponse, error) {
+	c.mu.Lock()
+	c.nextID++
+	corr := "replay-permission-" + strconv.Itoa(c.nextID)
+	t := c.tools[string(p.ToolCall.ToolCallId)]
+	c.mu.Unlock()
+	if p.ToolCall.Title != nil {
+		t.title = *p.ToolCall.Title
+	}
+	if p.ToolCall.Kind != nil {
+		t.kind = string(*p.ToolCall.Kind)
+	}
+	c.request(corr, acp.ClientMethodSessionRequestPermission, audit.DirectionDownstreamToUpstream, p)
+
+	var resp acp.RequestPermissionResponse
+	kind, ok := c.answers.permission(t)
+	option, found := optionOfKind(p.Options, kind)
+	switch {
+	case ok && kind == "cancelled":
+		resp.Outcome.Cancelled = &acp.RequestPermissionOutcomeCancelled{Outcome: "cancelled"}
+	case ok && found:
+		resp.Outcome.Selected = &acp.RequestPermissionOutcomeSelected{Outcome: "selected", OptionId: option}
+	default:
+		// The user was never asked; say no.
+		c.miss(acp.ClientMethodSessionRequestPermission, t.title)
+		if option, found = optionOfKind(p.Options, string(acp.PermissionOptionKindRejectOnce)); !found {
+			option, found = optionOfKind(p.Options, string(acp.PermissionOptionKindRejectAlways))
+		}
+		if found {
+			resp.Outcome.Selected = &acp.RequestPermissionOutcomeSelected{Outcome: "selected", OptionId: option}
+		} else {
+			resp.Outcome.Cancelled = &acp.RequestPermissionOutcomeCancelled{Outcome: "cancelled"}
+		}
+	}
+	if ok {
+		c.mu.Lock()
+		c.stats.Replayed++
+		c.mu.Unlock()
+	}
+	c.response(corr, acp.ClientMethodSessionRequestPermission, audit.DirectionUpstreamToDownstream, resp, nil)
+	return resp, nil
+}
+
+func optionOfKind(options []acp.PermissionOption, kind string) (acp.PermissionOptionId, bool) {
+	for _, o := range options {
+		if string(o.Kind) == kind {
+			return o.OptionId, true
+		}
+	}
+	return "", false
+}
+
+func (c *client) ReadTextFile(ctx context.Context, p acp.ReadTextFileRequest) (acp.ReadTextFileResponse, error) {
+	var resp acp.ReadTextFileResponse
+	return resp, c.replay(acp.ClientMethodFsReadTextFile, p, p.Path, &resp)
+}
+
+func (c *client) WriteTextFile(ctx context.Context, p acp.WriteTextFileRequest) (acp.WriteTextFileResponse, error) {
+	var resp acp.WriteTextFileResponse
+	raw, _ := json.Marshal(p)
+	if r, ok := c.answers.take(acp.ClientMethodFsWriteTextFile, raw); ok {
+		return resp, c.answer(r, &resp)
+	}
+	c.mu.Lock()
+	c.stats.Simulated++
+	c.mu.Unlock()
+	return resp, nil
+}
+
+func (c *client) CreateTerminal(ctx context.Context, p acp.CreateTerminalRequest) (acp.CreateTerminalResponse, error) {
+	var resp acp.CreateTerminalResponse
+	return resp, c.replay(acp.ClientMethodTerminalCreate, p, p.Command, &resp)
+}
+
+func (c *client) TerminalOutput(ctx context.Context, p acp.TerminalOutputRequest) (acp.TerminalOutputResponse, error) {
+	var resp acp.TerminalOutputResponse
+	return resp, c.replay(acp.ClientMethodTerminalOutput, p, p.TerminalId, &resp)
+}
+
+func (c *client) WaitForTerminalExit(ctx context.Context, p acp.WaitForTerminalExitRequest) (acp.WaitForTerminalExitResponse, error) {
+	var resp acp.WaitForTerminalExitResponse
+	return resp, c.replay(acp.ClientMethodTerminalWaitForExit, p, p.TerminalId, &resp)
+}
+
+func (c *client) KillTerminalCommand(ctx context.Context, p acp.KillTerminalCommandRequest) (acp.KillTerminalCommandResponse, error) {
+	var resp acp.KillTerminalCommandResponse
+	return resp, c.replay(acp.ClientMethodTerminalKill, p, p.TerminalId, &resp)
+}
+
+func (c *client) ReleaseTerminal(ctx context.Context, p acp.ReleaseTerminalRequest) (acp.ReleaseTerminalResponse, error) {
+	var resp acp.ReleaseTerminalResponse
+	return resp, c.replay(acp.ClientMethodTerminalRelease, p, p.TerminalId, &resp)
+}
+
+// replay answers the request params with the recorded response of the
+// same request, decoded into result. detail names the request in the
+// report if there is none.
+func (c *client) replay(method string, params any, detail string, result any) error {
+	raw, _ := json.Marshal(params)
+	r, ok := c.answers.take(method, raw)
+	if !ok {
+		c.miss(method, detail)
+		return acp.NewInternalError(map[string]any{"error": "not in the replayed recording"})
+	}
+	return c.answer(r, result)
+}
+
+func (c *client) answer(r audit.Record, result any) error {
+	c.mu.Lock()
+	c.stats.Replayed++
+	c.mu.Unlock()
+	if r.Error != nil {
+		re := &acp.RequestError{Code: r.Error.Code, Message: r.Error.Message}
+		if len(r.Error.Data) > 0 {
+			re.Data = r.Error.Data
+		}
+		return re
+	}
+	return json.Unmarshal(r.Raw, result)
+}
+
+func (c *client) miss(method, detail string) {
+	c.mu.Lock()
+	c.stats.Missed = append(c.stats.Missed, Miss{Method: method, Detail: detail})
+	c.mu.Unlock()
+}
+
+// report compares the exchange so far with rec.
+func (c *client) report(rec Recording) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orig := sides(rec.SessionID, rec.Records, rec.Turns)
+	live := sides(c.session, c.records, nil)
+	rep := Report{SessionID: rec.SessionID, ReplaySessionID: c.session, Callbacks: c.stats}
+	for i, o := range orig {
+		t := Turn{Prompt: o.prompt, Original: o.Side}
+		if i < len(live) {
+			t.Replay = live[i].Side
+		}
+		rep.Turns = append(rep.Turns, t)
+	}
+	return rep
+}
@@ -0,0 +1,201 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"acp-gate/internal/acpinspect"
+	"acp-gate/internal/audit"
+	acp "github.com/coder/acp-go-sdk"
+)
+
+// fakeAgent reads the file named by each prompt after asking for
+// permission, replies with its content and writes a copy of it.
+type fakeAgent struct {
+	conn *acp.AgentSideConnection
+	// picked collects the permission options the client chose.
+	picked []string
+}
+
+func (a *fakeAgent) Authenticate(context.Context, acp.AuthenticateRequest) (acp.AuthenticateResponse, error) {
+	return acp.AuthenticateResponse{}, nil
+}
+
+func (a *fakeAgent) Initialize(context.Context, acp.InitializeRequest) (acp.InitializeResponse, error) {
+	return acp.InitializeResponse{ProtocolVersion: acp.ProtocolVersionNumber}, nil
+}
+
+func (a *fakeAgent) Cancel(context.Context, acp.CancelNotification) error { return nil }
+
+func (a *fakeAgent) NewSession(context.Context, acp.NewSessionRequest) (acp.NewSessionResponse, error) {
+	return acp.NewSessionResponse{SessionId: "live"}, nil
+}
+
+func (a *fakeAgent) SetSessionMode(context.Context, acp.SetSessionModeRequest) (acp.SetSessionModeResponse, error) {
+	return acp.SetSessionModeResponse{}, nil
+}
+
+func (a *fakeAgent) Prompt(ctx context.Context, p acp.PromptRequest) (acp.PromptResponse, error) {
+	path := p.Prompt[0].Text.Text
+	// Tool call ids differ from the recording.
+	id := acp.ToolCallId("live-" + path)
+	title := "Read " + path
+	if err := a.conn.SessionUpdate(ctx, acp.SessionNotification{SessionId: p.SessionId,
+		Update: acp.StartReadToolCall(id, title, path)}); err != nil {
+		return acp.PromptResponse{}, err
+	}
+	perm, err := a.conn.RequestPermission(ctx, acp.RequestPermissionRequest{SessionId: p.SessionId,
+		ToolCall: acp.RequestPermissionToolCall{ToolCallId: id},
+		Options: []acp.PermissionOption{
+			{OptionId: "live-allow", Name: "Allow", Kind: acp.PermissionOptionKindAllowOnce},
+			{OptionId: "live-deny", Name: "Deny", Kind: acp.PermissionOptionKindRejectOnce},
+		}})
+	if err != nil {
+		return acp.PromptResponse{}, err
+	}
+	a.picked = append(a.picked, string(perm.Outcome.Selected.OptionId))
+	status, reply := acp.ToolCallStatusCompleted, ""
+	if f, err := a.conn.ReadTextFile(ctx, acp.ReadTextFileRequest{SessionId: p.SessionId, Path: path}); err != nil {
+		status, reply = acp.ToolCallStatusFailed, "cannot read "+path
+	} else {
+		reply = f.Content
+		if _, err := a.conn.WriteTextFile(ctx, acp.WriteTextFileRequest{SessionId: p.SessionId, Path: path + ".bak", Content: f.Content}); err != nil {
+			return acp.PromptResponse{}, err
+		}
+	}
+	if err := a.conn.SessionUpdate(ctx, acp.SessionNotification{SessionId: p.SessionId,
+		Update: acp.UpdateToolCall(id, acp.WithUpdateStatus(status))}); err != nil {
+		return acp.PromptResponse{}, err
+	}
+	if err := a.conn.SessionUpdate(ctx, acp.SessionNotification{SessionId: p.SessionId,
+		Update: acp.UpdateAgentMessageText(reply)}); err != nil {
+		return acp.PromptResponse{}, err
+	}
+	return acp.PromptResponse{StopReason: acp.StopReasonEndTurn}, nil
+}
+
+// recording is a session in which the user asked about main.go and then
+// about other.go, allowing the reads. The agent answered the second turn
+// differently than fakeAgent does. As in recordings made by the proxy, the
+// first tool call is announced after its permission request, and its last
+// update is recorded after the next prompt.
+func recording() Recording {
+	var rows []audit.Record
+	n := 0
+	add := func(dir audit.Direction, method, kind, corr, raw string) {
+		n++
+		r := audit.Record{Timestamp: time.Unix(int64(n), 0), Direction: dir, SessionID: "orig", Method: method,
+			CorrelationID: corr, Raw: []byte(raw)}
+		switch kind {
+		case "request":
+			r.IsRequest = true
+		case "notify":
+			r.IsNotify = true
+		}
+		if kind != "" {
+			// As extracted by the proxy.
+			_, _, r.UserText, r.AgentText = acpinspect.Extract(acpinspect.AnyMessage{Method: method, Params: r.Raw})
+		}
+		rows = append(rows, r)
+	}
+	up, down := audit.DirectionUpstreamToDownstream, audit.DirectionDownstreamToUpstream
+	var late func()
+	for i, path := range []string{"main.go", "other.go"} {
+		c := func(s string) string { return fmt.Sprintf("c-%d-%s", i, s) }
+		add(up, "session/prompt", "request", c("p"), `{"sessionId":"orig","prompt":[{"type":"text","text":"`+path+`"}]}`)
+		if late != nil {
+			late()
+		}
+		announce := func() {
+			add(down, "session/update", "notify", c("u1"),
+				`{"sessionId":"orig","update":{"sessionUpdate":"tool_call","toolCallId":"`+c("t")+`","title":"Read `+path+`","kind":"read","status":"pending"}}`)
+		}
+		if i == 1 {
+			announce()
+		}
+		add(down, "session/request_permission", "request", c("perm"),
+			`{"sessionId":"orig","toolCall":{"toolCallId":"`+c("t")+`"},"options":[{"optionId":"ok","name":"Yes","kind":"allow_once"},{"optionId":"no","name":"No","kind":"reject_once"}]}`)
+		if i == 0 {
+			announce()
+		}
+		add(up, "session/request_permission", "", c("perm"), `{"outcome":{"outcome":"selected","optionId":"ok"}}`)
+		if i == 0 {
+			add(down, "fs/read_text_file", "request", c("read"), `{"sessionId":"orig","path":"main.go"}`)
+			add(up, "fs/read_text_file", "", c("read"), `{"content":"package main"}`)
+		}
+		done := func() {
+			add(down, "session/update", "notify", c("u2"),
+				`{"sessionId":"orig","update":{"sessionUpdate":"tool_call_update","toolCallId":"`+c("t")+`","status":"completed"}}`)
+		}
+		late = nil
+		if i == 0 {
+			late = done
+		} else {
+			done()
+		}
+		add(up, "session/prompt", "", c("p"), `{"stopReason":"end_turn"}`)
+	}
+	return Recording{SessionID: "orig", Cwd: "/p", Records: rows}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	toAgentR, toAgentW := io.Pipe()
+	fromAgentR, fromAgentW := io.Pipe()
+	agent := &fakeAgent{}
+	agent.conn = acp.NewAgentSideConnection(agent, fromAgentW, toAgentR)
+
+	rep, err := Run(ctx, recording(), toAgentW, fromAgentR, Options{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rep.ReplaySessionID != "live" || len(rep.Turns) != 2 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if strings.Join(agent.picked, ",") != "live-allow,live-allow" {
+		t.Fatalf("expected the recorded choice for both permission requests, got %v", agent.picked)
+	}
+
+	first := rep.Turns[0]
+	if first.Prompt != "main.go" || first.Differs() || first.Replay.Text != "package main" ||
+		first.Replay.StopReason != "end_turn" || len(first.Replay.Permissions) != 1 || first.Replay.Permissions[0].Outcome != "Allow" ||
+		len(first.Original.Permissions) != 1 || first.Original.Permissions[0].Title != "Read main.go" {
+		t.Fatalf("unexpected first turn: %+v", first)
+	}
+	// other.go was never read in the recording, so the replayed read
+	// fails and the tool call with it.
+	second := rep.Turns[1]
+	if !second.Differs() || second.Replay.ToolCalls[0].Status != "failed" || second.Original.ToolCalls[0].Status != "completed" {
+		t.Fatalf("unexpected second turn: %+v", second)
+	}
+	cb := rep.Callbacks
+	if cb.Replayed != 3 || cb.Simulated != 1 || len(cb.Missed) != 1 ||
+		cb.Missed[0] != (Miss{Method: "fs/read_text_file", Detail: "other.go"}) {
+		t.Fatalf("unexpected callbacks: %+v", cb)
+	}
+
+	var buf bytes.Buffer
+	if err := rep.WriteText(&buf, 80); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"== Turn 1 (same)", "== Turn 2 (differs)", "tool: [completed] read Read main.go",
+		"| tool: [failed] read Read other.go", "missed fs/read_text_file other.go"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("report lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	got := wrap("one two three four\nfive", 9)
+	if strings.Join(got, "|") != "one two|three|four|five" {
+		t.Fatalf("unexpected wrap: %q", got)
+	}
+}
@@ -0,0 +1,245 @@
+package replay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"acp-gate/internal/audit"
+	"acp-gate/internal/transcript"
+	acp "github.com/coder/acp-go-sdk"
+)
+
+// Report compares a replay with its recording, turn by turn.
+type Report struct {
+	SessionID       string
+	ReplaySessionID string
+	Turns           []Turn
+	Callbacks       Callbacks
+}
+
+// Turn is one recorded prompt with what the agent did with it in the
+// recording and in the replay.
+type Turn struct {
+	Prompt   string
+	Original Side
+	Replay   Side
+}
+
+// Side is what the agent did in one turn.
+type Side struct {
+	// Text is the agent's message text; thoughts are left out.
+	Text        string
+	ToolCalls   []ToolCall
+	Permissions []Permission
+	StopReason  string
+	// Error is the JSON-RPC error message of a failed turn.
+	Error string
+}
+
+// ToolCall is the final state of a tool call.
+type ToolCall struct {
+	Title  string
+	Kind   string
+	Status string
+}
+
+// Permission is a permission request and the name of the option picked,
+// or "cancelled".
+type Permission struct {
+	Title   string
+	Outcome string
+}
+
+// Callbacks counts how the requests the agent made of the client were
+// answered.
+type Callbacks struct {
+	// Replayed requests were answered from the recording.
+	Replayed int
+	// Simulated file writes were acknowledged without writing.
+	Simulated int
+	// Missed requests were not in the recording. They failed, except
+	// permission requests, which were rejected.
+	Missed []Miss
+}
+
+// Miss is a request the recording could not answer.
+type Miss struct {
+	Method string
+	// Detail names the file, command, terminal or tool call concerned.
+	Detail string
+}
+
+// Differs reports whether the turn ended differently in the replay, or ran
+// different tool calls. The agent text is not compared, since models
+// rarely word an answer the same way twice.
+func (t Turn) Differs() bool {
+	o, r := t.Original, t.Replay
+	if o.StopReason != r.StopReason || (o.Error == "") != (r.Error == "") || len(o.ToolCalls) != len(r.ToolCalls) {
+		return true
+	}
+	for i := range o.ToolCalls {
+		if o.ToolCalls[i] != r.ToolCalls[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type side struct {
+	prompt string
+	Side
+}
+
+// sides splits records into prompt turns and summarizes each. Rows before
+// the first prompt are left out.
+//
+// The proxy records notifications as they are handled, so updates sent
+// just before a prompt response may be recorded after it, or after the
+// next prompt. A tool call is therefore shown once, in the turn it first
+// appears in, with its final state in the session. The last message chunks
+// of a turn may still show up in the next one.
+func sides(sessionID string, records []audit.Record, turns []audit.Turn) []side {
+	var groups [][]audit.Record
+	for _, r := range records {
+		if r.Method == acp.AgentMethodSessionPrompt && r.IsRequest {
+			groups = append(groups, nil)
+		}
+		if len(groups) > 0 {
+			groups[len(groups)-1] = append(groups[len(groups)-1], r)
+		}
+	}
+	final := map[string]*transcript.ToolCall{}
+	for _, e := range transcript.Build(sessionID, records).Entries {
+		if e.Tool != nil {
+			final[e.Tool.ID] = e.Tool
+		}
+	}
+	shown := map[string]bool{}
+	out := make([]side, len(groups))
+	for i, g := range groups {
+		s := &out[i]
+		for _, e := range transcript.BuildWithTurns(sessionID, g, turns).Entries {
+			switch e.Kind {
+			case transcript.EntryUser:
+				if s.prompt == "" {
+					s.prompt = e.Text
+				}
+			case transcript.EntryAgent:
+				s.Text += e.Text
+			case transcript.EntryToolCall:
+				if shown[e.Tool.ID] {
+					continue
+				}
+				shown[e.Tool.ID] = true
+				tc := e.Tool
+				if f := final[tc.ID]; f != nil {
+					tc = f
+				}
+				s.ToolCalls = append(s.ToolCalls, ToolCall{Title: tc.Title, Kind: tc.Kind, Status: tc.Status})
+			case transcript.EntryPermission:
+				p := e.Permission
+				outcome := p.Outcome
+				if o, ok := p.Selected(); ok {
+					outcome = o.Name
+				}
+				title := p.Title
+				if f := final[p.ToolCallID]; title == "" && f != nil {
+					title = f.Title
+				}
+				s.Permissions = append(s.Permissions, Permission{Title: title, Outcome: outcome})
+			case transcript.EntryTurnEnd:
+				s.StopReason, s.Error = e.Text, e.Error
+			}
+		}
+	}
+	return out
+}
+
+// WriteText writes the report with the recorded and the replayed turns side
+// by side, in lines of at most width characters.
+func (r Report) WriteText(w io.Writer, width int) error {
+	col := max((width-3)/2, 20)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Session %s replayed as %s\n", r.SessionID, r.ReplaySessionID)
+	differ := 0
+	for i, t := range r.Turns {
+		verdict := "same"
+		if t.Differs() {
+			verdict = "differs"
+			differ++
+		}
+		fmt.Fprintf(bw, "\n== Turn %d (%s)\n", i+1, verdict)
+		for _, l := range wrap(t.Prompt, 2*col+1) {
+			fmt.Fprintf(bw, "> %s\n", l)
+		}
+		left, right := t.Original.lines(col), t.Replay.lines(col)
+		fmt.Fprintf(bw, "%-*s | %s\n", col, "ORIGINAL", "REPLAY")
+		fmt.Fprintf(bw, "%s-+-%s\n", strings.Repeat("-", col), strings.Repeat("-", col))
+		for j := 0; j < max(len(left), len(right)); j++ {
+			var l, rt string
+			if j < len(left) {
+				l = left[j]
+			}
+			if j < len(right) {
+				rt = right[j]
+			}
+			fmt.Fprintf(bw, "%s%s | %s\n", l, strings.Repeat(" ", col-utf8.RuneCountInString(l)), rt)
+		}
+	}
+	cb := r.Callbacks
+	fmt.Fprintf(bw, "\n%d turns, %d differ. Client requests: %d replayed, %d file writes simulated, %d not in the recording.\n",
+		len(r.Turns), differ, cb.Replayed, cb.Simulated, len(cb.Missed))
+	for _, m := range cb.Missed {
+		fmt.Fprintf(bw, "  missed %s %s\n", m.Method, m.Detail)
+	}
+	return bw.Flush()
+}
+
+// lines renders s in lines of at most width characters.
+func (s Side) lines(width int) []string {
+	var out []string
+	switch {
+	case s.Error != "":
+		out = append(out, wrap("error: "+s.Error, width)...)
+	case s.StopReason != "":
+		out = append(out, "stop: "+s.StopReason)
+	default:
+		out = append(out, "(no response)")
+	}
+	for _, tc := range s.ToolCalls {
+		out = append(out, wrap(fmt.Sprintf("tool: [%s] %s %s", tc.Status, tc.Kind, tc.Title), width)...)
+	}
+	for _, p := range s.Permissions {
+		out = append(out, wrap(fmt.Sprintf("permission: %s -> %s", p.Title, p.Outcome), width)...)
+	}
+	if s.Text != "" {
+		out = append(out, "")
+		out = append(out, wrap(s.Text, width)...)
+	}
+	return out
+}
+
+// wrap breaks text into lines of at most width runes, at spaces where
+// possible.
+func wrap(text string, width int) []string {
+	var out []string
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		rs := []rune(line)
+		for len(rs) > width {
+			cut := width
+			for i := width; i > width/2; i-- {
+				if rs[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			out = append(out, strings.TrimRight(string(rs[:cut]), " "))
+			rs = []rune(strings.TrimLeft(string(rs[cut:]), " "))
+		}
+		out = append(out, string(rs))
+	}
+	return out
+}
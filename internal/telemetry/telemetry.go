@@ -0,0 +1,110 @@
+// Package telemetry sets up OpenTelemetry tracing for acp-gate and carries
+// trace context across the gRPC tunnel between acp-gate instances.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// ScopeName is the instrumentation scope of the spans acp-gate creates.
+const ScopeName = "acp-gate"
+
+// Options configures Setup.
+type Options struct {
+	// Endpoint is the OTLP/gRPC collector, as host:port (plain text) or
+	// as a URL: http://host:4317 for plain text, https:// for TLS.
+	Endpoint string
+	// ServiceName is reported as service.name (default "acp-gate").
+	ServiceName string
+	// Mode is reported as acp_gate.mode (local, client, proxy or server).
+	Mode string
+}
+
+// Setup installs a global tracer provider exporting to opts.Endpoint and
+// the W3C trace context propagator. The returned function flushes and
+// stops the exporter.
+func Setup(ctx context.Context, opts Options) (shutdown func(context.Context) error, err error) {
+	var eopts []otlptracegrpc.Option
+	if strings.Contains(opts.Endpoint, "://") {
+		eopts = append(eopts, otlptracegrpc.WithEndpointURL(opts.Endpoint))
+	} else {
+		eopts = append(eopts, otlptracegrpc.WithEndpoint(opts.Endpoint), otlptracegrpc.WithInsecure())
+	}
+	exp, err := otlptracegrpc.New(ctx, eopts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+	name := opts.ServiceName
+	if name == "" {
+		name = "acp-gate"
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", name)}
+	if opts.Mode != "" {
+		attrs = append(attrs, attribute.String("acp_gate.mode", opts.Mode))
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the acp-gate tracer of the global provider. It is a no-op
+// until Setup has been called.
+func Tracer() trace.Tracer {
+	return otel.Tracer(ScopeName)
+}
+
+// Outgoing adds the trace context of ctx to the outgoing gRPC metadata, so
+// that the next hop continues the trace.
+func Outgoing(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// Incoming returns ctx with the remote trace context found in its incoming
+// gRPC metadata, if any.
+func Incoming(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// metadataCarrier adapts gRPC metadata to propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,225 @@
+// Package textdiff computes line-based unified diffs.
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxEdits bounds the work spent looking for a minimal diff. Beyond it the
+// differing lines are reported as one replacement, which is still a valid
+// diff, just not a minimal one.
+const maxEdits = 1000
+
+// Stat counts the lines a diff adds and removes.
+type Stat struct {
+	Added   int
+	Removed int
+}
+
+// Unified returns the hunks of a unified diff that turns a into b, with
+// context lines of unchanged text around each change, or "" if a and b
+// are equal. The ---/+++ file header is left to the caller.
+func Unified(a, b string, context int) (string, Stat) {
+	edits := diff(lines(a), lines(b))
+	var (
+		sb   strings.Builder
+		stat Stat
+	)
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		// The hunk starts context lines before the change and runs until
+		// a stretch of more than 2*context unchanged lines.
+		start := max(i-context, 0)
+		end, same := i, 0
+		for j := i; j < len(edits) && same <= 2*context; j++ {
+			if edits[j].op == ' ' {
+				same++
+				continue
+			}
+			end, same = j+1, 0
+		}
+		end = min(end+context, len(edits))
+		writeHunk(&sb, edits[start:end], &stat)
+		i = end
+	}
+	return sb.String(), stat
+}
+
+type edit struct {
+	op byte // ' ', '-' or '+'
+	// a and b are the line indexes in the old and new text; only the ones
+	// that apply to op are meaningful.
+	a, b int
+	line string
+}
+
+func writeHunk(sb *strings.Builder, h []edit, stat *Stat) {
+	var aStart, bStart, aLen, bLen int
+	aStart, bStart = -1, -1
+	for _, e := range h {
+		if e.op != '+' {
+			if aStart < 0 {
+				aStart = e.a
+			}
+			aLen++
+		}
+		if e.op != '-' {
+			if bStart < 0 {
+				bStart = e.b
+			}
+			bLen++
+		}
+	}
+	// An empty range is numbered after the line it follows.
+	if aLen == 0 {
+		aStart = h[0].a - 1
+	}
+	if bLen == 0 {
+		bStart = h[0].b - 1
+	}
+	fmt.Fprintf(sb, "@@ -%d,%d +%d,%d @@\n", aStart+1, aLen, bStart+1, bLen)
+	for _, e := range h {
+		switch e.op {
+		case '-':
+			stat.Removed++
+		case '+':
+			stat.Added++
+		}
+		sb.WriteByte(e.op)
+		sb.WriteString(e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// lines splits s after each newline.
+func lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	out := strings.SplitAfter(s, "\n")
+	if out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// diff returns the edit script turning a into b. Common leading and
+// trailing lines are matched first; the rest is diffed with Myers'
+// algorithm.
+func diff(a, b []string) []edit {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	var out []edit
+	for i := 0; i < pre; i++ {
+		out = append(out, edit{' ', i, i, a[i]})
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	mid := myers(ma, mb)
+	if mid == nil {
+		for i, l := range ma {
+			mid = append(mid, edit{'-', i, 0, l})
+		}
+		for i, l := range mb {
+			mid = append(mid, edit{'+', len(ma), i, l})
+		}
+	}
+	for _, e := range mid {
+		e.a += pre
+		e.b += pre
+		out = append(out, e)
+	}
+	for i := 0; i < suf; i++ {
+		out = append(out, edit{' ', len(a) - suf + i, len(b) - suf + i, a[len(a)-suf+i]})
+	}
+	return out
+}
+
+// myers returns a minimal edit script turning a into b, or nil if it needs
+// more than maxEdits insertions and deletions.
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return []edit{}
+	}
+	off := n + m + 1
+	v := make([]int, 2*off+1)
+	// trace[d] holds v[-d..d] after step d.
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		if d > maxEdits {
+			return nil
+		}
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		if done {
+			break
+		}
+	}
+
+	// Walk back from the end, emitting edits in reverse.
+	var rev []edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		var pk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := at(pk)
+		py := px - pk
+		for x > px && y > py {
+			x, y = x-1, y-1
+			rev = append(rev, edit{' ', x, y, a[x]})
+		}
+		if pk == k+1 {
+			y--
+			rev = append(rev, edit{'+', x, y, b[y]})
+		} else {
+			x--
+			rev = append(rev, edit{'-', x, y, a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		rev = append(rev, edit{' ', x, y, a[x]})
+	}
+	out := make([]edit, len(rev))
+	for i, e := range rev {
+		out[len(rev)-1-i] = e
+	}
+	return out
+}
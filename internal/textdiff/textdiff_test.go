@@ -0,0 +1,105 @@
+package textdiff
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	for _, tc := range []struct {
+		name, a, b, want string
+		stat             Stat
+	}{
+		{"equal", "a\nb\n", "a\nb\n", "", Stat{}},
+		{"create", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n", Stat{Added: 2}},
+		{"delete all", "a\n", "", "@@ -1,1 +0,0 @@\n-a\n", Stat{Removed: 1}},
+		{"change", "a\nb\nc\n", "a\nB\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n", Stat{Added: 1, Removed: 1}},
+		{"insert", "a\nb\n", "a\nx\nb\n", "@@ -1,2 +1,3 @@\n a\n+x\n b\n", Stat{Added: 1}},
+		{"no newline", "a\nb", "a\nb\n", "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n", Stat{Added: 1, Removed: 1}},
+	} {
+		got, stat := Unified(tc.a, tc.b, 3)
+		if got != tc.want || stat != tc.stat {
+			t.Fatalf("%s: got %q %+v, want %q %+v", tc.name, got, stat, tc.want, tc.stat)
+		}
+	}
+}
+
+func TestUnifiedSeparateHunks(t *testing.T) {
+	var a, b []string
+	for i := range 20 {
+		a = append(a, fmt.Sprintf("line %d\n", i))
+	}
+	b = append(b, a...)
+	b[1], b[18] = "one\n", "eighteen\n"
+	got, _ := Unified(strings.Join(a, ""), strings.Join(b, ""), 2)
+	if n := strings.Count(got, "@@ -"); n != 2 {
+		t.Fatalf("expected 2 hunks, got %d:\n%s", n, got)
+	}
+	if !strings.HasPrefix(got, "@@ -1,4 +1,4 @@\n") || !strings.Contains(got, "@@ -17,4 +17,4 @@\n") {
+		t.Fatalf("unexpected hunk ranges:\n%s", got)
+	}
+}
+
+func TestUnifiedApplies(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	gen := func() string {
+		var sb strings.Builder
+		n := r.Intn(30)
+		for i := range n {
+			sb.WriteByte(byte('a' + r.Intn(5)))
+			if i < n-1 || r.Intn(2) == 0 {
+				sb.WriteByte('\n')
+			}
+		}
+		return sb.String()
+	}
+	for range 500 {
+		a, b := gen(), gen()
+		d, _ := Unified(a, b, r.Intn(4))
+		if got := apply(t, a, d); got != b {
+			t.Fatalf("applying\n%s\nto %q gave %q, want %q", d, a, got, b)
+		}
+	}
+}
+
+// apply applies the hunks of d to a.
+func apply(t *testing.T, a, d string) string {
+	t.Helper()
+	old := lines(a)
+	var out []string
+	next := 0
+	hunk := strings.Split(d, "\n")
+	for i := 0; i < len(hunk)-1; i++ {
+		l := hunk[i]
+		if strings.HasPrefix(l, "@@") {
+			var aStart, aLen int
+			if _, err := fmt.Sscanf(l, "@@ -%d,%d", &aStart, &aLen); err != nil {
+				t.Fatalf("bad hunk header %q", l)
+			}
+			if aLen == 0 {
+				aStart++
+			}
+			out = append(out, old[next:aStart-1]...)
+			next = aStart - 1
+			continue
+		}
+		text := l[1:] + "\n"
+		if i+1 < len(hunk) && strings.HasPrefix(hunk[i+1], `\`) {
+			text = l[1:]
+			i++
+		}
+		switch l[0] {
+		case ' ':
+			out = append(out, text)
+			next++
+		case '-':
+			next++
+		case '+':
+			out = append(out, text)
+		}
+	}
+	out = append(out, old[next:]...)
+	return strings.Join(out, "")
+}
@@ -0,0 +1,138 @@
+package transcript
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+// WriteMarkdown renders t as a Markdown document.
+func (t Transcript) WriteMarkdown(w io.Writer) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Session %s\n", t.SessionID)
+	for _, e := range t.Entries {
+		sb.WriteString("\n")
+		switch e.Kind {
+		case EntryUser:
+			fmt.Fprintf(&sb, "## User (%s)\n\n%s\n", e.Time.Local().Format(timeLayout), strings.TrimSpace(e.Text))
+		case EntryAgent:
+			fmt.Fprintf(&sb, "### Agent\n\n%s\n", strings.TrimSpace(e.Text))
+		case EntryThought:
+			sb.WriteString("### Thought\n\n")
+			for _, line := range strings.Split(strings.TrimSpace(e.Text), "\n") {
+				sb.WriteString("> " + line + "\n")
+			}
+		case EntryToolCall:
+			tc := e.Tool
+			fmt.Fprintf(&sb, "**Tool call** `%s`", toolTitle(tc))
+			if tc.Kind != "" {
+				fmt.Fprintf(&sb, " (%s)", tc.Kind)
+			}
+			fmt.Fprintf(&sb, ": %s\n", toolStatus(tc))
+			for _, l := range tc.Locations {
+				fmt.Fprintf(&sb, "- `%s`\n", l)
+			}
+			if out := strings.TrimSpace(tc.Output); out != "" {
+				fmt.Fprintf(&sb, "\n```\n%s\n```\n", out)
+			}
+		case EntryPermission:
+			p := e.Permission
+			names := make([]string, 0, len(p.Options))
+			for _, o := range p.Options {
+				names = append(names, o.Name)
+			}
+			fmt.Fprintf(&sb, "**Permission requested** for `%s` (options: %s): %s\n", permissionTitle(p), strings.Join(names, ", "), permissionOutcome(p))
+		case EntryTurnEnd:
+			if e.Error != "" {
+				fmt.Fprintf(&sb, "_Turn failed: %s_\n", e.Error)
+			} else {
+				fmt.Fprintf(&sb, "_Turn ended: %s_\n", e.Text)
+			}
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteHTML renders t as a self-contained HTML page.
+func (t Transcript) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, t)
+}
+
+func toolTitle(tc *ToolCall) string {
+	if tc.Title != "" {
+		return tc.Title
+	}
+	return tc.ID
+}
+
+func toolStatus(tc *ToolCall) string {
+	if tc.Status == "" {
+		return "unknown"
+	}
+	return tc.Status
+}
+
+func permissionTitle(p *Permission) string {
+	if p.Title != "" {
+		return p.Title
+	}
+	return p.ToolCallID
+}
+
+func permissionOutcome(p *Permission) string {
+	if o, ok := p.Selected(); ok {
+		return fmt.Sprintf("%s (%s)", o.Name, o.Kind)
+	}
+	if p.Outcome == "" {
+		return "no response"
+	}
+	return p.Outcome
+}
+
+var htmlTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time":              func(t time.Time) string { return t.Local().Format(timeLayout) },
+	"trim":              strings.TrimSpace,
+	"toolTitle":         toolTitle,
+	"toolStatus":        toolStatus,
+	"permissionTitle":   permissionTitle,
+	"permissionOutcome": permissionOutcome,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Session {{.SessionID}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 50rem; margin: 2rem auto; line-height: 1.5; color: #222; }
+.entry { margin: 1rem 0; padding: 0.75rem 1rem; border-radius: 6px; }
+.user { background: #e3f2fd; }
+.agent { background: #f5f5f5; }
+.thought { color: #666; font-style: italic; border-left: 3px solid #ccc; }
+.tool_call, .permission { border: 1px solid #ddd; font-size: 0.9rem; }
+.turn_end { color: #888; font-size: 0.85rem; padding: 0 1rem; }
+.meta { color: #888; font-size: 0.8rem; }
+pre { white-space: pre-wrap; margin: 0.5rem 0 0; }
+.text { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Session {{.SessionID}}</h1>
+{{range .Entries}}<div class="entry {{.Kind}}">
+{{- if eq .Kind "user"}}<div class="meta">User &middot; {{time .Time}}</div><div class="text">{{trim .Text}}</div>
+{{- else if eq .Kind "agent"}}<div class="meta">Agent</div><div class="text">{{trim .Text}}</div>
+{{- else if eq .Kind "thought"}}<div class="meta">Thought</div><div class="text">{{trim .Text}}</div>
+{{- else if eq .Kind "tool_call"}}<strong>Tool call</strong> <code>{{toolTitle .Tool}}</code>{{with .Tool.Kind}} ({{.}}){{end}}: {{toolStatus .Tool}}
+{{- with .Tool.Locations}}<ul>{{range .}}<li><code>{{.}}</code></li>{{end}}</ul>{{end}}
+{{- with trim .Tool.Output}}<pre>{{.}}</pre>{{end}}
+{{- else if eq .Kind "permission"}}<strong>Permission requested</strong> for <code>{{permissionTitle .Permission}}</code>
+(options: {{range $i, $o := .Permission.Options}}{{if $i}}, {{end}}{{$o.Name}}{{end}}): <strong>{{permissionOutcome .Permission}}</strong>
+{{- else if eq .Kind "turn_end"}}{{if .Error}}Turn failed: {{.Error}}{{else}}Turn ended: {{.Text}}{{end}}
+{{- end}}
+</div>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,315 @@
+// Package transcript reconstructs a readable conversation from the raw
+// audit_events rows of one session.
+package transcript
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"acp-gate/internal/audit"
+	acp "github.com/coder/acp-go-sdk"
+)
+
+type EntryKind string
+
+const (
+	EntryUser       EntryKind = "user"
+	EntryAgent      EntryKind = "agent"
+	EntryThought    EntryKind = "thought"
+	EntryToolCall   EntryKind = "tool_call"
+	EntryPermission EntryKind = "permission"
+	EntryTurnEnd    EntryKind = "turn_end"
+)
+
+// Entry is one block of the transcript. Consecutive message and thought
+// chunks are coalesced into a single entry.
+type Entry struct {
+	Kind EntryKind
+	Time time.Time
+	Text string
+
+	// Error is the JSON-RPC error message of a failed prompt turn.
+	Error string
+
+	Tool       *ToolCall
+	Permission *Permission
+}
+
+// ToolCall is the latest known state of a tool call, after applying every
+// tool_call_update seen for its id.
+type ToolCall struct {
+	ID        string
+	Title     string
+	Kind      string
+	Status    string
+	Locations []string
+	Output    string
+}
+
+// Permission is a session/request_permission exchange.
+type Permission struct {
+	ToolCallID string
+	Title      string
+	Options    []PermissionOption
+
+	// Outcome is the selected option id, "cancelled", "error: <message>"
+	// if the client failed the request, or empty if no response was
+	// recorded.
+	Outcome string
+}
+
+type PermissionOption struct {
+	ID   string
+	Name string
+	Kind string
+}
+
+// Selected returns the option the user picked, if any.
+func (p *Permission) Selected() (PermissionOption, bool) {
+	for _, o := range p.Options {
+		if o.ID == p.Outcome {
+			return o, true
+		}
+	}
+	return PermissionOption{}, false
+}
+
+type Transcript struct {
+	SessionID string
+	Entries   []Entry
+}
+
+// Build reconstructs the transcript of sessionID from records, which must be
+// in the order they were written (as returned by audit.Store.Query).
+func Build(sessionID string, records []audit.Record) Transcript {
+	return BuildWithTurns(sessionID, records, nil)
+}
+
+// BuildWithTurns is Build for sessions recorded with turns (see
+// audit.TurnMode): the thought and agent text of a turn whose message
+// chunks are not among records is taken from its turn and added at the end
+// of the turn.
+func BuildWithTurns(sessionID string, records []audit.Record, turns []audit.Turn) Transcript {
+	b := builder{t: Transcript{SessionID: sessionID}, tools: map[string]int{}, perms: map[string]int{}, turns: map[string]audit.Turn{}}
+	for _, t := range turns {
+		if t.CorrelationID != "" {
+			b.turns[t.CorrelationID] = t
+		}
+	}
+	for _, r := range records {
+		b.add(r)
+	}
+	b.fillTurn()
+	return b.t
+}
+
+type builder struct {
+	t Transcript
+
+	// tools maps tool call ids to their entry index.
+	tools map[string]int
+	// perms maps correlation ids of permission requests to their entry
+	// index; pendingPerms is the FIFO fallback for rows recorded before
+	// correlation ids existed.
+	perms        map[string]int
+	pendingPerms []int
+
+	// turns maps correlation ids of prompt requests to their turn; turn
+	// and turnStart are the correlation id and first entry of the current
+	// one.
+	turns     map[string]audit.Turn
+	turn      string
+	turnStart int
+}
+
+func (b *builder) add(r audit.Record) {
+	switch r.Method {
+	case acp.AgentMethodSessionPrompt:
+		if r.IsRequest {
+			b.fillTurn()
+			b.turn, b.turnStart = r.CorrelationID, len(b.t.Entries)
+			b.appendText(EntryUser, r.Timestamp, r.UserText, false)
+			return
+		}
+		if r.CorrelationID == b.turn {
+			b.fillTurn()
+		}
+		if r.Error != nil {
+			b.t.Entries = append(b.t.Entries, Entry{Kind: EntryTurnEnd, Time: r.Timestamp, Error: r.Error.Message})
+			return
+		}
+		var res acp.PromptResponse
+		if json.Unmarshal(r.Raw, &res) == nil && res.StopReason != "" {
+			b.t.Entries = append(b.t.Entries, Entry{Kind: EntryTurnEnd, Time: r.Timestamp, Text: string(res.StopReason)})
+		}
+
+	case acp.ClientMethodSessionUpdate:
+		var n acp.SessionNotification
+		if json.Unmarshal(r.Raw, &n) != nil {
+			return
+		}
+		b.addUpdate(r.Timestamp, r.UserText, r.AgentText, n.Update)
+
+	case acp.ClientMethodSessionRequestPermission:
+		if r.IsRequest {
+			var req acp.RequestPermissionRequest
+			if json.Unmarshal(r.Raw, &req) != nil {
+				return
+			}
+			p := &Permission{ToolCallID: string(req.ToolCall.ToolCallId)}
+			if req.ToolCall.Title != nil {
+				p.Title = *req.ToolCall.Title
+			} else if i, ok := b.tools[p.ToolCallID]; ok {
+				p.Title = b.t.Entries[i].Tool.Title
+			}
+			for _, o := range req.Options {
+				p.Options = append(p.Options, PermissionOption{ID: string(o.OptionId), Name: o.Name, Kind: string(o.Kind)})
+			}
+			if r.CorrelationID != "" {
+				b.perms[r.CorrelationID] = len(b.t.Entries)
+			} else {
+				b.pendingPerms = append(b.pendingPerms, len(b.t.Entries))
+			}
+			b.t.Entries = append(b.t.Entries, Entry{Kind: EntryPermission, Time: r.Timestamp, Permission: p})
+			return
+		}
+		i, ok := b.permissionFor(r)
+		if !ok {
+			return
+		}
+		if r.Error != nil {
+			b.t.Entries[i].Permission.Outcome = "error: " + r.Error.Message
+			return
+		}
+		var res acp.RequestPermissionResponse
+		if json.Unmarshal(r.Raw, &res) != nil {
+			return
+		}
+		switch {
+		case res.Outcome.Selected != nil:
+			b.t.Entries[i].Permission.Outcome = string(res.Outcome.Selected.OptionId)
+		case res.Outcome.Cancelled != nil:
+			b.t.Entries[i].Permission.Outcome = "cancelled"
+		}
+	}
+}
+
+func (b *builder) addUpdate(ts time.Time, userText, agentText string, u acp.SessionUpdate) {
+	switch {
+	case u.UserMessageChunk != nil:
+		b.appendText(EntryUser, ts, userText, true)
+	case u.AgentMessageChunk != nil:
+		b.appendText(EntryAgent, ts, agentText, true)
+	case u.AgentThoughtChunk != nil:
+		b.appendText(EntryThought, ts, agentText, true)
+	case u.ToolCall != nil:
+		tc := u.ToolCall
+		t := &ToolCall{
+			ID:     string(tc.ToolCallId),
+			Title:  tc.Title,
+			Kind:   string(tc.Kind),
+			Status: string(tc.Status),
+			Output: toolText(tc.Content),
+		}
+		for _, l := range tc.Locations {
+			t.Locations = append(t.Locations, l.Path)
+		}
+		b.tools[t.ID] = len(b.t.Entries)
+		b.t.Entries = append(b.t.Entries, Entry{Kind: EntryToolCall, Time: ts, Tool: t})
+	case u.ToolCallUpdate != nil:
+		tu := u.ToolCallUpdate
+		i, ok := b.tools[string(tu.ToolCallId)]
+		if !ok {
+			// Update for a tool call we never saw being created.
+			i = len(b.t.Entries)
+			b.tools[string(tu.ToolCallId)] = i
+			b.t.Entries = append(b.t.Entries, Entry{Kind: EntryToolCall, Time: ts, Tool: &ToolCall{ID: string(tu.ToolCallId)}})
+		}
+		t := b.t.Entries[i].Tool
+		if tu.Title != nil {
+			t.Title = *tu.Title
+		}
+		if tu.Kind != nil {
+			t.Kind = string(*tu.Kind)
+		}
+		if tu.Status != nil {
+			t.Status = string(*tu.Status)
+		}
+		if tu.Locations != nil {
+			t.Locations = t.Locations[:0]
+			for _, l := range tu.Locations {
+				t.Locations = append(t.Locations, l.Path)
+			}
+		}
+		if tu.Content != nil {
+			t.Output = toolText(tu.Content)
+		}
+	}
+}
+
+// fillTurn adds the thought and agent text of the current turn if none of
+// its chunks were seen.
+func (b *builder) fillTurn() {
+	t, ok := b.turns[b.turn]
+	b.turn = ""
+	if !ok {
+		return
+	}
+	for _, e := range b.t.Entries[b.turnStart:] {
+		if e.Kind == EntryAgent || e.Kind == EntryThought {
+			return
+		}
+	}
+	at := t.FirstChunk
+	if at.IsZero() {
+		at = t.Ended
+	}
+	if t.ThoughtText != "" {
+		b.appendText(EntryThought, at, t.ThoughtText, false)
+	}
+	if t.AgentText != "" {
+		b.appendText(EntryAgent, at, t.AgentText, false)
+	}
+}
+
+// permissionFor returns the entry index of the permission request answered
+// by the response r.
+func (b *builder) permissionFor(r audit.Record) (int, bool) {
+	if r.CorrelationID != "" {
+		i, ok := b.perms[r.CorrelationID]
+		delete(b.perms, r.CorrelationID)
+		return i, ok
+	}
+	if len(b.pendingPerms) == 0 {
+		return 0, false
+	}
+	i := b.pendingPerms[0]
+	b.pendingPerms = b.pendingPerms[1:]
+	return i, true
+}
+
+// appendText adds text as a new entry, or appends it to the previous entry
+// when coalesce is set and that entry has the same kind.
+func (b *builder) appendText(kind EntryKind, ts time.Time, text string, coalesce bool) {
+	if n := len(b.t.Entries); coalesce && n > 0 && b.t.Entries[n-1].Kind == kind {
+		b.t.Entries[n-1].Text += text
+		return
+	}
+	b.t.Entries = append(b.t.Entries, Entry{Kind: kind, Time: ts, Text: text})
+}
+
+func toolText(items []acp.ToolCallContent) string {
+	var parts []string
+	for _, it := range items {
+		switch {
+		case it.Content != nil && it.Content.Content.Text != nil:
+			parts = append(parts, it.Content.Content.Text.Text)
+		case it.Diff != nil:
+			parts = append(parts, "diff: "+it.Diff.Path)
+		case it.Terminal != nil:
+			parts = append(parts, "terminal: "+it.Terminal.TerminalId)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,89 @@
+package transcript
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"acp-gate/internal/audit"
+)
+
+func update(agentText, raw string) audit.Record {
+	return audit.Record{Direction: audit.DirectionDownstreamToUpstream, SessionID: "s", Method: "session/update", IsNotify: true, AgentText: agentText, Raw: []byte(raw)}
+}
+
+func TestBuild(t *testing.T) {
+	records := []audit.Record{
+		{Timestamp: time.UnixMilli(1), Direction: audit.DirectionUpstreamToDownstream, SessionID: "s", Method: "session/prompt", IsRequest: true, UserText: "fix it", Raw: []byte(`{"sessionId":"s","prompt":[{"type":"text","text":"fix it"}]}`)},
+		update("hmm", `{"sessionId":"s","update":{"sessionUpdate":"agent_thought_chunk","content":{"type":"text","text":"hmm"}}}`),
+		update("Sure, ", `{"sessionId":"s","update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"Sure, "}}}`),
+		update("done.", `{"sessionId":"s","update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"done."}}}`),
+		update("", `{"sessionId":"s","update":{"sessionUpdate":"tool_call","toolCallId":"t1","title":"Edit a.go","kind":"edit","status":"pending","locations":[{"path":"/a.go"}]}}`),
+		{Direction: audit.DirectionDownstreamToUpstream, SessionID: "s", Method: "session/request_permission", IsRequest: true, Raw: []byte(`{"sessionId":"s","toolCall":{"toolCallId":"t1"},"options":[{"optionId":"ok","name":"Allow","kind":"allow_once"},{"optionId":"no","name":"Reject","kind":"reject_once"}]}`)},
+		{Direction: audit.DirectionUpstreamToDownstream, SessionID: "s", Method: "session/request_permission", Raw: []byte(`{"outcome":{"outcome":"selected","optionId":"ok"}}`)},
+		update("", `{"sessionId":"s","update":{"sessionUpdate":"tool_call_update","toolCallId":"t1","status":"completed"}}`),
+		{Direction: audit.DirectionDownstreamToUpstream, SessionID: "s", Method: "session/prompt", Raw: []byte(`{"stopReason":"end_turn"}`)},
+	}
+
+	tr := Build("s", records)
+	var kinds []string
+	for _, e := range tr.Entries {
+		kinds = append(kinds, string(e.Kind))
+	}
+	if got, want := strings.Join(kinds, ","), "user,thought,agent,tool_call,permission,turn_end"; got != want {
+		t.Fatalf("unexpected entries: got %s want %s", got, want)
+	}
+	if tr.Entries[2].Text != "Sure, done." {
+		t.Fatalf("agent chunks not coalesced: %q", tr.Entries[2].Text)
+	}
+	if tc := tr.Entries[3].Tool; tc.Status != "completed" || tc.Title != "Edit a.go" || len(tc.Locations) != 1 {
+		t.Fatalf("unexpected tool call: %+v", tc)
+	}
+	p := tr.Entries[4].Permission
+	if p.Title != "Edit a.go" {
+		t.Fatalf("permission title not taken from tool call: %q", p.Title)
+	}
+	if o, ok := p.Selected(); !ok || o.Kind != "allow_once" {
+		t.Fatalf("unexpected permission outcome: %+v", p)
+	}
+
+	var md bytes.Buffer
+	if err := tr.WriteMarkdown(&md); err != nil {
+		t.Fatalf("WriteMarkdown: %v", err)
+	}
+	if !strings.Contains(md.String(), "Sure, done.") || !strings.Contains(md.String(), "Allow (allow_once)") {
+		t.Fatalf("unexpected markdown:\n%s", md.String())
+	}
+
+	var html bytes.Buffer
+	if err := tr.WriteHTML(&html); err != nil {
+		t.Fatalf("WriteHTML: %v", err)
+	}
+	if !strings.Contains(html.String(), "<code>Edit a.go</code>") {
+		t.Fatalf("unexpected html:\n%s", html.String())
+	}
+}
+
+func TestBuildWithTurns(t *testing.T) {
+	records := []audit.Record{
+		{Direction: audit.DirectionUpstreamToDownstream, SessionID: "s", Method: "session/prompt", IsRequest: true, CorrelationID: "c-1", UserText: "fix it", Raw: []byte(`{"sessionId":"s","prompt":[{"type":"text","text":"fix it"}]}`)},
+		update("", `{"sessionId":"s","update":{"sessionUpdate":"tool_call","toolCallId":"t1","title":"Edit a.go","kind":"edit","status":"completed"}}`),
+		{Direction: audit.DirectionDownstreamToUpstream, SessionID: "s", Method: "session/prompt", CorrelationID: "c-1", Raw: []byte(`{"stopReason":"end_turn"}`)},
+		// This turn kept its chunks.
+		{Direction: audit.DirectionUpstreamToDownstream, SessionID: "s", Method: "session/prompt", IsRequest: true, CorrelationID: "c-2", UserText: "thanks", Raw: []byte(`{"sessionId":"s","prompt":[{"type":"text","text":"thanks"}]}`)},
+		update("np", `{"sessionId":"s","update":{"sessionUpdate":"agent_message_chunk","content":{"type":"text","text":"np"}}}`),
+	}
+	turns := []audit.Turn{
+		{CorrelationID: "c-1", ThoughtText: "hmm", AgentText: "Done."},
+		{CorrelationID: "c-2", AgentText: "np"},
+	}
+	tr := BuildWithTurns("s", records, turns)
+	var got []string
+	for _, e := range tr.Entries {
+		got = append(got, string(e.Kind)+":"+e.Text)
+	}
+	if want := "user:fix it,tool_call:,thought:hmm,agent:Done.,turn_end:end_turn,user:thanks,agent:np"; strings.Join(got, ",") != want {
+		t.Fatalf("unexpected entries:\n got %s\nwant %s", strings.Join(got, ","), want)
+	}
+}
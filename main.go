@@ -2,6 +2,7 @@ package main
 
 import (
     "context"
+    "crypto/ed25519"
     "flag"
     "fmt"
     "log/slog"
@@ -10,12 +11,17 @@ import (
     "os/exec"
     "os/signal"
     "syscall"
+    "time"
 
     acp "github.com/coder/acp-go-sdk"
     "acp-gate/internal/audit"
     "acp-gate/internal/config"
     "acp-gate/internal/proxy"
+    "acp-gate/internal/redact"
     "acp-gate/internal/remote"
+    "acp-gate/internal/telemetry"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
     "google.golang.org/grpc"
     "google.golang.org/grpc/credentials/insecure"
     "google.golang.org/grpc/encoding"
@@ -30,6 +36,14 @@ func (m *multiFlag) Set(v string) error {
 }
 
 func main() {
+    // Subcommands are dispatched before the proxy flags are parsed.
+    if len(os.Args) > 1 && os.Args[1] == "audit" {
+        os.Exit(runAudit(context.Background(), os.Args[2:]))
+    }
+    if len(os.Args) > 1 && os.Args[1] == "replay" {
+        os.Exit(runReplay(context.Background(), os.Args[2:]))
+    }
+
     var (
         auditDBPath string
         cfgPath     string
@@ -38,6 +52,18 @@ func main() {
         agentArgs   multiFlag
         servePort   int
         connectAddr string
+        auditQueue  int
+        overflow    string
+        spillPath   string
+        turns       string
+        retention   retentionFlags
+        pruneEvery  time.Duration
+        keyFile     string
+        signingKey  string
+        cpEvery     time.Duration
+        sinkFlags   multiFlag
+        otelAddr    string
+        otelService string
     )
 
     flag.StringVar(&auditDBPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
@@ -47,6 +73,18 @@ func main() {
     flag.Var(&agentArgs, "agent-arg", "argument for downstream agent (repeatable)")
     flag.IntVar(&servePort, "server", -1, "run in server mode on given port (0 for auto)")
     flag.StringVar(&connectAddr, "connect", "", "run in client mode, connect to server at host:port")
+    flag.IntVar(&auditQueue, "audit-queue", 4096, "number of audit records buffered for the background writer (0 writes synchronously)")
+    flag.StringVar(&overflow, "audit-overflow", "block", "what to do when the audit queue is full: block, drop or spill")
+    flag.StringVar(&spillPath, "audit-spill", "", "spill file for -audit-overflow spill (default: <audit-db>.spill)")
+    flag.StringVar(&turns, "audit-turns", "off", "record each prompt turn with its streamed text in the turns table: off, keep (also keep the chunk events) or drop (leave the text chunk events out)")
+    retention.register(flag.CommandLine, "retention-")
+    flag.DurationVar(&pruneEvery, "retention-interval", time.Hour, "how often to enforce the -retention-* limits")
+    flag.StringVar(&keyFile, "audit-key-file", "", auditKeyFileUsage)
+    flag.StringVar(&signingKey, "audit-signing-key", "", "Ed25519 key file for signing audit checkpoints (see audit keygen -signing)")
+    flag.DurationVar(&cpEvery, "checkpoint-interval", 5*time.Minute, "how often to sign an audit checkpoint when -audit-signing-key is set")
+    flag.Var(&sinkFlags, "audit-sink", auditSinkUsage)
+    flag.StringVar(&otelAddr, "otel-endpoint", "", "OTLP/gRPC collector for traces, host:port or http(s)://host:port (default: $OTEL_EXPORTER_OTLP_ENDPOINT; tracing is off if neither is set)")
+    flag.StringVar(&otelService, "otel-service-name", "acp-gate", "service.name reported with traces")
     flag.Parse()
 
     var cfg config.Config
@@ -64,12 +102,91 @@ func main() {
         }
     }
 
+    redactor, err := newRedactor(cfg.Redaction)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "redaction config: %v\n", err)
+        os.Exit(2)
+    }
+
+    turnMode, err := audit.ParseTurnMode(turns)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "-audit-turns: %v\n", err)
+        os.Exit(2)
+    }
+
+    keyring, err := loadAuditKeyring(keyFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "audit key: %v\n", err)
+        os.Exit(2)
+    }
+
+    var signer ed25519.PrivateKey
+    if signingKey != "" {
+        if signer, err = audit.LoadSigningKey(signingKey); err != nil {
+            fmt.Fprintf(os.Stderr, "audit signing key: %v\n", err)
+            os.Exit(2)
+        }
+    }
+
+    sinks, err := auditSinkSpecs(sinkFlags, cfg.AuditSinks)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%v\n", err)
+        os.Exit(2)
+    }
+    // Sessions are attributed to the agent server picked from the config,
+    // the same way config.Resolve picks it.
+    sessionAgent := agentName
+    if sessionAgent == "" {
+        sessionAgent, _, _ = config.OnlyAgent(cfg)
+    }
+
+    aud := auditSetup{
+        sinks:      sinks,
+        dbPath:     auditDBPath,
+        queue:      auditQueue,
+        overflow:   overflow,
+        spillPath:  spillPath,
+        turns:      turnMode,
+        retention:  retention.retention(),
+        pruneEvery: pruneEvery,
+        cpEvery:    cpEvery,
+        redactor:   redactor,
+        keyring:    keyring,
+        signer:     signer,
+        agentName:  sessionAgent,
+    }
+
     logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
     slog.SetDefault(logger)
 
     ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
     defer stop()
 
+    tracing := otelAddr != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+    if tracing {
+        mode := "local"
+        switch {
+        case servePort >= 0 && connectAddr != "":
+            mode = "proxy"
+        case servePort >= 0:
+            mode = "server"
+        case connectAddr != "":
+            mode = "client"
+        }
+        shutdown, err := telemetry.Setup(ctx, telemetry.Options{Endpoint: otelAddr, ServiceName: otelService, Mode: mode})
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "tracing: %v\n", err)
+            os.Exit(2)
+        }
+        defer func() {
+            sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+            defer cancel()
+            if err := shutdown(sctx); err != nil {
+                slog.Error("flush traces", "err", err)
+            }
+        }()
+    }
+
     // Register raw codec for gRPC tunnel.
     encoding.RegisterCodec(remote.RawCodec)
 
@@ -111,21 +228,22 @@ func main() {
                 resolvedEnv = os.Environ()
             }
 
-            // Open audit store (server-side only)
-            store, err := audit.Open(ctx, auditDBPath)
+            // Open audit sinks (server-side only)
+            sink, err := aud.open(ctx, false)
             if err != nil {
-                fmt.Fprintf(os.Stderr, "open audit db: %v\n", err)
+                fmt.Fprintf(os.Stderr, "%v\n", err)
                 os.Exit(1)
             }
             // Will be closed on context done when server stops
             // but also defer close here to ensure cleanup on early returns
-            defer store.Close()
+            defer sink.Close()
 
             remote.RegisterGateServer(grpcServer, &remote.GateService{Cfg: remote.ServerConfig{
                 Cmd:   resolvedCmd,
                 Args:  resolvedArgs,
                 Env:   resolvedEnv,
-                Store: store,
+                Sink:  sink,
+                Trace: tracing,
             }})
         }
 
@@ -152,8 +270,13 @@ func main() {
         }
         defer conn.Close()
 
+        // The tunnel span is continued by the proxy hops and the server.
+        ctx, span := telemetry.Tracer().Start(ctx, "acp-gate/tunnel", trace.WithSpanKind(trace.SpanKindClient),
+            trace.WithAttributes(attribute.String("acp_gate.next_hop", connectAddr)))
+        defer span.End()
+
         cli := remote.NewGateClient(conn)
-        stream, err := cli.Tunnel(ctx)
+        stream, err := cli.Tunnel(telemetry.Outgoing(ctx))
         if err != nil {
             fmt.Fprintf(os.Stderr, "open tunnel: %v\n", err)
             os.Exit(1)
@@ -203,12 +326,12 @@ func main() {
         resolvedEnv = os.Environ()
     }
 
-    store, err := audit.Open(ctx, auditDBPath)
+    sink, err := aud.open(ctx, true)
     if err != nil {
-        fmt.Fprintf(os.Stderr, "open audit db: %v\n", err)
+        fmt.Fprintf(os.Stderr, "%v\n", err)
         os.Exit(1)
     }
-    defer store.Close()
+    defer sink.Close()
 
     downstream := exec.CommandContext(ctx, resolvedCmd, resolvedArgs...)
     downstream.Stderr = os.Stderr
@@ -230,12 +353,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	connID := audit.NewConnectionID()
+	_ = audit.StartConnection(ctx, sink, audit.Connection{
+		ID:         connID,
+		Mode:       audit.ConnLocal,
+		Command:    resolvedCmd,
+		Args:       resolvedArgs,
+		EnvDiff:    audit.EnvDiff(os.Environ(), resolvedEnv),
+		EnvRemoved: audit.EnvRemoved(os.Environ(), resolvedEnv),
+		PID:        downstream.Process.Pid,
+	})
+
 	// 2. Prepare proxy and connections.
 	proxyAgent := &proxy.ProxyAgent{}
-	proxyAgent.SetStore(store)
+	proxyAgent.SetSink(sink)
+	proxyAgent.SetConnection(connID)
 
 	proxyClient := &proxy.ProxyClient{}
-	proxyClient.SetStore(store)
+	proxyClient.SetSink(sink)
+	proxyClient.SetConnection(connID)
+	if tracing {
+		tracer := proxy.NewTracer(ctx)
+		proxyAgent.SetTracer(tracer)
+		proxyClient.SetTracer(tracer)
+	}
 
 	// Connect to Editor (Upstream)
 	// Editor writes to our Stdin, reads from our Stdout.
@@ -256,16 +397,85 @@ func main() {
 		waitCh <- downstream.Wait()
 	}()
 
+	var reason string
+	exited := false
 	select {
 	case <-upstreamConn.Done():
 		// Editor closed connection
+		reason = audit.CloseUpstream
 	case <-downstreamConn.Done():
 		// Agent closed connection
+		reason = audit.CloseDownstream
 	case err := <-waitCh:
+		reason, exited = audit.CloseAgentExit, true
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "downstream agent exited with error: %v\n", err)
 		}
 	case <-ctx.Done():
 		// Signal received
+		reason = audit.CloseShutdown
 	}
+
+	// Requests still awaiting a response when we stop are recorded as abandoned.
+	proxyAgent.Abandon(context.Background())
+	proxyClient.Abandon(context.Background())
+	if !exited {
+		remote.StopAgent(downstream, dsIn, waitCh)
+	}
+	_ = audit.FinishConnection(context.Background(), sink, connID, audit.ConnectionEnd{ExitCode: remote.ExitCode(downstream), Reason: reason})
+}
+
+// startAuditWriter moves audit writes off the proxy path unless the queue
+// is disabled.
+func startAuditWriter(store *audit.Store, dbPath string, queue int, overflow, spillPath string) error {
+    if queue <= 0 {
+        return nil
+    }
+    if spillPath == "" {
+        spillPath = dbPath + ".spill"
+    }
+    return store.StartWriter(audit.WriterOptions{
+        QueueSize: queue,
+        Overflow:  audit.Overflow(overflow),
+        SpillPath: spillPath,
+        OnError: func(err error) {
+            slog.Error("audit write failed", "err", err)
+        },
+    })
+}
+
+func logPrune(res audit.PruneResult, err error) {
+    if err != nil {
+        slog.Error("audit retention failed", "err", err)
+        return
+    }
+    if res.Deleted > 0 || res.Stripped > 0 {
+        slog.Info("audit retention", "deleted", res.Deleted, "raw_cleared", res.Stripped, "freed_bytes", res.Freed)
+    }
+}
+
+func logDropped(n uint64) {
+    slog.Warn("audit records lost", "count", n)
+}
+
+func logCheckpoint(cp audit.Checkpoint, err error) {
+    if err != nil {
+        slog.Error("audit checkpoint failed", "err", err)
+        return
+    }
+    if cp.LastRowID > 0 {
+        slog.Debug("audit checkpoint", "last_row_id", cp.LastRowID)
+    }
+}
+
+// newRedactor builds the audit redactor from the config file section.
+func newRedactor(rc config.Redaction) (*redact.Redactor, error) {
+    opts := redact.Options{DisableBuiltin: rc.DisableBuiltin, Salt: rc.Salt}
+    for _, p := range rc.Patterns {
+        opts.Patterns = append(opts.Patterns, redact.Pattern{Name: p.Name, Regex: p.Regex})
+    }
+    for _, p := range rc.JSONPaths {
+        opts.Paths = append(opts.Paths, redact.PathRule{Method: p.Method, Path: p.Path})
+    }
+    return redact.New(opts)
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"acp-gate/internal/audit"
+	"acp-gate/internal/config"
+	"acp-gate/internal/remote"
+	"acp-gate/internal/replay"
+)
+
+// replayDiffers is the exit code of "acp-gate replay" when the agent did
+// something different in at least one turn.
+const replayDiffers = 3
+
+// runReplay implements "acp-gate replay": it sends the prompts of a
+// recorded session to a fresh agent process and reports how the agent's
+// output and tool calls compare with the recording. It returns the process
+// exit code.
+func runReplay(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	var (
+		dbPath      string
+		keyFile     string
+		sessionID   string
+		cfgPath     string
+		agentName   string
+		agentCmd    string
+		agentArgs   multiFlag
+		cwd         string
+		turnTimeout time.Duration
+		width       int
+		asJSON      bool
+	)
+	fs.StringVar(&dbPath, "audit-db", "audit.sqlite", "path to SQLite audit DB")
+	fs.StringVar(&keyFile, "audit-key-file", "", auditKeyFileUsage)
+	fs.StringVar(&sessionID, "session", "", "recorded session id to replay (required)")
+	fs.StringVar(&cfgPath, "config", "", "path to JSON config file with agent_servers (default: ~/.config/.acp-gate/config.json if present)")
+	fs.StringVar(&agentName, "agent-name", "", "agent server name from config to replay against (default: the agent that served the session)")
+	fs.StringVar(&agentCmd, "agent-cmd", "", "agent command to replay against instead of one from the config")
+	fs.Var(&agentArgs, "agent-arg", "argument for the agent (repeatable)")
+	fs.StringVar(&cwd, "cwd", "", "working directory for the new session (default: that of the recorded session)")
+	fs.DurationVar(&turnTimeout, "turn-timeout", 10*time.Minute, "cancel a prompt turn that takes longer than this (0 for no limit)")
+	fs.IntVar(&width, "width", 160, "width of the side-by-side report")
+	fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: acp-gate replay -session <id> [-agent-name <name>] [flags]\n\n"+
+			"Exits with status %d if the agent ran different tool calls or ended a turn differently.\n\n", replayDiffers)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if sessionID == "" {
+		fmt.Fprintln(os.Stderr, "replay: missing required flag: -session")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rec, agent, err := loadReplay(ctx, dbPath, keyFile, sessionID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	if agentName == "" && agentCmd == "" {
+		agentName = agent
+	}
+	var cfg config.Config
+	if cfgPath == "" {
+		if p, ok := config.FindExistingDefaultConfig(); ok {
+			cfgPath = p
+		}
+	}
+	if cfgPath != "" {
+		if cfg, err = config.Load(cfgPath); err != nil {
+			fmt.Fprintf(os.Stderr, "replay: load config: %v\n", err)
+			return 2
+		}
+	} else if agentCmd == "" {
+		fmt.Fprintln(os.Stderr, "replay: missing required flag: -agent-cmd (or provide -config with -agent-name)")
+		return 2
+	}
+	cmdPath, cmdArgs, env, err := config.Resolve(cfg, agentName, agentCmd, agentArgs, os.Environ())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 2
+	}
+
+	rep, err := replayAgent(ctx, rec, cmdPath, cmdArgs, env, replay.Options{Cwd: cwd, TurnTimeout: turnTimeout})
+	if err != nil && len(rep.Turns) == 0 {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	var werr error
+	if asJSON {
+		werr = json.NewEncoder(os.Stdout).Encode(rep)
+	} else {
+		werr = rep.WriteText(os.Stdout, width)
+	}
+	if err = errors.Join(err, werr); err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	for _, t := range rep.Turns {
+		if t.Differs() {
+			return replayDiffers
+		}
+	}
+	return 0
+}
+
+// loadReplay reads the recording of sessionID and returns it with the name
+// of the agent that served it.
+func loadReplay(ctx context.Context, dbPath, keyFile, sessionID string) (replay.Recording, string, error) {
+	store, err := openAuditDB(ctx, dbPath, keyFile)
+	if err != nil {
+		return replay.Recording{}, "", err
+	}
+	defer store.Close()
+
+	sessions, err := store.ListSessions(ctx, audit.SessionFilter{ID: sessionID})
+	if err != nil {
+		return replay.Recording{}, "", err
+	}
+	if len(sessions) == 0 {
+		return replay.Recording{}, "", fmt.Errorf("no session %q recorded", sessionID)
+	}
+	sess := sessions[0]
+	rec := replay.Recording{SessionID: sessionID, Cwd: sess.Cwd, ClientCapabilities: sess.ClientCapabilities}
+	if rec.Records, err = store.Query(ctx, audit.Filter{SessionID: sessionID}); err != nil {
+		return rec, "", err
+	}
+	for i, r := range rec.Records {
+		if r.Sealed {
+			return rec, "", fmt.Errorf("session %q has encrypted payloads; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", sessionID)
+		}
+		if rec.Records[i].Raw, err = store.Rehydrate(ctx, r.Raw); err != nil {
+			return rec, "", err
+		}
+	}
+	// Sessions recorded with -audit-turns drop may lack the message chunks.
+	if rec.Turns, err = store.Turns(ctx, audit.TurnFilter{SessionID: sessionID}); err != nil {
+		return rec, "", err
+	}
+	for _, t := range rec.Turns {
+		if t.Sealed {
+			return rec, "", fmt.Errorf("session %q has encrypted payloads; pass -audit-key-file or set ACP_GATE_AUDIT_KEY", sessionID)
+		}
+	}
+	return rec, sess.AgentName, nil
+}
+
+// replayAgent starts the agent, replays rec against it and stops it.
+func replayAgent(ctx context.Context, rec replay.Recording, cmdPath string, args, env []string, opts replay.Options) (replay.Report, error) {
+	agent := exec.CommandContext(ctx, cmdPath, args...)
+	agent.Stderr = os.Stderr
+	agent.Env = env
+	in, err := agent.StdinPipe()
+	if err != nil {
+		return replay.Report{}, err
+	}
+	out, err := agent.StdoutPipe()
+	if err != nil {
+		return replay.Report{}, err
+	}
+	if err := agent.Start(); err != nil {
+		return replay.Report{}, fmt.Errorf("start agent: %w", err)
+	}
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- agent.Wait() }()
+	defer remote.StopAgent(agent, in, waitCh)
+	return replay.Run(ctx, rec, in, out, opts)
+}